@@ -0,0 +1,183 @@
+// The gRPC API of canvas, for internal callers. It draws the same maps as
+// the HTTP endpoints, through the same caches, limits and feature flags.
+//
+// The Go code beside this file is generated from it:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative canvaspb/canvas.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.0
+// source: canvaspb/canvas.proto
+
+package canvaspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Canvas_Render_FullMethodName       = "/canvas.v1.Canvas/Render"
+	Canvas_RenderFrames_FullMethodName = "/canvas.v1.Canvas/RenderFrames"
+)
+
+// CanvasClient is the client API for Canvas service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Canvas draws seismic intensity maps.
+type CanvasClient interface {
+	// Render draws one map, as GET /map does.
+	Render(ctx context.Context, in *RenderRequest, opts ...grpc.CallOption) (*RenderResponse, error)
+	// RenderFrames draws the frames of an animation, as GET /animation does,
+	// and streams each as a PNG once it is drawn, so that a caller can show or
+	// encode them before the last is done.
+	RenderFrames(ctx context.Context, in *AnimationRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Frame], error)
+}
+
+type canvasClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCanvasClient(cc grpc.ClientConnInterface) CanvasClient {
+	return &canvasClient{cc}
+}
+
+func (c *canvasClient) Render(ctx context.Context, in *RenderRequest, opts ...grpc.CallOption) (*RenderResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RenderResponse)
+	err := c.cc.Invoke(ctx, Canvas_Render_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *canvasClient) RenderFrames(ctx context.Context, in *AnimationRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Frame], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Canvas_ServiceDesc.Streams[0], Canvas_RenderFrames_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AnimationRequest, Frame]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Canvas_RenderFramesClient = grpc.ServerStreamingClient[Frame]
+
+// CanvasServer is the server API for Canvas service.
+// All implementations must embed UnimplementedCanvasServer
+// for forward compatibility.
+//
+// Canvas draws seismic intensity maps.
+type CanvasServer interface {
+	// Render draws one map, as GET /map does.
+	Render(context.Context, *RenderRequest) (*RenderResponse, error)
+	// RenderFrames draws the frames of an animation, as GET /animation does,
+	// and streams each as a PNG once it is drawn, so that a caller can show or
+	// encode them before the last is done.
+	RenderFrames(*AnimationRequest, grpc.ServerStreamingServer[Frame]) error
+	mustEmbedUnimplementedCanvasServer()
+}
+
+// UnimplementedCanvasServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCanvasServer struct{}
+
+func (UnimplementedCanvasServer) Render(context.Context, *RenderRequest) (*RenderResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Render not implemented")
+}
+func (UnimplementedCanvasServer) RenderFrames(*AnimationRequest, grpc.ServerStreamingServer[Frame]) error {
+	return status.Errorf(codes.Unimplemented, "method RenderFrames not implemented")
+}
+func (UnimplementedCanvasServer) mustEmbedUnimplementedCanvasServer() {}
+func (UnimplementedCanvasServer) testEmbeddedByValue()                {}
+
+// UnsafeCanvasServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CanvasServer will
+// result in compilation errors.
+type UnsafeCanvasServer interface {
+	mustEmbedUnimplementedCanvasServer()
+}
+
+func RegisterCanvasServer(s grpc.ServiceRegistrar, srv CanvasServer) {
+	// If the following call pancis, it indicates UnimplementedCanvasServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Canvas_ServiceDesc, srv)
+}
+
+func _Canvas_Render_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CanvasServer).Render(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Canvas_Render_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CanvasServer).Render(ctx, req.(*RenderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Canvas_RenderFrames_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AnimationRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CanvasServer).RenderFrames(m, &grpc.GenericServerStream[AnimationRequest, Frame]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Canvas_RenderFramesServer = grpc.ServerStreamingServer[Frame]
+
+// Canvas_ServiceDesc is the grpc.ServiceDesc for Canvas service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Canvas_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "canvas.v1.Canvas",
+	HandlerType: (*CanvasServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Render",
+			Handler:    _Canvas_Render_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "RenderFrames",
+			Handler:       _Canvas_RenderFrames_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "canvaspb/canvas.proto",
+}
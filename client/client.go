@@ -0,0 +1,599 @@
+// Package client calls the canvas rendering API.
+//
+//	c, err := client.New("https://canvas.example.com", client.WithAPIKey(key))
+//	if err != nil {
+//		return err
+//	}
+//	png, result, err := c.Map(ctx, client.MapOptions{
+//		Scale: []client.Intensity{{ID: 13, Scale: 4}, {ID: 14, Scale: 3}},
+//		Size:  2,
+//	})
+//
+// Requests are retried when the server is rate limited or overloaded,
+// honoring its Retry-After header, and on network errors.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a canvas API client. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	userAgent  string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key as a bearer token with every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient replaces the HTTP client. The default has no timeout, so
+// use contexts to bound requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a failed request is retried (default 3),
+// and the initial backoff (default 500ms), which doubles on each attempt.
+func WithRetries(max int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = max, backoff }
+}
+
+// WithUserAgent sets the User-Agent header.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: invalid base URL: %q", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{},
+		maxRetries: 3,
+		backoff:    500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		userAgent:  "canvas-go-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Error is an error response from the server.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	// RetryAfter is the delay the server asked for, if any.
+	RetryAfter time.Duration
+	// Param is the query parameter at fault, for an invalid one.
+	Param string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("canvas: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Temporary reports whether retrying the request later may succeed.
+func (e *Error) Temporary() bool {
+	switch e.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Result describes a rendered image.
+type Result struct {
+	// ImageID addresses the image on the server, for Thumbnail and diffs.
+	ImageID string
+	// Backend is the rasterization backend that drew the image.
+	Backend string
+	// Bytes is the size of the image.
+	Bytes int64
+}
+
+// Map renders a map and returns the PNG.
+func (c *Client) Map(ctx context.Context, opts MapOptions) ([]byte, *Result, error) {
+	var buf bytes.Buffer
+	result, err := c.MapTo(ctx, opts, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), result, nil
+}
+
+// MapTo renders a map and streams the PNG to w, without holding it in memory.
+// Retries only happen before the first byte is written.
+func (c *Client) MapTo(ctx context.Context, opts MapOptions, w io.Writer) (*Result, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	path := "/map"
+	if opts.Name != "" {
+		path += "/" + url.PathEscape(opts.Name)
+	}
+	return c.download(ctx, path, query, w)
+}
+
+// UploadedMap is a map uploaded to the server's object storage bucket.
+type UploadedMap struct {
+	// URL is where the PNG can be fetched, public or signed.
+	URL string `json:"url"`
+	// Expires is when a signed URL stops working, zero for public URLs.
+	Expires time.Time `json:"expires"`
+	// Key is the name of the object in the bucket.
+	Key     string `json:"key"`
+	ImageID string `json:"image_id"`
+	Bytes   int    `json:"bytes"`
+}
+
+// MapURL renders a map, has the server upload it to its bucket, and returns
+// the URL of the PNG rather than the PNG, for platforms that take a URL. The
+// server must be run with -bucket.
+func (c *Client) MapURL(ctx context.Context, opts MapOptions) (*UploadedMap, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	query.Set("output", "url")
+	path := "/map"
+	if opts.Name != "" {
+		path += "/" + url.PathEscape(opts.Name)
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, path, query, &buf); err != nil {
+		return nil, err
+	}
+	var uploaded UploadedMap
+	if err := json.Unmarshal(buf.Bytes(), &uploaded); err != nil {
+		return nil, fmt.Errorf("canvas: invalid upload: %w", err)
+	}
+	return &uploaded, nil
+}
+
+// Region is a prefecture of a map image, outlined in pixels.
+type Region struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	NameJa string   `json:"name_ja"`
+	Scale  int      `json:"scale"`
+	Value  *float64 `json:"value"`
+	Href   string   `json:"href"`
+	// Polygons are the exterior rings of the prefecture, as x, y pairs.
+	Polygons [][][2]int `json:"polygons"`
+}
+
+// Regions are the prefectures of a map image, and the image's URL on the
+// server.
+type Regions struct {
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Image   string   `json:"image"`
+	Regions []Region `json:"regions"`
+}
+
+// Regions returns the outline of each prefecture in pixels of the map the
+// options draw, without rendering it, for click-through on static images.
+// href is a link template with {id}, {name} and {name_ja}, or empty.
+func (c *Client) Regions(ctx context.Context, opts MapOptions, href string) (*Regions, error) {
+	data, err := c.hitRegions(ctx, opts, "regions", href, "")
+	if err != nil {
+		return nil, err
+	}
+	var regions Regions
+	if err := json.Unmarshal(data, &regions); err != nil {
+		return nil, fmt.Errorf("canvas: invalid regions: %w", err)
+	}
+	return &regions, nil
+}
+
+// Area is a feature of a map that Scale can shade, as listed by Areas.
+type Area struct {
+	ID     int    `json:"id"`
+	NameJa string `json:"name_ja"`
+	NameEn string `json:"name_en"`
+	// Centroid is the lon, lat of the center of its area.
+	Centroid [2]float64 `json:"centroid"`
+	// BBox is its min lon, min lat, max lon and max lat.
+	BBox [4]float64 `json:"bbox"`
+}
+
+// Areas lists the features of the map of Japan, or of the named map name,
+// with the boundaries in use on asOf unless it is zero.
+func (c *Client) Areas(ctx context.Context, name string, asOf time.Time) ([]Area, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("map", name)
+	}
+	if !asOf.IsZero() {
+		query.Set("asof", asOf.Format(time.DateOnly))
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/areas", query, &buf); err != nil {
+		return nil, err
+	}
+	var list struct {
+		Areas []Area `json:"areas"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &list); err != nil {
+		return nil, fmt.Errorf("canvas: invalid areas: %w", err)
+	}
+	return list.Areas, nil
+}
+
+// ImageMap returns an HTML fragment of the map image and a <map> element
+// named mapName (default "canvas") linking each prefecture to href, like
+// Regions.
+func (c *Client) ImageMap(ctx context.Context, opts MapOptions, href, mapName string) (string, error) {
+	data, err := c.hitRegions(ctx, opts, "imagemap", href, mapName)
+	return string(data), err
+}
+
+// HTMLMap returns the map as an svg element to inline in a page, with the
+// name and intensity of each prefecture as a tooltip, and its data as data-*
+// attributes. href links each prefecture, like Regions, or is empty.
+func (c *Client) HTMLMap(ctx context.Context, opts MapOptions, href string) (string, error) {
+	data, err := c.hitRegions(ctx, opts, "html", href, "")
+	return string(data), err
+}
+
+// AltText returns a description of the map for screen readers: the
+// prefectures of the strongest intensities, in the language of opts.
+func (c *Client) AltText(ctx context.Context, opts MapOptions) (string, error) {
+	data, err := c.hitRegions(ctx, opts, "alt", "", "")
+	return string(data), err
+}
+
+func (c *Client) hitRegions(ctx context.Context, opts MapOptions, format, href, mapName string) ([]byte, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	query.Set("format", format)
+	if href != "" {
+		query.Set("href", href)
+	}
+	if mapName != "" {
+		query.Set("map_name", mapName)
+	}
+	path := "/map"
+	if opts.Name != "" {
+		path += "/" + url.PathEscape(opts.Name)
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, path, query, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UploadOptions describes a map uploaded with UploadMap.
+type UploadOptions struct {
+	// IDProperty is the feature property matched against the ids of Scale
+	// or Values (default "id").
+	IDProperty string
+	// Object picks the object of a TopoJSON topology with several.
+	Object string
+}
+
+// UploadMap renders the features of a GeoJSON FeatureCollection or TopoJSON
+// topology instead of a map of the server, and returns the PNG. MapOptions.CRS
+// also applies to data without a crs member.
+func (c *Client) UploadMap(ctx context.Context, data []byte, upload UploadOptions, opts MapOptions) ([]byte, *Result, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, nil, err
+	}
+	if upload.IDProperty != "" {
+		query.Set("id_property", upload.IDProperty)
+	}
+	if upload.Object != "" {
+		query.Set("object", upload.Object)
+	}
+	var buf bytes.Buffer
+	result, err := c.send(ctx, http.MethodPost, "/map", query, data, "application/geo+json", &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), result, nil
+}
+
+// Badge renders a badge and returns the PNG.
+func (c *Client) Badge(ctx context.Context, opts BadgeOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/badge", opts.Query(), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Legend renders the key to the intensity colors on its own and returns the
+// PNG, or the SVG document with opts.SVG.
+func (c *Client) Legend(ctx context.Context, opts LegendOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/legend", opts.Query(), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Animation renders an animation of an intensity timeline, as GIF unless
+// the options ask for APNG.
+func (c *Client) Animation(ctx context.Context, opts AnimationOptions) ([]byte, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/animation", query, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Propagation renders an animation of the waves of an earthquake, as APNG
+// unless the options ask for a GIF.
+func (c *Client) Propagation(ctx context.Context, opts PropagationOptions) ([]byte, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/propagation", query, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Grid renders several maps sharing one view as a single PNG.
+func (c *Client) Grid(ctx context.Context, opts GridOptions) ([]byte, *Result, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	result, err := c.download(ctx, "/grid", query, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), result, nil
+}
+
+// Tile renders one XYZ tile of a map, as a transparent PNG.
+func (c *Client) Tile(ctx context.Context, opts TileOptions) ([]byte, *Result, error) {
+	query, err := opts.Map.Query()
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	result, err := c.download(ctx, opts.path(), query, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), result, nil
+}
+
+// SocialKit returns a ZIP of the images, alt text and caption of a post
+// about an earthquake.
+func (c *Client) SocialKit(ctx context.Context, opts SocialKitOptions) ([]byte, error) {
+	query, err := opts.Query()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/social", query, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Batch renders several maps in one request and returns a ZIP of their PNGs,
+// named after BatchMap.Name. The server checks every map before rendering
+// any.
+func (c *Client) Batch(ctx context.Context, maps []BatchMap) ([]byte, error) {
+	body, err := batchBody(maps)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.send(ctx, http.MethodPost, "/map/batch", url.Values{}, body, "application/json", &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Job is a render run in the background by the server.
+type Job struct {
+	ID string `json:"id"`
+	// Status is queued, running, done or failed.
+	Status   string     `json:"status"`
+	URL      string     `json:"url"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started"`
+	Finished *time.Time `json:"finished"`
+	// ContentType, Bytes and ImageID describe the result of a done job.
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+	ImageID     string `json:"image_id"`
+	// Error is what the endpoint of a failed job returned.
+	Error *Error `json:"error"`
+	// Callback is where the result is pushed, and CallbackError is set when
+	// that failed.
+	Callback      string `json:"callback"`
+	CallbackError string `json:"callback_error"`
+}
+
+// StartJob queues the render of path, such as "/map" or "/animation", with
+// the query of its options, and returns at once. When callback is set, the
+// server POSTs the result there once it is done; otherwise poll with Job.
+func (c *Client) StartJob(ctx context.Context, path string, query url.Values, callback string) (*Job, error) {
+	body, err := json.Marshal(map[string]string{"url": path + "?" + query.Encode(), "callback": callback})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.send(ctx, http.MethodPost, "/jobs", url.Values{}, body, "application/json", &buf); err != nil {
+		return nil, err
+	}
+	return decodeJob(buf.Bytes())
+}
+
+// Job returns the state of a job.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var buf bytes.Buffer
+	if _, err := c.download(ctx, "/jobs/"+url.PathEscape(id), url.Values{}, &buf); err != nil {
+		return nil, err
+	}
+	return decodeJob(buf.Bytes())
+}
+
+// JobResult streams the result of a done job to w. The error of a failed
+// job is returned as *Error, as the endpoint returned it.
+func (c *Client) JobResult(ctx context.Context, id string, w io.Writer) (*Result, error) {
+	return c.download(ctx, "/jobs/"+url.PathEscape(id)+"/result", url.Values{}, w)
+}
+
+func decodeJob(data []byte) (*Job, error) {
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("canvas: invalid job: %w", err)
+	}
+	return &job, nil
+}
+
+// Thumbnail returns a thumbnail of a stored image, width pixels wide.
+func (c *Client) Thumbnail(ctx context.Context, imageID string, width int) ([]byte, error) {
+	var buf bytes.Buffer
+	query := url.Values{"w": {strconv.Itoa(width)}}
+	if _, err := c.download(ctx, "/images/"+url.PathEscape(imageID)+"/thumb", query, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Client) download(ctx context.Context, path string, query url.Values, w io.Writer) (*Result, error) {
+	return c.send(ctx, http.MethodGet, path, query, nil, "", w)
+}
+
+// Function to send a request, retrying temporary failures, and stream the
+// image of the response to w
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body []byte, contentType string, w io.Writer) (*Result, error) {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, method, u.String(), body, contentType)
+		if err == nil {
+			defer resp.Body.Close()
+			n, err := io.Copy(w, resp.Body)
+			if err != nil {
+				return nil, fmt.Errorf("canvas: download interrupted after %d bytes: %w", n, err)
+			}
+			return &Result{
+				ImageID: resp.Header.Get("X-Image-ID"),
+				Backend: resp.Header.Get("X-Render-Backend"),
+				Bytes:   n,
+			}, nil
+		}
+
+		var apiErr *Error
+		retryable := !errors.As(err, &apiErr) || apiErr.Temporary()
+		if !retryable || attempt >= c.maxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := c.backoff << attempt
+		if delay > c.maxBackoff || delay <= 0 {
+			delay = c.maxBackoff
+		}
+		// Full jitter, so clients shed at the same time do not return together
+		delay = time.Duration(rand.Int64N(int64(delay)) + 1)
+		if apiErr != nil && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Function to send one request, turning non-200 responses into *Error
+func (c *Client) do(ctx context.Context, method, u string, body []byte, contentType string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Jobs are accepted before they run
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &Error{Status: resp.StatusCode, Code: "HTTP_" + strconv.Itoa(resp.StatusCode), Message: http.StatusText(resp.StatusCode)}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var parsed struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			Param   string `json:"param"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &parsed) == nil && parsed.Error.Code != "" {
+		apiErr.Code, apiErr.Message, apiErr.Param = parsed.Error.Code, parsed.Error.Message, parsed.Error.Param
+	} else if text := strings.TrimSpace(string(data)); text != "" {
+		apiErr.Message = text
+	}
+	return nil, apiErr
+}
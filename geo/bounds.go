@@ -0,0 +1,178 @@
+package geo
+
+import (
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Bounds calculates the drawing range of the prefectures with a non-zero
+// intensity in scaleMap. A nil scaleMap includes every feature, which gives
+// the whole-country view. When nothing matches, the result has
+// MinLon > MaxLon.
+func Bounds(fc *geojson.FeatureCollection, scaleMap map[int]int) BBox {
+	b := BBox{MinLon: 180.0, MinLat: 90.0, MaxLon: -180.0, MaxLat: -90.0}
+
+	for _, feature := range fc.Features {
+		// Skip if the scale is 0 (transparent prefectures are not calculated)
+		id := int(feature.Properties["id"].(float64))
+		if scaleMap != nil && scaleMap[id] == 0 {
+			continue
+		}
+
+		// Calculate the range from the coordinates of the polygon
+		for _, ring := range FeatureRings(feature) {
+			for _, coord := range ring {
+				lon, lat := coord[0], coord[1]
+				b.MinLon = min(b.MinLon, lon)
+				b.MinLat = min(b.MinLat, lat)
+				b.MaxLon = max(b.MaxLon, lon)
+				b.MaxLat = max(b.MaxLat, lat)
+			}
+		}
+	}
+	return b
+}
+
+// FeatureBounds returns the box around a Polygon or MultiPolygon feature.
+func FeatureBounds(feature *geojson.Feature) BBox {
+	b := BBox{MinLon: 180.0, MinLat: 90.0, MaxLon: -180.0, MaxLat: -90.0}
+	for _, ring := range FeatureRings(feature) {
+		r := LineBounds(ring)
+		b.MinLon, b.MinLat = min(b.MinLon, r.MinLon), min(b.MinLat, r.MinLat)
+		b.MaxLon, b.MaxLat = max(b.MaxLon, r.MaxLon), max(b.MaxLat, r.MaxLat)
+	}
+	return b
+}
+
+// Centroid returns the center of the area of a Polygon or MultiPolygon
+// feature, its holes left out. Unlike LabelPoint, it can lie outside concave
+// shapes and between islands.
+func Centroid(feature *geojson.Feature) (lon, lat float64) {
+	var polygons [][][][]float64
+	switch feature.Geometry.Type {
+	case "Polygon":
+		polygons = [][][][]float64{feature.Geometry.Polygon}
+	case "MultiPolygon":
+		polygons = feature.Geometry.MultiPolygon
+	}
+
+	var area, x, y float64
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		// Exterior rings count whichever way they are wound, and holes
+		// against them
+		sign := 1.0
+		if RingArea(polygon[0]) < 0 {
+			sign = -1
+		}
+		for i, ring := range polygon {
+			ringSign := sign
+			if i > 0 && (RingArea(ring) > 0) == (sign > 0) {
+				ringSign = -sign
+			}
+			for j := range ring {
+				a, b := ring[j], ring[(j+1)%len(ring)]
+				f := (a[0]*b[1] - b[0]*a[1]) * ringSign
+				x += (a[0] + b[0]) * f
+				y += (a[1] + b[1]) * f
+				area += f
+			}
+		}
+	}
+	if area == 0 {
+		return 0, 0
+	}
+	return x / (3 * area), y / (3 * area)
+}
+
+// Expand widens the box to at least minSpan degrees on each axis, keeping
+// its center.
+func (b BBox) Expand(minSpan float64) BBox {
+	if span := b.MaxLon - b.MinLon; span < minSpan {
+		pad := (minSpan - span) / 2
+		b.MinLon, b.MaxLon = b.MinLon-pad, b.MaxLon+pad
+	}
+	if span := b.MaxLat - b.MinLat; span < minSpan {
+		pad := (minSpan - span) / 2
+		b.MinLat, b.MaxLat = b.MinLat-pad, b.MaxLat+pad
+	}
+	return b
+}
+
+// Intersects tells whether two boxes overlap.
+func (b BBox) Intersects(other BBox) bool {
+	return b.MinLon <= other.MaxLon && other.MinLon <= b.MaxLon && b.MinLat <= other.MaxLat && other.MinLat <= b.MaxLat
+}
+
+// LineBounds returns the box around the coordinates of a line or ring.
+func LineBounds(line [][]float64) BBox {
+	b := BBox{MinLon: 180.0, MinLat: 90.0, MaxLon: -180.0, MaxLat: -90.0}
+	for _, coord := range line {
+		b.MinLon, b.MaxLon = min(b.MinLon, coord[0]), max(b.MaxLon, coord[0])
+		b.MinLat, b.MaxLat = min(b.MinLat, coord[1]), max(b.MaxLat, coord[1])
+	}
+	return b
+}
+
+// Center returns the mean of the coordinates of a ring.
+func Center(coords [][]float64) (float64, float64) {
+	var sumLon, sumLat float64
+	count := len(coords)
+
+	for _, coord := range coords {
+		sumLon += coord[0]
+		sumLat += coord[1]
+	}
+
+	return sumLon / float64(count), sumLat / float64(count)
+}
+
+// FeatureRings lists the rings of a Polygon or MultiPolygon feature, with
+// every hole wound against its exterior ring. Renderers fill with the nonzero
+// rule (ScannerGV does not implement even-odd), so this orientation is what
+// keeps lakes and enclaves unfilled.
+func FeatureRings(feature *geojson.Feature) [][][]float64 {
+	var polygons [][][][]float64
+	switch feature.Geometry.Type {
+	case "Polygon":
+		polygons = [][][][]float64{feature.Geometry.Polygon}
+	case "MultiPolygon":
+		polygons = feature.Geometry.MultiPolygon
+	}
+
+	var rings [][][]float64
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		exteriorCCW := RingArea(polygon[0]) > 0
+		rings = append(rings, polygon[0])
+		for _, hole := range polygon[1:] {
+			if (RingArea(hole) > 0) == exteriorCCW {
+				hole = reverseRing(hole)
+			}
+			rings = append(rings, hole)
+		}
+	}
+	return rings
+}
+
+// RingArea calculates the signed area of a ring, positive when
+// counter-clockwise in lon/lat.
+func RingArea(ring [][]float64) float64 {
+	var area float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return area / 2
+}
+
+func reverseRing(ring [][]float64) [][]float64 {
+	reversed := make([][]float64, len(ring))
+	for i, coord := range ring {
+		reversed[len(ring)-1-i] = coord
+	}
+	return reversed
+}
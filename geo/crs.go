@@ -0,0 +1,147 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// CRS is a geographic coordinate reference system that input coordinates
+// can be given in. Everything is drawn in WGS84.
+type CRS string
+
+const (
+	WGS84    CRS = "wgs84"
+	JGD2011  CRS = "jgd2011"
+	JGD2000  CRS = "jgd2000"
+	TokyoCRS CRS = "tokyo" // Tokyo Datum, used by Japanese data before 2002
+)
+
+// Names and EPSG codes of each CRS, as given in parameters, configuration
+// and the crs member of GeoJSON files
+var crsNames = map[string]CRS{
+	"wgs84":     WGS84,
+	"epsg:4326": WGS84,
+	"crs84":     WGS84,
+	"jgd2011":   JGD2011,
+	"epsg:6668": JGD2011,
+	"jgd2000":   JGD2000,
+	"epsg:4612": JGD2000,
+	"tokyo":     TokyoCRS,
+	"epsg:4301": TokyoCRS,
+}
+
+// ParseCRS reads a CRS name (wgs84, jgd2011, jgd2000 or tokyo), an EPSG code
+// such as EPSG:6668, or an OGC URN such as urn:ogc:def:crs:EPSG::6668. An
+// empty name is WGS84.
+func ParseCRS(name string) (CRS, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if key == "" {
+		return WGS84, nil
+	}
+	// urn:ogc:def:crs:EPSG::6668 and urn:ogc:def:crs:OGC:1.3:CRS84
+	if rest, ok := strings.CutPrefix(key, "urn:ogc:def:crs:"); ok {
+		parts := strings.Split(rest, ":")
+		key = parts[len(parts)-1]
+		if parts[0] == "epsg" {
+			key = "epsg:" + key
+		}
+	}
+	if crs, ok := crsNames[key]; ok {
+		return crs, nil
+	}
+	return "", fmt.Errorf("unknown CRS: %s (must be wgs84, jgd2011, jgd2000 or tokyo, or their EPSG code)", name)
+}
+
+// Function to read the CRS a GeoJSON file declares in its crs member, as in
+// {"type": "name", "properties": {"name": "urn:ogc:def:crs:EPSG::4301"}}.
+// Files without one are WGS84.
+func declaredCRS(fc *geojson.FeatureCollection) (CRS, error) {
+	if fc.CRS == nil {
+		return WGS84, nil
+	}
+	properties, _ := fc.CRS["properties"].(map[string]any)
+	name, _ := properties["name"].(string)
+	if fc.CRS["type"] != "name" || name == "" {
+		return "", fmt.Errorf("unsupported crs member (must be a named CRS)")
+	}
+	return ParseCRS(name)
+}
+
+// Ellipsoids of the datums
+var (
+	grs80  = ellipsoid{a: 6378137, f: 1 / 298.257222101}
+	bessel = ellipsoid{a: 6377397.155, f: 1 / 299.152813}
+)
+
+// Translation in meters from the Tokyo Datum to JGD2000, the three-parameter
+// transformation of the Geospatial Information Authority of Japan. It is
+// good to within a few meters; grid-based corrections (TKY2JGD) are finer
+// but not needed at map scale.
+var tokyoShift = [3]float64{-146.414, 507.337, 680.507}
+
+type ellipsoid struct {
+	a, f float64
+}
+
+// ToWGS84 converts a coordinate in the CRS to WGS84. JGD2011 and JGD2000
+// are realizations of ITRF on GRS80 and differ from WGS84 by far less than a
+// pixel, so only the Tokyo Datum moves.
+func (c CRS) ToWGS84(lon, lat float64) (float64, float64) {
+	if c != TokyoCRS {
+		return lon, lat
+	}
+	x, y, z := bessel.toGeocentric(lon, lat)
+	return grs80.fromGeocentric(x+tokyoShift[0], y+tokyoShift[1], z+tokyoShift[2])
+}
+
+// Function to convert a coordinate on the ellipsoid surface to geocentric
+// meters
+func (e ellipsoid) toGeocentric(lon, lat float64) (x, y, z float64) {
+	e2 := e.f * (2 - e.f)
+	phi, lambda := lat*math.Pi/180, lon*math.Pi/180
+	n := e.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+	return n * math.Cos(phi) * math.Cos(lambda), n * math.Cos(phi) * math.Sin(lambda), n * (1 - e2) * math.Sin(phi)
+}
+
+// Function to convert geocentric meters back to longitude and latitude,
+// iterating on the latitude, which converges in a few steps
+func (e ellipsoid) fromGeocentric(x, y, z float64) (lon, lat float64) {
+	e2 := e.f * (2 - e.f)
+	p := math.Hypot(x, y)
+	phi := math.Atan2(z, p*(1-e2))
+	for i := 0; i < 5; i++ {
+		n := e.a / math.Sqrt(1-e2*math.Sin(phi)*math.Sin(phi))
+		h := p/math.Cos(phi) - n
+		phi = math.Atan2(z, p*(1-e2*n/(n+h)))
+	}
+	return math.Atan2(y, x) * 180 / math.Pi, phi * 180 / math.Pi
+}
+
+// Function to convert every coordinate of the features and borders to WGS84
+// in place. Coordinates shared by several rings may be the same slice, so
+// each is converted once.
+func convertCoordinates(crs CRS, rings [][][]float64) {
+	if crs == WGS84 || crs == "" {
+		return
+	}
+	done := make(map[*float64]bool)
+	for _, ring := range rings {
+		for _, coord := range ring {
+			if len(coord) < 2 || done[&coord[0]] {
+				continue
+			}
+			done[&coord[0]] = true
+			coord[0], coord[1] = crs.ToWGS84(coord[0], coord[1])
+		}
+	}
+}
+
+// ToWGS84 converts the corners of the box to WGS84.
+func (b BBox) ToWGS84(crs CRS) BBox {
+	minLon, minLat := crs.ToWGS84(b.MinLon, b.MinLat)
+	maxLon, maxLat := crs.ToWGS84(b.MaxLon, b.MaxLat)
+	return BBox{MinLon: minLon, MinLat: minLat, MaxLon: maxLon, MaxLat: maxLat}
+}
@@ -0,0 +1,362 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Douglas-Peucker tolerances in degrees, from coarsest to finest. At 26 px per
+// degree (the whole country at 1280x720) 0.02 degrees is about half a pixel.
+var simplifyTolerances = []float64{0.04, 0.02, 0.01, 0.005, 0.0025, 0.00125}
+
+// Largest simplification error allowed on screen, in pixels
+const maxSimplifyError = 0.5
+
+type simplifiedLevel struct {
+	Tolerance float64
+	Features  []*geojson.Feature
+	Borders   [][][]float64
+}
+
+// Dataset is the map data, loaded and simplified once at startup.
+type Dataset struct {
+	Full    *geojson.FeatureCollection
+	ids     map[int]bool
+	borders [][][]float64
+	levels  []simplifiedLevel
+	// Label points of the features of every level, found on first use
+	labels sync.Map
+}
+
+// Load reads a GeoJSON or TopoJSON file of prefectures, each with a numeric
+// "id" property, and precomputes its simplified geometries when simplify is
+// set.
+func Load(path string, simplify bool) (*Dataset, error) {
+	return LoadWithID(path, "id", simplify)
+}
+
+// LoadWithID reads a GeoJSON or TopoJSON file whose features are identified
+// by another property, a number or a string of digits. It is copied to "id",
+// which the renderer reads.
+func LoadWithID(path, idProperty string, simplify bool) (*Dataset, error) {
+	return LoadFile(path, LoadOptions{IDProperty: idProperty, Simplify: simplify})
+}
+
+// LoadOptions describes how a map file is read.
+type LoadOptions struct {
+	// Object of a TopoJSON file holding the features. Empty picks the only
+	// object of the topology, and is required for GeoJSON.
+	Object string
+	// IDProperty identifies the features (default "id").
+	IDProperty string
+	// CRS of the coordinates, converted to WGS84. Empty uses the crs member
+	// of a GeoJSON file, or WGS84.
+	CRS CRS
+	// Simplify precomputes simplified geometries.
+	Simplify bool
+}
+
+// LoadFile reads a map file like LoadWithID, with more options.
+func LoadFile(path string, opts LoadOptions) (*Dataset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read geojson: %v", err)
+	}
+	return Parse(data, opts)
+}
+
+// Parse reads map data held in memory, as LoadFile does from a file.
+func Parse(data []byte, opts LoadOptions) (*Dataset, error) {
+	idProperty := opts.IDProperty
+	if idProperty == "" {
+		idProperty = "id"
+	}
+	var fc *geojson.FeatureCollection
+	var borders [][][]float64
+	var err error
+	crs := opts.CRS
+	if isTopoJSON(data) {
+		// The arcs of a topology are its borders, each stored once
+		fc, borders, err = parseTopoJSON(data, opts.Object)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read topojson: %v", err)
+		}
+	} else {
+		if opts.Object != "" {
+			return nil, fmt.Errorf("Failed to read geojson: object %q given for a file that is not TopoJSON", opts.Object)
+		}
+		fc, err = geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal geojson: %v", err)
+		}
+		if crs == "" {
+			if crs, err = declaredCRS(fc); err != nil {
+				return nil, fmt.Errorf("Failed to read geojson: %v", err)
+			}
+		}
+	}
+
+	for i, feature := range fc.Features {
+		if feature.Geometry == nil {
+			return nil, fmt.Errorf("Invalid GeoJSON: feature %d has no geometry", i)
+		}
+	}
+
+	// Converted before the borders are found, which compare coordinates
+	var rings [][][]float64
+	for _, feature := range fc.Features {
+		rings = append(rings, featureRings(feature)...)
+	}
+	convertCoordinates(crs, append(rings, borders...))
+	if borders == nil {
+		borders = Borders(fc.Features)
+	}
+
+	ids := make(map[int]bool, len(fc.Features))
+	for i, feature := range fc.Features {
+		var id float64
+		switch v := feature.Properties[idProperty].(type) {
+		case float64:
+			id = v
+		case string:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ID format in GeoJSON: %s of feature %d is %q, not a number", idProperty, i, v)
+			}
+			id = float64(n)
+		default:
+			return nil, fmt.Errorf("Invalid ID format in GeoJSON: feature %d has no numeric %s property", i, idProperty)
+		}
+		feature.Properties["id"] = id
+		ids[int(id)] = true
+	}
+
+	d := &Dataset{Full: fc, ids: ids, borders: borders}
+	if opts.Simplify {
+		anchors := findAnchors(fc.Features)
+		for _, tolerance := range simplifyTolerances {
+			features := simplifyFeatures(fc.Features, tolerance, anchors)
+			d.levels = append(d.levels, simplifiedLevel{
+				Tolerance: tolerance,
+				Features:  features,
+				Borders:   Borders(features),
+			})
+		}
+	}
+	return d, nil
+}
+
+// HasID reports whether a feature has the ID.
+func (d *Dataset) HasID(id int) bool {
+	return d.ids[id]
+}
+
+// FeaturesFor returns the coarsest geometry that stays within half a pixel
+// of the original at the given zoom.
+func (d *Dataset) FeaturesFor(pixelsPerDegree float64) []*geojson.Feature {
+	if level := d.levelFor(pixelsPerDegree); level != nil {
+		return level.Features
+	}
+	return d.Full.Features
+}
+
+// BordersFor returns the outlines of the geometry FeaturesFor picks at the
+// same zoom, with every shared border once.
+func (d *Dataset) BordersFor(pixelsPerDegree float64) [][][]float64 {
+	if level := d.levelFor(pixelsPerDegree); level != nil {
+		return level.Borders
+	}
+	return d.borders
+}
+
+// LabelPoint returns the LabelPoint of a feature of the dataset, at any level
+// of simplification, computed once.
+func (d *Dataset) LabelPoint(feature *geojson.Feature) (lon, lat float64) {
+	if p, ok := d.labels.Load(feature); ok {
+		point := p.([2]float64)
+		return point[0], point[1]
+	}
+	lon, lat = LabelPoint(feature)
+	d.labels.Store(feature, [2]float64{lon, lat})
+	return lon, lat
+}
+
+func (d *Dataset) levelFor(pixelsPerDegree float64) *simplifiedLevel {
+	for i, level := range d.levels {
+		if level.Tolerance*pixelsPerDegree <= maxSimplifyError {
+			return &d.levels[i]
+		}
+	}
+	return nil
+}
+
+func simplifyFeatures(features []*geojson.Feature, tolerance float64, anchors map[vertex]bool) []*geojson.Feature {
+	simplified := make([]*geojson.Feature, len(features))
+	for i, feature := range features {
+		var geometry *geojson.Geometry
+		switch feature.Geometry.Type {
+		case "Polygon":
+			geometry = geojson.NewPolygonGeometry(simplifyPolygon(feature.Geometry.Polygon, tolerance, anchors))
+		case "MultiPolygon":
+			polygons := make([][][][]float64, len(feature.Geometry.MultiPolygon))
+			for j, polygon := range feature.Geometry.MultiPolygon {
+				polygons[j] = simplifyPolygon(polygon, tolerance, anchors)
+			}
+			geometry = geojson.NewMultiPolygonGeometry(polygons...)
+		default:
+			geometry = feature.Geometry
+		}
+
+		copied := geojson.NewFeature(geometry)
+		copied.ID = feature.ID
+		copied.Properties = feature.Properties
+		simplified[i] = copied
+	}
+	return simplified
+}
+
+func simplifyPolygon(polygon [][][]float64, tolerance float64, anchors map[vertex]bool) [][][]float64 {
+	rings := make([][][]float64, len(polygon))
+	for i, ring := range polygon {
+		rings[i] = simplifyRing(ring, tolerance, anchors)
+	}
+	return rings
+}
+
+// Function to simplify a closed ring with Douglas-Peucker. The anchors on the
+// ring are kept and the stretches between them simplified one by one. A ring
+// with a single anchor, or none, is also split at the vertex farthest from its
+// start so both halves have a proper baseline. Rings that would collapse keep
+// a triangle so small islands stay visible.
+func simplifyRing(ring [][]float64, tolerance float64, anchors map[vertex]bool) [][]float64 {
+	if len(ring) <= 4 {
+		return ring
+	}
+
+	last := len(ring) - 1
+	// Start at an anchor, so the start is a vertex neighbors keep too
+	if !anchors[toVertex(ring[0])] {
+		for i := 1; i < last; i++ {
+			if anchors[toVertex(ring[i])] {
+				ring = rotateRing(ring, i)
+				break
+			}
+		}
+	}
+
+	keep := make([]bool, len(ring))
+	keep[0], keep[last] = true, true
+	kept := []int{0}
+	for i := 1; i < last; i++ {
+		if anchors[toVertex(ring[i])] {
+			keep[i] = true
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) == 1 {
+		split := 0
+		var farthest float64
+		for i := 1; i < last; i++ {
+			if d := math.Hypot(ring[i][0]-ring[0][0], ring[i][1]-ring[0][1]); d > farthest {
+				split, farthest = i, d
+			}
+		}
+		if split == 0 {
+			return ring
+		}
+		keep[split] = true
+		kept = append(kept, split)
+	}
+	kept = append(kept, last)
+	for i := 1; i < len(kept); i++ {
+		simplifySpan(ring, kept[i-1], kept[i], tolerance, keep)
+	}
+
+	var result [][]float64
+	for i, k := range keep {
+		if k {
+			result = append(result, ring[i])
+		}
+	}
+
+	if len(result) < 4 {
+		split := kept[1]
+		// Keep the vertex farthest from the split line to form a triangle
+		apex, apexDist := 0, -1.0
+		for i := 1; i < last; i++ {
+			if i == split {
+				continue
+			}
+			if d := segmentDistance(ring[i], ring[0], ring[split]); d > apexDist {
+				apex, apexDist = i, d
+			}
+		}
+		if apex < split {
+			return [][]float64{ring[0], ring[apex], ring[split], ring[last]}
+		}
+		return [][]float64{ring[0], ring[split], ring[apex], ring[last]}
+	}
+	return result
+}
+
+// Function to simplify the stretch between two kept vertices, always walking
+// it in the same direction. Neighbors traverse a shared border in opposite
+// directions, and near-ties between distances must not break differently.
+func simplifySpan(ring [][]float64, first, last int, tolerance float64, keep []bool) {
+	if !vertexLess(toVertex(ring[last]), toVertex(ring[first])) {
+		douglasPeucker(ring, first, last, tolerance, keep)
+		return
+	}
+	reversed := reverseRing(ring[first : last+1])
+	keepReversed := make([]bool, len(reversed))
+	douglasPeucker(reversed, 0, len(reversed)-1, tolerance, keepReversed)
+	for i, k := range keepReversed {
+		if k {
+			keep[last-i] = true
+		}
+	}
+}
+
+// Function to start a closed ring at another vertex
+func rotateRing(ring [][]float64, start int) [][]float64 {
+	rotated := make([][]float64, 0, len(ring))
+	rotated = append(rotated, ring[start:len(ring)-1]...)
+	rotated = append(rotated, ring[:start]...)
+	return append(rotated, ring[start])
+}
+
+// Iterative Douglas-Peucker between two kept vertices
+func douglasPeucker(points [][]float64, first, last int, tolerance float64, keep []bool) {
+	stack := [][2]int{{first, last}}
+	for len(stack) > 0 {
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		index, maxDist := 0, 0.0
+		for i := span[0] + 1; i < span[1]; i++ {
+			if d := segmentDistance(points[i], points[span[0]], points[span[1]]); d > maxDist {
+				index, maxDist = i, d
+			}
+		}
+		if maxDist > tolerance {
+			keep[index] = true
+			stack = append(stack, [2]int{span[0], index}, [2]int{index, span[1]})
+		}
+	}
+}
+
+// Function to calculate the distance from p to the segment a-b
+func segmentDistance(p, a, b []float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
@@ -0,0 +1,68 @@
+package geo
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Representative epicenters of the JMA hypocenter regions (震央地名), one
+// name,lat,lon row per region, near the middle of where its earthquakes
+// occur
+//
+//go:embed hypocenters.csv
+var hypocentersCSV []byte
+
+// Hypocenters resolves JMA hypocenter region names, such as 石川県能登地方,
+// to coordinates, for reports that name the epicenter rather than give it.
+type Hypocenters struct {
+	byName map[string]Station
+}
+
+// DefaultHypocenters returns the bundled table of hypocenter regions.
+func DefaultHypocenters() *Hypocenters {
+	byName, err := readPlaces(bytes.NewReader(hypocentersCSV), "hypocenter region")
+	if err != nil {
+		panic(err)
+	}
+	return &Hypocenters{byName: byName}
+}
+
+// LoadHypocenters reads the bundled table, then a CSV file of name,lat,lon
+// rows in the same format that adds regions or moves bundled ones.
+func LoadHypocenters(path string) (*Hypocenters, error) {
+	h := DefaultHypocenters()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open hypocenter regions: %v", err)
+	}
+	defer f.Close()
+	overrides, err := readPlaces(f, "hypocenter region")
+	if err != nil {
+		return nil, err
+	}
+	for name, place := range overrides {
+		h.byName[strings.Join(strings.Fields(name), "")] = place
+	}
+	return h, nil
+}
+
+// Geocode returns the coordinates of a hypocenter region by name. Spaces,
+// including full-width ones, are ignored.
+func (h *Hypocenters) Geocode(name string) (lat, lon float64, ok bool) {
+	if h == nil {
+		return 0, 0, false
+	}
+	place, ok := h.byName[strings.Join(strings.Fields(name), "")]
+	return place.Lat, place.Lon, ok
+}
+
+// Len returns the number of regions.
+func (h *Hypocenters) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.byName)
+}
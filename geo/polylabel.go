@@ -0,0 +1,185 @@
+package geo
+
+import (
+	"container/heap"
+	"math"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Labels are placed to within this fraction of the shorter side of their
+// polygon
+const labelPrecision = 0.01
+
+// LabelPoint returns where to label a Polygon or MultiPolygon feature: the
+// pole of inaccessibility of its largest polygon, the inside point farthest
+// from its outline. Unlike the average of the vertices, it stays inside
+// concave shapes, and away from holes.
+func LabelPoint(feature *geojson.Feature) (lon, lat float64) {
+	var polygons [][][][]float64
+	switch feature.Geometry.Type {
+	case "Polygon":
+		polygons = [][][][]float64{feature.Geometry.Polygon}
+	case "MultiPolygon":
+		polygons = feature.Geometry.MultiPolygon
+	}
+
+	var largest [][][]float64
+	var largestArea float64
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		if area := math.Abs(RingArea(polygon[0])); largest == nil || area > largestArea {
+			largest, largestArea = polygon, area
+		}
+	}
+	if largest == nil {
+		return 0, 0
+	}
+	return PoleOfInaccessibility(largest)
+}
+
+// PoleOfInaccessibility finds the point of a polygon (an exterior ring and its
+// holes) farthest from its outline, with the polylabel algorithm: cells of a
+// grid over the polygon are split in quarters, best first, until none can
+// hold a point farther from the outline than the best found by more than the
+// precision. Distances are measured with longitudes shrunk by the cosine of
+// the latitude of the polygon, as on the map.
+func PoleOfInaccessibility(polygon [][][]float64) (lon, lat float64) {
+	exterior := polygon[0]
+	b := BBox{MinLon: exterior[0][0], MinLat: exterior[0][1], MaxLon: exterior[0][0], MaxLat: exterior[0][1]}
+	for _, coord := range exterior {
+		b.MinLon, b.MaxLon = min(b.MinLon, coord[0]), max(b.MaxLon, coord[0])
+		b.MinLat, b.MaxLat = min(b.MinLat, coord[1]), max(b.MaxLat, coord[1])
+	}
+
+	// Project to a plane where distances are even in both directions
+	k := math.Cos((b.MinLat + b.MaxLat) / 2 * math.Pi / 180)
+	rings := make([][][2]float64, len(polygon))
+	for i, ring := range polygon {
+		rings[i] = make([][2]float64, len(ring))
+		for j, coord := range ring {
+			rings[i][j] = [2]float64{coord[0] * k, coord[1]}
+		}
+	}
+	minX, minY := b.MinLon*k, b.MinLat
+	width, height := (b.MaxLon-b.MinLon)*k, b.MaxLat-b.MinLat
+	cellSize := min(width, height)
+	if cellSize == 0 {
+		return b.MinLon, b.MinLat
+	}
+	precision := cellSize * labelPrecision
+	h := cellSize / 2
+
+	cells := &cellQueue{}
+	for x := minX; x < minX+width; x += cellSize {
+		for y := minY; y < minY+height; y += cellSize {
+			heap.Push(cells, newCell(x+h, y+h, h, rings))
+		}
+	}
+
+	// The centroid is a good first guess for compact shapes
+	best := newCell(minX+width/2, minY+height/2, 0, rings)
+	if cx, cy, ok := ringCentroid(rings[0]); ok {
+		if c := newCell(cx, cy, 0, rings); c.d > best.d {
+			best = c
+		}
+	}
+
+	for cells.Len() > 0 {
+		c := heap.Pop(cells).(cell)
+		if c.d > best.d {
+			best = c
+		}
+		// No point of the cell can do better
+		if c.max-best.d <= precision {
+			continue
+		}
+		h := c.h / 2
+		heap.Push(cells, newCell(c.x-h, c.y-h, h, rings))
+		heap.Push(cells, newCell(c.x+h, c.y-h, h, rings))
+		heap.Push(cells, newCell(c.x-h, c.y+h, h, rings))
+		heap.Push(cells, newCell(c.x+h, c.y+h, h, rings))
+	}
+	return best.x / k, best.y
+}
+
+// A square cell of the search, with the signed distance from its center to
+// the outline (negative outside) and the most any of its points can have
+type cell struct {
+	x, y, h float64
+	d, max  float64
+}
+
+func newCell(x, y, h float64, rings [][][2]float64) cell {
+	d := pointToPolygonDistance(x, y, rings)
+	return cell{x: x, y: y, h: h, d: d, max: d + h*math.Sqrt2}
+}
+
+// Cells with the most potential come out first
+type cellQueue []cell
+
+func (q cellQueue) Len() int           { return len(q) }
+func (q cellQueue) Less(i, j int) bool { return q[i].max > q[j].max }
+func (q cellQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *cellQueue) Push(x any)        { *q = append(*q, x.(cell)) }
+func (q *cellQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// Function to get the distance from a point to the outline of a polygon,
+// negative when the point is outside it (or in a hole)
+func pointToPolygonDistance(x, y float64, rings [][][2]float64) float64 {
+	inside := false
+	minDistSq := math.Inf(1)
+	for _, ring := range rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > y) != (b[1] > y) && x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+			minDistSq = min(minDistSq, segmentDistanceSq(x, y, a, b))
+		}
+	}
+	d := math.Sqrt(minDistSq)
+	if !inside {
+		return -d
+	}
+	return d
+}
+
+// Function to get the squared distance from a point to a segment
+func segmentDistanceSq(px, py float64, a, b [2]float64) float64 {
+	x, y := a[0], a[1]
+	dx, dy := b[0]-x, b[1]-y
+	if dx != 0 || dy != 0 {
+		t := ((px-x)*dx + (py-y)*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			x, y = b[0], b[1]
+		} else if t > 0 {
+			x, y = x+dx*t, y+dy*t
+		}
+	}
+	dx, dy = px-x, py-y
+	return dx*dx + dy*dy
+}
+
+// Function to get the centroid of the area of a ring, if it has any
+func ringCentroid(ring [][2]float64) (x, y float64, ok bool) {
+	var area float64
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		f := a[0]*b[1] - b[0]*a[1]
+		x += (a[0] + b[0]) * f
+		y += (a[1] + b[1]) * f
+		area += f * 3
+	}
+	if area == 0 {
+		return 0, 0, false
+	}
+	return x / area, y / area, true
+}
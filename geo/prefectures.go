@@ -0,0 +1,105 @@
+package geo
+
+import (
+	"strconv"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Prefecture is one of the 47 prefectures, identified by its JIS X 0401 code.
+type Prefecture struct {
+	Code  int
+	Name  string // Romanized, as in the GeoJSON
+	Kanji string
+}
+
+// Prefectures lists the prefectures in JIS code order.
+var Prefectures = []Prefecture{
+	{1, "Hokkaido", "北海道"}, {2, "Aomori", "青森県"}, {3, "Iwate", "岩手県"},
+	{4, "Miyagi", "宮城県"}, {5, "Akita", "秋田県"}, {6, "Yamagata", "山形県"},
+	{7, "Fukushima", "福島県"}, {8, "Ibaraki", "茨城県"}, {9, "Tochigi", "栃木県"},
+	{10, "Gunma", "群馬県"}, {11, "Saitama", "埼玉県"}, {12, "Chiba", "千葉県"},
+	{13, "Tokyo", "東京都"}, {14, "Kanagawa", "神奈川県"}, {15, "Niigata", "新潟県"},
+	{16, "Toyama", "富山県"}, {17, "Ishikawa", "石川県"}, {18, "Fukui", "福井県"},
+	{19, "Yamanashi", "山梨県"}, {20, "Nagano", "長野県"}, {21, "Gifu", "岐阜県"},
+	{22, "Shizuoka", "静岡県"}, {23, "Aichi", "愛知県"}, {24, "Mie", "三重県"},
+	{25, "Shiga", "滋賀県"}, {26, "Kyoto", "京都府"}, {27, "Osaka", "大阪府"},
+	{28, "Hyogo", "兵庫県"}, {29, "Nara", "奈良県"}, {30, "Wakayama", "和歌山県"},
+	{31, "Tottori", "鳥取県"}, {32, "Shimane", "島根県"}, {33, "Okayama", "岡山県"},
+	{34, "Hiroshima", "広島県"}, {35, "Yamaguchi", "山口県"}, {36, "Tokushima", "徳島県"},
+	{37, "Kagawa", "香川県"}, {38, "Ehime", "愛媛県"}, {39, "Kochi", "高知県"},
+	{40, "Fukuoka", "福岡県"}, {41, "Saga", "佐賀県"}, {42, "Nagasaki", "長崎県"},
+	{43, "Kumamoto", "熊本県"}, {44, "Oita", "大分県"}, {45, "Miyazaki", "宮崎県"},
+	{46, "Kagoshima", "鹿児島県"}, {47, "Okinawa", "沖縄県"},
+}
+
+// PrefectureCode looks a prefecture up by its kanji name, with or without
+// the 都/道/府/県 suffix, or by its romanized name in any case, with or
+// without long vowels (Hyōgo, Hyougo) and a suffix such as -ken or
+// Prefecture. Full-width letters are read as their ASCII forms.
+func PrefectureCode(name string) (int, bool) {
+	name = strings.TrimSpace(norm.NFKC.String(name))
+	romaji := foldRomaji(name)
+	for _, p := range Prefectures {
+		if name == p.Kanji || romaji == foldRomaji(p.Name) {
+			return p.Code, true
+		}
+		if kanji := []rune(p.Kanji); p.Code != 1 && name == string(kanji[:len(kanji)-1]) {
+			return p.Code, true
+		}
+	}
+	return 0, false
+}
+
+// ParsePrefecture looks a prefecture up by its name, as PrefectureCode
+// does, or by its JIS X 0401 code, as 28 or 08, or ISO 3166-2 code, as JP-28.
+func ParsePrefecture(key string) (int, bool) {
+	key = strings.TrimSpace(norm.NFKC.String(key))
+	digits := key
+	if len(key) > 2 && strings.EqualFold(key[:2], "JP") {
+		digits = strings.TrimLeft(key[2:], "-_ ")
+	}
+	if code, err := strconv.Atoi(digits); err == nil && len(digits) <= 2 && digits[0] != '+' && digits[0] != '-' {
+		if code < 1 || code > len(Prefectures) {
+			return 0, false
+		}
+		return code, true
+	}
+	return PrefectureCode(key)
+}
+
+// Long vowels as Hepburn writes them, and as typed
+var longVowels = strings.NewReplacer("ō", "o", "ū", "u", "ô", "o", "û", "u", "ou", "o", "oo", "o", "uu", "u")
+
+// Function to fold a romanized prefecture name to compare it: lowercase,
+// without long vowels, separators, or a trailing suffix such as -ken
+func foldRomaji(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == '.'
+	})
+	for len(words) > 1 {
+		switch words[len(words)-1] {
+		case "ken", "to", "fu", "prefecture", "pref":
+			words = words[:len(words)-1]
+			continue
+		}
+		break
+	}
+	return longVowels.Replace(strings.Join(words, ""))
+}
+
+// FeatureNames returns the romanized and Japanese names of a feature. The
+// romanized one is its "name" property, and the Japanese one its "name_ja"
+// property or, for prefectures, that of Prefectures.
+func FeatureNames(feature *geojson.Feature) (romaji, kanji string) {
+	romaji, _ = feature.Properties["name"].(string)
+	kanji, _ = feature.Properties["name_ja"].(string)
+	if kanji == "" && romaji != "" {
+		if code, ok := PrefectureCode(romaji); ok {
+			kanji = Prefectures[code-1].Kanji
+		}
+	}
+	return romaji, kanji
+}
@@ -0,0 +1,71 @@
+package geo
+
+import "testing"
+
+func TestParsePrefecture(t *testing.T) {
+	tests := []struct {
+		key  string
+		code int
+		ok   bool
+	}{
+		// Kanji, with or without the suffix
+		{"東京都", 13, true},
+		{"東京", 13, true},
+		{"兵庫県", 28, true},
+		{"北海道", 1, true},
+		{"北海", 0, false},
+		// Romaji in any case, with long vowels and suffixes
+		{"Hyogo", 28, true},
+		{"hyogo", 28, true},
+		{"HYOGO", 28, true},
+		{"Hyōgo", 28, true},
+		{"Hyôgo", 28, true},
+		{"Hyougo", 28, true},
+		{"Hyogo-ken", 28, true},
+		{"Hyogo Prefecture", 28, true},
+		{"Hyogo pref.", 28, true},
+		{"Tokyo-to", 13, true},
+		{"Kyoto-fu", 26, true},
+		{"Kyouto", 26, true},
+		{"Ōita", 44, true},
+		{"Kōchi", 39, true},
+		{"Hokkaido", 1, true},
+		// JIS codes
+		{"28", 28, true},
+		{"08", 8, true},
+		{"8", 8, true},
+		{"1", 1, true},
+		{"47", 47, true},
+		{" 13 ", 13, true},
+		// ISO 3166-2 codes
+		{"JP-28", 28, true},
+		{"jp-28", 28, true},
+		{"JP28", 28, true},
+		{"jp_08", 8, true},
+		{"JP 13", 13, true},
+		// Full-width forms, folded by NFKC
+		{"２８", 28, true},
+		{"ＪＰ－２８", 28, true},
+		{"Ｈｙｏｇｏ", 28, true},
+		// Out of range or malformed
+		{"0", 0, false},
+		{"00", 0, false},
+		{"48", 0, false},
+		{"JP-48", 0, false},
+		{"JP-00", 0, false},
+		{"128", 0, false},
+		{"028", 0, false},
+		{"+1", 0, false},
+		{"-1", 0, false},
+		{"JP-", 0, false},
+		{"JP", 0, false},
+		{"", 0, false},
+		{"Atlantis", 0, false},
+	}
+	for _, tt := range tests {
+		code, ok := ParsePrefecture(tt.key)
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("ParsePrefecture(%q) = %d, %v; want %d, %v", tt.key, code, ok, tt.code, tt.ok)
+		}
+	}
+}
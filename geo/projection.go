@@ -0,0 +1,193 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Projector projects coordinates onto a plane for a view centered on a
+// point, in degrees of latitude at that point, so that zoom levels mean the
+// same in every projection. North is up.
+type Projector interface {
+	Project(lon, lat float64) (x, y float64)
+	// Extent is the part of the plane a bounding box covers.
+	Extent(b BBox) (minX, minY, maxX, maxY float64)
+}
+
+// Projections are the supported map projections, by name, each built for a
+// view centered on lon0, lat0.
+var Projections = map[string]func(lon0, lat0 float64) Projector{
+	// Plate carrée, with longitudes shrunk by the cosine of the center
+	// latitude
+	"equirectangular": func(lon0, lat0 float64) Projector {
+		return equirectangular{lon0: lon0, lat0: lat0, lonCorrection: math.Cos(lat0 * math.Pi / 180.0)}
+	},
+	// Spherical Mercator, as used by web map tiles
+	"mercator": func(lon0, lat0 float64) Projector {
+		return mercator{lon0: lon0, y0: mercatorY(lat0), k: math.Cos(lat0 * math.Pi / 180.0)}
+	},
+	// Azimuthal equidistant, keeping distances and directions from the
+	// center true, such as from an epicenter
+	"azimuthal": func(lon0, lat0 float64) Projector {
+		phi0 := lat0 * math.Pi / 180
+		return azimuthal{lon0: lon0, sinPhi0: math.Sin(phi0), cosPhi0: math.Cos(phi0)}
+	},
+}
+
+// DefaultProjection is the projection of maps whose options name none.
+const DefaultProjection = "equirectangular"
+
+// ParseProjection checks a projection name. An empty name is the default.
+func ParseProjection(name string) (string, error) {
+	if name == "" {
+		return DefaultProjection, nil
+	}
+	if _, ok := Projections[name]; !ok {
+		names := make([]string, 0, len(Projections))
+		for n := range Projections {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown projection: %s (must be %s)", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// Projection maps lon/lat to canvas pixels, centered on the middle of a
+// bounding box.
+type Projection struct {
+	// Scale is the zoom in pixels per degree of latitude at the center.
+	Scale float64
+
+	projector        Projector
+	midX, midY       float64
+	centerX, centerY float64
+}
+
+// Fit centers the box on a width x height canvas and zooms it to fill the
+// canvas minus margin (a fraction of each side), in the default projection.
+func Fit(b BBox, width, height, margin float64) Projection {
+	return FitProjection(DefaultProjection, b, width, height, margin)
+}
+
+// FitProjection is Fit in the named projection, which must be one of
+// Projections.
+func FitProjection(name string, b BBox, width, height, margin float64) Projection {
+	// Calculate the effective drawing area
+	effectiveWidth := width * (1.0 - 2*margin)
+	effectiveHeight := height * (1.0 - 2*margin)
+
+	p := Projection{
+		projector: Projections[name]((b.MaxLon+b.MinLon)/2, (b.MaxLat+b.MinLat)/2),
+		centerX:   width / 2,
+		centerY:   height / 2,
+	}
+	minX, minY, maxX, maxY := p.projector.Extent(b)
+	p.midX, p.midY = (minX+maxX)/2, (minY+maxY)/2
+	p.Scale = min(effectiveWidth/(maxX-minX), effectiveHeight/(maxY-minY))
+	return p
+}
+
+// Span returns the width and height of the box in the named projection, in
+// degrees of latitude at its center.
+func Span(name string, b BBox) (width, height float64) {
+	minX, minY, maxX, maxY := Projections[name]((b.MaxLon+b.MinLon)/2, (b.MaxLat+b.MinLat)/2).Extent(b)
+	return maxX - minX, maxY - minY
+}
+
+// Shift returns the projection moved by dx, dy pixels on the canvas, such as
+// below a banner.
+func (p Projection) Shift(dx, dy float64) Projection {
+	p.centerX += dx
+	p.centerY += dy
+	return p
+}
+
+// ToScreen converts a coordinate to canvas pixels.
+func (p Projection) ToScreen(lon, lat float64) (x, y float64) {
+	px, py := p.projector.Project(lon, lat)
+	x = (px-p.midX)*p.Scale + p.centerX
+	y = (p.midY-py)*p.Scale + p.centerY
+	return
+}
+
+// The equirectangular projection, corrected for the shrinking of longitude
+// at the center latitude
+type equirectangular struct {
+	lon0, lat0    float64
+	lonCorrection float64
+}
+
+func (e equirectangular) Project(lon, lat float64) (float64, float64) {
+	return (lon - e.lon0) * e.lonCorrection, lat - e.lat0
+}
+
+// The box is symmetric about the center, so the view centers on it exactly
+func (e equirectangular) Extent(b BBox) (float64, float64, float64, float64) {
+	halfWidth := (b.MaxLon - b.MinLon) * e.lonCorrection / 2 // Correct longitude range
+	halfHeight := (b.MaxLat - b.MinLat) / 2
+	return -halfWidth, -halfHeight, halfWidth, halfHeight
+}
+
+// Latitudes are clamped to the square of web map tiles
+const mercatorMaxLat = 85.05112878
+
+func mercatorY(lat float64) float64 {
+	phi := math.Max(-mercatorMaxLat, math.Min(mercatorMaxLat, lat)) * math.Pi / 180
+	return math.Log(math.Tan(math.Pi/4+phi/2)) * 180 / math.Pi
+}
+
+// Spherical Mercator, scaled by k so a degree of latitude at the center is a
+// unit
+type mercator struct {
+	lon0, y0, k float64
+}
+
+func (m mercator) Project(lon, lat float64) (float64, float64) {
+	return (lon - m.lon0) * m.k, (mercatorY(lat) - m.y0) * m.k
+}
+
+// Meridians and parallels are straight, so the corners bound the box
+func (m mercator) Extent(b BBox) (float64, float64, float64, float64) {
+	minX, minY := m.Project(b.MinLon, b.MinLat)
+	maxX, maxY := m.Project(b.MaxLon, b.MaxLat)
+	return minX, minY, maxX, maxY
+}
+
+// The azimuthal equidistant projection on the sphere
+type azimuthal struct {
+	lon0             float64
+	sinPhi0, cosPhi0 float64
+}
+
+func (a azimuthal) Project(lon, lat float64) (float64, float64) {
+	phi, dLambda := lat*math.Pi/180, (lon-a.lon0)*math.Pi/180
+	sinPhi, cosPhi := math.Sin(phi), math.Cos(phi)
+	cosC := a.sinPhi0*sinPhi + a.cosPhi0*cosPhi*math.Cos(dLambda)
+	c := math.Acos(math.Max(-1, math.Min(1, cosC)))
+	// The angular distance over its sine, 1 at the center
+	k := 1.0
+	if s := math.Sin(c); s > 1e-12 {
+		k = c / s
+	}
+	x := k * cosPhi * math.Sin(dLambda)
+	y := k * (a.cosPhi0*sinPhi - a.sinPhi0*cosPhi*math.Cos(dLambda))
+	return x * 180 / math.Pi, y * 180 / math.Pi
+}
+
+// Parallels curve, so the extent is found along the edges of the box
+func (a azimuthal) Extent(b BBox) (float64, float64, float64, float64) {
+	const steps = 32
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / steps
+		lon, lat := b.MinLon+t*(b.MaxLon-b.MinLon), b.MinLat+t*(b.MaxLat-b.MinLat)
+		for _, p := range [][2]float64{{lon, b.MinLat}, {lon, b.MaxLat}, {b.MinLon, lat}, {b.MaxLon, lat}} {
+			x, y := a.Project(p[0], p[1])
+			minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+		}
+	}
+	return minX, minY, maxX, maxY
+}
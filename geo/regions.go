@@ -0,0 +1,59 @@
+// Package geo loads the prefecture geometry and fits it to the canvas.
+package geo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BBox is a geographic bounding box in degrees.
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// Regions are named viewports for consistent framing. Remote islands (Izu,
+// Ogasawara, Amami) are left out so the mainland of each region fills the
+// canvas.
+var Regions = map[string]BBox{
+	"hokkaido": {139.3, 41.3, 145.9, 45.6},
+	"tohoku":   {139.0, 36.7, 142.2, 41.6},
+	"kanto":    {138.3, 34.8, 141.0, 37.2},
+	"chubu":    {135.9, 34.5, 139.9, 38.6},
+	"kinki":    {134.2, 33.4, 136.9, 35.8},
+	"kansai":   {134.2, 33.4, 136.9, 35.8},
+	"chugoku":  {130.8, 33.7, 134.5, 35.7},
+	"shikoku":  {132.0, 32.6, 134.9, 34.5},
+	"kyushu":   {128.5, 30.9, 132.1, 34.8},
+	"okinawa":  {122.9, 24.0, 131.4, 27.9},
+}
+
+// ParseBBox parses "minLon,minLat,maxLon,maxLat" or a region name.
+func ParseBBox(value string) (BBox, error) {
+	if region, ok := Regions[strings.ToLower(value)]; ok {
+		return region, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return BBox{}, fmt.Errorf("Invalid bbox: %s (must be minLon,minLat,maxLon,maxLat or a region name)", value)
+	}
+
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("Invalid bbox: %s (%q is not a number)", value, part)
+		}
+		v[i] = f
+	}
+
+	b := BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if b.MinLon < -180 || b.MaxLon > 180 || b.MinLat < -90 || b.MaxLat > 90 {
+		return BBox{}, fmt.Errorf("Invalid bbox: %s (out of range)", value)
+	}
+	if b.MinLon >= b.MaxLon || b.MinLat >= b.MaxLat {
+		return BBox{}, fmt.Errorf("Invalid bbox: %s (minimum must be less than maximum)", value)
+	}
+	return b, nil
+}
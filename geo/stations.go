@@ -0,0 +1,88 @@
+package geo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Station is a seismic intensity observation point.
+type Station struct {
+	Name string
+	Lat  float64
+	Lon  float64
+}
+
+// Stations indexes observation points by name.
+type Stations struct {
+	byName map[string]Station
+}
+
+// LoadStations reads a CSV file of observation points, one name,lat,lon row
+// per station. A header row is skipped. Names are matched as the JMA and
+// P2P地震情報 reports spell them, e.g. 輪島市門前町走出.
+func LoadStations(path string) (*Stations, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open stations: %v", err)
+	}
+	defer f.Close()
+
+	byName, err := readPlaces(f, "station")
+	if err != nil {
+		return nil, err
+	}
+	return &Stations{byName: byName}, nil
+}
+
+// Function to read name,lat,lon rows into places by name, skipping a header
+// row. what names a row in errors.
+func readPlaces(reader io.Reader, what string) (map[string]Station, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	places := make(map[string]Station)
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %ss: %v", what, err)
+		}
+		lat, latErr := strconv.ParseFloat(record[1], 64)
+		lon, lonErr := strconv.ParseFloat(record[2], 64)
+		if latErr != nil || lonErr != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("Invalid %s on line %d: %s", what, line, strings.Join(record, ","))
+		}
+		if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("Invalid %s on line %d: coordinates out of range", what, line)
+		}
+		name := strings.TrimSpace(record[0])
+		places[name] = Station{Name: name, Lat: lat, Lon: lon}
+	}
+	return places, nil
+}
+
+// Lookup finds a station by name.
+func (s *Stations) Lookup(name string) (Station, bool) {
+	if s == nil {
+		return Station{}, false
+	}
+	station, ok := s.byName[strings.TrimSpace(name)]
+	return station, ok
+}
+
+// Len returns the number of stations.
+func (s *Stations) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.byName)
+}
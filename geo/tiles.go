@@ -0,0 +1,44 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxTileZoom is the deepest zoom of map tiles. Beyond it, tiles show less
+// than the detail of the full geometry.
+const MaxTileZoom = 16
+
+// Tile is a web map tile in the XYZ scheme of OpenStreetMap, Leaflet and
+// MapLibre: zoom Z splits the Web Mercator square into 2^Z by 2^Z tiles, X
+// counted eastward from the antimeridian and Y southward from the top.
+type Tile struct {
+	Z, X, Y int
+}
+
+// Validate checks the zoom, up to MaxTileZoom, and that the tile is within
+// the square of its zoom.
+func (t Tile) Validate() error {
+	if t.Z < 0 || t.Z > MaxTileZoom {
+		return fmt.Errorf("invalid tile zoom: %d (must be between 0 and %d)", t.Z, MaxTileZoom)
+	}
+	if n := 1 << t.Z; t.X < 0 || t.X >= n || t.Y < 0 || t.Y >= n {
+		return fmt.Errorf("invalid tile: %d/%d/%d (x and y must be between 0 and %d at zoom %d)", t.Z, t.X, t.Y, n-1, t.Z)
+	}
+	return nil
+}
+
+// Bounds returns the area the tile covers. In the Mercator projection, the
+// box is a square.
+func (t Tile) Bounds() BBox {
+	n := float64(int(1) << t.Z)
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return BBox{
+		MinLon: float64(t.X)/n*360 - 180,
+		MinLat: lat(t.Y + 1),
+		MaxLon: float64(t.X+1)/n*360 - 180,
+		MaxLat: lat(t.Y),
+	}
+}
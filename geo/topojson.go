@@ -0,0 +1,192 @@
+package geo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// A TopoJSON topology. Geometries refer to arcs by index, with ^i (-i-1)
+// for arc i reversed, so borders between features are stored once.
+type topology struct {
+	Type      string `json:"type"`
+	Transform *struct {
+		Scale     [2]float64 `json:"scale"`
+		Translate [2]float64 `json:"translate"`
+	} `json:"transform"`
+	Arcs    [][][]float64           `json:"arcs"`
+	Objects map[string]topoGeometry `json:"objects"`
+}
+
+type topoGeometry struct {
+	Type       string          `json:"type"`
+	ID         any             `json:"id"`
+	Properties map[string]any  `json:"properties"`
+	Arcs       json.RawMessage `json:"arcs"`
+	Geometries []topoGeometry  `json:"geometries"`
+}
+
+// Function to tell TopoJSON from GeoJSON by the type of the document
+func isTopoJSON(data []byte) bool {
+	var doc struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &doc) == nil && doc.Type == "Topology"
+}
+
+// Function to convert an object of a TopoJSON topology to GeoJSON features.
+// An empty object name picks the only object. It also returns the arcs the
+// polygons are made of, each once, which are the borders of the features.
+func parseTopoJSON(data []byte, object string) (*geojson.FeatureCollection, [][][]float64, error) {
+	var topo topology
+	if err := json.Unmarshal(data, &topo); err != nil {
+		return nil, nil, err
+	}
+	if object == "" {
+		if len(topo.Objects) != 1 {
+			names := make([]string, 0, len(topo.Objects))
+			for name := range topo.Objects {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, nil, fmt.Errorf("topology has %d objects (%s); name the one to use", len(names), strings.Join(names, ", "))
+		}
+		for name := range topo.Objects {
+			object = name
+		}
+	}
+	root, ok := topo.Objects[object]
+	if !ok {
+		return nil, nil, fmt.Errorf("topology has no object %q", object)
+	}
+
+	arcs := topo.decodeArcs()
+	used := make([]bool, len(arcs))
+	// Function to join arcs into a ring, dropping the point each arc shares
+	// with the previous one
+	ring := func(indices []int) ([][]float64, error) {
+		var coords [][]float64
+		for _, i := range indices {
+			reversed := i < 0
+			if reversed {
+				i = ^i
+			}
+			if i >= len(arcs) {
+				return nil, fmt.Errorf("arc %d out of range (%d arcs)", i, len(arcs))
+			}
+			used[i] = true
+			arc := arcs[i]
+			if len(arc) == 0 {
+				continue
+			}
+			if reversed {
+				arc = reverseRing(arc)
+			}
+			if len(coords) > 0 {
+				arc = arc[1:]
+			}
+			coords = append(coords, arc...)
+		}
+		return coords, nil
+	}
+	polygon := func(rings [][]int) ([][][]float64, error) {
+		polygon := make([][][]float64, len(rings))
+		for i, indices := range rings {
+			r, err := ring(indices)
+			if err != nil {
+				return nil, err
+			}
+			polygon[i] = r
+		}
+		return polygon, nil
+	}
+
+	geometries := root.Geometries
+	if root.Type != "GeometryCollection" {
+		geometries = []topoGeometry{root}
+	}
+	fc := geojson.NewFeatureCollection()
+	for i, g := range geometries {
+		var geometry *geojson.Geometry
+		switch g.Type {
+		case "Polygon":
+			var rings [][]int
+			if err := json.Unmarshal(g.Arcs, &rings); err != nil {
+				return nil, nil, fmt.Errorf("geometry %d: invalid arcs: %v", i, err)
+			}
+			p, err := polygon(rings)
+			if err != nil {
+				return nil, nil, fmt.Errorf("geometry %d: %v", i, err)
+			}
+			geometry = geojson.NewPolygonGeometry(p)
+		case "MultiPolygon":
+			var polygons [][][]int
+			if err := json.Unmarshal(g.Arcs, &polygons); err != nil {
+				return nil, nil, fmt.Errorf("geometry %d: invalid arcs: %v", i, err)
+			}
+			multi := make([][][][]float64, len(polygons))
+			for j, rings := range polygons {
+				p, err := polygon(rings)
+				if err != nil {
+					return nil, nil, fmt.Errorf("geometry %d: %v", i, err)
+				}
+				multi[j] = p
+			}
+			geometry = geojson.NewMultiPolygonGeometry(multi...)
+		case "":
+			// Null geometries have nothing to draw
+			continue
+		default:
+			return nil, nil, fmt.Errorf("geometry %d: unsupported type %s (must be Polygon or MultiPolygon)", i, g.Type)
+		}
+
+		feature := geojson.NewFeature(geometry)
+		feature.ID = g.ID
+		feature.Properties = g.Properties
+		if feature.Properties == nil {
+			feature.Properties = map[string]any{}
+		}
+		// Like GeoJSON features, the ID may stand in for the properties
+		if _, ok := feature.Properties["id"]; !ok && g.ID != nil {
+			feature.Properties["id"] = g.ID
+		}
+		fc.AddFeature(feature)
+	}
+
+	var borders [][][]float64
+	for i, arc := range arcs {
+		if used[i] && len(arc) > 1 {
+			borders = append(borders, arc)
+		}
+	}
+	return fc, borders, nil
+}
+
+// Function to get the arcs in degrees, undoing the delta encoding of
+// quantized topologies
+func (topo *topology) decodeArcs() [][][]float64 {
+	arcs := make([][][]float64, len(topo.Arcs))
+	for i, arc := range topo.Arcs {
+		coords := make([][]float64, 0, len(arc))
+		var x, y float64
+		for _, p := range arc {
+			if len(p) < 2 {
+				continue
+			}
+			if topo.Transform == nil {
+				coords = append(coords, []float64{p[0], p[1]})
+				continue
+			}
+			x, y = x+p[0], y+p[1]
+			coords = append(coords, []float64{
+				x*topo.Transform.Scale[0] + topo.Transform.Translate[0],
+				y*topo.Transform.Scale[1] + topo.Transform.Translate[1],
+			})
+		}
+		arcs[i] = coords
+	}
+	return arcs
+}
@@ -0,0 +1,131 @@
+package geo
+
+import (
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// A coordinate, usable as a map key
+type vertex [2]float64
+
+// An undirected segment, with its ends in a fixed order
+type edge struct {
+	a, b vertex
+}
+
+func newEdge(p, q vertex) edge {
+	if vertexLess(q, p) {
+		p, q = q, p
+	}
+	return edge{p, q}
+}
+
+func vertexLess(p, q vertex) bool {
+	return p[0] < q[0] || (p[0] == q[0] && p[1] < q[1])
+}
+
+func toVertex(coord []float64) vertex {
+	return vertex{coord[0], coord[1]}
+}
+
+// Function to list the rings of a feature as they are stored, whatever their
+// orientation
+func featureRings(feature *geojson.Feature) [][][]float64 {
+	switch feature.Geometry.Type {
+	case "Polygon":
+		return feature.Geometry.Polygon
+	case "MultiPolygon":
+		var rings [][][]float64
+		for _, polygon := range feature.Geometry.MultiPolygon {
+			rings = append(rings, polygon...)
+		}
+		return rings
+	}
+	return nil
+}
+
+// Function to find the vertices where a border between prefectures starts or
+// ends: where three or more lines meet, or where a shared border reaches the
+// coast. Keeping these through simplification, and simplifying each stretch
+// between them on its own, makes neighbors simplify a shared border to the
+// same vertices.
+func findAnchors(features []*geojson.Feature) map[vertex]bool {
+	uses := make(map[edge]int)
+	neighbors := make(map[vertex][]vertex)
+	for _, feature := range features {
+		for _, ring := range featureRings(feature) {
+			for i := 1; i < len(ring); i++ {
+				p, q := toVertex(ring[i-1]), toVertex(ring[i])
+				if p == q {
+					continue
+				}
+				e := newEdge(p, q)
+				if uses[e] == 0 {
+					neighbors[p] = append(neighbors[p], q)
+					neighbors[q] = append(neighbors[q], p)
+				}
+				uses[e]++
+			}
+		}
+	}
+
+	anchors := make(map[vertex]bool)
+	for v, ns := range neighbors {
+		if len(ns) != 2 || uses[newEdge(v, ns[0])] != uses[newEdge(v, ns[1])] {
+			anchors[v] = true
+		}
+	}
+	return anchors
+}
+
+// Borders lists the outlines of the features as polylines in which every
+// segment appears once, so a border between two prefectures is not stroked
+// twice. A polyline whose first and last points are equal is closed.
+func Borders(features []*geojson.Feature) [][][]float64 {
+	seen := make(map[edge]bool)
+	var lines [][][]float64
+	for _, feature := range features {
+		for _, ring := range featureRings(feature) {
+			lines = append(lines, ringBorders(ring, seen)...)
+		}
+	}
+	return lines
+}
+
+// Function to split a ring into the stretches whose segments were not drawn
+// by an earlier ring
+func ringBorders(ring [][]float64, seen map[edge]bool) [][][]float64 {
+	var lines [][][]float64
+	var line [][]float64
+	for i := 1; i < len(ring); i++ {
+		p, q := toVertex(ring[i-1]), toVertex(ring[i])
+		if p == q {
+			continue
+		}
+		e := newEdge(p, q)
+		if seen[e] {
+			if len(line) > 0 {
+				lines = append(lines, line)
+				line = nil
+			}
+			continue
+		}
+		seen[e] = true
+		if len(line) == 0 {
+			line = append(line, ring[i-1])
+		}
+		line = append(line, ring[i])
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+
+	// A stretch running through the start of the ring was split in two
+	if n := len(lines); n > 1 {
+		first, last := lines[0], lines[n-1]
+		if toVertex(first[0]) == toVertex(ring[0]) && toVertex(last[len(last)-1]) == toVertex(ring[len(ring)-1]) {
+			lines[0] = append(last, first[1:]...)
+			lines = lines[:n-1]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,63 @@
+// Package i18n holds the built-in strings of the maps, such as the default
+// footer and the banner of event maps, in a message catalog per language.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Languages with a catalog
+const (
+	English  = "en"
+	Japanese = "ja"
+)
+
+//go:embed en.json ja.json
+var catalogFiles embed.FS
+
+// Messages by language, then key
+var catalogs = map[string]map[string]string{}
+
+func init() {
+	for _, lang := range []string{English, Japanese} {
+		data, err := catalogFiles.ReadFile(lang + ".json")
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("invalid %s catalog: %v", lang, err))
+		}
+		catalogs[lang] = messages
+	}
+}
+
+// Parse checks a language. Empty is English.
+func Parse(value string) (string, error) {
+	if value == "" {
+		return English, nil
+	}
+	if _, ok := catalogs[value]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid lang: %s (must be %s)", value, strings.Join([]string{English, Japanese}, " or "))
+}
+
+// T gets the message of a key in a language, formatted with args as by
+// fmt.Sprintf. Languages and keys without a message fall back to English,
+// and keys missing from it too are returned as they are.
+func T(lang, key string, args ...any) string {
+	message, ok := catalogs[lang][key]
+	if !ok {
+		if message, ok = catalogs[English][key]; !ok {
+			return key
+		}
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"canvas/geo"
+	"canvas/render"
+	"canvas/server"
+)
+
+// Flags of the render subcommand that map one to one onto /map parameters
+var renderParams = []struct{ name, usage string }{
+	{"scale", `intensities as JSON, e.g. '[{"id":13,"scale":4}]' (required unless -points, -values, -markers or -overlay is given)`},
+	{"scale_type", "jma (the default), mmi for Modified Mercalli intensities 1 (I) to 12 (XII) or lpgm for long-period ground motion classes 1 to 4 in -scale and -points"},
+	{"values", `feature values as JSON for a choropleth map, e.g. '[{"id":13,"value":42.5}]' (instead of -scale)`},
+	{"ramp", "colors of the values, e.g. 0:#f0f9ff,50:#38bdf8,100:#1e3a8a"},
+	{"ramp_mode", "steps (the default) or linear"},
+	{"points", `station intensities as JSON, e.g. '[{"lat":35.69,"lon":139.69,"scale":4}]'`},
+	{"markers", `pins and symbols as JSON, e.g. '[{"lat":35.68,"lon":139.77,"icon":"star","label":"Tokyo"}]'`},
+	{"overlay", `GeoJSON lines and polygons drawn over the map, styled by their simplestyle properties, e.g. '{"type":"Feature","properties":{"stroke":"#ff0000"},"geometry":{...}}'`},
+	{"reference", "built-in overlays drawn beneath the markers: plates, faults or both, e.g. plates,faults"},
+	{"size", "size preset: 1 (1280x720), 2 or 3"},
+	{"width", "output width in pixels"},
+	{"height", "output height in pixels"},
+	{"margin", "fraction of the canvas left empty on each side"},
+	{"min_span", "minimum extent of the view in degrees"},
+	{"extent", "auto or japan"},
+	{"bbox", "minLon,minLat,maxLon,maxLat or a region name"},
+	{"footer", "footer text"},
+	{"title", "title written in a banner above the map"},
+	{"subtitle", "line written under the title"},
+	{"preset", "social card size with the title banner: og (1200x630), twitter (1200x675) or square (1080x1080)"},
+	{"stroke", "color of the borders, e.g. #a1a1aa (the default)"},
+	{"stroke_width", "width of the borders in pixels at 1280x720 (default 0.4)"},
+	{"fill_opacity", "opacity of the prefecture fills, 0 to 1 (default 0.8)"},
+	{"backend", "rasterization backend"},
+	{"precision", "decimals of the path coordinates, 1 to 6 (default: by zoom, or 2 for SVG)"},
+	{"layers", "layer stack, bottom first, e.g. fills,borders:multiply,labels"},
+	{"density", "auto to thin labels and markers by zoom, or all"},
+	{"insets", "auto to draw remote islands in boxes when they would zoom the map out, or none"},
+	{"projection", "equirectangular (the default), mercator or azimuthal"},
+	{"names", "romaji, kanji or both to write the prefecture names"},
+	{"lang", "en or ja, the language of the default footer"},
+	{"simulate", "deuteranopia, protanopia or tritanopia to preview the map with a color vision deficiency"},
+}
+
+// Function to render maps to files without starting the server, either one
+// described by flags or every output of a spec file
+func runRender(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	for _, p := range renderParams {
+		fs.String(p.name, "", p.usage)
+	}
+	fs.Bool("scale_text", false, "draw the intensity value on each prefecture")
+	fs.Bool("heatmap", false, "interpolate the point intensities over the land, beneath the borders")
+	fs.Bool("highlight", false, "outline the prefectures with the strongest shaking")
+	out := fs.String("out", "map.png", "file to write the PNG to, or an SVG document when it ends in .svg; - writes to stdout")
+	fs.StringVar(out, "o", "map.png", "shorthand for -out")
+	format := fs.String("format", "", "png or svg (default from the -out extension, png for stdout)")
+	quiet := fs.Bool("quiet", false, "only log warnings and errors")
+	logFormat := fs.String("log-format", "text", "log format: text or json")
+	specPath := fs.String("spec", "", "YAML or JSON spec file of the outputs to render, instead of the map flags")
+	dataPath := fs.String("data", "japan.geojson", "GeoJSON or TopoJSON file of the prefectures")
+	dataCRS := fs.String("data-crs", "", "CRS of the -data coordinates: wgs84, jgd2011, jgd2000 or tokyo (default: the crs member of the file, or wgs84)")
+	simplify := fs.Bool("simplify", true, "pick a simplified geometry by zoom level, as the server does")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: canvas render -scale '[...]' [flags]")
+		fmt.Fprintln(fs.Output(), "       canvas render -scale '[...]' -o - | magick - out.webp")
+		fmt.Fprintln(fs.Output(), "       canvas render -spec map.yaml")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+	level := "info"
+	if *quiet {
+		level = "warn"
+	}
+	if err := server.SetupLogging(*logFormat, level); err != nil {
+		return err
+	}
+	switch *format {
+	case "", "png", "svg":
+	default:
+		return fmt.Errorf("invalid format: %s (must be png or svg)", *format)
+	}
+
+	// The flags go through the same validation as the query parameters
+	query := url.Values{}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "out", "o", "format", "quiet", "log-format", "spec", "data", "simplify":
+		default:
+			query.Set(f.Name, f.Value.String())
+		}
+	})
+
+	outputs := []specOutput{{Path: *out, Query: query}}
+	if *specPath != "" {
+		if len(query) > 0 {
+			return fmt.Errorf("-spec cannot be combined with map flags")
+		}
+		var err error
+		if outputs, err = loadRenderSpec(*specPath); err != nil {
+			return err
+		}
+	}
+
+	// Validate every output before the first file is written
+	options := make([]*render.Options, len(outputs))
+	toStdout := 0
+	for i, output := range outputs {
+		opts, err := server.ParseRenderOptions(output.Query)
+		if err != nil {
+			return fmt.Errorf("%s: %w", output.Path, err)
+		}
+		options[i] = opts
+		if output.Path == "-" {
+			toStdout++
+		}
+	}
+	if toStdout > 1 {
+		return fmt.Errorf("only one output can be written to stdout")
+	}
+	if toStdout == 1 {
+		// Binary output would garble the terminal
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("refusing to write an image to a terminal; redirect stdout or pipe it")
+		}
+	}
+
+	var crs geo.CRS
+	if *dataCRS != "" {
+		var err error
+		if crs, err = geo.ParseCRS(*dataCRS); err != nil {
+			return err
+		}
+	}
+	dataset, err := geo.LoadFile(*dataPath, geo.LoadOptions{CRS: crs, Simplify: *simplify})
+	if err != nil {
+		return err
+	}
+	for i, output := range outputs {
+		if err := renderToFile(dataset, options[i], output.Path, *format); err != nil {
+			return fmt.Errorf("%s: %w", output.Path, err)
+		}
+	}
+	return nil
+}
+
+// Function to render a map to a file, or to stdout when the path is -. The
+// format is png or svg, or taken from the file extension when empty.
+func renderToFile(dataset *geo.Dataset, opts *render.Options, path, format string) error {
+	backend := opts.Backend
+	if backend == "" {
+		backend = render.DefaultBackend
+	}
+	scene := render.BuildScene(dataset, opts)
+
+	var data []byte
+	var err error
+	if format == "" && strings.EqualFold(filepath.Ext(path), ".svg") {
+		format = "svg"
+	}
+	if format == "svg" {
+		data, err = render.SVG(scene)
+	} else {
+		data, err = render.Backends[backend].Render(scene)
+	}
+	if err != nil {
+		return fmt.Errorf("render failed: %w", err)
+	}
+	if path == "-" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+		slog.Info("wrote image", "path", "stdout", "format", cmp.Or(format, "png"), "width", opts.Width, "height", opts.Height, "bytes", len(data))
+		return nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	slog.Info("wrote image", "path", path, "format", cmp.Or(format, "png"), "width", opts.Width, "height", opts.Height, "bytes", len(data))
+	return nil
+}
@@ -0,0 +1,172 @@
+//go:build accel
+
+package render
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// Experimental backend for large outputs, built with -tags accel. It draws
+// like the raster backend, but each path is rasterized over its own bounding
+// box instead of the whole canvas, into a coverage mask built by the SIMD
+// accumulator of golang.org/x/image/vector, and only the pixels the mask
+// covers are composited, on every core. Antialiased edges can differ from
+// the raster backend by one level, since the mask has 8 bits.
+type acceleratedBackend struct{}
+
+func init() {
+	Backends["accel"] = acceleratedBackend{}
+}
+
+func (b acceleratedBackend) Render(scene *Scene) ([]byte, error) {
+	rgba, err := b.Draw(scene)
+	if err != nil {
+		return nil, err
+	}
+	defer scene.Timings.Start("encode")()
+	return EncodePNG(rgba)
+}
+
+func (b acceleratedBackend) Draw(scene *Scene) (*image.RGBA, error) {
+	rgba, err := drawLayers(scene, func(dst *image.RGBA, layers []string) error {
+		return rasterLayers(dst, scene, layers, &maskScanner{dst: dst})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rgba, finishDraw(rgba, scene, b)
+}
+
+// A vertex of a path, starting a subpath or continuing it
+type maskVertex struct {
+	p     fixed.Point26_6
+	start bool
+}
+
+// A rasterx.Scanner that keeps the path until Draw, so it can be rasterized
+// within its extent. Only uniform colors are supported, which are all the
+// map uses.
+type maskScanner struct {
+	dst                    *image.RGBA
+	clip                   image.Rectangle
+	color                  color.Color
+	path                   []maskVertex
+	minX, minY, maxX, maxY fixed.Int26_6
+
+	z    vector.Rasterizer
+	mask []byte
+}
+
+func (s *maskScanner) extend(p fixed.Point26_6) {
+	if len(s.path) == 0 {
+		s.minX, s.minY, s.maxX, s.maxY = p.X, p.Y, p.X, p.Y
+		return
+	}
+	s.minX, s.minY = min(s.minX, p.X), min(s.minY, p.Y)
+	s.maxX, s.maxY = max(s.maxX, p.X), max(s.maxY, p.Y)
+}
+
+func (s *maskScanner) Start(a fixed.Point26_6) {
+	s.extend(a)
+	s.path = append(s.path, maskVertex{p: a, start: true})
+}
+
+func (s *maskScanner) Line(b fixed.Point26_6) {
+	s.extend(b)
+	s.path = append(s.path, maskVertex{p: b})
+}
+
+func (s *maskScanner) GetPathExtent() fixed.Rectangle26_6 {
+	return fixed.Rectangle26_6{Min: fixed.Point26_6{X: s.minX, Y: s.minY}, Max: fixed.Point26_6{X: s.maxX, Y: s.maxY}}
+}
+
+// The mask always has the size of the path, so the bounds are the canvas
+func (s *maskScanner) SetBounds(w, h int) {}
+
+func (s *maskScanner) SetColor(c interface{}) {
+	if c, ok := c.(color.Color); ok {
+		s.color = c
+	}
+}
+
+// x/image/vector only fills with the nonzero rule
+func (s *maskScanner) SetWinding(useNonZeroWinding bool) {}
+
+func (s *maskScanner) SetClip(rect image.Rectangle) {
+	s.clip = rect
+}
+
+func (s *maskScanner) Clear() {
+	s.path = s.path[:0]
+}
+
+// Draw fills the path since the last Clear with the color.
+func (s *maskScanner) Draw() {
+	if len(s.path) == 0 || s.color == nil {
+		return
+	}
+	// The pixels the path touches, on the canvas
+	r := image.Rect(s.minX.Floor(), s.minY.Floor(), s.maxX.Ceil()+1, s.maxY.Ceil()+1).Intersect(s.dst.Bounds())
+	if s.clip != image.ZR {
+		r = r.Intersect(s.clip)
+	}
+	if r.Empty() {
+		return
+	}
+
+	w, h := r.Dx(), r.Dy()
+	s.z.Reset(w, h)
+	ox, oy := float32(r.Min.X), float32(r.Min.Y)
+	for _, v := range s.path {
+		x, y := float32(v.p.X)/64-ox, float32(v.p.Y)/64-oy
+		if v.start {
+			s.z.MoveTo(x, y)
+		} else {
+			s.z.LineTo(x, y)
+		}
+	}
+	if cap(s.mask) < w*h {
+		s.mask = make([]byte, w*h)
+	}
+	// Drawing src onto a whole Alpha of the rasterizer's size takes the
+	// SIMD path, which writes every pixel of the mask
+	mask := &image.Alpha{Pix: s.mask[:w*h], Stride: w, Rect: image.Rect(0, 0, w, h)}
+	s.z.DrawOp = draw.Src
+	s.z.Draw(mask, mask.Rect, image.Opaque, image.Point{})
+
+	compositeMask(s.dst, r, mask, s.color)
+}
+
+// Function to composite a uniform color over dst through a coverage mask
+// placed at r, skipping uncovered pixels, in rows spread over every core.
+// The formula is that of x/image/vector for uniform sources.
+func compositeMask(dst *image.RGBA, r image.Rectangle, mask *image.Alpha, c color.Color) {
+	sr, sg, sb, sa := c.RGBA()
+	rows := chunkRanges(r.Dy())
+	parallelEach(len(rows), func(i int) {
+		for y := rows[i][0]; y < rows[i][1]; y++ {
+			pix := dst.Pix[dst.PixOffset(r.Min.X, r.Min.Y+y):]
+			m := mask.Pix[y*mask.Stride : y*mask.Stride+r.Dx()]
+			for x, coverage := range m {
+				if coverage == 0 {
+					continue
+				}
+				ma := uint32(coverage) * 0x101
+				a := 0xffff - (sa * ma / 0xffff)
+				j := 4 * x
+				pix[j+0] = uint8(((uint32(pix[j+0])*0x101*a + sr*ma) / 0xffff) >> 8)
+				pix[j+1] = uint8(((uint32(pix[j+1])*0x101*a + sg*ma) / 0xffff) >> 8)
+				pix[j+2] = uint8(((uint32(pix[j+2])*0x101*a + sb*ma) / 0xffff) >> 8)
+				pix[j+3] = uint8(((uint32(pix[j+3])*0x101*a + sa*ma) / 0xffff) >> 8)
+			}
+		}
+	})
+}
+
+var _ rasterx.Scanner = (*maskScanner)(nil)
@@ -0,0 +1,171 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"sort"
+	"time"
+
+	"canvas/geo"
+)
+
+// Most frames in one animation
+const MAX_FRAMES = 60
+
+// Animation formats
+const (
+	FormatGIF  = "gif"
+	FormatAPNG = "apng"
+)
+
+// Frame is one step of an animation: the intensities reported so far, and
+// how long they are shown.
+type Frame struct {
+	ScaleMap map[int]int
+	Points   []Point
+	// Label is drawn before the footer, usually the time of the report.
+	Label string
+	// Waves are drawn over the map when set.
+	Waves *Waves
+	Delay time.Duration
+}
+
+// Animate draws every frame with the options and encodes them as a looping
+// GIF or APNG. All frames share the view that frames every intensity of the
+// animation, so prefectures do not move as reports come in.
+func Animate(dataset *geo.Dataset, opts *Options, backend Backend, frames []Frame, format string) ([]byte, error) {
+	images := make([]*image.RGBA, len(frames))
+	err := DrawFrames(dataset, opts, backend, frames, func(i int, rgba *image.RGBA) error {
+		images[i] = rgba
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatGIF:
+		return encodeGIF(images, frames)
+	case FormatAPNG:
+		return encodeAPNG(images, frames)
+	}
+	return nil, fmt.Errorf("unknown animation format: %s", format)
+}
+
+// DrawFrames draws the frames of an animation in order, as Animate does, and
+// hands each to fn as soon as it is drawn. It stops at the first error,
+// including one from fn.
+func DrawFrames(dataset *geo.Dataset, opts *Options, backend Backend, frames []Frame, fn func(i int, rgba *image.RGBA) error) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames to animate")
+	}
+	if len(frames) > MAX_FRAMES {
+		return fmt.Errorf("too many frames: %d (at most %d)", len(frames), MAX_FRAMES)
+	}
+
+	// Frame the strongest intensity of each prefecture, and every point
+	framing := *opts
+	framing.ScaleMap = make(map[int]int)
+	framing.Points = nil
+	for _, frame := range frames {
+		for id, scale := range frame.ScaleMap {
+			framing.ScaleMap[id] = max(framing.ScaleMap[id], scale)
+		}
+		framing.Points = append(framing.Points, frame.Points...)
+	}
+	view := BuildScene(dataset, &framing)
+
+	for i, frame := range frames {
+		scene := *view
+		scene.ScaleMap = frame.ScaleMap
+		scene.Points = frame.Points
+		if frame.Label != "" {
+			scene.FooterText = frame.Label + " · " + view.footerText()
+		}
+		rgba, err := backend.Draw(&scene)
+		if err != nil {
+			return err
+		}
+		if frame.Waves != nil {
+			drawWaves(rgba, &scene, frame.Waves)
+		}
+		if err := fn(i, rgba); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseAnimationFormat checks an animation format name.
+func ParseAnimationFormat(value string) (string, error) {
+	switch value {
+	case "", FormatGIF:
+		return FormatGIF, nil
+	case FormatAPNG:
+		return FormatAPNG, nil
+	case "webm":
+		// Encoding video needs a VP8 or VP9 encoder, which the standard
+		// library lacks
+		return "", fmt.Errorf("webm output is not supported (use apng)")
+	}
+	return "", fmt.Errorf("unknown animation format: %s (must be gif or apng)", value)
+}
+
+// Function to encode frames as a looping GIF with one palette of the colors
+// they use most. Maps are mostly flat fills, so the colors left out are
+// antialiased edges, and they are drawn with the nearest color kept rather
+// than dithered.
+func encodeGIF(images []*image.RGBA, frames []Frame) ([]byte, error) {
+	counts := make(map[color.RGBA]int)
+	for _, rgba := range images {
+		for i := 0; i < len(rgba.Pix); i += 4 {
+			counts[color.RGBA{R: rgba.Pix[i], G: rgba.Pix[i+1], B: rgba.Pix[i+2], A: 0xff}]++
+		}
+	}
+	colors := make([]color.RGBA, 0, len(counts))
+	for c := range counts {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		if counts[colors[i]] != counts[colors[j]] {
+			return counts[colors[i]] > counts[colors[j]]
+		}
+		return rgbKey(colors[i]) < rgbKey(colors[j])
+	})
+	palette := make(color.Palette, 0, 256)
+	for _, c := range colors[:min(256, len(colors))] {
+		palette = append(palette, c)
+	}
+
+	// Palette.Index is a linear search, so each distinct color is looked up
+	// once
+	index := make(map[color.RGBA]uint8, len(colors))
+	anim := &gif.GIF{LoopCount: 0}
+	for n, rgba := range images {
+		paletted := image.NewPaletted(rgba.Bounds(), palette)
+		for i, j := 0, 0; i < len(rgba.Pix); i, j = i+4, j+1 {
+			c := color.RGBA{R: rgba.Pix[i], G: rgba.Pix[i+1], B: rgba.Pix[i+2], A: 0xff}
+			idx, ok := index[c]
+			if !ok {
+				idx = uint8(palette.Index(c))
+				index[c] = idx
+			}
+			paletted.Pix[j] = idx
+		}
+		anim.Image = append(anim.Image, paletted)
+		// GIF delays are in hundredths of a second
+		anim.Delay = append(anim.Delay, int(frames[n].Delay/(10*time.Millisecond)))
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, fmt.Errorf("failed to encode gif: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func rgbKey(c color.RGBA) uint32 {
+	return uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+}
@@ -0,0 +1,121 @@
+package render
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"time"
+)
+
+// Function to encode frames as a looping APNG. Each frame is encoded by
+// image/png, and its image data moved into the animation chunks. Frames
+// after the first only cover the pixels that changed from the one before.
+func encodeAPNG(images []*image.RGBA, frames []Frame) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	sequence := uint32(0)
+
+	for i, rgba := range images {
+		region := rgba.Bounds()
+		if i > 0 {
+			region = changedRegion(images[i-1], rgba)
+		}
+		chunks, err := pngChunks(rgba.SubImage(region))
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			// The header of the first frame is that of the animation
+			writeChunk(&buf, "IHDR", chunks[0].data)
+			actl := make([]byte, 8)
+			binary.BigEndian.PutUint32(actl[0:], uint32(len(images)))
+			binary.BigEndian.PutUint32(actl[4:], 0) // Loop forever
+			writeChunk(&buf, "acTL", actl)
+		}
+
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(region.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(region.Dy()))
+		binary.BigEndian.PutUint32(fctl[12:], uint32(region.Min.X))
+		binary.BigEndian.PutUint32(fctl[16:], uint32(region.Min.Y))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(min(frames[i].Delay/time.Millisecond, 65535)))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		// Frames are opaque, so they replace what they cover and are kept
+		fctl[24], fctl[25] = 0, 0
+		writeChunk(&buf, "fcTL", fctl)
+		sequence++
+
+		for _, c := range chunks {
+			if c.kind != "IDAT" {
+				continue
+			}
+			if i == 0 {
+				writeChunk(&buf, "IDAT", c.data)
+				continue
+			}
+			fdat := make([]byte, 4+len(c.data))
+			binary.BigEndian.PutUint32(fdat, sequence)
+			copy(fdat[4:], c.data)
+			writeChunk(&buf, "fdAT", fdat)
+			sequence++
+		}
+	}
+	writeChunk(&buf, "IEND", nil)
+	return buf.Bytes(), nil
+}
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+// Function to encode an image as PNG and split it into its chunks
+func pngChunks(img image.Image) ([]pngChunk, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode png: %w", err)
+	}
+	data := buf.Bytes()[8:]
+	var chunks []pngChunk
+	for len(data) >= 12 {
+		length := binary.BigEndian.Uint32(data)
+		chunks = append(chunks, pngChunk{kind: string(data[4:8]), data: data[8 : 8+length]})
+		data = data[12+length:]
+	}
+	return chunks, nil
+}
+
+func writeChunk(buf *bytes.Buffer, kind string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	buf.WriteString(kind)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// Function to find the bounds of the pixels that differ between two frames,
+// or a single pixel when none do, since a frame cannot be empty
+func changedRegion(prev, next *image.RGBA) image.Rectangle {
+	bounds := next.Bounds()
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X-1, bounds.Min.Y-1
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := next.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := row + (x-bounds.Min.X)*4
+			if !bytes.Equal(prev.Pix[i:i+4], next.Pix[i:i+4]) {
+				minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+			}
+		}
+	}
+	if maxX < minX {
+		return image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+1, bounds.Min.Y+1)
+	}
+	return image.Rect(minX, minY, maxX+1, maxY+1)
+}
@@ -0,0 +1,50 @@
+package render
+
+import (
+	"image"
+	"image/draw"
+
+	"canvas/geo"
+
+	"github.com/srwiley/rasterx"
+)
+
+// BadgeRegion frames the four main islands; Okinawa and the Ogasawara
+// islands would shrink the silhouette to a few pixels.
+var BadgeRegion = geo.BBox{MinLon: 128.5, MinLat: 30.9, MaxLon: 146.0, MaxLat: 45.6}
+
+// RenderBadge draws Japan as one silhouette filled with the color of the
+// given intensity, on a square transparent or dark canvas.
+func RenderBadge(dataset *geo.Dataset, size, intensity int, dark bool) ([]byte, error) {
+	scene := BuildScene(dataset, &Options{
+		Width:      size,
+		Height:     size,
+		Multiplier: float64(size) / BASE_HEIGHT,
+		Margin:     0.04,
+		BBox:       &BadgeRegion,
+	})
+
+	rgba := image.NewRGBA(image.Rect(0, 0, size, size))
+	if dark {
+		draw.Draw(rgba, rgba.Bounds(), image.NewUniform(ParseHexColor("#18181b")), image.Point{}, draw.Src)
+	}
+
+	// Intensity 0 is drawn in the border gray; its fill color would vanish
+	// on dark backgrounds
+	fill := IntensityColor(intensity)
+	if intensity == 0 {
+		fill = "#a1a1aa"
+	}
+
+	var rings [][][]float64
+	for _, feature := range scene.Features {
+		rings = append(rings, geo.FeatureRings(feature)...)
+	}
+	scanner := rasterx.NewScannerGV(size, size, rgba, rgba.Bounds())
+	filler := rasterx.NewFiller(size, size, scanner)
+	AddRings(filler, rings, scene.ToScreen)
+	filler.SetColor(ParseHexColor(fill))
+	filler.Draw()
+
+	return EncodePNG(rgba)
+}
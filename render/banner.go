@@ -0,0 +1,142 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"unicode/utf8"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+)
+
+// Longest title or subtitle, in characters
+const MAX_TITLE = 80
+
+const (
+	bannerColor         = "#09090b"
+	bannerTitleColor    = "#fafafa"
+	bannerSubtitleColor = "#a1a1aa"
+
+	// Sizes at 1280x720, in pixels
+	bannerPadding      = 18.0
+	bannerTitleSize    = 30.0
+	bannerSubtitleSize = 18.0
+	bannerLineGap      = 8.0
+)
+
+// ValidateBanner checks the title and subtitle of the banner: at most
+// MAX_TITLE characters each, and no subtitle without a title.
+func ValidateBanner(title, subtitle string) error {
+	if subtitle != "" && title == "" {
+		return fmt.Errorf("a subtitle requires a title")
+	}
+	for _, text := range []struct{ name, value string }{{"title", title}, {"subtitle", subtitle}} {
+		if n := utf8.RuneCountInString(text.value); n > MAX_TITLE {
+			return fmt.Errorf("invalid %s: %d characters (at most %d)", text.name, n, MAX_TITLE)
+		}
+	}
+	return nil
+}
+
+// Function to get the height of the banner across the top of the canvas,
+// zero without a title. The map is fit beneath it.
+func (o *Options) bannerHeight() int {
+	if o.Title == "" {
+		return 0
+	}
+	_, _, height := bannerLayout(o.Subtitle != "", o.Multiplier)
+	return height
+}
+
+// Function to lay out the banner: the baselines of the title and subtitle,
+// and its height
+func bannerLayout(subtitle bool, multiplier float64) (titleY, subtitleY, height int) {
+	y := bannerPadding + 0.75*bannerTitleSize
+	titleY = int(math.Round(y * multiplier))
+	if subtitle {
+		y += bannerLineGap + bannerSubtitleSize
+		subtitleY = int(math.Round(y * multiplier))
+	}
+	// Room for the descenders
+	height = int(math.Round((y + 0.25*bannerTitleSize + bannerPadding/2) * multiplier))
+	return titleY, subtitleY, height
+}
+
+// Function to pick the font of a banner line: the CJK font for Japanese text
+// when there is one, else Roboto
+func bannerFont(text string, latin *truetype.Font) (*truetype.Font, error) {
+	if !hasCJK(text) {
+		return latin, nil
+	}
+	cjk, err := loadCJKFont()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CJK font: %w", err)
+	}
+	if cjk == nil {
+		return latin, nil
+	}
+	return cjk, nil
+}
+
+// Function to draw the banner with the title and subtitle over the top of
+// the canvas
+func drawBanner(rgba *image.RGBA, scene *Scene) error {
+	if scene.Title == "" {
+		return nil
+	}
+	titleY, subtitleY, height := bannerLayout(scene.Subtitle != "", scene.Multiplier)
+	draw.Draw(rgba, image.Rect(0, 0, scene.Width, height), image.NewUniform(ParseHexColor(bannerColor)), image.Point{}, draw.Src)
+
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetClip(rgba.Bounds())
+	c.SetDst(rgba)
+	x := int(math.Round(bannerPadding * scene.Multiplier))
+	lines := []struct {
+		text   string
+		weight int
+		size   float64
+		color  string
+		y      int
+	}{
+		{scene.Title, 500, bannerTitleSize, bannerTitleColor, titleY},
+		{scene.Subtitle, 400, bannerSubtitleSize, bannerSubtitleColor, subtitleY},
+	}
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		latin, err := loadFont(line.weight)
+		if err != nil {
+			return fmt.Errorf("failed to load font: %w", err)
+		}
+		f, err := bannerFont(line.text, latin)
+		if err != nil {
+			return err
+		}
+		c.SetFont(f)
+		c.SetFontSize(line.size * scene.Multiplier)
+		c.SetSrc(image.NewUniform(ParseHexColor(line.color)))
+		if _, err := c.DrawString(line.text, freetype.Pt(x, line.y)); err != nil {
+			return fmt.Errorf("failed to draw banner: %w", err)
+		}
+	}
+	return nil
+}
+
+// Function to write the banner as a rectangle and text elements
+func svgBanner(canvas *svg.SVG, scene *Scene) {
+	if scene.Title == "" {
+		return
+	}
+	titleY, subtitleY, height := bannerLayout(scene.Subtitle != "", scene.Multiplier)
+	canvas.Rect(0, 0, scene.Width, height, "fill:"+bannerColor)
+	x := int(math.Round(bannerPadding * scene.Multiplier))
+	canvas.Text(x, titleY, scene.Title, fmt.Sprintf("fill:%s;font-family:Roboto,sans-serif;font-weight:500;font-size:%.1fpx", bannerTitleColor, bannerTitleSize*scene.Multiplier))
+	if scene.Subtitle != "" {
+		canvas.Text(x, subtitleY, scene.Subtitle, fmt.Sprintf("fill:%s;font-family:Roboto,sans-serif;font-size:%.1fpx", bannerSubtitleColor, bannerSubtitleSize*scene.Multiplier))
+	}
+}
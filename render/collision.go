@@ -0,0 +1,106 @@
+package render
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// Size of label text at 1280x720, in pixels
+	labelFontSize = 14
+	// Advance of a Roboto digit and height of its capitals, in ems
+	labelAdvance   = 0.56
+	labelCapHeight = 0.71
+	// Outline drawn around label text so it reads on any fill, in pixels at
+	// 1280x720
+	labelHaloWidth = 1.5
+)
+
+// Color of the label halos, the background of the map
+const labelHaloColor = "#18181b"
+
+// Shifts tried when a label overlaps one placed before it, in label widths
+// and lines of text: half a line up and down, half a label sideways, then a
+// whole line or label away
+var labelShifts = [][2]float64{
+	{0, 0},
+	{0, -0.5}, {0, 0.5}, {0.5, 0}, {-0.5, 0},
+	{0, -1}, {0, 1}, {1, 0}, {-1, 0},
+	{1, -1}, {-1, -1}, {1, 1}, {-1, 1},
+}
+
+// Function to get the width and cap height of text at a font size, in
+// pixels. Kana and kanji are a full em wide.
+func labelSize(text string, size float64) (width, height float64) {
+	for _, r := range text {
+		if isCJK(r) {
+			width += size
+		} else {
+			width += labelAdvance * size
+		}
+	}
+	return width, labelCapHeight * size
+}
+
+// Function to get the size of the scale value labels, in pixels
+func (scene *Scene) labelFontSize() float64 {
+	return labelFontSize * scene.Multiplier
+}
+
+// Function to get the label of text at a font size, centered on x, y
+func centeredLabel(x, y float64, text string, size float64, priority int) textLabel {
+	width, height := labelSize(text, size)
+	return textLabel{X: int(x - width/2), Y: int(y + height/2), Text: text, Size: size, Priority: priority}
+}
+
+// Function to get the pixels a label covers, with its halo
+func (scene *Scene) labelBox(label textLabel) image.Rectangle {
+	width, height := labelSize(label.Text, label.Size)
+	halo := int(math.Ceil(labelHaloWidth * scene.Multiplier))
+	return image.Rect(label.X-halo, label.Y-int(math.Ceil(height))-halo, label.X+int(math.Ceil(width))+halo, label.Y+halo)
+}
+
+// Function to keep labels from overlapping. Labels are placed by priority,
+// and one that overlaps a label already placed is shifted to the first free
+// spot nearby, or dropped when there is none. placed holds the boxes of
+// labels of earlier classes, and grows with these. With DensityAll every
+// label is kept where it is.
+func (scene *Scene) avoidCollisions(labels []textLabel, placed *[]image.Rectangle) []textLabel {
+	if scene.Density == DensityAll {
+		return labels
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Priority > labels[j].Priority })
+
+	canvas := image.Rect(0, 0, scene.Width, scene.Height)
+	kept := labels[:0]
+	for _, label := range labels {
+		width, height := labelSize(label.Text, label.Size)
+		for i, shift := range labelShifts {
+			moved := label
+			moved.X += int(shift[0] * width)
+			moved.Y += int(shift[1] * height * 2)
+			box := scene.labelBox(moved)
+			// A label may start off the canvas, but is not moved off it
+			if i > 0 && !box.In(canvas) {
+				continue
+			}
+			if overlapsAny(box, *placed) {
+				continue
+			}
+			*placed = append(*placed, box)
+			kept = append(kept, moved)
+			break
+		}
+	}
+	return kept
+}
+
+func overlapsAny(box image.Rectangle, boxes []image.Rectangle) bool {
+	for _, b := range boxes {
+		if box.Overlaps(b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// Label densities
+const (
+	DensityAuto = "auto" // Label classes by zoom, thinned where crowded
+	DensityAll  = "all"  // Every label and marker
+)
+
+// A kind of label or marker. Classes are shown from MinZoom (pixels per
+// degree) on, and thinned to PerCell items per grid cell of Cell pixels at
+// 1280x720, strongest first. Text classes share one grid, and those of a
+// lower Rank claim its cells first.
+type labelClass struct {
+	Rank    int
+	MinZoom float64
+	Cell    float64
+	PerCell int
+}
+
+var (
+	// Scale value of each shaded prefecture, shown at every zoom
+	prefectureLabels = labelClass{Rank: 0, Cell: 20, PerCell: 1}
+	// Scale value next to each station marker, once the view is regional
+	stationLabels = labelClass{Rank: 1, MinZoom: 150, Cell: 20, PerCell: 1}
+	// Station markers; at national zoom thousands of them share a few pixels
+	stationMarkers = labelClass{Cell: 7, PerCell: 1}
+	// Labels of the markers given with the map, placed before any other
+	markerLabelClass = labelClass{Rank: -1}
+)
+
+// An item competing for a place in a grid, with its priority within its class
+type densityItem struct {
+	X, Y     float64
+	Priority int
+}
+
+// A grid of cells counting the items placed in them
+type densityGrid struct {
+	cell  float64
+	count map[[2]int]int
+}
+
+func newDensityGrid(scene *Scene, class labelClass) *densityGrid {
+	return &densityGrid{cell: class.Cell * scene.Multiplier, count: make(map[[2]int]int)}
+}
+
+// Function to keep the items of a class its grid has room for, highest
+// priority first, and return their indices in their original order. With
+// DensityAll, or a nil grid, everything is kept.
+func (scene *Scene) thin(class labelClass, grid *densityGrid, items []densityItem) []int {
+	keep := make([]int, 0, len(items))
+	if scene.Density == DensityAll || grid == nil {
+		for i := range items {
+			keep = append(keep, i)
+		}
+		return keep
+	}
+	if scene.PixelsPerDegree < class.MinZoom {
+		return keep
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return items[order[a]].Priority > items[order[b]].Priority })
+	for _, i := range order {
+		key := [2]int{int(math.Floor(items[i].X / grid.cell)), int(math.Floor(items[i].Y / grid.cell))}
+		if grid.count[key] >= class.PerCell {
+			continue
+		}
+		grid.count[key]++
+		keep = append(keep, i)
+	}
+	sort.Ints(keep)
+	return keep
+}
+
+// Text label classes, with the function placing the labels of each. They
+// are sorted by rank once, at startup.
+var textClasses = []struct {
+	class labelClass
+	place func(scene *Scene, grid *densityGrid) []textLabel
+}{
+	{prefectureLabels, scaleLabels},
+	{stationLabels, markerLabels},
+	{nameLabels, nameLabelsFor},
+	{markerLabelClass, overlayLabels},
+}
+
+func init() {
+	sort.SliceStable(textClasses, func(i, j int) bool { return textClasses[i].class.Rank < textClasses[j].class.Rank })
+}
+
+// Function to place the text labels of every class, by rank, clear of each
+// other
+func (scene *Scene) labels() []textLabel {
+	if !scene.ShowScale && scene.Names == "" && !scene.hasMarkerLabels() {
+		return nil
+	}
+	// The classes that are thinned share the cells of the prefecture values;
+	// marker labels, placed first, are never thinned
+	grid := newDensityGrid(scene, prefectureLabels)
+	var labels []textLabel
+	var placed []image.Rectangle
+	for _, c := range textClasses {
+		labels = append(labels, scene.avoidCollisions(c.place(scene, grid), &placed)...)
+	}
+	return labels
+}
+
+// Function to label the station markers with their scale values, right of
+// the marker
+func markerLabels(scene *Scene, grid *densityGrid) []textLabel {
+	if !scene.ShowScale {
+		return nil
+	}
+	markers := pointMarkers(scene)
+	items := make([]densityItem, len(markers))
+	for i, m := range markers {
+		items[i] = densityItem{X: m.X, Y: m.Y, Priority: m.Scale}
+	}
+	var labels []textLabel
+	for _, i := range scene.thin(stationLabels, grid, items) {
+		m := markers[i]
+		if m.Scale == 0 {
+			continue
+		}
+		labels = append(labels, textLabel{
+			X:        int(m.X + m.Size),
+			Y:        int(m.Y + 5*scene.Multiplier),
+			Text:     scene.scaleLabel(m.Scale),
+			Size:     scene.labelFontSize(),
+			Priority: m.Scale,
+		})
+	}
+	return labels
+}
+
+// ParseDensity checks a label density name.
+func ParseDensity(value string) (string, error) {
+	switch value {
+	case "", DensityAuto:
+		return DensityAuto, nil
+	case DensityAll:
+		return DensityAll, nil
+	}
+	return "", fmt.Errorf("invalid density: %s (must be auto or all)", value)
+}
@@ -0,0 +1,378 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"canvas/geo"
+
+	svg "github.com/ajstarks/svgo"
+	geojson "github.com/paulmach/go.geojson"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Most GeoJSON overlays in one map, and vertices across them
+	MAX_OVERLAYS         = 5
+	MAX_OVERLAY_VERTICES = 50000
+)
+
+// Default style of overlay features, in the simplestyle properties that
+// override it
+const (
+	overlayStroke        = "#fafafa"
+	overlayStrokeWidth   = 1.5 // Pixels at 1280x720
+	overlayStrokeOpacity = 1.0
+	overlayFill          = "#fafafa"
+	overlayFillOpacity   = 0.25
+)
+
+// OverlayStyle is how an overlay feature is drawn. Widths and dashes are in
+// pixels at 1280x720, and scale with the output.
+type OverlayStyle struct {
+	Stroke        string // "#rrggbb"
+	StrokeWidth   float64
+	StrokeOpacity float64
+	Fill          string // "#rrggbb", for polygons
+	FillOpacity   float64
+	Dash          []float64 // Lengths of the dashes and gaps, solid when nil
+}
+
+// OverlayFeature is a line or polygon of an overlay. Lines are open
+// polylines; Rings are the rings of polygons, holes oriented against their
+// exterior.
+type OverlayFeature struct {
+	Lines [][][]float64
+	Rings [][][]float64
+	Style OverlayStyle
+}
+
+// Overlay is a GeoJSON layer drawn over the map, such as fault traces, rail
+// lines or affected road segments.
+type Overlay struct {
+	Features []OverlayFeature
+}
+
+// ParseOverlay reads a GeoJSON FeatureCollection or Feature of lines and
+// polygons, with coordinates in crs. Each feature is styled by its
+// simplestyle properties ("stroke", "stroke-width", "stroke-opacity",
+// "fill", "fill-opacity"), and "stroke-dasharray" as in CSS, e.g. "4,2".
+func ParseOverlay(data []byte, crs geo.CRS) (*Overlay, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	var features []*geojson.Feature
+	switch head.Type {
+	case "FeatureCollection":
+		fc, err := geojson.UnmarshalFeatureCollection(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+		}
+		features = fc.Features
+	case "Feature":
+		feature, err := geojson.UnmarshalFeature(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+		}
+		features = []*geojson.Feature{feature}
+	default:
+		return nil, fmt.Errorf("invalid GeoJSON: type %q (must be FeatureCollection or Feature)", head.Type)
+	}
+
+	overlay := &Overlay{}
+	for i, feature := range features {
+		if feature.Geometry == nil {
+			return nil, fmt.Errorf("feature %d has no geometry", i)
+		}
+		style, err := parseOverlayStyle(feature.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("feature %d: %v", i, err)
+		}
+		f := OverlayFeature{Style: style}
+		if err := addOverlayGeometry(&f, feature.Geometry); err != nil {
+			return nil, fmt.Errorf("feature %d: %v", i, err)
+		}
+		for _, line := range append(f.Lines, f.Rings...) {
+			for _, coord := range line {
+				if len(coord) < 2 {
+					return nil, fmt.Errorf("feature %d: coordinate with fewer than 2 values", i)
+				}
+				coord[0], coord[1] = crs.ToWGS84(coord[0], coord[1])
+				if coord[1] < -90 || coord[1] > 90 || coord[0] < -180 || coord[0] > 180 {
+					return nil, fmt.Errorf("feature %d has coordinates out of range", i)
+				}
+			}
+		}
+		overlay.Features = append(overlay.Features, f)
+	}
+	if n := overlay.Vertices(); n > MAX_OVERLAY_VERTICES {
+		return nil, fmt.Errorf("too many vertices: %d (at most %d)", n, MAX_OVERLAY_VERTICES)
+	}
+	return overlay, nil
+}
+
+// Function to add the lines and rings of a geometry to a feature. Points
+// are refused, since markers draw them.
+func addOverlayGeometry(f *OverlayFeature, g *geojson.Geometry) error {
+	switch g.Type {
+	case geojson.GeometryLineString:
+		f.Lines = append(f.Lines, g.LineString)
+	case geojson.GeometryMultiLineString:
+		f.Lines = append(f.Lines, g.MultiLineString...)
+	case geojson.GeometryPolygon, geojson.GeometryMultiPolygon:
+		f.Rings = append(f.Rings, geo.FeatureRings(&geojson.Feature{Geometry: g})...)
+	case geojson.GeometryCollection:
+		for _, child := range g.Geometries {
+			if err := addOverlayGeometry(f, child); err != nil {
+				return err
+			}
+		}
+	case geojson.GeometryPoint, geojson.GeometryMultiPoint:
+		return fmt.Errorf("%s geometries are not drawn; use markers for points", g.Type)
+	default:
+		return fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+	for _, line := range append(f.Lines, f.Rings...) {
+		if len(line) < 2 {
+			return fmt.Errorf("a line or ring has fewer than 2 positions")
+		}
+	}
+	return nil
+}
+
+// Function to read the style of a feature from its properties
+func parseOverlayStyle(props map[string]interface{}) (OverlayStyle, error) {
+	style := OverlayStyle{
+		Stroke:        overlayStroke,
+		StrokeWidth:   overlayStrokeWidth,
+		StrokeOpacity: overlayStrokeOpacity,
+		Fill:          overlayFill,
+		FillOpacity:   overlayFillOpacity,
+	}
+	color := func(name string, dst *string) error {
+		v, ok := props[name]
+		if !ok {
+			return nil
+		}
+		s, _ := v.(string)
+		c := "#" + strings.TrimPrefix(strings.ToLower(s), "#")
+		if len(c) == 4 {
+			// Shorthand such as #f00
+			c = string([]byte{'#', c[1], c[1], c[2], c[2], c[3], c[3]})
+		}
+		if _, err := strconv.ParseUint(c[1:], 16, 32); err != nil || len(c) != 7 {
+			return fmt.Errorf("invalid %s: %v (must be #rrggbb)", name, v)
+		}
+		*dst = c
+		return nil
+	}
+	number := func(name string, dst *float64, lo, hi float64) error {
+		v, ok := props[name]
+		if !ok {
+			return nil
+		}
+		n, ok := v.(float64)
+		if !ok || math.IsNaN(n) || n < lo || n > hi {
+			return fmt.Errorf("invalid %s: %v (must be between %g and %g)", name, v, lo, hi)
+		}
+		*dst = n
+		return nil
+	}
+	if err := color("stroke", &style.Stroke); err != nil {
+		return style, err
+	}
+	if err := color("fill", &style.Fill); err != nil {
+		return style, err
+	}
+	if err := number("stroke-width", &style.StrokeWidth, 0, 20); err != nil {
+		return style, err
+	}
+	if err := number("stroke-opacity", &style.StrokeOpacity, 0, 1); err != nil {
+		return style, err
+	}
+	if err := number("fill-opacity", &style.FillOpacity, 0, 1); err != nil {
+		return style, err
+	}
+	if v, ok := props["stroke-dasharray"]; ok {
+		s, _ := v.(string)
+		for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil || n <= 0 || n > 100 {
+				return style, fmt.Errorf("invalid stroke-dasharray: %v (must be lengths between 0 and 100, e.g. \"4,2\")", v)
+			}
+			style.Dash = append(style.Dash, n)
+		}
+		if len(style.Dash)%2 == 1 {
+			// As in CSS, an odd list is repeated
+			style.Dash = append(style.Dash, style.Dash...)
+		}
+	}
+	return style, nil
+}
+
+// Vertices counts the positions of the lines and rings of the overlay.
+func (o *Overlay) Vertices() int {
+	n := 0
+	for _, f := range o.Features {
+		for _, line := range append(f.Lines, f.Rings...) {
+			n += len(line)
+		}
+	}
+	return n
+}
+
+// WithOverlays returns the stack with the overlays layer added right beneath
+// the points, markers and labels, unless it is already there.
+func WithOverlays(layers []Layer) []Layer {
+	if layers == nil {
+		layers = DefaultLayers
+	}
+	at := len(layers)
+	for i := len(layers) - 1; i >= 0; i-- {
+		switch layers[i].Name {
+		case LayerOverlays:
+			return layers
+		case LayerPoints, LayerMarkers, LayerLabels:
+			at = i
+		}
+	}
+	stack := make([]Layer, 0, len(layers)+1)
+	stack = append(stack, layers[:at]...)
+	stack = append(stack, Layer{Name: LayerOverlays})
+	return append(stack, layers[at:]...)
+}
+
+// Features of the overlays that share a style, drawn in one pass
+type overlayGroup struct {
+	Style OverlayStyle
+	Lines [][][]float64
+	Rings [][][]float64
+}
+
+// Function to group the features of the overlays by style, in the order the
+// styles first appear. Overlays are drawn in order, so a later overlay is
+// only drawn under an earlier one where they share a style.
+func overlayGroups(scene *Scene) []overlayGroup {
+	var groups []overlayGroup
+	index := make(map[string]int)
+	for _, overlay := range scene.Overlays {
+		for _, f := range overlay.Features {
+			key := fmt.Sprint(f.Style)
+			i, ok := index[key]
+			if !ok {
+				i = len(groups)
+				index[key] = i
+				groups = append(groups, overlayGroup{Style: f.Style})
+			}
+			groups[i].Lines = append(groups[i].Lines, f.Lines...)
+			groups[i].Rings = append(groups[i].Rings, f.Rings...)
+		}
+	}
+	return groups
+}
+
+// Function to get the stroke width and dashes of a style in pixels of the
+// scene
+func (style OverlayStyle) scaled(scene *Scene) (float64, []float64) {
+	var dash []float64
+	for _, d := range style.Dash {
+		dash = append(dash, d*scene.Multiplier)
+	}
+	return style.StrokeWidth * scene.Multiplier, dash
+}
+
+// Function to draw the overlays: for each style, the polygon fills, then
+// the outlines and lines
+func rasterOverlays(dasher *rasterx.Dasher, scene *Scene) {
+	for _, group := range overlayGroups(scene) {
+		style := group.Style
+		if len(group.Rings) > 0 && style.FillOpacity > 0 {
+			dasher.Clear()
+			filler := &dasher.Filler
+			AddRings(filler, group.Rings, scene.ToScreen)
+			filler.SetColor(rasterx.ApplyOpacity(ParseHexColor(style.Fill), style.FillOpacity))
+			filler.Draw()
+		}
+		width, dash := style.scaled(scene)
+		if width == 0 || style.StrokeOpacity == 0 {
+			continue
+		}
+		dasher.Clear()
+		// Round caps would close the gaps of short dashes
+		capper := rasterx.RoundCap
+		if len(dash) > 0 {
+			capper = rasterx.ButtCap
+		}
+		dasher.SetStroke(fixed.Int26_6(width*64), 4*64, capper, capper, nil, rasterx.Round, dash, 0)
+		AddRings(dasher, group.Rings, scene.ToScreen)
+		addOpenLines(dasher, group.Lines, scene.ToScreen)
+		dasher.SetColor(rasterx.ApplyOpacity(ParseHexColor(style.Stroke), style.StrokeOpacity))
+		dasher.Draw()
+	}
+}
+
+// Function to add polylines that are never closed, unlike AddLines
+func addOpenLines(adder rasterx.Adder, lines [][][]float64, toScreen func(lon, lat float64) (float64, float64)) {
+	addProjected(adder, projectLines(lines, func([][]float64) bool { return false }, toScreen))
+}
+
+// Function to write the overlays as a filled and a stroked path per style,
+// in the order the raster backend draws them
+func svgOverlays(canvas *svg.SVG, scene *Scene, precision int, path []byte) []byte {
+	for _, group := range overlayGroups(scene) {
+		style := group.Style
+		width, dash := style.scaled(scene)
+		if len(group.Rings) > 0 && style.FillOpacity > 0 {
+			path = path[:0]
+			for _, ring := range group.Rings {
+				path = appendVisible(path, ring, true, scene, precision, 0)
+			}
+			if len(path) > 0 {
+				canvas.Path(string(path), fmt.Sprintf("fill:%s;fill-opacity:%g", style.Fill, style.FillOpacity))
+			}
+		}
+		if width == 0 || style.StrokeOpacity == 0 {
+			continue
+		}
+		path = path[:0]
+		for _, ring := range group.Rings {
+			path = appendVisible(path, ring, true, scene, precision, width)
+		}
+		for _, line := range group.Lines {
+			path = appendVisible(path, line, false, scene, precision, width)
+		}
+		if len(path) == 0 {
+			continue
+		}
+		strokeStyle := fmt.Sprintf("fill:none;stroke:%s;stroke-opacity:%g;stroke-width:%.1f;stroke-linejoin:round", style.Stroke, style.StrokeOpacity, width)
+		if len(dash) == 0 {
+			strokeStyle += ";stroke-linecap:round"
+		} else {
+			parts := make([]string, len(dash))
+			for i, d := range dash {
+				parts[i] = strconv.FormatFloat(d, 'f', -1, 64)
+			}
+			strokeStyle += ";stroke-dasharray:" + strings.Join(parts, ",")
+		}
+		canvas.Path(string(path), strokeStyle)
+	}
+	return path
+}
+
+// Function to append a ring or line to SVG path data unless all of it,
+// widened by pad, is off the canvas
+func appendVisible(path []byte, coords [][]float64, closed bool, scene *Scene, precision int, pad float64) []byte {
+	n := len(path)
+	path, onCanvas := appendSVGPath(path, coords, closed, scene, precision, pad)
+	if !onCanvas {
+		return path[:n]
+	}
+	return path
+}
@@ -0,0 +1,115 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"canvas/geo"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+)
+
+// Most panels in one grid
+const MAX_PANELS = 9
+
+// Panel is one map of a grid, such as the foreshock next to the mainshock.
+type Panel struct {
+	ScaleMap map[int]int
+	Points   []Point
+	// Title is drawn in the top left corner of the panel.
+	Title string
+}
+
+// Color of the gutters between panels
+var gridGutter = color.RGBA{R: 0x3f, G: 0x3f, B: 0x46, A: 0xff}
+
+// Function to find the width of the gutters between panels
+func gridGutterWidth(opts *Options) int {
+	return max(1, int(4*opts.Multiplier))
+}
+
+// GridSize returns the size of the image of count panels of opts.Width by
+// opts.Height, in rows of columns.
+func GridSize(opts *Options, count, columns int) (int, int) {
+	columns = min(columns, count)
+	rows := (count + columns - 1) / columns
+	gutter := gridGutterWidth(opts)
+	return columns*opts.Width + (columns-1)*gutter, rows*opts.Height + (rows-1)*gutter
+}
+
+// Grid draws every panel with the options and lays them out in rows of
+// columns, each opts.Width by opts.Height. Like the frames of an animation,
+// all panels share the view that frames every intensity of the grid, so
+// they can be compared at a glance.
+func Grid(dataset *geo.Dataset, opts *Options, backend Backend, panels []Panel, columns int) (*image.RGBA, error) {
+	if len(panels) == 0 {
+		return nil, fmt.Errorf("no panels to draw")
+	}
+	if len(panels) > MAX_PANELS {
+		return nil, fmt.Errorf("too many panels: %d (at most %d)", len(panels), MAX_PANELS)
+	}
+	if columns < 1 {
+		return nil, fmt.Errorf("invalid number of columns: %d", columns)
+	}
+	width, height := GridSize(opts, len(panels), columns)
+	if width > MAX_DIMENSION || height > MAX_DIMENSION || width*height > MAX_PIXELS {
+		return nil, fmt.Errorf("grid too large: %dx%d (at most %dx%d and %d pixels)", width, height, MAX_DIMENSION, MAX_DIMENSION, MAX_PIXELS)
+	}
+
+	framing := *opts
+	framing.ScaleMap = make(map[int]int)
+	framing.Points = nil
+	for _, panel := range panels {
+		for id, scale := range panel.ScaleMap {
+			framing.ScaleMap[id] = max(framing.ScaleMap[id], scale)
+		}
+		framing.Points = append(framing.Points, panel.Points...)
+	}
+	view := BuildScene(dataset, &framing)
+
+	f, err := loadFont(500)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load font: %w", err)
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, out.Bounds(), image.NewUniform(gridGutter), image.Point{}, draw.Src)
+	gutter := gridGutterWidth(opts)
+	columns = min(columns, len(panels))
+	for i, panel := range panels {
+		scene := *view
+		scene.ScaleMap = panel.ScaleMap
+		scene.Points = panel.Points
+		rgba, err := backend.Draw(&scene)
+		if err != nil {
+			return nil, err
+		}
+		if panel.Title != "" {
+			if err := drawTitle(rgba, &scene, f, panel.Title); err != nil {
+				return nil, err
+			}
+		}
+		x := (i % columns) * (opts.Width + gutter)
+		y := (i / columns) * (opts.Height + gutter)
+		draw.Draw(out, image.Rect(x, y, x+opts.Width, y+opts.Height), rgba, image.Point{}, draw.Src)
+	}
+	return out, nil
+}
+
+// Function to draw the title of a panel in its top left corner
+func drawTitle(rgba *image.RGBA, scene *Scene, f *truetype.Font, title string) error {
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(f)
+	c.SetFontSize(20 * scene.Multiplier)
+	c.SetClip(rgba.Bounds())
+	c.SetDst(rgba)
+	c.SetSrc(image.NewUniform(color.RGBA{0xfa, 0xfa, 0xfa, 0xff}))
+	if _, err := c.DrawString(title, freetype.Pt(int(12*scene.Multiplier), int(32*scene.Multiplier))); err != nil {
+		return fmt.Errorf("failed to draw title: %w", err)
+	}
+	return nil
+}
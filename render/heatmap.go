@@ -0,0 +1,207 @@
+package render
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"canvas/geo"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/srwiley/rasterx"
+)
+
+const (
+	// Stations farther than this from a spot do not weigh on its intensity
+	heatmapRadiusKm = 40.0
+	// Pixels between the samples of the interpolation at 1280x720; the
+	// image is filled in bilinearly between them
+	heatmapStep = 4.0
+	// Opacity of the heatmap where it is fully covered by stations
+	heatmapOpacity = 0.85
+	// Kilometers per degree of latitude
+	kmPerDegree = 111.2
+)
+
+// WithHeatmap returns the stack with the heatmap layer added right above the
+// fills, or at the bottom without them, unless it is already there.
+func WithHeatmap(layers []Layer) []Layer {
+	if layers == nil {
+		layers = DefaultLayers
+	}
+	at := 0
+	for i, layer := range layers {
+		if layer.Name == LayerHeatmap {
+			return layers
+		}
+		if layer.Name == LayerFills {
+			at = i + 1
+		}
+	}
+	stack := make([]Layer, 0, len(layers)+1)
+	stack = append(stack, layers[:at]...)
+	stack = append(stack, Layer{Name: LayerHeatmap})
+	return append(stack, layers[at:]...)
+}
+
+// Function to draw the heatmap over the canvas
+func drawHeatmap(dst *image.RGBA, scene *Scene) {
+	if heat := heatmapImage(scene); heat != nil {
+		draw.Draw(dst, dst.Bounds(), heat, image.Point{}, draw.Over)
+	}
+}
+
+// Function to embed the heatmap in an SVG document as a PNG image, since it
+// has no vector form
+func svgHeatmap(canvas *svg.SVG, scene *Scene) error {
+	heat := heatmapImage(scene)
+	if heat == nil {
+		return nil
+	}
+	data, err := EncodePNG(heat)
+	if err != nil {
+		return err
+	}
+	canvas.Image(0, 0, scene.Width, scene.Height, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(data))
+	return nil
+}
+
+// Function to interpolate the station intensities over the land with
+// inverse distance weighting. Each station weighs ((R-d)/(R*d))^2 within R of
+// a spot (Franke and Nielson's modification of Shepard's method), so the
+// surface is smooth and ends where no station is near. Returns nil when the
+// scene has no points.
+func heatmapImage(scene *Scene) *image.RGBA {
+	if len(scene.Points) == 0 {
+		return nil
+	}
+	width, height := scene.Width, scene.Height
+	radius := heatmapRadiusKm / kmPerDegree * scene.PixelsPerDegree
+
+	// Bucket the stations by cells of the radius, so each sample only looks
+	// at the stations of the cells around it
+	type station struct{ x, y, scale float64 }
+	buckets := make(map[[2]int][]station)
+	for _, p := range scene.Points {
+		x, y := scene.ToScreen(p.Lon, p.Lat)
+		if x < -radius || y < -radius || x > float64(width)+radius || y > float64(height)+radius {
+			continue
+		}
+		key := [2]int{int(math.Floor(x / radius)), int(math.Floor(y / radius))}
+		buckets[key] = append(buckets[key], station{x, y, float64(p.Scale)})
+	}
+
+	step := heatmapStep * scene.Multiplier
+	cols, rows := int(float64(width)/step)+2, int(float64(height)/step)+2
+	// Premultiplied intensity and coverage of each sample
+	values := make([]float64, cols*rows)
+	coverage := make([]float64, cols*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			x, y := float64(col)*step, float64(row)*step
+			cx, cy := int(math.Floor(x/radius)), int(math.Floor(y/radius))
+			var sum, weights, nearest float64
+			exact := -1.0
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					for _, s := range buckets[[2]int{cx + dx, cy + dy}] {
+						d := math.Hypot(s.x-x, s.y-y)
+						if d >= radius {
+							continue
+						}
+						if d < 1e-9 {
+							exact = s.scale
+							continue
+						}
+						w := (radius - d) / (radius * d)
+						sum += w * w * s.scale
+						weights += w * w
+						nearest = max(nearest, 1-d/radius)
+					}
+				}
+			}
+			i := row*cols + col
+			switch {
+			case exact >= 0:
+				values[i], coverage[i] = exact, 1
+			case weights > 0:
+				// Fade out over the outer half of the radius
+				c := min(1, 2*nearest)
+				values[i], coverage[i] = sum/weights*c, c
+			}
+		}
+	}
+
+	land := landMask(scene)
+	heat := image.NewRGBA(image.Rect(0, 0, width, height))
+	for py := 0; py < height; py++ {
+		fy := float64(py) / step
+		row := int(fy)
+		ty := fy - float64(row)
+		for px := 0; px < width; px++ {
+			mask := land.Pix[py*land.Stride+px*4+3]
+			if mask == 0 {
+				continue
+			}
+			fx := float64(px) / step
+			col := int(fx)
+			tx := fx - float64(col)
+			i := row*cols + col
+			c := bilerp(coverage[i], coverage[i+1], coverage[i+cols], coverage[i+cols+1], tx, ty)
+			if c <= 0 {
+				continue
+			}
+			v := bilerp(values[i], values[i+1], values[i+cols], values[i+cols+1], tx, ty) / c
+			if v < 0.5 {
+				// Below intensity 1 nothing was felt
+				continue
+			}
+			rgb := scene.intensityRamp(v)
+			a := c * heatmapOpacity * float64(mask) / 255
+			o := py*heat.Stride + px*4
+			heat.Pix[o] = uint8(float64(rgb.R)*a + 0.5)
+			heat.Pix[o+1] = uint8(float64(rgb.G)*a + 0.5)
+			heat.Pix[o+2] = uint8(float64(rgb.B)*a + 0.5)
+			heat.Pix[o+3] = uint8(a*255 + 0.5)
+		}
+	}
+	return heat
+}
+
+func bilerp(v00, v10, v01, v11, tx, ty float64) float64 {
+	top := v00 + (v10-v00)*tx
+	bottom := v01 + (v11-v01)*tx
+	return top + (bottom-top)*ty
+}
+
+// Function to blend the colors of the two intensities around a fractional
+// one, so the heatmap shades smoothly between the classes
+func (scene *Scene) intensityRamp(v float64) color.NRGBA {
+	top := MaxScale(scene.ScaleType)
+	v = max(0, min(float64(top), v))
+	lower := int(v)
+	a := ParseHexColor(scene.intensityColor(lower))
+	if lower == top {
+		return a
+	}
+	b := ParseHexColor(scene.intensityColor(lower + 1))
+	t := v - float64(lower)
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5) }
+	return color.NRGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: 0xff}
+}
+
+// Function to rasterize the prefectures as an opaque mask, antialiased at
+// the coast
+func landMask(scene *Scene) *image.RGBA {
+	mask := image.NewRGBA(image.Rect(0, 0, scene.Width, scene.Height))
+	scanner := rasterx.NewScannerGV(scene.Width, scene.Height, mask, mask.Bounds())
+	filler := rasterx.NewFiller(scene.Width, scene.Height, scanner)
+	for _, feature := range scene.Features {
+		AddRings(filler, geo.FeatureRings(feature), scene.ToScreen)
+	}
+	filler.SetColor(color.White)
+	filler.Draw()
+	return mask
+}
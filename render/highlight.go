@@ -0,0 +1,122 @@
+package render
+
+import (
+	"fmt"
+	"math"
+
+	"canvas/geo"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Outline of the strongest shaking at 1280x720, in pixels: a crisp line
+	// over a wide, faint glow, so the area stands out even in thumbnails
+	highlightWidth       = 2.0
+	highlightGlowWidth   = 9.0
+	highlightGlowOpacity = 0.35
+	highlightColor       = "#fafafa"
+)
+
+// WithHighlight returns the stack with the highlight layer added right above
+// the borders, or above the fills without them, unless it is already there.
+func WithHighlight(layers []Layer) []Layer {
+	if layers == nil {
+		layers = DefaultLayers
+	}
+	at := 0
+	for i, layer := range layers {
+		if layer.Name == LayerHighlight {
+			return layers
+		}
+		if layer.Name == LayerBorders || (layer.Name == LayerFills && at == 0) {
+			at = i + 1
+		}
+	}
+	stack := make([]Layer, 0, len(layers)+1)
+	stack = append(stack, layers[:at]...)
+	stack = append(stack, Layer{Name: LayerHighlight})
+	return append(stack, layers[at:]...)
+}
+
+// Function to get the rings of the features with the strongest shaking: the
+// highest intensity, or the highest value on choropleth maps. Several
+// features can share it. Maps with nothing shaded have none.
+func highlightRings(scene *Scene) [][][]float64 {
+	var rings [][][]float64
+	if scene.Ramp != nil {
+		if len(scene.Values) == 0 {
+			return nil
+		}
+		top := math.Inf(-1)
+		for _, v := range scene.Values {
+			top = max(top, v)
+		}
+		for _, feature := range scene.Features {
+			if v, ok := scene.Values[int(feature.Properties["id"].(float64))]; ok && v == top {
+				rings = append(rings, geo.FeatureRings(feature)...)
+			}
+		}
+		return rings
+	}
+
+	top := 0
+	for _, scale := range scene.ScaleMap {
+		top = max(top, scale)
+	}
+	if top == 0 {
+		return nil
+	}
+	for _, feature := range scene.Features {
+		if scene.ScaleMap[int(feature.Properties["id"].(float64))] == top {
+			rings = append(rings, geo.FeatureRings(feature)...)
+		}
+	}
+	return rings
+}
+
+// Function to stroke the outline of the strongest shaking, the glow first
+func rasterHighlight(dasher *rasterx.Dasher, scene *Scene) {
+	rings := highlightRings(scene)
+	if len(rings) == 0 {
+		return
+	}
+	for _, stroke := range []struct {
+		width, opacity float64
+	}{{highlightGlowWidth, highlightGlowOpacity}, {highlightWidth, 1}} {
+		dasher.Clear()
+		dasher.SetStroke(fixed.Int26_6(stroke.width*scene.Multiplier*64), 4*64, rasterx.RoundCap, rasterx.RoundCap, nil, rasterx.Round, nil, 0)
+		AddRings(dasher, rings, scene.ToScreen)
+		dasher.SetColor(rasterx.ApplyOpacity(ParseHexColor(highlightColor), stroke.opacity))
+		dasher.Draw()
+	}
+}
+
+// Function to write the outline of the strongest shaking as two stroked
+// paths, the glow first
+func svgHighlight(canvas *svg.SVG, scene *Scene, precision int, path []byte) []byte {
+	rings := highlightRings(scene)
+	if len(rings) == 0 {
+		return path
+	}
+	pad := highlightGlowWidth * scene.Multiplier
+	path = path[:0]
+	for _, ring := range rings {
+		var onCanvas bool
+		n := len(path)
+		path, onCanvas = appendSVGPath(path, ring, true, scene, precision, pad)
+		if !onCanvas {
+			path = path[:n]
+		}
+	}
+	if len(path) == 0 {
+		return path
+	}
+	canvas.Path(string(path), fmt.Sprintf("fill:none;stroke:%s;stroke-opacity:%g;stroke-width:%.1f;stroke-linejoin:round",
+		highlightColor, highlightGlowOpacity, highlightGlowWidth*scene.Multiplier))
+	canvas.Path(string(path), fmt.Sprintf("fill:none;stroke:%s;stroke-width:%.1f;stroke-linejoin:round",
+		highlightColor, highlightWidth*scene.Multiplier))
+	return path
+}
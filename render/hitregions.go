@@ -0,0 +1,127 @@
+package render
+
+import (
+	"image"
+	"math"
+
+	"canvas/geo"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// HitRegion is the outline of a feature in pixels of the image, for HTML
+// image maps and other click-through.
+type HitRegion struct {
+	ID     int
+	Name   string // Romanized name, as in the "name" property
+	NameJa string // Japanese name, when known
+	// Polygons are the exterior rings of the polygons of the feature that
+	// show on the image, insets included. Holes are left out, since an
+	// image map area cannot have any.
+	Polygons [][]image.Point
+}
+
+// HitRegions returns the outline of each feature that shows on the image of
+// the scene, in the order of the features. Polygons are rounded to whole
+// pixels, and those smaller than a pixel are left out.
+func HitRegions(scene *Scene) []HitRegion {
+	var regions []HitRegion
+	byID := make(map[int]int)
+	// Polygons of the main view under an inset box cannot be clicked
+	var covered []image.Rectangle
+	for _, box := range scene.Insets {
+		covered = append(covered, box.Rect)
+	}
+	add := func(s *Scene, offset image.Point, covered []image.Rectangle) {
+		bounds := image.Rect(0, 0, s.Width, s.Height)
+		for _, feature := range s.Features {
+			polygons := exteriorRings(feature, s, bounds, offset, covered)
+			if len(polygons) == 0 {
+				continue
+			}
+			id := int(feature.Properties["id"].(float64))
+			i, ok := byID[id]
+			if !ok {
+				romaji, kanji := geo.FeatureNames(feature)
+				i = len(regions)
+				byID[id] = i
+				regions = append(regions, HitRegion{ID: id, Name: romaji, NameJa: kanji})
+			}
+			regions[i].Polygons = append(regions[i].Polygons, polygons...)
+		}
+	}
+	add(scene, image.Point{}, covered)
+	for _, box := range scene.Insets {
+		add(scene.insetScene(box), box.Rect.Min, nil)
+	}
+	return regions
+}
+
+// Function to project the exterior ring of each polygon of a feature to
+// whole pixels, shifted by offset. Rings that miss the bounds, lie within a
+// covered rectangle or cover less than a pixel are left out, and repeated
+// pixels are dropped.
+func exteriorRings(feature *geojson.Feature, scene *Scene, bounds image.Rectangle, offset image.Point, covered []image.Rectangle) [][]image.Point {
+	var polygons [][][][]float64
+	switch feature.Geometry.Type {
+	case "Polygon":
+		polygons = [][][][]float64{feature.Geometry.Polygon}
+	case "MultiPolygon":
+		polygons = feature.Geometry.MultiPolygon
+	}
+
+	var rings [][]image.Point
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			continue
+		}
+		var ring []image.Point
+		extent := image.Rectangle{}
+		for i, coord := range polygon[0] {
+			x, y := scene.ToScreen(coord[0], coord[1])
+			p := image.Pt(int(math.Round(x)), int(math.Round(y)))
+			if i == 0 {
+				extent = image.Rectangle{Min: p, Max: p}
+			}
+			extent = extent.Union(image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+			if len(ring) > 0 && ring[len(ring)-1] == p {
+				continue
+			}
+			ring = append(ring, p)
+		}
+		if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+			ring = ring[:len(ring)-1]
+		}
+		if len(ring) < 3 || !extent.Overlaps(bounds) {
+			continue
+		}
+		if math.Abs(pixelArea(ring)) < 1 || withinAny(extent, covered) {
+			continue
+		}
+		for i := range ring {
+			ring[i] = ring[i].Add(offset)
+		}
+		rings = append(rings, ring)
+	}
+	return rings
+}
+
+// Function to get the signed area of a ring of pixels, by the shoelace
+// formula
+func pixelArea(ring []image.Point) float64 {
+	var sum int
+	for i, p := range ring {
+		q := ring[(i+1)%len(ring)]
+		sum += p.X*q.Y - q.X*p.Y
+	}
+	return float64(sum) / 2
+}
+
+func withinAny(r image.Rectangle, rects []image.Rectangle) bool {
+	for _, c := range rects {
+		if r.In(c) {
+			return true
+		}
+	}
+	return false
+}
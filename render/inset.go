@@ -0,0 +1,322 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"canvas/geo"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Inset modes
+const (
+	InsetsAuto = "auto" // Remote island groups in boxes when they would zoom the map out
+	InsetsNone = "none" // Everything framed in one view
+)
+
+// Inset is a remote island group that can be drawn in a framed box of its
+// own. Rings and points whose center lies in one of the areas belong to it.
+type Inset struct {
+	Name  string
+	Areas []geo.BBox
+}
+
+// Insets are the island groups drawn in boxes. Amami, south of Kyushu, is
+// left to the main view, so Okinawa is two areas: the Ryukyu arc west of
+// Yoron, up to Iotori-shima, and the Daito Islands.
+var Insets = []Inset{
+	{Name: "okinawa", Areas: []geo.BBox{
+		{MinLon: 122.5, MinLat: 23.8, MaxLon: 128.36, MaxLat: 27.95},
+		{MinLon: 130.9, MinLat: 24.3, MaxLon: 131.5, MaxLat: 26.2},
+	}},
+	{Name: "ogasawara", Areas: []geo.BBox{
+		{MinLon: 136.0, MinLat: 20.0, MaxLon: 154.0, MaxLat: 27.8},
+	}},
+}
+
+const (
+	// An inset is drawn when framing its island group would cut the zoom of
+	// the map by more than this fraction
+	insetZoomLoss = 0.25
+	// Largest size of a box, as a fraction of the canvas
+	insetMaxWidth  = 0.3
+	insetMaxHeight = 0.35
+)
+
+// InsetBox is an inset placed on the canvas, with its own projection.
+type InsetBox struct {
+	Name string
+	// Rect is where the box is on the canvas.
+	Rect     image.Rectangle
+	Features []*geojson.Feature
+	Borders  [][][]float64
+	// ToScreen converts a coordinate to pixels of the box.
+	ToScreen        func(lon, lat float64) (x, y float64)
+	PixelsPerDegree float64
+}
+
+// ParseInsets checks an inset mode name.
+func ParseInsets(value string) (string, error) {
+	switch value {
+	case "", InsetsAuto:
+		return InsetsAuto, nil
+	case InsetsNone:
+		return InsetsNone, nil
+	}
+	return "", fmt.Errorf("invalid insets: %s (must be auto or none)", value)
+}
+
+func (inset Inset) contains(lon, lat float64) bool {
+	for _, a := range inset.Areas {
+		if lon >= a.MinLon && lon <= a.MaxLon && lat >= a.MinLat && lat <= a.MaxLat {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to find the inset a ring or point belongs to, or -1
+func insetAt(lon, lat float64) int {
+	for i, inset := range Insets {
+		if inset.contains(lon, lat) {
+			return i
+		}
+	}
+	return -1
+}
+
+var emptyBounds = geo.BBox{MinLon: 180.0, MinLat: 90.0, MaxLon: -180.0, MaxLat: -90.0}
+
+func extendBounds(b geo.BBox, ring [][]float64) geo.BBox {
+	for _, coord := range ring {
+		b.MinLon, b.MaxLon = min(b.MinLon, coord[0]), max(b.MaxLon, coord[0])
+		b.MinLat, b.MaxLat = min(b.MinLat, coord[1]), max(b.MaxLat, coord[1])
+	}
+	return b
+}
+
+func unionBounds(a, b geo.BBox) geo.BBox {
+	return geo.BBox{
+		MinLon: min(a.MinLon, b.MinLon), MinLat: min(a.MinLat, b.MinLat),
+		MaxLon: max(a.MaxLon, b.MaxLon), MaxLat: max(a.MaxLat, b.MaxLat),
+	}
+}
+
+// Function to split the shaded prefectures and points between the main view
+// and the insets. It returns the insets to draw, if any, and the bounds of
+// what is left to the main view.
+func splitInsets(fc *geojson.FeatureCollection, shaded map[int]int, opts *Options) ([]Inset, geo.BBox) {
+	rest := emptyBounds
+	inside := make([]geo.BBox, len(Insets))
+	for i := range inside {
+		inside[i] = emptyBounds
+	}
+	add := func(ring [][]float64) {
+		lon, lat := geo.Center(ring)
+		if i := insetAt(lon, lat); i >= 0 {
+			inside[i] = extendBounds(inside[i], ring)
+		} else {
+			rest = extendBounds(rest, ring)
+		}
+	}
+	for _, feature := range fc.Features {
+		if shaded[int(feature.Properties["id"].(float64))] == 0 {
+			continue
+		}
+		for _, ring := range geo.FeatureRings(feature) {
+			add(ring)
+		}
+	}
+	for _, p := range opts.Points {
+		if p.Scale > 0 {
+			add([][]float64{{p.Lon, p.Lat}})
+		}
+	}
+	if rest.MinLon > rest.MaxLon {
+		// Only remote islands are shaded, and they are the map
+		return nil, rest
+	}
+
+	// Function to get the zoom the canvas would frame the bounds at
+	zoom := func(b geo.BBox) float64 {
+		return geo.FitProjection(opts.projection(), b.Expand(opts.MinSpan), float64(opts.Width), float64(opts.Height-opts.bannerHeight()), opts.Margin).Scale
+	}
+	var used []Inset
+	for i, b := range inside {
+		if b.MinLon > b.MaxLon {
+			continue
+		}
+		if combined := unionBounds(rest, b); zoom(combined) < (1-insetZoomLoss)*zoom(rest) {
+			used = append(used, Insets[i])
+		} else {
+			rest = combined
+		}
+	}
+	return used, rest
+}
+
+// Function to place the boxes of the insets on the canvas, each at the zoom
+// of the map unless that is too large for a box. A box goes to the corner
+// that hides the least of the map, among those not taken already.
+func layoutInsets(dataset *geo.Dataset, insets []Inset, view geo.Projection, opts *Options, taken []image.Rectangle) []InsetBox {
+	var boxes []InsetBox
+	for _, inset := range insets {
+		// The box frames the whole island group, and the shaded points in it
+		b := emptyBounds
+		for _, feature := range dataset.Full.Features {
+			for _, ring := range geo.FeatureRings(feature) {
+				if inset.contains(geo.Center(ring)) {
+					b = extendBounds(b, ring)
+				}
+			}
+		}
+		for _, p := range opts.Points {
+			if p.Scale > 0 && inset.contains(p.Lon, p.Lat) {
+				b = extendBounds(b, [][]float64{{p.Lon, p.Lat}})
+			}
+		}
+		b = b.Expand(opts.MinSpan)
+
+		pad := 6 * opts.Multiplier
+		lonSpan, latSpan := geo.Span(opts.projection(), b)
+		zoom := min(view.Scale,
+			(insetMaxWidth*float64(opts.Width)-2*pad)/lonSpan,
+			(insetMaxHeight*float64(opts.Height)-2*pad)/latSpan)
+		if zoom <= 0 {
+			continue
+		}
+		innerWidth, innerHeight := lonSpan*zoom, latSpan*zoom
+		projection := geo.FitProjection(opts.projection(), b, innerWidth, innerHeight, 0)
+		size := image.Pt(int(math.Ceil(innerWidth+2*pad)), int(math.Ceil(innerHeight+2*pad)))
+
+		rect := bestCorner(dataset, view, opts, size, taken)
+		if rect.Empty() {
+			// Every corner is taken
+			continue
+		}
+		taken = append(taken, rect)
+		boxes = append(boxes, InsetBox{
+			Name:     inset.Name,
+			Rect:     rect,
+			Features: dataset.FeaturesFor(projection.Scale),
+			Borders:  dataset.BordersFor(projection.Scale),
+			ToScreen: func(lon, lat float64) (float64, float64) {
+				x, y := projection.ToScreen(lon, lat)
+				return x + pad, y + pad
+			},
+			PixelsPerDegree: projection.Scale,
+		})
+	}
+	return boxes
+}
+
+// Function to pick the corner of the canvas where a box of the size hides
+// the fewest vertices of the map, counting shaded ones and points many times
+// over. Ties go to the first corner: top left, where the Sea of Japan is,
+// then bottom right, over the Pacific. Bottom corners stay clear of the
+// footer, and top corners of the banner.
+func bestCorner(dataset *geo.Dataset, view geo.Projection, opts *Options, size image.Point, taken []image.Rectangle) image.Rectangle {
+	edge := int(10 * opts.Multiplier)
+	top := opts.bannerHeight() + edge
+	bottom := opts.Height - int(28*opts.Multiplier) - size.Y
+	right := opts.Width - edge - size.X
+	corners := []image.Point{{edge, top}, {right, bottom}, {right, top}, {edge, bottom}}
+
+	features := dataset.FeaturesFor(view.Scale)
+	best, bestCost := image.Rectangle{}, math.MaxInt
+	for _, corner := range corners {
+		rect := image.Rectangle{Min: corner, Max: corner.Add(size)}
+		if corner.X < 0 || corner.Y < top {
+			continue
+		}
+		overlaps := false
+		for _, t := range taken {
+			overlaps = overlaps || rect.Overlaps(t)
+		}
+		if overlaps {
+			continue
+		}
+
+		cost := 0
+		hides := func(lon, lat float64) bool {
+			x, y := view.ToScreen(lon, lat)
+			return image.Pt(int(x), int(y)).In(rect)
+		}
+		for _, feature := range features {
+			id := int(feature.Properties["id"].(float64))
+			weight := 1
+			if _, valued := opts.Values[id]; valued || opts.ScaleMap[id] > 0 {
+				weight = 10
+			}
+			for _, ring := range geo.FeatureRings(feature) {
+				for _, coord := range ring {
+					if hides(coord[0], coord[1]) {
+						cost += weight
+					}
+				}
+			}
+		}
+		for _, p := range opts.Points {
+			if hides(p.Lon, p.Lat) {
+				cost += 10
+			}
+		}
+		if cost < bestCost {
+			best, bestCost = rect, cost
+		}
+	}
+	return best
+}
+
+// Function to get the scene of an inset: the map, with the projection and
+// geometry of the box and no footer
+func (scene *Scene) insetScene(box InsetBox) *Scene {
+	inset := *scene
+	inset.Width, inset.Height = box.Rect.Dx(), box.Rect.Dy()
+	inset.Features, inset.Borders = box.Features, box.Borders
+	inset.ToScreen, inset.PixelsPerDegree = box.ToScreen, box.PixelsPerDegree
+	inset.Insets = nil
+	// Timed as a whole by drawInsets, and simulated with the map
+	inset.Timings = nil
+	inset.Simulate = ""
+	inset.bare = true
+	return &inset
+}
+
+// Function to draw the insets of a scene over its image with the backend,
+// each in a box framed like the borders
+func drawInsets(rgba *image.RGBA, scene *Scene, backend Backend) error {
+	if len(scene.Insets) > 0 {
+		defer scene.Timings.Start("insets")()
+	}
+	for _, box := range scene.Insets {
+		img, err := backend.Draw(scene.insetScene(box))
+		if err != nil {
+			return err
+		}
+		draw.Draw(rgba, box.Rect, img, image.Point{}, draw.Src)
+
+		stroke := insetFrameWidth(scene)
+		frame := image.NewUniform(ParseHexColor(insetFrameColor))
+		r := box.Rect
+		for _, side := range []image.Rectangle{
+			{r.Min, image.Pt(r.Max.X, r.Min.Y+stroke)},
+			{image.Pt(r.Min.X, r.Max.Y-stroke), r.Max},
+			{r.Min, image.Pt(r.Min.X+stroke, r.Max.Y)},
+			{image.Pt(r.Max.X-stroke, r.Min.Y), r.Max},
+		} {
+			draw.Draw(rgba, side, frame, image.Point{}, draw.Src)
+		}
+	}
+	return nil
+}
+
+const insetFrameColor = "#71717a"
+
+// Function to get the width of the frame of an inset, in whole pixels
+func insetFrameWidth(scene *Scene) int {
+	return max(1, int(scene.Multiplier+0.5))
+}
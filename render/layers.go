@@ -0,0 +1,168 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+)
+
+// Layers of a map, drawn in the order of the stack
+const (
+	LayerFills     = "fills"     // Prefectures, shaded by intensity
+	LayerHeatmap   = "heatmap"   // Station intensities interpolated over the land
+	LayerBorders   = "borders"   // Prefecture borders and coastline
+	LayerHighlight = "highlight" // Outline of the strongest shaking
+	LayerOverlays  = "overlays"  // GeoJSON lines and polygons given with the map
+	LayerPoints    = "points"    // Station markers
+	LayerMarkers   = "markers"   // Pins and symbols given with the map
+	LayerLabels    = "labels"    // Scale values and footer
+)
+
+// Blend modes, as in CSS mix-blend-mode
+const (
+	BlendNormal   = "normal"
+	BlendMultiply = "multiply"
+	BlendScreen   = "screen"
+)
+
+// Layer is one entry of the layer stack.
+type Layer struct {
+	Name  string
+	Blend string // BlendNormal when empty
+}
+
+// DefaultLayers is the stack of maps whose options give none, bottom first.
+var DefaultLayers = []Layer{
+	{Name: LayerFills},
+	{Name: LayerBorders},
+	{Name: LayerPoints},
+	{Name: LayerLabels},
+}
+
+var layerNames = []string{LayerFills, LayerHeatmap, LayerBorders, LayerHighlight, LayerOverlays, LayerPoints, LayerMarkers, LayerLabels}
+
+var blendModes = map[string]func(backdrop, source float64) float64{
+	BlendNormal:   func(_, s float64) float64 { return s },
+	BlendMultiply: func(b, s float64) float64 { return b * s },
+	BlendScreen:   func(b, s float64) float64 { return b + s - b*s },
+}
+
+// ParseLayers parses a stack such as "fills,borders:multiply,labels", bottom
+// first. Layers left out are not drawn.
+func ParseLayers(spec string) ([]Layer, error) {
+	var layers []Layer
+	for _, part := range strings.Split(spec, ",") {
+		name, blend, _ := strings.Cut(strings.TrimSpace(part), ":")
+		layers = append(layers, Layer{Name: name, Blend: blend})
+	}
+	if err := validateLayers(layers); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// Function to check that a stack names each known layer at most once, with
+// a known blend mode
+func validateLayers(layers []Layer) error {
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		known := false
+		for _, name := range layerNames {
+			known = known || layer.Name == name
+		}
+		if !known {
+			return fmt.Errorf("unknown layer: %q (must be one of %s)", layer.Name, strings.Join(layerNames, ", "))
+		}
+		if seen[layer.Name] {
+			return fmt.Errorf("duplicate layer: %s", layer.Name)
+		}
+		seen[layer.Name] = true
+		if _, ok := blendModes[layer.blend()]; !ok {
+			return fmt.Errorf("unknown blend mode for layer %s: %q (must be normal, multiply or screen)", layer.Name, layer.Blend)
+		}
+	}
+	return nil
+}
+
+func (layer Layer) blend() string {
+	if layer.Blend == "" {
+		return BlendNormal
+	}
+	return layer.Blend
+}
+
+// Function to draw the layer stack onto a canvas filled with the background,
+// unless the scene is transparent.
+// Runs of layers in the normal blend mode are drawn by one call, straight
+// onto the canvas. Other layers are drawn alone on a transparent image, then
+// blended in.
+func drawLayers(scene *Scene, drawTo func(dst *image.RGBA, layers []string) error) (*image.RGBA, error) {
+	bounds := image.Rect(0, 0, scene.Width, scene.Height)
+	rgba := image.NewRGBA(bounds)
+	if !scene.Transparent {
+		draw.Draw(rgba, bounds, image.NewUniform(ParseHexColor("#18181b")), image.Point{}, draw.Src)
+	}
+
+	var scratch *image.RGBA
+	stack := scene.Layers
+	for i := 0; i < len(stack); {
+		if blend := stack[i].blend(); blend != BlendNormal {
+			if scratch == nil {
+				scratch = image.NewRGBA(bounds)
+			} else {
+				clear(scratch.Pix)
+			}
+			if err := drawTo(scratch, []string{stack[i].Name}); err != nil {
+				return nil, err
+			}
+			done := scene.Timings.Start("blend")
+			blendImage(rgba, scratch, blendModes[blend])
+			done()
+			i++
+			continue
+		}
+
+		var names []string
+		for ; i < len(stack) && stack[i].blend() == BlendNormal; i++ {
+			names = append(names, stack[i].Name)
+		}
+		if err := drawTo(rgba, names); err != nil {
+			return nil, err
+		}
+	}
+	return rgba, nil
+}
+
+// Function to composite src over dst with a separable blend mode, following
+// the W3C compositing formula on premultiplied colors
+func blendImage(dst, src *image.RGBA, mode func(backdrop, source float64) float64) {
+	for i := 0; i < len(src.Pix); i += 4 {
+		as := float64(src.Pix[i+3]) / 255
+		if as == 0 {
+			continue
+		}
+		ab := float64(dst.Pix[i+3]) / 255
+		for c := 0; c < 3; c++ {
+			cs := float64(src.Pix[i+c]) / 255
+			cb := float64(dst.Pix[i+c]) / 255
+			var mixed float64
+			if ab > 0 {
+				mixed = as * ab * mode(cb/ab, cs/as)
+			}
+			out := cs*(1-ab) + cb*(1-as) + mixed
+			dst.Pix[i+c] = uint8(min(255, out*255+0.5))
+		}
+		dst.Pix[i+3] = uint8(min(255, (as+ab-as*ab)*255+0.5))
+	}
+}
+
+// Function to tell whether a layer is in the stack
+func (scene *Scene) hasLayer(name string) bool {
+	for _, layer := range scene.Layers {
+		if layer.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"canvas/i18n"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/golang/freetype"
+)
+
+const (
+	legendColor       = "#09090b"
+	legendBorderColor = "#3f3f46"
+
+	// Sizes at 1280x720, in pixels
+	legendPadding    = 8.0
+	legendTitleSize  = 12.0
+	legendTextSize   = 11.0
+	legendLineHeight = 17.0
+	legendSwatch     = 11.0
+	legendGap        = 6.0
+)
+
+// A line of the legend, with the English text drawn instead when no font has
+// the glyphs of the localized one
+type legendLine struct {
+	text, fallback string
+}
+
+// A key to the colors of a scale, boxed in a corner of the map
+type legend struct {
+	Title   legendLine
+	Entries []legendLine
+	Rect    image.Rectangle
+}
+
+// Function to build the legend of a scale that needs one on the map: the
+// long-period ground motion classes, which readers know less well than
+// shindo. Other scales get none.
+func newLegend(opts *Options) *legend {
+	if opts.ScaleType != ScaleLPGM {
+		return nil
+	}
+	return scaleLegend(opts.ScaleType, opts.Lang)
+}
+
+// Function to build the legend of every intensity of a scale above zero.
+// Long-period ground motion classes are described, and other intensities
+// written as labeled on the map.
+func scaleLegend(scaleType, lang string) *legend {
+	line := func(key string) legendLine {
+		return legendLine{text: i18n.T(lang, key), fallback: i18n.T(i18n.English, key)}
+	}
+	l := &legend{Title: line("legend." + scaleType)}
+	scene := &Scene{ScaleType: scaleType}
+	for scale := 1; scale <= MaxScale(scaleType); scale++ {
+		if scaleType == ScaleLPGM {
+			l.Entries = append(l.Entries, line("lpgm."+strconv.Itoa(scale)))
+		} else {
+			label := scene.scaleLabel(scale)
+			l.Entries = append(l.Entries, legendLine{text: label, fallback: label})
+		}
+	}
+	return l
+}
+
+// Formats of a standalone legend
+const (
+	LegendPNG = "png"
+	LegendSVG = "svg"
+)
+
+// RenderLegend draws the legend of the scale of opts on its own, as a PNG or
+// an SVG document just large enough for it, for pages that show the key apart
+// from the map. It follows the scale type, palette, language and multiplier
+// of opts, and its color vision simulation.
+func RenderLegend(opts *Options, format string) ([]byte, error) {
+	multiplier := legendMultiplier(opts)
+	l := scaleLegend(opts.ScaleType, opts.Lang)
+	l.Rect = image.Rectangle{Max: l.size(multiplier)}
+	scene := &Scene{ScaleType: opts.ScaleType, Palette: opts.Palette, Multiplier: multiplier, legend: l}
+	if format == LegendSVG {
+		var buf bytes.Buffer
+		canvas := svg.New(&buf)
+		canvas.Start(l.Rect.Dx(), l.Rect.Dy())
+		if opts.Simulate != "" {
+			fmt.Fprint(canvas.Writer, svgVisionFilter(opts.Simulate))
+			fmt.Fprintf(canvas.Writer, "<g filter=\"url(#simulate-%s)\">\n", opts.Simulate)
+		}
+		svgLegend(canvas, scene)
+		if opts.Simulate != "" {
+			fmt.Fprintln(canvas.Writer, "</g>")
+		}
+		canvas.End()
+		return buf.Bytes(), nil
+	}
+	rgba := image.NewRGBA(l.Rect)
+	if err := drawLegend(rgba, scene); err != nil {
+		return nil, err
+	}
+	if opts.Simulate != "" {
+		simulateVision(rgba, Simulations[opts.Simulate])
+	}
+	return EncodePNG(rgba)
+}
+
+// LegendSize returns the size in pixels of the legend RenderLegend draws.
+func LegendSize(opts *Options) image.Point {
+	return scaleLegend(opts.ScaleType, opts.Lang).size(legendMultiplier(opts))
+}
+
+// Function to get the multiplier of a standalone legend, 1 when unset
+func legendMultiplier(opts *Options) float64 {
+	if opts.Multiplier == 0 {
+		return 1
+	}
+	return opts.Multiplier
+}
+
+// Function to get the size of the legend box, wide enough for the localized
+// text and its fallback
+func (l *legend) size(multiplier float64) image.Point {
+	width := 0.0
+	for _, text := range []string{l.Title.text, l.Title.fallback} {
+		w, _ := labelSize(text, legendTitleSize)
+		width = max(width, w)
+	}
+	for _, line := range l.Entries {
+		for _, text := range []string{line.text, line.fallback} {
+			w, _ := labelSize(text, legendTextSize)
+			width = max(width, legendSwatch+legendGap+w)
+		}
+	}
+	height := legendLineHeight*float64(len(l.Entries)+1) - (legendLineHeight - legendTitleSize)
+	return image.Pt(
+		int(math.Ceil((width+2*legendPadding)*multiplier)),
+		int(math.Ceil((height+2*legendPadding)*multiplier)),
+	)
+}
+
+// Function to get the baseline of the title, then of each entry
+func (l *legend) baseline(i int, multiplier float64) int {
+	return l.Rect.Min.Y + int(math.Round((legendPadding+legendTitleSize*0.8+float64(i)*legendLineHeight)*multiplier))
+}
+
+// Function to draw the legend box, its swatches and text
+func drawLegend(rgba *image.RGBA, scene *Scene) error {
+	l := scene.legend
+	if l == nil {
+		return nil
+	}
+	m := scene.Multiplier
+	border := max(1, int(math.Round(m)))
+	draw.Draw(rgba, l.Rect, image.NewUniform(ParseHexColor(legendBorderColor)), image.Point{}, draw.Src)
+	draw.Draw(rgba, l.Rect.Inset(border), image.NewUniform(ParseHexColor(legendColor)), image.Point{}, draw.Src)
+
+	latin, err := loadFont(400)
+	if err != nil {
+		return fmt.Errorf("failed to load font: %w", err)
+	}
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetClip(rgba.Bounds())
+	c.SetDst(rgba)
+	c.SetSrc(image.NewUniform(ParseHexColor(bannerTitleColor)))
+	// Function to write a line in the font that has its glyphs, or its
+	// fallback
+	write := func(line legendLine, size float64, x, y int) error {
+		f, err := bannerFont(line.text, latin)
+		if err != nil {
+			return err
+		}
+		text := line.text
+		if f == latin && hasCJK(text) {
+			text = line.fallback
+		}
+		c.SetFont(f)
+		c.SetFontSize(size * m)
+		if _, err := c.DrawString(text, freetype.Pt(x, y)); err != nil {
+			return fmt.Errorf("failed to draw legend: %w", err)
+		}
+		return nil
+	}
+
+	x := l.Rect.Min.X + int(math.Round(legendPadding*m))
+	if err := write(l.Title, legendTitleSize, x, l.baseline(0, m)); err != nil {
+		return err
+	}
+	swatch := int(math.Round(legendSwatch * m))
+	textX := x + int(math.Round((legendSwatch+legendGap)*m))
+	for i, entry := range l.Entries {
+		y := l.baseline(i+1, m)
+		r := image.Rect(x, y-swatch+int(m), x+swatch, y+int(m))
+		draw.Draw(rgba, r, image.NewUniform(ParseHexColor(scene.intensityColor(i+1))), image.Point{}, draw.Src)
+		if err := write(entry, legendTextSize, textX, y); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to write the legend as a group of rectangles and text elements
+func svgLegend(canvas *svg.SVG, scene *Scene) {
+	l := scene.legend
+	if l == nil {
+		return
+	}
+	m := scene.Multiplier
+	canvas.Rect(l.Rect.Min.X, l.Rect.Min.Y, l.Rect.Dx(), l.Rect.Dy(), fmt.Sprintf("fill:%s;stroke:%s;stroke-width:%.1f", legendColor, legendBorderColor, m))
+	textStyle := func(size float64, weight int) string {
+		return fmt.Sprintf("fill:%s;font-family:Roboto,sans-serif;font-weight:%d;font-size:%.1fpx", bannerTitleColor, weight, size*m)
+	}
+	x := l.Rect.Min.X + int(math.Round(legendPadding*m))
+	canvas.Text(x, l.baseline(0, m), l.Title.text, textStyle(legendTitleSize, 500))
+	swatch := int(math.Round(legendSwatch * m))
+	textX := x + int(math.Round((legendSwatch+legendGap)*m))
+	for i, entry := range l.Entries {
+		y := l.baseline(i+1, m)
+		canvas.Rect(x, y-swatch+int(m), swatch, swatch, "fill:"+scene.intensityColor(i+1))
+		canvas.Text(textX, y, entry.text, textStyle(legendTextSize, 400))
+	}
+}
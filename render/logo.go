@@ -0,0 +1,186 @@
+package render
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"strings"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Corners a logo can be placed in
+const (
+	LogoTopLeft     = "top-left"
+	LogoTopRight    = "top-right"
+	LogoBottomLeft  = "bottom-left"
+	LogoBottomRight = "bottom-right"
+)
+
+// Widest logo, in pixels at 1280x720
+const MAX_LOGO_WIDTH = 640.0
+
+// LogoImage is a decoded PNG or SVG logo.
+type LogoImage struct {
+	raster image.Image
+	svg    []byte
+	// Height over width
+	aspect float64
+	digest string
+}
+
+// LoadLogo reads a PNG or SVG logo, told apart by the extension of the path.
+func LoadLogo(path string) (*LogoImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	logo := &LogoImage{digest: hex.EncodeToString(sum[:8])}
+	if strings.HasSuffix(strings.ToLower(path), ".svg") {
+		icon, err := oksvg.ReadIconStream(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SVG logo: %w", err)
+		}
+		if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+			return nil, fmt.Errorf("invalid SVG logo: no viewBox")
+		}
+		logo.svg, logo.aspect = data, icon.ViewBox.H/icon.ViewBox.W
+		return logo, nil
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PNG logo: %w", err)
+	}
+	size := img.Bounds().Size()
+	logo.raster, logo.aspect = img, float64(size.Y)/float64(size.X)
+	return logo, nil
+}
+
+// MarshalJSON stands for the logo by a digest of its file, so options that
+// differ only by logo hash differently.
+func (l *LogoImage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.digest)
+}
+
+// Function to draw the logo at a size
+func (l *LogoImage) draw(width, height int) (*image.RGBA, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if l.svg == nil {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), l.raster, l.raster.Bounds(), draw.Src, nil)
+		return dst, nil
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(l.svg))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVG logo: %w", err)
+	}
+	icon.SetTarget(0, 0, float64(width), float64(height))
+	icon.Draw(rasterx.NewDasher(width, height, rasterx.NewScannerGV(width, height, dst, dst.Bounds())), 1.0)
+	return dst, nil
+}
+
+// Logo is a brand image composited over a corner of the map, scaled with
+// the multiplier.
+type Logo struct {
+	Image    *LogoImage
+	Position string  // One of the Logo* corners
+	Width    float64 // Pixels at 1280x720
+	Opacity  float64 // 0 to 1
+	// ReplaceFooter leaves the footer text out, so the logo takes its place.
+	ReplaceFooter bool
+}
+
+// Validate checks the corner, width and opacity of the logo.
+func (l *Logo) Validate() error {
+	if l.Image == nil {
+		return fmt.Errorf("logo has no image")
+	}
+	switch l.Position {
+	case LogoTopLeft, LogoTopRight, LogoBottomLeft, LogoBottomRight:
+	default:
+		return fmt.Errorf("invalid logo position: %q (must be top-left, top-right, bottom-left or bottom-right)", l.Position)
+	}
+	if !(l.Width > 0 && l.Width <= MAX_LOGO_WIDTH) {
+		return fmt.Errorf("invalid logo width: %g (must be greater than 0 and at most %g)", l.Width, MAX_LOGO_WIDTH)
+	}
+	if !(l.Opacity >= 0 && l.Opacity <= 1) {
+		return fmt.Errorf("invalid logo opacity: %g (must be between 0 and 1)", l.Opacity)
+	}
+	return nil
+}
+
+// Function to get where the logo goes on a canvas: in its corner, clear of
+// the banner, and above the footer unless it replaces it
+func logoRect(logo *Logo, opts *Options) image.Rectangle {
+	if logo == nil {
+		return image.Rectangle{}
+	}
+	edge := int(10 * opts.Multiplier)
+	width := int(math.Round(logo.Width * opts.Multiplier))
+	height := int(math.Round(logo.Width * logo.Image.aspect * opts.Multiplier))
+	x, y := edge, edge+opts.bannerHeight()
+	if logo.Position == LogoTopRight || logo.Position == LogoBottomRight {
+		x = opts.Width - edge - width
+	}
+	if logo.Position == LogoBottomLeft || logo.Position == LogoBottomRight {
+		bottom := opts.Height - edge
+		if !logo.ReplaceFooter && logo.Position == LogoBottomLeft {
+			// The footer is written along the bottom left
+			bottom = opts.Height - int(28*opts.Multiplier)
+		}
+		y = bottom - height
+	}
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// Function to composite the logo over the canvas
+func drawLogo(rgba *image.RGBA, scene *Scene) error {
+	if scene.Logo == nil || scene.logoRect.Empty() {
+		return nil
+	}
+	r := scene.logoRect
+	img, err := scene.Logo.Image.draw(r.Dx(), r.Dy())
+	if err != nil {
+		return err
+	}
+	alpha := image.NewUniform(color.Alpha{A: uint8(math.Round(scene.Logo.Opacity * 255))})
+	draw.DrawMask(rgba, r, img, image.Point{}, alpha, image.Point{}, draw.Over)
+	return nil
+}
+
+// Function to write the logo as an image element, the PNG or SVG embedded
+// as a data URI
+func svgLogo(canvas *svg.SVG, scene *Scene) error {
+	if scene.Logo == nil || scene.logoRect.Empty() {
+		return nil
+	}
+	logo, r := scene.Logo, scene.logoRect
+	var uri string
+	if logo.Image.svg != nil {
+		uri = "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(logo.Image.svg)
+	} else {
+		img, err := logo.Image.draw(r.Dx(), r.Dy())
+		if err != nil {
+			return err
+		}
+		data, err := EncodePNG(img)
+		if err != nil {
+			return err
+		}
+		uri = "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+	}
+	canvas.Image(r.Min.X, r.Min.Y, r.Dx(), r.Dy(), uri, fmt.Sprintf(`opacity="%g"`, logo.Opacity))
+	return nil
+}
@@ -0,0 +1,56 @@
+package render
+
+import (
+	"sort"
+
+	"github.com/srwiley/rasterx"
+)
+
+// A station marker: a square centered on the point, filled with the color of
+// its intensity
+type marker struct {
+	X, Y  float64
+	Size  float64
+	Scale int
+}
+
+// Function to place the point markers, weakest first so the strongest
+// shaking is drawn on top where markers overlap. Points off the canvas are
+// left out, and crowded ones thinned to the strongest.
+func pointMarkers(scene *Scene) []marker {
+	size := 7 * scene.Multiplier
+	markers := make([]marker, 0, len(scene.Points))
+	items := make([]densityItem, 0, len(scene.Points))
+	for _, p := range scene.Points {
+		x, y := scene.ToScreen(p.Lon, p.Lat)
+		if x < -size || y < -size || x > float64(scene.Width)+size || y > float64(scene.Height)+size {
+			continue
+		}
+		markers = append(markers, marker{X: x, Y: y, Size: size, Scale: p.Scale})
+		items = append(items, densityItem{X: x, Y: y, Priority: p.Scale})
+	}
+
+	kept := make([]marker, 0, len(markers))
+	for _, i := range scene.thin(stationMarkers, newDensityGrid(scene, stationMarkers), items) {
+		kept = append(kept, markers[i])
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Scale < kept[j].Scale })
+	return kept
+}
+
+// Function to outline the markers in the background color, which keeps
+// neighbors apart in dense areas
+func markerStrokeWidth(scene *Scene) float64 {
+	return 0.6 * scene.Multiplier
+}
+
+// Function to add the square of a marker, grown by grow pixels on each side,
+// as a closed subpath
+func (m marker) addTo(adder rasterx.Adder, grow float64) {
+	half := m.Size/2 + grow
+	adder.Start(rasterx.ToFixedP(m.X-half, m.Y-half))
+	adder.Line(rasterx.ToFixedP(m.X+half, m.Y-half))
+	adder.Line(rasterx.ToFixedP(m.X+half, m.Y+half))
+	adder.Line(rasterx.ToFixedP(m.X-half, m.Y+half))
+	adder.Stop(true)
+}
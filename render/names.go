@@ -0,0 +1,140 @@
+package render
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"canvas/geo"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+)
+
+// Prefecture name modes
+const (
+	NamesRomaji = "romaji" // Romanized names, as in the GeoJSON
+	NamesKanji  = "kanji"  // Japanese names
+	NamesBoth   = "both"   // Japanese names followed by romanized ones
+)
+
+// ParseNames checks a name mode. Empty draws no names.
+func ParseNames(value string) (string, error) {
+	switch value {
+	case "", NamesRomaji, NamesKanji, NamesBoth:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid names: %s (must be romaji, kanji or both)", value)
+}
+
+var (
+	// Name of each feature, kept from the feature with fewer labels than
+	// values and stations, and placed after them
+	nameLabels = labelClass{Rank: 2, Cell: 20, PerCell: 1}
+)
+
+const (
+	// Size of names at 1280x720 and national zoom, in pixels. They grow
+	// with the zoom up to nameMaxGrowth times, from nameGrowthZoom pixels
+	// per degree on.
+	nameFontSize   = 11
+	nameGrowthZoom = 100
+	nameMaxGrowth  = 1.5
+)
+
+// CJKFontPath is a font with Japanese glyphs, such as Noto Sans JP, used
+// for kanji names on raster output. Roboto has none, so without it names are
+// drawn romanized there.
+var CJKFontPath = "./fonts/noto-sans-jp-regular.ttf"
+
+var cjkFont struct {
+	once sync.Once
+	font *truetype.Font
+	err  error
+}
+
+// Function to load the CJK font once, or nil when there is none
+func loadCJKFont() (*truetype.Font, error) {
+	cjkFont.once.Do(func() {
+		data, err := os.ReadFile(CJKFontPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		if err != nil {
+			cjkFont.err = err
+			return
+		}
+		cjkFont.font, cjkFont.err = freetype.ParseFont(data)
+	})
+	return cjkFont.font, cjkFont.err
+}
+
+// Function to tell kana and kanji from other letters
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+func hasCJK(text string) bool {
+	return strings.IndexFunc(text, isCJK) >= 0
+}
+
+// Function to get the size of names at the zoom of the scene, in pixels
+func (scene *Scene) nameFontSize() float64 {
+	growth := min(nameMaxGrowth, max(1, scene.PixelsPerDegree/nameGrowthZoom))
+	return math.Round(nameFontSize*scene.Multiplier*growth*2) / 2
+}
+
+// Function to name the features at their pole of inaccessibility, or below
+// their value when it is written too. Shaded features are named first.
+func nameLabelsFor(scene *Scene, grid *densityGrid) []textLabel {
+	if scene.Names == "" {
+		return nil
+	}
+	size := scene.nameFontSize()
+	var labels []textLabel
+	for _, feature := range scene.Features {
+		romaji, kanji := geo.FeatureNames(feature)
+		text, fallback := romaji, ""
+		switch {
+		case scene.Names == NamesKanji && kanji != "":
+			text, fallback = kanji, romaji
+		case scene.Names == NamesBoth && kanji != "" && romaji != "":
+			text, fallback = kanji+" "+romaji, romaji
+		}
+		if text == "" {
+			continue
+		}
+
+		id := int(feature.Properties["id"].(float64))
+		priority := 0
+		valued := false
+		if scene.Ramp != nil {
+			_, valued = scene.Values[id]
+		} else {
+			valued = scene.ScaleMap[id] > 0
+			priority = scene.ScaleMap[id]
+		}
+		if valued {
+			priority++
+		}
+
+		x, y := scene.ToScreen(scene.LabelPoint(feature))
+		if x < 0 || y < 0 || x >= float64(scene.Width) || y >= float64(scene.Height) {
+			// Off the view, as most features of a regional map are
+			continue
+		}
+		if valued && scene.ShowScale {
+			// A line below the value
+			y += labelCapHeight*scene.labelFontSize()/2 + 0.4*size + labelCapHeight*size/2
+		}
+		label := centeredLabel(x, y, text, size, priority)
+		label.Fallback = fallback
+		labels = append(labels, label)
+	}
+	return labels
+}
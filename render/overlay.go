@@ -0,0 +1,359 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+// Marker icons. A pin has its tip on the place, and the other shapes are
+// centered on it.
+const (
+	IconPin      = "pin"
+	IconCircle   = "circle"
+	IconSquare   = "square"
+	IconTriangle = "triangle"
+	IconDiamond  = "diamond"
+	IconStar     = "star"
+	IconCross    = "cross" // An ×, as JMA marks epicenters
+)
+
+var markerIcons = []string{IconPin, IconCircle, IconSquare, IconTriangle, IconDiamond, IconStar, IconCross}
+
+const (
+	// Most markers in one map
+	MAX_MARKERS = 500
+	// Longest marker label, in characters
+	MAX_MARKER_LABEL = 64
+
+	// Size of a marker at 1280x720, in pixels
+	markerSize = 16.0
+	// Width of the outline that keeps markers apart from the map, in pixels
+	// at 1280x720
+	markerOutlineWidth = 1.5
+)
+
+// DefaultMarkerColor fills markers that give no color.
+const DefaultMarkerColor = "#fafafa"
+
+// Marker is a symbol placed over the map, such as a shelter, an evacuation
+// center or any other annotation, with an optional label right of it.
+type Marker struct {
+	Lon   float64
+	Lat   float64
+	Icon  string // IconPin when empty
+	Label string
+	Color string // "#rrggbb", DefaultMarkerColor when empty
+}
+
+// Validate checks the place, icon, color and label of the marker.
+func (m Marker) Validate() error {
+	if m.Lat < -90 || m.Lat > 90 || m.Lon < -180 || m.Lon > 180 {
+		return fmt.Errorf("invalid marker: %g,%g (out of range)", m.Lat, m.Lon)
+	}
+	if m.Icon != "" && !knownIcon(m.Icon) {
+		return fmt.Errorf("invalid marker icon: %q (must be one of %s)", m.Icon, strings.Join(markerIcons, ", "))
+	}
+	if m.Color != "" {
+		if len(m.Color) != 7 || m.Color[0] != '#' {
+			return fmt.Errorf("invalid marker color: %q (must be #rrggbb)", m.Color)
+		}
+		if _, err := strconv.ParseUint(m.Color[1:], 16, 32); err != nil {
+			return fmt.Errorf("invalid marker color: %q (must be #rrggbb)", m.Color)
+		}
+	}
+	if n := utf8.RuneCountInString(m.Label); n > MAX_MARKER_LABEL {
+		return fmt.Errorf("invalid marker label: %d characters (at most %d)", n, MAX_MARKER_LABEL)
+	}
+	return nil
+}
+
+func knownIcon(icon string) bool {
+	for _, name := range markerIcons {
+		if icon == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Marker) icon() string {
+	if m.Icon == "" {
+		return IconPin
+	}
+	return m.Icon
+}
+
+func (m Marker) color() string {
+	if m.Color == "" {
+		return DefaultMarkerColor
+	}
+	return m.Color
+}
+
+// WithMarkers returns the stack with the markers layer added right beneath
+// the labels, or on top without them, unless it is already there.
+func WithMarkers(layers []Layer) []Layer {
+	if layers == nil {
+		layers = DefaultLayers
+	}
+	at := len(layers)
+	for i, layer := range layers {
+		if layer.Name == LayerMarkers {
+			return layers
+		}
+		if layer.Name == LayerLabels {
+			at = i
+		}
+	}
+	stack := make([]Layer, 0, len(layers)+1)
+	stack = append(stack, layers[:at]...)
+	stack = append(stack, Layer{Name: LayerMarkers})
+	return append(stack, layers[at:]...)
+}
+
+// A marker placed on the canvas: the rings of its icon and of the dot of a
+// pin, and the point its label is centered on vertically
+type placedMarker struct {
+	Color  string
+	Rings  [][][2]float64
+	Dot    [][2]float64
+	LabelX float64
+	LabelY float64
+	Label  string
+}
+
+// Function to place the markers of the scene, in order. Markers off the
+// canvas are left out.
+func overlayMarkers(scene *Scene) []placedMarker {
+	size := markerSize * scene.Multiplier
+	var placed []placedMarker
+	for _, m := range scene.Markers {
+		x, y := scene.ToScreen(m.Lon, m.Lat)
+		if x < -size || y < -2*size || x > float64(scene.Width)+size || y > float64(scene.Height)+size {
+			continue
+		}
+		p := placedMarker{Color: m.color(), LabelX: x + 0.6*size, LabelY: y, Label: m.Label}
+		r := size / 2
+		switch m.icon() {
+		case IconPin:
+			// A round head whose sides run tangent down to the tip
+			head := 0.4 * size
+			cy := y - 0.9*size
+			tangent := math.Acos(head / (y - cy))
+			ring := [][2]float64{{x, y}}
+			for i := 0; i <= 24; i++ {
+				angle := tangent + (2*math.Pi-2*tangent)*float64(i)/24
+				ring = append(ring, [2]float64{x + head*math.Sin(angle), cy + head*math.Cos(angle)})
+			}
+			p.Rings = [][][2]float64{ring}
+			p.Dot = regularRing(x, cy, 0.4*head, 16, 0)
+			p.LabelY = cy
+		case IconCircle:
+			p.Rings = [][][2]float64{regularRing(x, y, r, 32, 0)}
+		case IconSquare:
+			p.Rings = [][][2]float64{regularRing(x, y, r*math.Sqrt2, 4, math.Pi/4)}
+		case IconTriangle:
+			// Pointing up, its centroid on the place
+			p.Rings = [][][2]float64{regularRing(x, y, 1.15*r, 3, math.Pi)}
+		case IconDiamond:
+			p.Rings = [][][2]float64{regularRing(x, y, r, 4, 0)}
+		case IconStar:
+			ring := make([][2]float64, 10)
+			for i := range ring {
+				radius := r
+				if i%2 == 1 {
+					radius = 0.42 * r
+				}
+				angle := math.Pi + math.Pi*float64(i)/5
+				ring[i] = [2]float64{x + radius*math.Sin(angle), y + radius*math.Cos(angle)}
+			}
+			p.Rings = [][][2]float64{ring}
+		case IconCross:
+			// Two bars an eighth of the size thick on each side
+			p.Rings = [][][2]float64{crossRing(x, y, r, 0.125*size)}
+		}
+		placed = append(placed, p)
+	}
+	return placed
+}
+
+// Function to get the vertices of a regular polygon around x, y, the first
+// at angle radians clockwise from straight down
+func regularRing(x, y, radius float64, sides int, angle float64) [][2]float64 {
+	ring := make([][2]float64, sides)
+	for i := range ring {
+		a := angle + 2*math.Pi*float64(i)/float64(sides)
+		ring[i] = [2]float64{x + radius*math.Sin(a), y + radius*math.Cos(a)}
+	}
+	return ring
+}
+
+// Function to get the outline of an × reaching reach pixels from x, y along
+// each axis, its bars half pixels thick on each side of their middle
+func crossRing(x, y, reach, half float64) [][2]float64 {
+	d := half * math.Sqrt2 // Offset of the bar edges along an axis
+	return [][2]float64{
+		{x, y - d}, {x + reach - d, y - reach}, {x + reach, y - reach + d},
+		{x + d, y}, {x + reach, y + reach - d}, {x + reach - d, y + reach},
+		{x, y + d}, {x - reach + d, y + reach}, {x - reach, y + reach - d},
+		{x - d, y}, {x - reach, y - reach + d}, {x - reach + d, y - reach},
+	}
+}
+
+// Function to tell whether any marker of the scene has a label
+func (scene *Scene) hasMarkerLabels() bool {
+	for _, m := range scene.Markers {
+		if m.Label != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to label the markers that have a label, right of their icon.
+// Labels the user asked for are not thinned, only kept from overlapping.
+func overlayLabels(scene *Scene, _ *densityGrid) []textLabel {
+	var labels []textLabel
+	size := scene.labelFontSize()
+	for _, m := range overlayMarkers(scene) {
+		if m.Label == "" {
+			continue
+		}
+		_, height := labelSize(m.Label, size)
+		labels = append(labels, textLabel{
+			X:    int(m.LabelX + 3*scene.Multiplier),
+			Y:    int(m.LabelY + height/2),
+			Text: m.Label,
+			Size: size,
+		})
+	}
+	return labels
+}
+
+// Function to add a ring in pixels as a closed subpath
+func addScreenRing(adder rasterx.Adder, ring [][2]float64) {
+	for i, p := range ring {
+		if i == 0 {
+			adder.Start(rasterx.ToFixedP(p[0], p[1]))
+		} else {
+			adder.Line(rasterx.ToFixedP(p[0], p[1]))
+		}
+	}
+	adder.Stop(true)
+}
+
+// Function to draw the markers: every outline in the background color in
+// one pass, then the icons one color at a time, then the dots of the pins
+func rasterMarkers(dasher *rasterx.Dasher, scene *Scene) {
+	markers := overlayMarkers(scene)
+	if len(markers) == 0 {
+		return
+	}
+	dasher.Clear()
+	dasher.SetStroke(fixed.Int26_6(2*markerOutlineWidth*scene.Multiplier*64), 4*64, rasterx.ButtCap, rasterx.ButtCap, nil, rasterx.Round, nil, 0)
+	for _, m := range markers {
+		for _, ring := range m.Rings {
+			addScreenRing(dasher, ring)
+		}
+	}
+	dasher.SetColor(ParseHexColor(labelHaloColor))
+	dasher.Draw()
+
+	colors, byColor := groupMarkers(markers)
+	filler := &dasher.Filler
+	for _, fill := range colors {
+		dasher.Clear()
+		for _, m := range byColor[fill] {
+			for _, ring := range m.Rings {
+				addScreenRing(filler, ring)
+			}
+		}
+		filler.SetColor(ParseHexColor(fill))
+		filler.Draw()
+	}
+
+	dasher.Clear()
+	for _, m := range markers {
+		if m.Dot != nil {
+			addScreenRing(filler, m.Dot)
+		}
+	}
+	filler.SetColor(ParseHexColor(labelHaloColor))
+	filler.Draw()
+}
+
+// Function to group markers by color, in the order the colors first appear
+func groupMarkers(markers []placedMarker) ([]string, map[string][]placedMarker) {
+	var colors []string
+	byColor := make(map[string][]placedMarker)
+	for _, m := range markers {
+		if _, seen := byColor[m.Color]; !seen {
+			colors = append(colors, m.Color)
+		}
+		byColor[m.Color] = append(byColor[m.Color], m)
+	}
+	return colors, byColor
+}
+
+// Function to append a ring in pixels to SVG path data
+func appendScreenRing(path []byte, ring [][2]float64, precision int) []byte {
+	if len(path) > 0 {
+		path = append(path, ' ')
+	}
+	for i, p := range ring {
+		if i == 0 {
+			path = append(path, 'M')
+		} else {
+			path = append(path, " L"...)
+		}
+		path = appendCoord(path, p[0], precision)
+		path = append(path, ' ')
+		path = appendCoord(path, p[1], precision)
+	}
+	return append(path, " Z"...)
+}
+
+// Function to write the markers in the order the raster backend draws them:
+// the outlines, a path per color, then the dots of the pins
+func svgMarkers(canvas *svg.SVG, scene *Scene, precision int, path []byte) []byte {
+	markers := overlayMarkers(scene)
+	if len(markers) == 0 {
+		return path
+	}
+	path = path[:0]
+	for _, m := range markers {
+		for _, ring := range m.Rings {
+			path = appendScreenRing(path, ring, precision)
+		}
+	}
+	canvas.Path(string(path), fmt.Sprintf("fill:none;stroke:%s;stroke-width:%.1f;stroke-linejoin:round", labelHaloColor, 2*markerOutlineWidth*scene.Multiplier))
+
+	colors, byColor := groupMarkers(markers)
+	for _, fill := range colors {
+		path = path[:0]
+		for _, m := range byColor[fill] {
+			for _, ring := range m.Rings {
+				path = appendScreenRing(path, ring, precision)
+			}
+		}
+		canvas.Path(string(path), "fill:"+fill)
+	}
+
+	path = path[:0]
+	for _, m := range markers {
+		if m.Dot != nil {
+			path = appendScreenRing(path, m.Dot, precision)
+		}
+	}
+	if len(path) > 0 {
+		canvas.Path(string(path), "fill:"+labelHaloColor)
+	}
+	return path
+}
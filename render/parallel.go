@@ -0,0 +1,91 @@
+package render
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+// Chunks per core, so a core that drew a few large prefectures does not
+// leave the others waiting
+const chunksPerWorker = 4
+
+// Function to run fn for every index below n, on every core. Each call
+// writes the results of its own index only, so merging them by index is
+// deterministic however the calls were scheduled. With one core, or one
+// index, everything runs inline.
+func parallelEach(n int, fn func(i int)) {
+	workers := min(runtime.GOMAXPROCS(0), n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// Function to split [0, n) into contiguous chunks for parallelEach, fewer
+// and larger than single items where each item is little work
+func chunkRanges(n int) [][2]int {
+	count := runtime.GOMAXPROCS(0) * chunksPerWorker
+	size := max(1, (n+count-1)/count)
+	var chunks [][2]int
+	for start := 0; start < n; start += size {
+		chunks = append(chunks, [2]int{start, min(start+size, n)})
+	}
+	return chunks
+}
+
+// A polyline projected to fixed-point pixels
+type projectedLine struct {
+	points []fixed.Point26_6
+	closed bool
+}
+
+// Function to project lines to pixels in parallel, in input order
+func projectLines(lines [][][]float64, closed func(line [][]float64) bool, toScreen func(lon, lat float64) (float64, float64)) []projectedLine {
+	projected := make([]projectedLine, len(lines))
+	chunks := chunkRanges(len(lines))
+	parallelEach(len(chunks), func(c int) {
+		for i := chunks[c][0]; i < chunks[c][1]; i++ {
+			points := make([]fixed.Point26_6, len(lines[i]))
+			for j, coord := range lines[i] {
+				points[j] = rasterx.ToFixedP(toScreen(coord[0], coord[1]))
+			}
+			projected[i] = projectedLine{points: points, closed: closed(lines[i])}
+		}
+	})
+	return projected
+}
+
+// Function to add projected lines to the adder as subpaths, in order
+func addProjected(adder rasterx.Adder, lines []projectedLine) {
+	for _, line := range lines {
+		for i, p := range line.points {
+			if i == 0 {
+				adder.Start(p)
+			} else {
+				adder.Line(p)
+			}
+		}
+		adder.Stop(line.closed)
+	}
+}
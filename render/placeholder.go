@@ -0,0 +1,116 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Placeholder draws the image shown in place of a map while the service is
+// unavailable or when a request fails: a title and message centered on the
+// map background, with the intensity colors along the bottom edge, at the
+// size of the map it stands in for so page layouts hold. Long messages are
+// wrapped over up to three lines.
+func Placeholder(width, height int, title, message string) ([]byte, error) {
+	multiplier := min(float64(width)/BASE_WIDTH, float64(height)/BASE_HEIGHT)
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), image.NewUniform(ParseHexColor("#18181b")), image.Point{}, draw.Src)
+
+	// One band per intensity, 1 to 7
+	band := max(2, int(8*multiplier))
+	for i := 0; i < 7; i++ {
+		x0, x1 := width*i/7, width*(i+1)/7
+		fill := image.NewUniform(ParseHexColor(IntensityColor(i + 1)))
+		draw.Draw(rgba, image.Rect(x0, height-band, x1, height), fill, image.Point{}, draw.Src)
+	}
+
+	titleFont, err := loadFont(500)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load font: %w", err)
+	}
+	bodyFont, err := loadFont(400)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load font: %w", err)
+	}
+	type line struct {
+		text string
+		font *truetype.Font
+		size float64
+		y    float64
+	}
+	lines := []line{{title, titleFont, 40, -12}}
+	// Long messages, such as error details, are wrapped to the width of the
+	// image and cut after three lines
+	bodyFace := truetype.NewFace(bodyFont, &truetype.Options{Size: 20 * multiplier, DPI: 72})
+	for i, text := range wrapText(bodyFace, message, fixed.I(width*9/10), 3) {
+		lines = append(lines, line{text, bodyFont, 20, 32 + 28*float64(i)})
+	}
+
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		size := line.size * multiplier
+		face := truetype.NewFace(line.font, &truetype.Options{Size: size, DPI: 72})
+		advance := font.MeasureString(face, line.text).Ceil()
+
+		c := freetype.NewContext()
+		c.SetDPI(72)
+		c.SetFont(line.font)
+		c.SetFontSize(size)
+		c.SetClip(rgba.Bounds())
+		c.SetDst(rgba)
+		c.SetSrc(image.NewUniform(color.RGBA{0xfa, 0xfa, 0xfa, 0xff}))
+		at := freetype.Pt((width-advance)/2, height/2+int(line.y*multiplier))
+		if _, err := c.DrawString(line.text, at); err != nil {
+			return nil, fmt.Errorf("failed to draw placeholder text: %w", err)
+		}
+	}
+	return EncodePNG(rgba)
+}
+
+// Function to break text into at most maxLines lines no wider than width,
+// at spaces, ending the last with an ellipsis when the text does not fit
+func wrapText(face font.Face, text string, width fixed.Int26_6, maxLines int) []string {
+	var lines []string
+	var current string
+	words := strings.Fields(text)
+	for i, word := range words {
+		next := word
+		if current != "" {
+			next = current + " " + word
+		}
+		if current == "" || font.MeasureString(face, next) <= width {
+			current = next
+			continue
+		}
+		if len(lines) == maxLines-1 {
+			return append(lines, ellipsize(face, strings.Join(append([]string{current}, words[i:]...), " "), width))
+		}
+		lines = append(lines, ellipsize(face, current, width))
+		current = word
+	}
+	if current != "" {
+		lines = append(lines, ellipsize(face, current, width))
+	}
+	return lines
+}
+
+// Function to cut text to the width, ending it with an ellipsis
+func ellipsize(face font.Face, text string, width fixed.Int26_6) string {
+	if font.MeasureString(face, text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && font.MeasureString(face, string(runes)+"…") > width {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimRight(string(runes), " ") + "…"
+}
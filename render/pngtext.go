@@ -0,0 +1,79 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// TextChunk is a keyword and its text, written into a PNG as metadata.
+// Keywords are 1-79 printable ASCII characters, such as the registered
+// "Software" or "Copyright".
+type TextChunk struct {
+	Keyword string
+	Text    string
+}
+
+// EmbedText writes text chunks into an encoded PNG, right after its header,
+// so readers find them before the image data. Text that is plain ASCII is
+// written as tEXt, and other text as uncompressed UTF-8 iTXt. Chunks with
+// empty text are left out.
+func EmbedText(data []byte, chunks []TextChunk) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a PNG")
+	}
+	// The header chunk comes first, with 13 bytes of data
+	headerEnd := len(pngSignature) + 8 + 13 + 4
+	if len(data) < headerEnd || string(data[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, fmt.Errorf("PNG has no header chunk")
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 512)
+	buf.Write(data[:headerEnd])
+	for _, chunk := range chunks {
+		if chunk.Text == "" {
+			continue
+		}
+		if err := validKeyword(chunk.Keyword); err != nil {
+			return nil, err
+		}
+		if isASCII(chunk.Text) {
+			writeChunk(&buf, "tEXt", []byte(chunk.Keyword+"\x00"+chunk.Text))
+			continue
+		}
+		// Keyword, compression flag and method, empty language tag and
+		// translated keyword, then the text
+		writeChunk(&buf, "iTXt", []byte(chunk.Keyword+"\x00\x00\x00\x00\x00"+chunk.Text))
+	}
+	buf.Write(data[headerEnd:])
+	return buf.Bytes(), nil
+}
+
+// Function to check a keyword against the rules of the PNG specification
+func validKeyword(keyword string) error {
+	if len(keyword) == 0 || len(keyword) > 79 {
+		return fmt.Errorf("invalid PNG keyword %q: must be 1 to 79 characters", keyword)
+	}
+	if keyword[0] == ' ' || keyword[len(keyword)-1] == ' ' || bytes.Contains([]byte(keyword), []byte("  ")) {
+		return fmt.Errorf("invalid PNG keyword %q: no leading, trailing or repeated spaces", keyword)
+	}
+	for _, c := range []byte(keyword) {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("invalid PNG keyword %q: must be printable ASCII", keyword)
+		}
+	}
+	return nil
+}
+
+// Function to tell whether text fits a tEXt chunk as is: ASCII without
+// control characters other than line feeds
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c > 0x7e || (c < 0x20 && c != '\n') {
+			return false
+		}
+	}
+	return true
+}
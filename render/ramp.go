@@ -0,0 +1,102 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Most stops in one color ramp
+const MAX_RAMP_STOPS = 16
+
+// Ramp maps numeric values to colors, for choropleth maps of quantities
+// other than intensity: rainfall, warning levels, evacuation orders.
+type Ramp struct {
+	Stops []RampStop
+	// Continuous interpolates between the stops. Otherwise each value takes
+	// the color of the highest stop at or below it, and values below the
+	// first stop are left unshaded.
+	Continuous bool
+}
+
+// RampStop is the color of a value in a ramp.
+type RampStop struct {
+	Value float64 `json:"value"`
+	Color string  `json:"color"`
+}
+
+// ParseRamp parses stops written as "value:color,value:color,...", with
+// colors as "#rrggbb" or "rrggbb", in ascending order of value.
+func ParseRamp(value string, continuous bool) (*Ramp, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) < 2 || len(parts) > MAX_RAMP_STOPS {
+		return nil, fmt.Errorf("%d stops (must be between 2 and %d)", len(parts), MAX_RAMP_STOPS)
+	}
+	ramp := &Ramp{Continuous: continuous}
+	for _, part := range parts {
+		v, c, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("stop %q is not value:color", part)
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("stop %q has no valid value", part)
+		}
+		c = "#" + strings.TrimPrefix(strings.ToLower(c), "#")
+		if len(c) != 7 {
+			return nil, fmt.Errorf("stop %q has no valid color (must be #rrggbb)", part)
+		}
+		if _, err := strconv.ParseUint(c[1:], 16, 32); err != nil {
+			return nil, fmt.Errorf("stop %q has no valid color (must be #rrggbb)", part)
+		}
+		ramp.Stops = append(ramp.Stops, RampStop{Value: n, Color: c})
+	}
+	if err := ramp.Validate(); err != nil {
+		return nil, err
+	}
+	return ramp, nil
+}
+
+// Validate checks that the ramp has between 2 and MAX_RAMP_STOPS stops in
+// strictly ascending order.
+func (r *Ramp) Validate() error {
+	if len(r.Stops) < 2 || len(r.Stops) > MAX_RAMP_STOPS {
+		return fmt.Errorf("%d stops (must be between 2 and %d)", len(r.Stops), MAX_RAMP_STOPS)
+	}
+	if !sort.SliceIsSorted(r.Stops, func(i, j int) bool { return r.Stops[i].Value < r.Stops[j].Value }) {
+		return fmt.Errorf("stops must be in ascending order of value")
+	}
+	for i := 1; i < len(r.Stops); i++ {
+		if r.Stops[i].Value == r.Stops[i-1].Value {
+			return fmt.Errorf("two stops have the value %g", r.Stops[i].Value)
+		}
+	}
+	return nil
+}
+
+// Color returns the color of a value as "#rrggbb", or "" when a stepped
+// ramp leaves it unshaded.
+func (r *Ramp) Color(v float64) string {
+	// The last stop at or below the value
+	i := sort.Search(len(r.Stops), func(i int) bool { return r.Stops[i].Value > v }) - 1
+	if !r.Continuous {
+		if i < 0 {
+			return ""
+		}
+		return r.Stops[i].Color
+	}
+	if i < 0 {
+		return r.Stops[0].Color
+	}
+	if i == len(r.Stops)-1 {
+		return r.Stops[i].Color
+	}
+
+	lower, upper := r.Stops[i], r.Stops[i+1]
+	t := (v - lower.Value) / (upper.Value - lower.Value)
+	a, b := ParseHexColor(lower.Color), ParseHexColor(upper.Color)
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5) }
+	return fmt.Sprintf("#%02x%02x%02x", mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B))
+}
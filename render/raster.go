@@ -0,0 +1,154 @@
+package render
+
+import (
+	"fmt"
+	"image"
+
+	"canvas/geo"
+
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+// Backend that fills the projected polygons straight onto the image,
+// skipping the SVG encode and re-parse of the svg backend
+type rasterDirectBackend struct{}
+
+func (b rasterDirectBackend) Render(scene *Scene) ([]byte, error) {
+	rgba, err := b.Draw(scene)
+	if err != nil {
+		return nil, err
+	}
+	defer scene.Timings.Start("encode")()
+	return EncodePNG(rgba)
+}
+
+func (b rasterDirectBackend) Draw(scene *Scene) (*image.RGBA, error) {
+	rgba, err := drawLayers(scene, func(dst *image.RGBA, layers []string) error {
+		return rasterLayers(dst, scene, layers, rasterx.NewScannerGV(scene.Width, scene.Height, dst, dst.Bounds()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rgba, finishDraw(rgba, scene, b)
+}
+
+// Function to draw some layers of the stack onto dst, in order, with the
+// scanner filling paths onto dst
+func rasterLayers(dst *image.RGBA, scene *Scene, layers []string, scanner rasterx.Scanner) error {
+	dasher := rasterx.NewDasher(scene.Width, scene.Height, scanner)
+
+	for _, layer := range layers {
+		done := scene.Timings.Start(layer)
+		var err error
+		switch layer {
+		case LayerFills:
+			err = rasterFills(dasher, scene)
+		case LayerHeatmap:
+			drawHeatmap(dst, scene)
+		case LayerBorders:
+			rasterBorders(dasher, scene)
+		case LayerHighlight:
+			rasterHighlight(dasher, scene)
+		case LayerPoints:
+			rasterPoints(dasher, scene)
+		case LayerOverlays:
+			rasterOverlays(dasher, scene)
+		case LayerMarkers:
+			rasterMarkers(dasher, scene)
+		case LayerLabels:
+			err = drawText(dst, scene)
+		}
+		done()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to fill the prefectures. ScannerGV composites the whole canvas on
+// every Draw, so features are filled in one pass per color.
+func rasterFills(dasher *rasterx.Dasher, scene *Scene) error {
+	var colors []string
+	byColor := make(map[string][][][]float64)
+	for _, feature := range scene.Features {
+		id, ok := feature.Properties["id"].(float64)
+		if !ok {
+			return fmt.Errorf("Invalid ID format in GeoJSON")
+		}
+		fill := scene.featureColor(int(id))
+		if fill == "" {
+			continue
+		}
+		if _, seen := byColor[fill]; !seen {
+			colors = append(colors, fill)
+		}
+		byColor[fill] = append(byColor[fill], geo.FeatureRings(feature)...)
+	}
+
+	for _, fill := range colors {
+		dasher.Clear()
+		filler := &dasher.Filler
+		AddRings(filler, byColor[fill], scene.ToScreen)
+		filler.SetColor(rasterx.ApplyOpacity(ParseHexColor(fill), *scene.Style.FillOpacity))
+		filler.Draw()
+	}
+	return nil
+}
+
+// Function to stroke the borders in one pass, in the style of the scene and
+// with the same defaults oksvg applies to the svg backend
+func rasterBorders(dasher *rasterx.Dasher, scene *Scene) {
+	dasher.Clear()
+	dasher.SetStroke(fixed.Int26_6(scene.Style.StrokeWidth*scene.Multiplier*64), 4*64, rasterx.ButtCap, rasterx.ButtCap, nil, rasterx.Bevel, nil, 0)
+	AddLines(dasher, scene.Borders, scene.ToScreen)
+	dasher.SetColor(ParseHexColor(scene.Style.Stroke))
+	dasher.Draw()
+}
+
+// Function to draw the markers, one intensity at a time: an outline square
+// in the background color, then the fill inset by the same half stroke as in
+// SVG
+func rasterPoints(dasher *rasterx.Dasher, scene *Scene) {
+	markers := pointMarkers(scene)
+	half := markerStrokeWidth(scene) / 2
+	for start := 0; start < len(markers); {
+		end := start
+		for end < len(markers) && markers[end].Scale == markers[start].Scale {
+			end++
+		}
+		for _, grow := range []float64{half, -half} {
+			dasher.Clear()
+			filler := &dasher.Filler
+			for _, m := range markers[start:end] {
+				m.addTo(filler, grow)
+			}
+			if grow > 0 {
+				filler.SetColor(ParseHexColor("#18181b"))
+			} else {
+				filler.SetColor(ParseHexColor(scene.intensityColor(markers[start].Scale)))
+			}
+			filler.Draw()
+		}
+		start = end
+	}
+}
+
+// AddRings adds every ring as a closed subpath, projected with toScreen. The
+// rings are projected on every core, so toScreen must be safe for concurrent
+// use.
+func AddRings(adder rasterx.Adder, rings [][][]float64, toScreen func(lon, lat float64) (float64, float64)) {
+	addProjected(adder, projectLines(rings, func([][]float64) bool { return true }, toScreen))
+}
+
+// AddLines adds every polyline as a subpath, projected with toScreen like
+// AddRings. Lines that end where they start are closed.
+func AddLines(adder rasterx.Adder, lines [][][]float64, toScreen func(lon, lat float64) (float64, float64)) {
+	addProjected(adder, projectLines(lines, isClosed, toScreen))
+}
+
+func isClosed(line [][]float64) bool {
+	first, last := line[0], line[len(line)-1]
+	return len(line) > 2 && first[0] == last[0] && first[1] == last[1]
+}
@@ -0,0 +1,78 @@
+package render
+
+import (
+	"embed"
+	"fmt"
+	"strings"
+	"sync"
+
+	"canvas/geo"
+)
+
+// Built-in reference overlays, drawn in the overlays layer beneath those of
+// the request
+const (
+	ReferencePlates = "plates" // Tectonic plate boundaries around Japan
+	ReferenceFaults = "faults" // Major active fault zones
+)
+
+var referenceNames = []string{ReferencePlates, ReferenceFaults}
+
+// Simplified traces, styled by their simplestyle properties like any
+// overlay. They illustrate event graphics and are not fit for hazard
+// assessment.
+//
+//go:embed reference/*.geojson
+var referenceFiles embed.FS
+
+// Reference overlays by name, parsed on first use
+var referenceOverlays = sync.OnceValue(func() map[string]*Overlay {
+	overlays := make(map[string]*Overlay, len(referenceNames))
+	for _, name := range referenceNames {
+		data, err := referenceFiles.ReadFile("reference/" + name + ".geojson")
+		if err != nil {
+			panic(err)
+		}
+		overlay, err := ParseOverlay(data, geo.WGS84)
+		if err != nil {
+			panic(fmt.Sprintf("invalid reference overlay %s: %v", name, err))
+		}
+		overlays[name] = overlay
+	}
+	return overlays
+})
+
+// ParseReference parses a comma-separated list of reference overlays, such
+// as "plates,faults", in the order they are drawn.
+func ParseReference(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if err := validateReference(name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Function to put the named reference overlays beneath the others
+func withReference(names []string, overlays []*Overlay) []*Overlay {
+	if len(names) == 0 {
+		return overlays
+	}
+	stack := make([]*Overlay, 0, len(names)+len(overlays))
+	for _, name := range names {
+		stack = append(stack, referenceOverlays()[name])
+	}
+	return append(stack, overlays...)
+}
+
+func validateReference(name string) error {
+	for _, known := range referenceNames {
+		if name == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reference overlay: %q (must be one of %s)", name, strings.Join(referenceNames, ", "))
+}
@@ -0,0 +1,636 @@
+// Package render draws seismic intensity maps of Japan as PNG images.
+//
+//	r, err := render.Open("japan.geojson")
+//	if err != nil {
+//		return err
+//	}
+//	opts := render.DefaultOptions()
+//	opts.ScaleMap = map[int]int{13: 4, 14: 3}
+//	png, err := r.Render(opts)
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"canvas/geo"
+	"canvas/i18n"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+const (
+	BASE_WIDTH  = 1280.0
+	BASE_HEIGHT = 720.0
+
+	// Limits for the requested resolution
+	MIN_DIMENSION = 64
+	MAX_DIMENSION = 5120
+	MAX_PIXELS    = 5120 * 2880
+
+	// Most decimals kept in path coordinates
+	MAX_PRECISION = 6
+
+	// Most observation points in one map, above the roughly 4,400 stations
+	// JMA reports from
+	MAX_POINTS = 10000
+)
+
+// Point is the intensity (0-7, or up to MaxScale of the scale type)
+// observed at a station.
+type Point struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Scale int     `json:"scale"`
+}
+
+// Options describes a single map render.
+type Options struct {
+	// ScaleMap is the intensity (0-7, or up to MaxScale of ScaleType) of
+	// each prefecture, by JIS code.
+	ScaleMap map[int]int
+	// ScaleType is the scale of ScaleMap and Points: ScaleJMA (when empty),
+	// ScaleMMI, whose intensities I to XII are 1 to 12, colored with the
+	// USGS palette instead of Palette and labeled in Roman numerals, or
+	// ScaleLPGM, long-period ground motion classes 1 to 4 in their own
+	// palette with a legend.
+	ScaleType string
+	// Points are drawn as markers over the prefectures, which are usually
+	// left unshaded when points are given.
+	Points     []Point
+	Width      int
+	Height     int
+	Multiplier float64 // Scales strokes and text relative to 1280x720
+	Margin     float64
+	MinSpan    float64
+	Extent     string
+	BBox       *geo.BBox // Overrides the automatic bounds when set
+	FooterText string
+	ShowScale  bool
+	Backend    string
+	// Lang is the language of the built-in strings, such as the default
+	// footer: i18n.English (when empty) or i18n.Japanese.
+	Lang string
+	// Title, when set, is written in a banner across the top of the canvas,
+	// above Subtitle, and the map is fit beneath it.
+	Title    string
+	Subtitle string
+	// Logo, when set, is composited over a corner of the map.
+	Logo *Logo
+	// Precision is the number of decimals (1-6) of the path coordinates in
+	// pixels. Zero picks it by zoom for raster output, and two decimals for
+	// SVG export.
+	Precision int
+	// Layers is the stack to draw, bottom first. Nil draws DefaultLayers.
+	Layers []Layer
+	// Density is DensityAuto (the default when empty) or DensityAll.
+	Density string
+	// Palette is the fill color of each intensity, 0 to 7, as "#rrggbb".
+	// Nil uses IntensityColor.
+	Palette []string
+	// Style is the color and width of the borders and the opacity of the
+	// fills, with DefaultStyle for the fields left empty.
+	Style Style
+	// Values is a quantity of each feature, by ID, such as rainfall or a
+	// warning level. When given, features are colored by Ramp instead of
+	// ScaleMap.
+	Values map[int]float64
+	Ramp   *Ramp
+	// Insets is InsetsAuto (the default when empty) or InsetsNone.
+	Insets string
+	// Projection is one of geo.Projections, geo.DefaultProjection when
+	// empty.
+	Projection string
+	// Simulate is one of Simulations, to show the map as seen with a color
+	// vision deficiency, or empty.
+	Simulate string
+	// Names is NamesRomaji, NamesKanji or NamesBoth to write the names of
+	// the features, or empty.
+	Names string
+	// Markers are drawn in the markers layer, which WithMarkers adds to the
+	// stack. They do not move the view.
+	Markers []Marker
+	// Overlays are GeoJSON layers drawn in order in the overlays layer,
+	// which WithOverlays adds to the stack. They do not move the view.
+	Overlays []*Overlay
+	// Reference names built-in overlays, such as ReferencePlates, drawn
+	// beneath Overlays in the overlays layer.
+	Reference []string
+	// Tile, when set, draws the map as a web map tile: the tile fills the
+	// square canvas in the Mercator projection, on a transparent background
+	// with the prefectures that have nothing to show left unfilled, and
+	// without banner, footer, legend, logo or insets. BBox, Projection,
+	// Margin and Insets are ignored.
+	Tile *geo.Tile
+	// Timings, when set, records the time spent in each stage of the render.
+	Timings *Timings `json:"-"`
+}
+
+// DefaultOptions returns the options of a 1280x720 map with no prefecture
+// shaded.
+func DefaultOptions() Options {
+	return Options{
+		ScaleMap:   make(map[int]int),
+		Width:      BASE_WIDTH,
+		Height:     BASE_HEIGHT,
+		Multiplier: 1.0,
+		Margin:     0.1, // Fraction of the canvas left empty on each side
+		MinSpan:    2.0, // Degrees, so a single small prefecture is not zoomed in too far
+	}
+}
+
+// Function to get the name of the projection, defaulting empty
+func (o *Options) projection() string {
+	if o.Projection == "" {
+		return geo.DefaultProjection
+	}
+	return o.Projection
+}
+
+// Validate checks the options against the limits the server enforces.
+func (o *Options) Validate() error {
+	scaleType, err := ParseScaleType(o.ScaleType)
+	if err != nil {
+		return err
+	}
+	for id, scale := range o.ScaleMap {
+		if scale < 0 || scale > MaxScale(scaleType) {
+			return fmt.Errorf("invalid scale value for ID %d: %d", id, scale)
+		}
+	}
+	if len(o.Points) > MAX_POINTS {
+		return fmt.Errorf("too many points: %d (at most %d)", len(o.Points), MAX_POINTS)
+	}
+	for _, p := range o.Points {
+		if p.Scale < 0 || p.Scale > MaxScale(scaleType) {
+			return fmt.Errorf("invalid scale value for point %g,%g: %d", p.Lat, p.Lon, p.Scale)
+		}
+		if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+			return fmt.Errorf("invalid point: %g,%g (out of range)", p.Lat, p.Lon)
+		}
+	}
+	if o.Width < MIN_DIMENSION || o.Width > MAX_DIMENSION || o.Height < MIN_DIMENSION || o.Height > MAX_DIMENSION {
+		return fmt.Errorf("invalid dimensions: %dx%d (each side must be between %d and %d)", o.Width, o.Height, MIN_DIMENSION, MAX_DIMENSION)
+	}
+	if o.Width*o.Height > MAX_PIXELS {
+		return fmt.Errorf("invalid dimensions: %dx%d (at most %d pixels)", o.Width, o.Height, MAX_PIXELS)
+	}
+	if o.Tile != nil {
+		if err := o.Tile.Validate(); err != nil {
+			return err
+		}
+		if o.Width != o.Height {
+			return fmt.Errorf("invalid tile dimensions: %dx%d (tiles are square)", o.Width, o.Height)
+		}
+	}
+	if o.Margin < 0 || o.Margin > 0.45 {
+		return fmt.Errorf("invalid margin: %g (must be between 0 and 0.45)", o.Margin)
+	}
+	if o.Extent != "" && o.Extent != "auto" && o.Extent != "japan" {
+		return fmt.Errorf("invalid extent: %s (must be auto or japan)", o.Extent)
+	}
+	if o.Precision < 0 || o.Precision > MAX_PRECISION {
+		return fmt.Errorf("invalid precision: %d (must be between 1 and %d, or 0 for automatic)", o.Precision, MAX_PRECISION)
+	}
+	if _, err := ParseDensity(o.Density); err != nil {
+		return err
+	}
+	if _, err := ParseInsets(o.Insets); err != nil {
+		return err
+	}
+	if _, err := geo.ParseProjection(o.Projection); err != nil {
+		return err
+	}
+	if _, err := ParseSimulation(o.Simulate); err != nil {
+		return err
+	}
+	if _, err := ParseNames(o.Names); err != nil {
+		return err
+	}
+	if _, err := i18n.Parse(o.Lang); err != nil {
+		return err
+	}
+	if len(o.Markers) > MAX_MARKERS {
+		return fmt.Errorf("too many markers: %d (at most %d)", len(o.Markers), MAX_MARKERS)
+	}
+	for _, m := range o.Markers {
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, name := range o.Reference {
+		if err := validateReference(name); err != nil {
+			return err
+		}
+	}
+	if len(o.Overlays) > MAX_OVERLAYS {
+		return fmt.Errorf("too many overlays: %d (at most %d)", len(o.Overlays), MAX_OVERLAYS)
+	}
+	vertices := 0
+	for _, overlay := range o.Overlays {
+		vertices += overlay.Vertices()
+	}
+	if vertices > MAX_OVERLAY_VERTICES {
+		return fmt.Errorf("too many overlay vertices: %d (at most %d)", vertices, MAX_OVERLAY_VERTICES)
+	}
+	if o.Layers != nil {
+		if err := validateLayers(o.Layers); err != nil {
+			return err
+		}
+	}
+	if o.Backend != "" {
+		if _, ok := Backends[o.Backend]; !ok {
+			return fmt.Errorf("unknown backend: %s", o.Backend)
+		}
+	}
+	if o.Palette != nil {
+		if err := ValidatePalette(o.Palette); err != nil {
+			return err
+		}
+	}
+	if err := ValidateBanner(o.Title, o.Subtitle); err != nil {
+		return err
+	}
+	if o.Logo != nil {
+		if err := o.Logo.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := o.Style.Validate(); err != nil {
+		return err
+	}
+	if o.Values != nil && o.Ramp == nil {
+		return fmt.Errorf("values require a ramp")
+	}
+	for id, v := range o.Values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("invalid value for ID %d: %g", id, v)
+		}
+	}
+	if o.Ramp != nil {
+		if err := o.Ramp.Validate(); err != nil {
+			return fmt.Errorf("invalid ramp: %w", err)
+		}
+	}
+	return nil
+}
+
+// Scene is a projected map, ready to be rasterized by a backend.
+type Scene struct {
+	Width      int
+	Height     int
+	Multiplier float64
+	Features   []*geojson.Feature
+	// Borders are the outlines of Features, each shared border once.
+	Borders    [][][]float64
+	ScaleMap   map[int]int
+	Points     []Point
+	ToScreen   func(lon, lat float64) (x, y float64)
+	FooterText string
+	ShowScale  bool
+	// Lang is the language of the built-in strings.
+	Lang string
+	// Title and Subtitle are written in a banner above the map.
+	Title    string
+	Subtitle string
+	// Logo is composited over a corner, at logoRect.
+	Logo *Logo
+	// PixelsPerDegree is the zoom of the projection.
+	PixelsPerDegree float64
+	// Precision is the requested number of decimals, zero for automatic.
+	Precision int
+	// Layers is the stack to draw, bottom first.
+	Layers []Layer
+	// Density decides which labels and markers are shown.
+	Density string
+	// Palette replaces IntensityColor when set.
+	Palette []string
+	// ScaleType is the scale of ScaleMap and Points.
+	ScaleType string
+	// Style is how the borders and fills are drawn, every field set.
+	Style Style
+	// Values, when Ramp is set, color the features instead of ScaleMap.
+	Values map[int]float64
+	Ramp   *Ramp
+	// Insets are remote islands drawn in boxes over the map.
+	Insets []InsetBox
+	// LabelPoint is where the value of a feature is written.
+	LabelPoint func(feature *geojson.Feature) (lon, lat float64)
+	// Simulate names the color vision simulation applied to the image.
+	Simulate string
+	// Names is how features are named, if they are.
+	Names string
+	// Markers are the pins and symbols over the map.
+	Markers []Marker
+	// Overlays are the GeoJSON layers over the map, the reference ones
+	// first.
+	Overlays []*Overlay
+	// Timings records the stages of drawing the scene, when set.
+	Timings *Timings
+	// Transparent leaves the background, and the features with nothing to
+	// show, unfilled, for maps laid over others such as tiles.
+	Transparent bool
+	// Annotate, when set, describes the path of each feature in SVG
+	// documents, by its ID and names, for interactive maps.
+	Annotate func(id int, name, nameJa string) SVGAnnotation
+
+	bare     bool // The scene of an inset or tile, drawn without banner, footer or legend
+	logoRect image.Rectangle
+	legend   *legend
+}
+
+// BuildScene fits the map to the canvas and builds the projection.
+func BuildScene(dataset *geo.Dataset, opts *Options) *Scene {
+	defer opts.Timings.Start("scene")()
+	fc := dataset.Full
+
+	// Calculate the valid area
+	boundsScale := opts.ScaleMap
+	if opts.Ramp != nil {
+		// Every feature with a value is framed, whatever its color
+		boundsScale = make(map[int]int, len(opts.Values))
+		for id := range opts.Values {
+			boundsScale[id] = 1
+		}
+	}
+	if opts.Extent == "japan" {
+		boundsScale = nil
+	}
+	bounds := geo.Bounds(fc, boundsScale)
+	var insets []Inset
+	if boundsScale != nil && opts.BBox == nil && opts.Tile == nil && opts.Insets != InsetsNone {
+		// Remote islands go in boxes of their own rather than zoom the map
+		// out to reach them
+		var rest geo.BBox
+		if insets, rest = splitInsets(fc, boundsScale, opts); len(insets) > 0 {
+			bounds = rest
+		}
+	}
+	if boundsScale != nil && len(insets) == 0 {
+		// Points with an intensity are framed like shaded prefectures
+		for _, p := range opts.Points {
+			if p.Scale > 0 {
+				bounds.MinLon, bounds.MaxLon = min(bounds.MinLon, p.Lon), max(bounds.MaxLon, p.Lon)
+				bounds.MinLat, bounds.MaxLat = min(bounds.MinLat, p.Lat), max(bounds.MaxLat, p.Lat)
+			}
+		}
+	}
+	if bounds.MinLon > bounds.MaxLon {
+		// Nothing is shaded, so fall back to the whole country
+		bounds = geo.Bounds(fc, nil)
+	}
+	bounds = bounds.Expand(opts.MinSpan)
+	if opts.BBox != nil {
+		bounds = *opts.BBox
+	}
+
+	// The map is fit beneath the banner
+	top := float64(opts.bannerHeight())
+	name, margin := opts.projection(), opts.Margin
+	if opts.Tile != nil {
+		// Tiles line up with those of web maps only when they fill the
+		// canvas exactly
+		bounds, name, margin, top = opts.Tile.Bounds(), "mercator", 0, 0
+	}
+	projection := geo.FitProjection(name, bounds, float64(opts.Width), float64(opts.Height)-top, margin).Shift(0, top)
+	layers := opts.Layers
+	if layers == nil {
+		layers = DefaultLayers
+	}
+
+	scene := &Scene{
+		Width:      opts.Width,
+		Height:     opts.Height,
+		Multiplier: opts.Multiplier,
+		Features:   dataset.FeaturesFor(projection.Scale),
+		Borders:    dataset.BordersFor(projection.Scale),
+		ScaleMap:   opts.ScaleMap,
+		Points:     opts.Points,
+		ToScreen:   projection.ToScreen,
+		FooterText: opts.FooterText,
+		ShowScale:  opts.ShowScale,
+		Lang:       opts.Lang,
+		Title:      opts.Title,
+		Subtitle:   opts.Subtitle,
+		Logo:       opts.Logo,
+		logoRect:   logoRect(opts.Logo, opts),
+
+		PixelsPerDegree: projection.Scale,
+		Precision:       opts.Precision,
+		Layers:          layers,
+		Density:         opts.Density,
+		Palette:         opts.Palette,
+		ScaleType:       opts.ScaleType,
+		Style:           opts.Style.Over(DefaultStyle),
+		Values:          opts.Values,
+		Ramp:            opts.Ramp,
+		LabelPoint:      dataset.LabelPoint,
+		Simulate:        opts.Simulate,
+		Names:           opts.Names,
+		Markers:         opts.Markers,
+		Overlays:        withReference(opts.Reference, opts.Overlays),
+		Timings:         opts.Timings,
+	}
+	if opts.Tile != nil {
+		scene.clipToTile(bounds)
+		return scene
+	}
+	// The logo and legend claim their corners before the insets
+	var taken []image.Rectangle
+	if opts.Logo != nil {
+		taken = append(taken, scene.logoRect)
+	}
+	if l := newLegend(opts); l != nil {
+		if l.Rect = bestCorner(dataset, projection, opts, l.size(opts.Multiplier), taken); !l.Rect.Empty() {
+			scene.legend = l
+			taken = append(taken, l.Rect)
+		}
+	}
+	if len(insets) > 0 {
+		scene.Insets = layoutInsets(dataset, insets, projection, opts, taken)
+	}
+	return scene
+}
+
+// Function to pick the fill color of an intensity from the palette of the
+// scene, or that of the MMI or LPGM scale
+func (scene *Scene) intensityColor(scale int) string {
+	switch scene.ScaleType {
+	case ScaleMMI:
+		return MMIColor(scale)
+	case ScaleLPGM:
+		return LPGMColor(scale)
+	}
+	if scene.Palette != nil && scale >= 0 && scale < len(scene.Palette) {
+		return scene.Palette[scale]
+	}
+	return IntensityColor(scale)
+}
+
+// Function to pick the fill color of a feature: from the ramp by its value
+// on choropleth maps, otherwise by its intensity. Features left without a
+// color are filled like intensity 0, or not at all on transparent scenes,
+// where the color is empty.
+func (scene *Scene) featureColor(id int) string {
+	if scene.Ramp == nil {
+		scale := scene.ScaleMap[id]
+		if scale == 0 && scene.Transparent {
+			return ""
+		}
+		return scene.intensityColor(scale)
+	}
+	if v, ok := scene.Values[id]; ok {
+		if fill := scene.Ramp.Color(v); fill != "" {
+			return fill
+		}
+	}
+	if scene.Transparent {
+		return ""
+	}
+	return scene.intensityColor(0)
+}
+
+// Function to pick the decimals of path coordinates. Rounding to a tenth of
+// a pixel is invisible on national maps, but zoomed-in regional maps keep
+// every vertex of the full geometry, and there the snapping shows as kinks
+// along the coast.
+func (scene *Scene) pathPrecision(fallback int) int {
+	switch {
+	case scene.Precision > 0:
+		return scene.Precision
+	case fallback > 1:
+		return fallback
+	case scene.PixelsPerDegree > 200 || scene.Multiplier >= 2:
+		return 2
+	}
+	return 1
+}
+
+// Backend turns a projected scene into a PNG.
+type Backend interface {
+	Render(scene *Scene) ([]byte, error)
+	// Draw rasterizes the scene without encoding it.
+	Draw(scene *Scene) (*image.RGBA, error)
+}
+
+// Backends are the registered rasterization backends, selectable by name.
+var Backends = map[string]Backend{
+	"svg":    svgBackend{},
+	"raster": rasterDirectBackend{},
+}
+
+// DefaultBackend draws maps whose options name no backend.
+const DefaultBackend = "svg"
+
+// Renderer draws maps in-process from one dataset. It is safe for concurrent
+// use.
+type Renderer struct {
+	dataset *geo.Dataset
+}
+
+// NewRenderer returns a renderer drawing the prefectures of dataset.
+func NewRenderer(dataset *geo.Dataset) *Renderer {
+	return &Renderer{dataset: dataset}
+}
+
+// Open loads a GeoJSON file of prefectures, with simplified geometries, and
+// returns a renderer for it.
+func Open(path string) (*Renderer, error) {
+	dataset, err := geo.Load(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return NewRenderer(dataset), nil
+}
+
+// Dataset returns the map data the renderer draws.
+func (r *Renderer) Dataset() *geo.Dataset {
+	return r.dataset
+}
+
+// Render validates the options and draws the map as a PNG. A zero
+// Multiplier is derived from the dimensions.
+func (r *Renderer) Render(opts Options) ([]byte, error) {
+	if opts.Multiplier == 0 {
+		opts.Multiplier = min(float64(opts.Width)/BASE_WIDTH, float64(opts.Height)/BASE_HEIGHT)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	backend := opts.Backend
+	if backend == "" {
+		backend = DefaultBackend
+	}
+	return Backends[backend].Render(BuildScene(r.dataset, &opts))
+}
+
+// IntensityColor returns the fill color of a seismic intensity.
+func IntensityColor(scale int) string {
+	switch scale {
+	case 0:
+		return "#27272a"
+	case 1:
+		return "#bae6fd"
+	case 2:
+		return "#4ade80"
+	case 3:
+		return "#facc15"
+	case 4:
+		return "#f97316"
+	case 5:
+		return "#dc2626"
+	case 6:
+		return "#86198f"
+	case 7:
+		return "#500724"
+	default:
+		if scale > 6 {
+			return "#4a044e"
+		}
+		if scale > 5 {
+			return "#b91c1c"
+		}
+		return "#27272a"
+	}
+}
+
+// ValidatePalette checks a palette of eight "#rrggbb" colors, one per
+// intensity from 0 to 7.
+func ValidatePalette(palette []string) error {
+	if len(palette) != 8 {
+		return fmt.Errorf("invalid palette: %d colors (must be 8, for intensities 0 to 7)", len(palette))
+	}
+	for i, c := range palette {
+		if len(c) != 7 || c[0] != '#' {
+			return fmt.Errorf("invalid palette color for intensity %d: %q (must be #rrggbb)", i, c)
+		}
+		if _, err := strconv.ParseUint(c[1:], 16, 32); err != nil {
+			return fmt.Errorf("invalid palette color for intensity %d: %q (must be #rrggbb)", i, c)
+		}
+	}
+	return nil
+}
+
+// ParseHexColor converts "#rrggbb" to a color, falling back to black.
+func ParseHexColor(hex string) color.NRGBA {
+	v, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil {
+		return color.NRGBA{A: 0xff}
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
+
+// EncodePNG encodes an image with the default compression.
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
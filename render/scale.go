@@ -0,0 +1,101 @@
+package render
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Intensity scales of ScaleMap and Points
+const (
+	ScaleJMA  = "jma"  // JMA seismic intensity, 0 to 7
+	ScaleMMI  = "mmi"  // Modified Mercalli intensity, I to XII as 1 to 12
+	ScaleLPGM = "lpgm" // JMA long-period ground motion class, 0 to 4
+)
+
+// ParseScaleType checks an intensity scale. Empty is ScaleJMA.
+func ParseScaleType(value string) (string, error) {
+	switch value {
+	case "":
+		return ScaleJMA, nil
+	case ScaleJMA, ScaleMMI, ScaleLPGM:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid scale_type: %s (must be jma, mmi or lpgm)", value)
+}
+
+// MaxScale is the highest intensity of a scale: 7 for JMA, 12 (XII) for
+// MMI and 4 for long-period ground motion classes. Zero is no intensity on
+// all of them, and left unshaded.
+func MaxScale(scaleType string) int {
+	switch scaleType {
+	case ScaleMMI:
+		return 12
+	case ScaleLPGM:
+		return 4
+	}
+	return 7
+}
+
+// Fill colors of the Modified Mercalli intensities, from 0 (none) to XII,
+// after the USGS ShakeMap palette
+var mmiColors = [13]string{
+	"#27272a",
+	"#ffffff", // I
+	"#bfccff", // II
+	"#a0e6ff", // III
+	"#80ffff", // IV
+	"#7aff93", // V
+	"#ffff00", // VI
+	"#ffc800", // VII
+	"#ff9100", // VIII
+	"#ff0000", // IX
+	"#c80000", // X
+	"#a00000", // XI
+	"#800000", // XII
+}
+
+// MMIColor returns the fill color of a Modified Mercalli intensity, 0 to 12.
+func MMIColor(scale int) string {
+	if scale < 0 || scale >= len(mmiColors) {
+		return mmiColors[0]
+	}
+	return mmiColors[scale]
+}
+
+// Fill colors of the long-period ground motion classes, from 0 (none) to 4,
+// after those of the JMA observation maps
+var lpgmColors = [5]string{
+	"#27272a",
+	"#7dd3fc", // 1: felt by most people indoors
+	"#facc15", // 2: hard to walk without holding on
+	"#ef4444", // 3: hard to stay standing
+	"#9333ea", // 4: cannot stand, must crawl
+}
+
+// LPGMColor returns the fill color of a long-period ground motion class, 0
+// to 4.
+func LPGMColor(class int) string {
+	if class < 0 || class >= len(lpgmColors) {
+		return lpgmColors[0]
+	}
+	return lpgmColors[class]
+}
+
+// RomanNumeral writes an intensity from 1 to 12 in Roman numerals, as MMI
+// intensities are, and others in digits.
+func RomanNumeral(n int) string {
+	numerals := [...]string{"", "I", "II", "III", "IV", "V", "VI", "VII", "VIII", "IX", "X", "XI", "XII"}
+	if n < 1 || n >= len(numerals) {
+		return strconv.Itoa(n)
+	}
+	return numerals[n]
+}
+
+// Function to write an intensity as it is labeled on the map: in digits on
+// the JMA scale and in Roman numerals on the MMI scale
+func (scene *Scene) scaleLabel(scale int) string {
+	if scene.ScaleType == ScaleMMI {
+		return RomanNumeral(scale)
+	}
+	return strconv.Itoa(scale)
+}
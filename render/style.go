@@ -0,0 +1,64 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Widest prefecture border, in pixels at 1280x720
+const MAX_STROKE_WIDTH = 10.0
+
+// Style is how the prefectures are drawn: the color and width of their
+// borders and the opacity of their fills. Fields left empty take their value
+// from DefaultStyle.
+type Style struct {
+	Stroke      string   `json:"stroke,omitempty"`       // "#rrggbb"
+	StrokeWidth float64  `json:"stroke_width,omitempty"` // Pixels at 1280x720, scaled by Multiplier
+	FillOpacity *float64 `json:"fill_opacity,omitempty"` // 0 to 1
+}
+
+// DefaultStyle is the gray hairline borders and translucent fills of the
+// maps when no style is given.
+var DefaultStyle = Style{Stroke: "#a1a1aa", StrokeWidth: 0.4, FillOpacity: ptr(0.8)}
+
+// Function to get a pointer to a value, for the optional fields of Style
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Validate checks the border color, a border width of at most
+// MAX_STROKE_WIDTH, and a fill opacity from 0 to 1. The layers of the map
+// leave the borders out, not a zero width.
+func (s Style) Validate() error {
+	if s.Stroke != "" {
+		if len(s.Stroke) != 7 || s.Stroke[0] != '#' {
+			return fmt.Errorf("invalid stroke: %q (must be #rrggbb)", s.Stroke)
+		}
+		if _, err := strconv.ParseUint(s.Stroke[1:], 16, 32); err != nil {
+			return fmt.Errorf("invalid stroke: %q (must be #rrggbb)", s.Stroke)
+		}
+	}
+	if math.IsNaN(s.StrokeWidth) || s.StrokeWidth < 0 || s.StrokeWidth > MAX_STROKE_WIDTH {
+		return fmt.Errorf("invalid stroke_width: %g (must be greater than 0 and at most %g)", s.StrokeWidth, MAX_STROKE_WIDTH)
+	}
+	if s.FillOpacity != nil && !(*s.FillOpacity >= 0 && *s.FillOpacity <= 1) {
+		return fmt.Errorf("invalid fill_opacity: %g (must be between 0 and 1)", *s.FillOpacity)
+	}
+	return nil
+}
+
+// Over fills the fields left empty in s from base, such as the style of a
+// named map under the style of a request.
+func (s Style) Over(base Style) Style {
+	if s.Stroke == "" {
+		s.Stroke = base.Stroke
+	}
+	if s.StrokeWidth == 0 {
+		s.StrokeWidth = base.StrokeWidth
+	}
+	if s.FillOpacity == nil {
+		s.FillOpacity = base.FillOpacity
+	}
+	return s
+}
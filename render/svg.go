@@ -0,0 +1,437 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"math"
+	"strconv"
+
+	"canvas/geo"
+
+	svg "github.com/ajstarks/svgo"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// Backend that draws the map as SVG and rasterizes it with oksvg
+type svgBackend struct{}
+
+func (b svgBackend) Render(scene *Scene) ([]byte, error) {
+	rgba, err := b.Draw(scene)
+	if err != nil {
+		return nil, err
+	}
+	defer scene.Timings.Start("encode")()
+	return EncodePNG(rgba)
+}
+
+func (b svgBackend) Draw(scene *Scene) (*image.RGBA, error) {
+	precision := scene.pathPrecision(1)
+	rgba, err := drawLayers(scene, func(dst *image.RGBA, layers []string) error {
+		// Text and the heatmap are drawn as pixels, so the vector layers
+		// around them are rasterized in batches
+		var batch []Layer
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			svgData, err := writeSVG(scene, precision, batch, false)
+			if err != nil {
+				return err
+			}
+			batch = batch[:0]
+			done := scene.Timings.Start("rasterize")
+			defer done()
+			if err := rasterizeSVG(svgData, dst); err != nil {
+				return fmt.Errorf("Failed to convert svg to png: %v", err)
+			}
+			return nil
+		}
+		for _, layer := range layers {
+			if layer != LayerLabels && layer != LayerHeatmap {
+				batch = append(batch, Layer{Name: layer})
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			done := scene.Timings.Start(layer)
+			if layer == LayerHeatmap {
+				drawHeatmap(dst, scene)
+			} else if err := drawText(dst, scene); err != nil {
+				return err
+			}
+			done()
+		}
+		return flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rgba, finishDraw(rgba, scene, b)
+}
+
+// SVGAnnotation describes the path of a feature in an SVG document: Title is
+// shown as its tooltip, Href, when set, makes it a link, and Data are data-*
+// attributes, by name without the prefix, for scripts and style sheets.
+type SVGAnnotation struct {
+	Title string
+	Href  string
+	Data  [][2]string
+}
+
+// SVG draws the scene as a standalone SVG document, with the scale values
+// and footer as text. Coordinates default to two decimals, since vector
+// output is often scaled up after export. Blend modes are kept as CSS
+// mix-blend-mode on the layer groups.
+func SVG(scene *Scene) ([]byte, error) {
+	return writeSVG(scene, scene.pathPrecision(2), scene.Layers, true)
+}
+
+// InlineSVG draws the scene like SVG, as an svg element to inline in an HTML
+// page: without the XML prolog, and with a viewBox so that it can be scaled
+// by CSS. attrs are added to the element, such as `role="img"`.
+func InlineSVG(scene *Scene, attrs ...string) ([]byte, error) {
+	data, err := SVG(scene)
+	if err != nil {
+		return nil, err
+	}
+	data = data[bytes.Index(data, []byte("<svg"))+len("<svg"):]
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg viewBox="0 0 %d %d"`, scene.Width, scene.Height)
+	for _, attr := range attrs {
+		buf.WriteString(" " + attr)
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// Function to write layers as SVG, with coordinates rounded to the given
+// number of decimals. A standalone document also gets the background, the
+// text, a group per layer and the insets, each a nested svg element that
+// clips it to its box.
+func writeSVG(scene *Scene, precision int, layers []Layer, standalone bool) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	canvas := svg.New(buf)
+	canvas.Start(scene.Width, scene.Height)
+	simulate := standalone && scene.Simulate != ""
+	if simulate {
+		// The whole drawing, insets included, goes through the filter
+		fmt.Fprint(canvas.Writer, svgVisionFilter(scene.Simulate))
+		fmt.Fprintf(canvas.Writer, "<g filter=\"url(#simulate-%s)\">\n", scene.Simulate)
+	}
+	if err := writeSVGLayers(canvas, scene, precision, layers, standalone, ""); err != nil {
+		return nil, err
+	}
+	if standalone {
+		for _, box := range scene.Insets {
+			r := box.Rect
+			fmt.Fprintf(canvas.Writer, "<svg id=\"inset-%s\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\">\n", box.Name, r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+			if err := writeSVGLayers(canvas, scene.insetScene(box), precision, layers, true, box.Name+"-"); err != nil {
+				return nil, err
+			}
+			fmt.Fprintln(canvas.Writer, "</svg>")
+			// The frame is stroked inside the box, as on raster output
+			stroke := float64(insetFrameWidth(scene))
+			fmt.Fprintf(canvas.Writer, "<rect x=\"%g\" y=\"%g\" width=\"%g\" height=\"%g\" style=\"fill:none;stroke:%s;stroke-width:%g\" />\n",
+				float64(r.Min.X)+stroke/2, float64(r.Min.Y)+stroke/2, float64(r.Dx())-stroke, float64(r.Dy())-stroke, insetFrameColor, stroke)
+		}
+	}
+	if simulate {
+		fmt.Fprintln(canvas.Writer, "</g>")
+	}
+	canvas.End()
+	return buf.Bytes(), nil
+}
+
+// Function to write the layers of a scene onto the SVG canvas. Group IDs of
+// a standalone document get the prefix, so those of insets do not clash.
+func writeSVGLayers(canvas *svg.SVG, scene *Scene, precision int, layers []Layer, standalone bool, prefix string) error {
+	if standalone && !scene.Transparent {
+		canvas.Rect(0, 0, scene.Width, scene.Height, "fill:#18181b")
+	}
+
+	var path []byte
+	for _, layer := range layers {
+		if standalone {
+			attrs := []string{fmt.Sprintf(`id="%s%s"`, prefix, layer.Name)}
+			if blend := layer.blend(); blend != BlendNormal {
+				attrs = append(attrs, fmt.Sprintf(`style="mix-blend-mode:%s"`, blend))
+			}
+			canvas.Group(attrs...)
+		}
+		done := scene.Timings.Start(layer.Name)
+		var err error
+		switch layer.Name {
+		case LayerFills:
+			path, err = svgFills(canvas, scene, precision, path, standalone)
+		case LayerHeatmap:
+			if standalone {
+				err = svgHeatmap(canvas, scene)
+			}
+		case LayerBorders:
+			path = svgBorders(canvas, scene, precision, path)
+		case LayerHighlight:
+			path = svgHighlight(canvas, scene, precision, path)
+		case LayerPoints:
+			path = svgPoints(canvas, scene, precision, path)
+		case LayerOverlays:
+			path = svgOverlays(canvas, scene, precision, path)
+		case LayerMarkers:
+			path = svgMarkers(canvas, scene, precision, path)
+		case LayerLabels:
+			if standalone {
+				err = svgText(canvas, scene)
+			}
+		}
+		done()
+		if err != nil {
+			return err
+		}
+		if standalone {
+			canvas.Gend()
+		}
+	}
+	return nil
+}
+
+// Function to write a path per prefecture, filled by intensity or value. The
+// path data is built on every core, then written in order. In a standalone
+// document, paths carry the annotation of their feature, if any.
+func svgFills(canvas *svg.SVG, scene *Scene, precision int, path []byte, standalone bool) ([]byte, error) {
+	for _, feature := range scene.Features {
+		if _, ok := feature.Properties["id"].(float64); !ok {
+			return path, fmt.Errorf("Invalid ID format in GeoJSON")
+		}
+	}
+
+	// Prefectures entirely off the canvas are left out, which keeps exports
+	// of regional maps small
+	paths := make([]string, len(scene.Features))
+	parallelEach(len(scene.Features), func(i int) {
+		var path []byte
+		var visible bool
+		for _, ring := range geo.FeatureRings(scene.Features[i]) {
+			var onCanvas bool
+			path, onCanvas = appendSVGPath(path, ring, true, scene, precision, 0)
+			visible = visible || onCanvas
+		}
+		if visible {
+			paths[i] = string(path)
+		}
+	})
+
+	for i, feature := range scene.Features {
+		if paths[i] == "" {
+			continue
+		}
+		fillColor := scene.featureColor(int(feature.Properties["id"].(float64)))
+		if fillColor == "" {
+			continue
+		}
+		// Holes are also oriented against their exterior, so the nonzero
+		// rasterizer and any even-odd consumer of the SVG agree
+		style := fmt.Sprintf("fill:%s;fill-rule:evenodd;fill-opacity:%g", fillColor, *scene.Style.FillOpacity)
+		if !standalone || scene.Annotate == nil {
+			canvas.Path(paths[i], style)
+			continue
+		}
+		romaji, kanji := geo.FeatureNames(feature)
+		writeAnnotatedPath(canvas.Writer, paths[i], style, scene.Annotate(int(feature.Properties["id"].(float64)), romaji, kanji))
+	}
+	return path, nil
+}
+
+// Function to write a path with the tooltip, link and data attributes of its
+// annotation
+func writeAnnotatedPath(w io.Writer, d, style string, a SVGAnnotation) {
+	if a.Href != "" {
+		fmt.Fprintf(w, `<a href="%s">`, html.EscapeString(a.Href))
+	}
+	fmt.Fprintf(w, `<path d="%s" style="%s"`, d, style)
+	for _, attr := range a.Data {
+		fmt.Fprintf(w, ` data-%s="%s"`, attr[0], html.EscapeString(attr[1]))
+	}
+	if a.Title != "" {
+		fmt.Fprintf(w, "><title>%s</title></path>", html.EscapeString(a.Title))
+	} else {
+		fmt.Fprint(w, " />")
+	}
+	if a.Href != "" {
+		fmt.Fprint(w, "</a>")
+	}
+	fmt.Fprintln(w)
+}
+
+// Function to write the borders as one stroked path. Each border is in it
+// once, so a border between two prefectures is as heavy as the coastline.
+func svgBorders(canvas *svg.SVG, scene *Scene, precision int, path []byte) []byte {
+	strokeWidth := scene.Style.StrokeWidth * scene.Multiplier
+
+	// Each chunk of borders is built on its own core, then joined in order
+	chunks := chunkRanges(len(scene.Borders))
+	parts := make([][]byte, len(chunks))
+	parallelEach(len(chunks), func(c int) {
+		var part []byte
+		for _, line := range scene.Borders[chunks[c][0]:chunks[c][1]] {
+			var onCanvas bool
+			n := len(part)
+			part, onCanvas = appendSVGPath(part, line, isClosed(line), scene, precision, strokeWidth)
+			if !onCanvas {
+				part = part[:n]
+			}
+		}
+		parts[c] = part
+	})
+	path = path[:0]
+	for _, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		if len(path) > 0 {
+			path = append(path, ' ')
+		}
+		path = append(path, part...)
+	}
+	if len(path) > 0 {
+		canvas.Path(string(path), fmt.Sprintf("fill:none;stroke:%s;stroke-width:%g", scene.Style.Stroke, strokeWidth))
+	}
+	return path
+}
+
+// Function to write a square per station marker. There can be thousands, so
+// the style of each intensity is formatted once.
+func svgPoints(canvas *svg.SVG, scene *Scene, precision int, path []byte) []byte {
+	var styles [8]string
+	for _, m := range pointMarkers(scene) {
+		half := m.Size / 2
+		path = path[:0]
+		path = append(path, 'M')
+		path = appendCoord(path, m.X-half, precision)
+		path = append(path, ' ')
+		path = appendCoord(path, m.Y-half, precision)
+		path = append(path, " h"...)
+		path = appendCoord(path, m.Size, precision)
+		path = append(path, " v"...)
+		path = appendCoord(path, m.Size, precision)
+		path = append(path, " h"...)
+		path = appendCoord(path, -m.Size, precision)
+		path = append(path, " Z"...)
+		if styles[m.Scale] == "" {
+			styles[m.Scale] = fmt.Sprintf("fill:%s;stroke:#18181b;stroke-width:%.1f", scene.intensityColor(m.Scale), markerStrokeWidth(scene))
+		}
+		canvas.Path(string(path), styles[m.Scale])
+	}
+	return path
+}
+
+// Function to write the labels, banner and footer as text elements, and the
+// logo
+func svgText(canvas *svg.SVG, scene *Scene) error {
+	textStyle := func(size float64) string {
+		return fmt.Sprintf("fill:#fafafa;font-family:Roboto,sans-serif;font-size:%.1fpx", size)
+	}
+	for _, label := range scene.labels() {
+		// The halo is a stroke painted under the fill
+		style := fmt.Sprintf("%s;stroke:%s;stroke-width:%.1f;stroke-linejoin:round;paint-order:stroke", textStyle(label.Size), labelHaloColor, 2*labelHaloWidth*scene.Multiplier)
+		canvas.Text(label.X, label.Y, label.Text, style)
+	}
+	if scene.bare {
+		return nil
+	}
+	svgBanner(canvas, scene)
+	if scene.showFooter() {
+		x, y := footerPosition(scene)
+		canvas.Text(x, y, scene.footerText(), textStyle(scene.labelFontSize()))
+	}
+	svgLegend(canvas, scene)
+	return svgLogo(canvas, scene)
+}
+
+// Function to append a ring or line to SVG path data, and report whether any
+// of it, widened by pad, falls on the canvas
+func appendSVGPath(path []byte, coords [][]float64, closed bool, scene *Scene, precision int, pad float64) ([]byte, bool) {
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	if len(path) > 0 {
+		path = append(path, ' ')
+	}
+	for i, coord := range coords {
+		x, y := scene.ToScreen(coord[0], coord[1])
+		minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+		if i == 0 {
+			path = append(path, 'M')
+		} else {
+			path = append(path, " L"...)
+		}
+		path = appendCoord(path, x, precision)
+		path = append(path, ' ')
+		path = appendCoord(path, y, precision)
+	}
+	if closed {
+		path = append(path, " Z"...)
+	}
+	onCanvas := maxX >= -pad && maxY >= -pad && minX <= float64(scene.Width)+pad && minY <= float64(scene.Height)+pad
+	return path, onCanvas
+}
+
+// Powers of ten up to MAX_PRECISION
+var (
+	pow10      = [MAX_PRECISION + 1]float64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6}
+	pow10Int64 = [MAX_PRECISION + 1]int64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6}
+)
+
+// Function to append a pixel coordinate with the given number of decimals.
+// Path building spends most of its time formatting coordinates, and
+// rounding to an integer count of the last decimal takes a third less time
+// than strconv.AppendFloat with 'f', which works out the exact decimal value
+// of the float. The two agree except on halves, which are rounded away from
+// zero here even when the float is a hair below the half, and on negative
+// values that round to zero, written without the sign. Values too large
+// for the integer fall back to strconv.
+func appendCoord(dst []byte, v float64, precision int) []byte {
+	scaled := math.Round(v * pow10[precision])
+	if !(math.Abs(scaled) < 1e15) {
+		return strconv.AppendFloat(dst, v, 'f', precision, 64)
+	}
+	n := int64(scaled)
+	if n < 0 {
+		dst = append(dst, '-')
+		n = -n
+	}
+	dst = strconv.AppendInt(dst, n/pow10Int64[precision], 10)
+	if precision == 0 {
+		return dst
+	}
+	var frac [MAX_PRECISION]byte
+	rest := n % pow10Int64[precision]
+	for i := precision - 1; i >= 0; i-- {
+		frac[i] = byte('0' + rest%10)
+		rest /= 10
+	}
+	dst = append(dst, '.')
+	return append(dst, frac[:precision]...)
+}
+
+// Function to rasterize SVG data onto an image
+func rasterizeSVG(svgData []byte, dst *image.RGBA) error {
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+
+	// Loading SVG data
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(svgData))
+	if err != nil {
+		return fmt.Errorf("failed to read icon stream: %w", err)
+	}
+
+	// Drawing Area Settings
+	icon.SetTarget(0, 0, float64(width), float64(height))
+
+	scanner := rasterx.NewScannerGV(width, height, dst, dst.Bounds())
+	raster := rasterx.NewDasher(width, height, scanner)
+
+	// SVG rendering
+	icon.Draw(raster, 1.0)
+	return nil
+}
@@ -0,0 +1,80 @@
+package render
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestAppendCoord(t *testing.T) {
+	tests := []struct {
+		v         float64
+		precision int
+		want      string
+	}{
+		{0, 0, "0"},
+		{0, 2, "0.00"},
+		{1, 2, "1.00"},
+		{-1, 2, "-1.00"},
+		{123.456, 0, "123"},
+		{123.456, 1, "123.5"},
+		{123.456, 2, "123.46"},
+		{123.456, 3, "123.456"},
+		{123.456, 6, "123.456000"},
+		{-123.456, 2, "-123.46"},
+		{0.05, 2, "0.05"},
+		{0.001, 2, "0.00"},
+		{0.001, 3, "0.001"},
+		{-0.5, 2, "-0.50"},
+		{-0.05, 1, "-0.1"},
+		// Carries into the integer part
+		{9.999, 2, "10.00"},
+		{-9.999, 2, "-10.00"},
+		{0.9999999, 6, "1.000000"},
+		// Exact halves round away from zero
+		{0.5, 0, "1"},
+		{1.5, 0, "2"},
+		{2.5, 0, "3"},
+		{-2.5, 0, "-3"},
+		{0.125, 2, "0.13"},
+		{-0.125, 2, "-0.13"},
+		// and so do decimal halves the float falls a hair short of
+		{139.767125, 5, "139.76713"},
+		// Negative values that round to zero lose their sign
+		{-0.001, 2, "0.00"},
+		{-0.4, 0, "0"},
+		{math.Copysign(0, -1), 1, "0.0"},
+		// Values too large for the integer fall back to strconv
+		{1e15, 0, "1000000000000000"},
+		{1e20, 2, "100000000000000000000.00"},
+		{-1e20, 1, "-100000000000000000000.0"},
+		{123456789.123456, 6, "123456789.123456"},
+	}
+	for _, tt := range tests {
+		if got := string(appendCoord(nil, tt.v, tt.precision)); got != tt.want {
+			t.Errorf("appendCoord(%v, %d) = %q; want %q", tt.v, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestAppendCoordMatchesStrconv(t *testing.T) {
+	// Away from halves and from zero, the output is that of strconv
+	for precision := 0; precision <= MAX_PRECISION; precision++ {
+		for _, v := range []float64{0.3, 1.7, -1.7, 12.34567891, -98.7654321, 1279.99, 719.01, 35.681236, 139.767127, -4096.123} {
+			want := strconv.AppendFloat(nil, v, 'f', precision, 64)
+			if got := appendCoord(nil, v, precision); string(got) != string(want) {
+				t.Errorf("appendCoord(%v, %d) = %q; want %q", v, precision, got, want)
+			}
+		}
+	}
+}
+
+func TestAppendCoordAppends(t *testing.T) {
+	dst := []byte("M")
+	dst = appendCoord(dst, 1.25, 1)
+	dst = append(dst, ',')
+	dst = appendCoord(dst, -3, 0)
+	if string(dst) != "M1.3,-3" {
+		t.Errorf("appendCoord appended %q; want %q", dst, "M1.3,-3")
+	}
+}
@@ -0,0 +1,233 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"canvas/i18n"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/math/fixed"
+)
+
+func loadFont(weight int) (*truetype.Font, error) {
+	var fontPath string
+	switch weight {
+	case 400:
+		fontPath = "./fonts/roboto-regular.ttf"
+	case 500:
+		fontPath = "./fonts/roboto-medium.ttf"
+	default:
+		fontPath = "./fonts/roboto-regular.ttf" // default to regular
+	}
+
+	fontBytes, err := os.ReadFile(fontPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := freetype.ParseFont(fontBytes)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// A text placed on the canvas, at the start of its baseline. Labels of
+// higher priority keep their place when they would overlap.
+type textLabel struct {
+	X, Y int
+	Text string
+	// Size is the font size in pixels.
+	Size     float64
+	Priority int
+	// Fallback is drawn instead of Text when no font has its glyphs.
+	Fallback string
+}
+
+// Function to place the scale value of each shaded prefecture at its pole of
+// inaccessibility, or its value on choropleth maps
+func scaleLabels(scene *Scene, grid *densityGrid) []textLabel {
+	if !scene.ShowScale {
+		return nil
+	}
+	// Values outrank each other by size, like intensities
+	var rank map[float64]int
+	if scene.Ramp != nil {
+		values := make([]float64, 0, len(scene.Values))
+		for _, v := range scene.Values {
+			values = append(values, v)
+		}
+		sort.Float64s(values)
+		rank = make(map[float64]int, len(values))
+		for i, v := range values {
+			rank[v] = i
+		}
+	}
+
+	var labels []textLabel
+	var items []densityItem
+	for _, feature := range scene.Features {
+		id := int(feature.Properties["id"].(float64))
+		var text string
+		var priority int
+		if scene.Ramp != nil {
+			v, exists := scene.Values[id]
+			if !exists {
+				continue
+			}
+			text, priority = strconv.FormatFloat(v, 'f', -1, 64), rank[v]
+		} else {
+			scale, exists := scene.ScaleMap[id]
+			if !exists || scale == 0 {
+				continue
+			}
+			text, priority = scene.scaleLabel(scale), scale
+		}
+
+		// Inside the largest polygon, however concave
+		lon, lat := scene.LabelPoint(feature)
+
+		// Converted to screen coordinates
+		x, y := scene.ToScreen(lon, lat)
+		labels = append(labels, centeredLabel(x, y, text, scene.labelFontSize(), priority))
+		items = append(items, densityItem{X: x, Y: y, Priority: priority})
+	}
+
+	kept := labels[:0]
+	for _, i := range scene.thin(prefectureLabels, grid, items) {
+		kept = append(kept, labels[i])
+	}
+	return kept
+}
+
+// Function to get the offsets a label is drawn at in the halo color, around
+// a circle as wide as the halo. Raster text has no stroke, so the halo is
+// the text drawn again around it.
+func haloOffsets(scene *Scene) []fixed.Point26_6 {
+	radius := labelHaloWidth * scene.Multiplier
+	steps := max(8, int(math.Ceil(2*math.Pi*radius)))
+	offsets := make([]fixed.Point26_6, steps)
+	for i := range offsets {
+		angle := 2 * math.Pi * float64(i) / float64(steps)
+		offsets[i] = fixed.Point26_6{
+			X: fixed.Int26_6(math.Round(radius * math.Cos(angle) * 64)),
+			Y: fixed.Int26_6(math.Round(radius * math.Sin(angle) * 64)),
+		}
+	}
+	return offsets
+}
+
+func footerPosition(scene *Scene) (int, int) {
+	return int(10 * scene.Multiplier), scene.Height - int(14*scene.Multiplier)
+}
+
+// Function to tell whether the footer is written, which a logo can replace
+func (scene *Scene) showFooter() bool {
+	return !scene.bare && (scene.Logo == nil || !scene.Logo.ReplaceFooter)
+}
+
+func (scene *Scene) footerText() string {
+	if scene.FooterText == "" {
+		return i18n.T(scene.Lang, "footer.default")
+	}
+	return scene.FooterText
+}
+
+// Function to lay out the footer as a label, falling back to the English
+// default when the localized one has no font to draw it
+func (scene *Scene) footerLabel() textLabel {
+	x, y := footerPosition(scene)
+	label := textLabel{X: x, Y: y, Text: scene.footerText(), Size: labelFontSize * scene.Multiplier}
+	if scene.FooterText == "" {
+		label.Fallback = i18n.T(i18n.English, "footer.default")
+	}
+	return label
+}
+
+// Function to draw the labels and the footer on top of the map
+func drawText(rgba *image.RGBA, scene *Scene) error {
+	// Load the font
+	f, err := loadFont(400)
+	if err != nil {
+		return fmt.Errorf("failed to load font: %w", err)
+	}
+
+	// Context for scale value text drawing
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(f)
+	c.SetFontSize(labelFontSize * scene.Multiplier)
+	c.SetClip(rgba.Bounds())
+	c.SetDst(rgba)
+
+	labels := scene.labels()
+	var footer []textLabel
+	if scene.showFooter() {
+		footer = append(footer, scene.footerLabel())
+	}
+	var cjk *truetype.Font
+	for _, label := range append(footer, labels...) {
+		if hasCJK(label.Text) {
+			if cjk, err = loadCJKFont(); err != nil {
+				return fmt.Errorf("failed to load CJK font: %w", err)
+			}
+			break
+		}
+	}
+	// Function to draw a label at the offsets in the font that has its
+	// glyphs, or its fallback
+	drawLabel := func(label textLabel, offsets []fixed.Point26_6) error {
+		text, font := label.Text, f
+		if hasCJK(text) {
+			if cjk != nil {
+				font = cjk
+			} else if label.Fallback != "" {
+				text = label.Fallback
+			}
+		}
+		c.SetFont(font)
+		c.SetFontSize(label.Size)
+		for _, offset := range offsets {
+			if _, err := c.DrawString(text, freetype.Pt(label.X, label.Y).Add(offset)); err != nil {
+				return fmt.Errorf("failed to draw label: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Halos first, so no label is drawn over by another's
+	c.SetSrc(image.NewUniform(ParseHexColor(labelHaloColor)))
+	for _, label := range labels {
+		if err := drawLabel(label, haloOffsets(scene)); err != nil {
+			return err
+		}
+	}
+	c.SetSrc(image.NewUniform(color.RGBA{0xfa, 0xfa, 0xfa, 0xff}))
+	for _, label := range labels {
+		if err := drawLabel(label, []fixed.Point26_6{{}}); err != nil {
+			return err
+		}
+	}
+
+	if scene.bare {
+		return nil
+	}
+	if err := drawBanner(rgba, scene); err != nil {
+		return err
+	}
+	for _, label := range footer {
+		if err := drawLabel(label, []fixed.Point26_6{{}}); err != nil {
+			return err
+		}
+	}
+	if err := drawLegend(rgba, scene); err != nil {
+		return err
+	}
+	return drawLogo(rgba, scene)
+}
@@ -0,0 +1,55 @@
+package render
+
+import (
+	"canvas/geo"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Pixels around a tile whose geometry is kept, so that borders and markers
+// straddling the edge are drawn on the tiles on both sides of it
+const tileClipMargin = 8
+
+// Function to finish the scene of a tile: transparent and bare, with only the
+// features and borders reaching into the tile's box. Drawing a whole country
+// onto every tile would cost as much as a full map, and more at high zooms,
+// where the geometry is least simplified.
+func (scene *Scene) clipToTile(b geo.BBox) {
+	scene.Transparent, scene.bare = true, true
+	scene.Logo = nil
+	padLon := (b.MaxLon - b.MinLon) * tileClipMargin / float64(scene.Width)
+	padLat := (b.MaxLat - b.MinLat) * tileClipMargin / float64(scene.Height)
+	b = geo.BBox{MinLon: b.MinLon - padLon, MinLat: b.MinLat - padLat, MaxLon: b.MaxLon + padLon, MaxLat: b.MaxLat + padLat}
+
+	var features []*geojson.Feature
+	for _, feature := range scene.Features {
+		if featureIntersects(feature, b) {
+			features = append(features, feature)
+		}
+	}
+	var borders [][][]float64
+	for _, line := range scene.Borders {
+		if geo.LineBounds(line).Intersects(b) {
+			borders = append(borders, line)
+		}
+	}
+	scene.Features, scene.Borders = features, borders
+}
+
+// Function to tell whether the exterior of any polygon of a feature reaches
+// into a box
+func featureIntersects(feature *geojson.Feature, b geo.BBox) bool {
+	var polygons [][][][]float64
+	switch feature.Geometry.Type {
+	case "Polygon":
+		polygons = [][][][]float64{feature.Geometry.Polygon}
+	case "MultiPolygon":
+		polygons = feature.Geometry.MultiPolygon
+	}
+	for _, polygon := range polygons {
+		if len(polygon) > 0 && geo.LineBounds(polygon[0]).Intersects(b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package render
+
+import (
+	"sync"
+	"time"
+)
+
+// Timings records how long each stage of a render takes. A nil *Timings
+// records nothing, so renders are only timed when asked to be.
+type Timings struct {
+	mu     sync.Mutex
+	stages []Stage
+}
+
+// Stage is the time spent in one stage of a render. A stage entered several
+// times, such as a layer drawn in batches, adds up.
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Start starts timing a stage, until the returned function is called.
+func (t *Timings) Start(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.add(name, time.Since(start))
+	}
+}
+
+func (t *Timings) add(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.stages {
+		if t.stages[i].Name == name {
+			t.stages[i].Duration += d
+			return
+		}
+	}
+	t.stages = append(t.stages, Stage{Name: name, Duration: d})
+}
+
+// Stages returns the stages timed so far, in the order they were first
+// entered.
+func (t *Timings) Stages() []Stage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Stage(nil), t.stages...)
+}
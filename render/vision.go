@@ -0,0 +1,115 @@
+package render
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Simulations of color vision deficiencies, as 3x3 matrices on linear RGB.
+// They are those of Machado, Oliveira and Fernandes (2009) at full severity,
+// for the dichromacies missing one kind of cone.
+var Simulations = map[string][9]float64{
+	"protanopia": {
+		0.152286, 1.052583, -0.204868,
+		0.114503, 0.786281, 0.099216,
+		-0.003882, -0.048116, 1.051998,
+	},
+	"deuteranopia": {
+		0.367322, 0.860646, -0.227968,
+		0.280085, 0.672501, 0.047413,
+		-0.011820, 0.042940, 0.968881,
+	},
+	"tritanopia": {
+		1.255528, -0.076749, -0.178779,
+		-0.078411, 0.930809, 0.147602,
+		0.004733, 0.691367, 0.303900,
+	},
+}
+
+// ParseSimulation checks the name of a color vision simulation. An empty
+// name simulates nothing.
+func ParseSimulation(name string) (string, error) {
+	if _, ok := Simulations[name]; name != "" && !ok {
+		names := make([]string, 0, len(Simulations))
+		for n := range Simulations {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown simulation: %s (must be %s)", name, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// Function to finish drawing a scene: its insets, then the simulation over
+// the whole image
+func finishDraw(rgba *image.RGBA, scene *Scene, backend Backend) error {
+	if err := drawInsets(rgba, scene, backend); err != nil {
+		return err
+	}
+	if scene.Simulate != "" {
+		defer scene.Timings.Start("simulate")()
+		simulateVision(rgba, Simulations[scene.Simulate])
+	}
+	return nil
+}
+
+// Function to show an image as seen with a color vision deficiency. Colors
+// are converted to linear RGB through lookup tables, transformed, and
+// converted back, on every core.
+func simulateVision(rgba *image.RGBA, m [9]float64) {
+	var toLinear [256]float64
+	for i := range toLinear {
+		toLinear[i] = srgbToLinear(float64(i) / 255)
+	}
+	// Linear values back to sRGB, finely enough that no level is skipped
+	const steps = 4096
+	var toSRGB [steps + 1]uint8
+	for i := range toSRGB {
+		toSRGB[i] = uint8(math.Round(linearToSRGB(float64(i)/steps) * 255))
+	}
+	encode := func(v float64) uint8 {
+		return toSRGB[int(math.Round(min(1, max(0, v))*steps))]
+	}
+
+	rows := chunkRanges(rgba.Rect.Dy())
+	parallelEach(len(rows), func(i int) {
+		for y := rows[i][0]; y < rows[i][1]; y++ {
+			row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+4*rgba.Rect.Dx()]
+			for x := 0; x < len(row); x += 4 {
+				r, g, b := toLinear[row[x]], toLinear[row[x+1]], toLinear[row[x+2]]
+				row[x] = encode(m[0]*r + m[1]*g + m[2]*b)
+				row[x+1] = encode(m[3]*r + m[4]*g + m[5]*b)
+				row[x+2] = encode(m[6]*r + m[7]*g + m[8]*b)
+			}
+		}
+	})
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// Function to write the SVG filter of a simulation, for standalone output.
+// Filters work in linear RGB by default, like the raster simulation.
+func svgVisionFilter(name string) string {
+	m := Simulations[name]
+	var values []string
+	for row := 0; row < 3; row++ {
+		values = append(values, fmt.Sprintf("%g %g %g 0 0", m[3*row], m[3*row+1], m[3*row+2]))
+	}
+	values = append(values, "0 0 0 1 0")
+	return fmt.Sprintf("<defs><filter id=\"simulate-%s\" color-interpolation-filters=\"linearRGB\"><feColorMatrix type=\"matrix\" values=\"%s\" /></filter></defs>\n", name, strings.Join(values, " "))
+}
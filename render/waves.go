@@ -0,0 +1,98 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/math/fixed"
+)
+
+// Wave speeds in km/s, those of a uniform upper crust. Real fronts travel
+// faster with distance as they dive deeper, so far from the epicenter the
+// circles run behind.
+const (
+	PWaveSpeed = 6.0
+	SWaveSpeed = 3.5
+)
+
+// Earth radius in km, for the wavefront circles
+const earthRadiusKm = 6371.0
+
+// Waves are the P and S wavefronts of an earthquake some time after its
+// origin.
+type Waves struct {
+	Lat, Lon float64
+	Depth    float64 // km
+	Elapsed  time.Duration
+}
+
+// Radius returns how far from the epicenter, in km, a wave of the given
+// speed has reached the surface, or zero while it is still on its way up.
+func (w Waves) Radius(speed float64) float64 {
+	hypocentral := speed * w.Elapsed.Seconds()
+	if hypocentral <= w.Depth {
+		return 0
+	}
+	return math.Sqrt(hypocentral*hypocentral - w.Depth*w.Depth)
+}
+
+// Function to draw the wavefronts over a map: the S wave as a shaded disc
+// with a red edge, the P wave as a blue circle, and a cross at the epicenter
+func drawWaves(dst *image.RGBA, scene *Scene, waves *Waves) {
+	width, height := scene.Width, scene.Height
+	scanner := rasterx.NewScannerGV(width, height, dst, dst.Bounds())
+	dasher := rasterx.NewDasher(width, height, scanner)
+	stroke := fixed.Int26_6(2 * scene.Multiplier * 64)
+
+	if r := waves.Radius(SWaveSpeed); r > 0 {
+		circle := [][][]float64{waveCircle(waves.Lat, waves.Lon, r)}
+		dasher.Clear()
+		AddRings(&dasher.Filler, circle, scene.ToScreen)
+		dasher.Filler.SetColor(color.NRGBA{R: 0xef, G: 0x44, B: 0x44, A: 0x30})
+		dasher.Filler.Draw()
+
+		dasher.Clear()
+		dasher.SetStroke(stroke, 4*64, rasterx.ButtCap, rasterx.ButtCap, nil, rasterx.Round, nil, 0)
+		AddLines(dasher, circle, scene.ToScreen)
+		dasher.SetColor(ParseHexColor("#ef4444"))
+		dasher.Draw()
+	}
+	if r := waves.Radius(PWaveSpeed); r > 0 {
+		dasher.Clear()
+		dasher.SetStroke(stroke, 4*64, rasterx.ButtCap, rasterx.ButtCap, nil, rasterx.Round, nil, 0)
+		AddLines(dasher, [][][]float64{waveCircle(waves.Lat, waves.Lon, r)}, scene.ToScreen)
+		dasher.SetColor(ParseHexColor("#3b82f6"))
+		dasher.Draw()
+	}
+
+	x, y := scene.ToScreen(waves.Lon, waves.Lat)
+	arm := 6 * scene.Multiplier
+	dasher.Clear()
+	dasher.SetStroke(fixed.Int26_6(2.5*scene.Multiplier*64), 4*64, rasterx.RoundCap, rasterx.RoundCap, nil, rasterx.Round, nil, 0)
+	for _, d := range []float64{-1, 1} {
+		dasher.Start(rasterx.ToFixedP(x-arm, y-d*arm))
+		dasher.Line(rasterx.ToFixedP(x+arm, y+d*arm))
+		dasher.Stop(false)
+	}
+	dasher.SetColor(color.NRGBA{R: 0xfa, G: 0xfa, B: 0xfa, A: 0xff})
+	dasher.Draw()
+}
+
+// Function to trace the circle of points at a distance in km from a center
+// on the sphere, as a closed ring of coordinates
+func waveCircle(lat, lon, radius float64) [][]float64 {
+	const steps = 180
+	phi1, lambda1 := lat*math.Pi/180, lon*math.Pi/180
+	delta := radius / earthRadiusKm
+	ring := make([][]float64, 0, steps+1)
+	for i := 0; i <= steps; i++ {
+		bearing := float64(i%steps) / steps * 2 * math.Pi
+		phi2 := math.Asin(math.Sin(phi1)*math.Cos(delta) + math.Cos(phi1)*math.Sin(delta)*math.Cos(bearing))
+		lambda2 := lambda1 + math.Atan2(math.Sin(bearing)*math.Sin(delta)*math.Cos(phi1), math.Cos(delta)-math.Sin(phi1)*math.Sin(phi2))
+		ring = append(ring, []float64{lambda2 * 180 / math.Pi, phi2 * 180 / math.Pi})
+	}
+	return ring
+}
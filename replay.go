@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"canvas/server"
+)
+
+// Function to re-execute a recording against a running server
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the server to replay against")
+	outDir := fs.String("out", "", "directory to write the replayed images to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: canvas replay [flags] <recording.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a recording file is required")
+	}
+
+	entries, err := readRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	base, err := url.Parse(*target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+
+	var (
+		recorded, replayed []float64
+		failed, changed    int
+	)
+
+	for i, entry := range entries {
+		n := i + 1
+		u := *base
+		u.Path = strings.TrimSuffix(base.Path, "/") + entry.Path
+		u.RawQuery = url.Values(entry.Query).Encode()
+
+		start := time.Now()
+		resp, err := http.Get(u.String())
+		if err != nil {
+			return fmt.Errorf("request %d: %w", n, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("request %d: %w", n, err)
+		}
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+		recorded = append(recorded, entry.Duration)
+		replayed = append(replayed, elapsed)
+
+		status := "ok"
+		switch {
+		case resp.StatusCode != entry.Status:
+			status = fmt.Sprintf("status %d (recorded %d)", resp.StatusCode, entry.Status)
+			failed++
+		case entry.SHA256 != "":
+			sum := sha256.Sum256(body)
+			if hex.EncodeToString(sum[:]) != entry.SHA256 {
+				status = "changed"
+				changed++
+			}
+		}
+		fmt.Printf("%4d %-8s %8.1fms (recorded %8.1fms) %s\n", n, entry.Path, elapsed, entry.Duration, status)
+
+		if *outDir != "" && resp.StatusCode == http.StatusOK {
+			name := filepath.Join(*outDir, fmt.Sprintf("%04d.png", n))
+			if err := os.WriteFile(name, body, 0o644); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("\n%d requests, %d status mismatches, %d changed images\n", len(replayed), failed, changed)
+	fmt.Printf("recorded: p50 %.1fms p95 %.1fms\n", percentile(recorded, 50), percentile(recorded, 95))
+	fmt.Printf("replayed: p50 %.1fms p95 %.1fms\n", percentile(replayed, 50), percentile(replayed, 95))
+	return nil
+}
+
+// The whole file is read up front so replaying against a server that is
+// itself recording to the same file does not loop forever
+func readRecording(path string) ([]server.RecordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []server.RecordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var entry server.RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("request %d: %w", n, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Middleware letting through only requests carrying the admin token, in an
+// X-Admin-Token header or as the password of HTTP basic authentication, so
+// browsers can open the dashboard
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get("X-Admin-Token")
+		if presented == "" {
+			_, presented, _ = r.BasicAuth()
+		}
+		got := sha256.Sum256([]byte(presented))
+		if presented == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="canvas admin"`)
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized, "Missing or invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	handler := requireAdminToken("sekrit", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		header string
+		basic  string
+		status int
+	}{
+		{"header", "sekrit", "", http.StatusOK},
+		{"basic", "", "sekrit", http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong header", "secret", "", http.StatusUnauthorized},
+		{"wrong basic", "", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/features", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Admin-Token", tt.header)
+		}
+		if tt.basic != "" {
+			r.SetBasicAuth("admin", tt.basic)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d; want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
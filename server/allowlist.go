@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Set of networks allowed to reach the server
+type ipAllowlist struct {
+	prefixes []netip.Prefix
+}
+
+// Function to parse a comma-separated list of CIDR ranges or single addresses
+func parseAllowlist(value string) (*ipAllowlist, error) {
+	a := &ipAllowlist{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address in allowlist: %s", part)
+			}
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range in allowlist: %s", part)
+		}
+		a.prefixes = append(a.prefixes, prefix.Masked())
+	}
+	if len(a.prefixes) == 0 {
+		return nil, fmt.Errorf("allowlist is empty")
+	}
+	return a, nil
+}
+
+func (a *ipAllowlist) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejecting clients outside the allowlist. Only the connection's
+// address is checked; X-Forwarded-For is client-controlled.
+func (a *ipAllowlist) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil || !a.Allows(addr) {
+			writeError(w, http.StatusForbidden, ErrForbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
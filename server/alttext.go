@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"canvas/geo"
+	"canvas/i18n"
+	"canvas/render"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// Function to describe a map for screen readers, such as the alt text of a
+// post: the features of each intensity, strongest first, in the language of
+// the map. Only the strongest socialAltLevels intensities are named; weaker
+// features are counted. Maps with nothing shaded by intensity get the generic
+// alt text.
+func altText(dataset *geo.Dataset, opts *render.Options) string {
+	byScale := make(map[int][]string)
+	features := append([]*geojson.Feature(nil), dataset.Full.Features...)
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Properties["id"].(float64) < features[j].Properties["id"].(float64)
+	})
+	for _, feature := range features {
+		id := int(feature.Properties["id"].(float64))
+		scale := opts.ScaleMap[id]
+		if scale <= 0 {
+			continue
+		}
+		romaji, kanji := geo.FeatureNames(feature)
+		name := romaji
+		if (opts.Lang == i18n.Japanese && kanji != "") || name == "" {
+			name = kanji
+		}
+		if name == "" {
+			name = i18n.T(opts.Lang, "region.id", id)
+		}
+		byScale[scale] = append(byScale[scale], name)
+	}
+	if len(byScale) == 0 {
+		return i18n.T(opts.Lang, "map.alt")
+	}
+	scales := make([]int, 0, len(byScale))
+	for scale := range byScale {
+		scales = append(scales, scale)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(scales)))
+
+	var parts []string
+	rest := 0
+	for i, scale := range scales {
+		if i >= socialAltLevels {
+			rest += len(byScale[scale])
+			continue
+		}
+		label := intensityText(opts.Lang, opts.ScaleType, scale)
+		if i == 0 {
+			label = i18n.T(opts.Lang, "alt.max", label)
+		}
+		parts = append(parts, label+": "+strings.Join(byScale[scale], ", "))
+	}
+	if rest > 0 {
+		parts = append(parts, i18n.T(opts.Lang, "alt.more", rest))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Function to send the alt text of the map the query draws, without
+// rendering it
+func (s *server) serveAltText(w http.ResponseWriter, r *http.Request, opts *render.Options, maxAge int) {
+	etag := optionsETag(s.assets, struct {
+		*render.Options
+		Format string
+	}{opts, formatAlt})
+	if notModified(w, r, etag, maxAge) {
+		return
+	}
+	annotateRequest(r.Context(), "format", formatAlt)
+	setCacheHeaders(w, etag, maxAge)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(altText(s.dataset, opts)))
+}
+
+// GET /map/alt describes the map of the /map parameters, as format=alt does
+func (s *server) altHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("format") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "format cannot be given for /map/alt")
+		return
+	}
+	query.Set("format", formatAlt)
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	s.mapHandler(w, r)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"canvas/render"
+)
+
+// FrameQuery is one entry of the frames parameter: the intensities reported
+// by a time.
+type FrameQuery struct {
+	Time   time.Time        `json:"time"`
+	Scale  []IntensityQuery `json:"scale,omitempty"`
+	Points json.RawMessage  `json:"points,omitempty"`
+}
+
+// Function to parse a duration parameter given in milliseconds
+func parseMillis(query url.Values, name string, fallback, least, most time.Duration) (time.Duration, error) {
+	v := query.Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if d := time.Duration(n) * time.Millisecond; err == nil && d >= least && d <= most {
+		return d, nil
+	}
+	return 0, invalidParam(ErrInvalidQuery, "Invalid %s: %s (must be between %d and %d milliseconds)", name, v, least.Milliseconds(), most.Milliseconds())
+}
+
+// Function to parse the frames of an animation, each through the /map
+// parameters with its own scale and points. Without frames, the map of the
+// query is revealed one intensity at a time, strongest first.
+func parseAnimation(query url.Values) (*render.Options, []render.Frame, error) {
+	delay, err := parseMillis(query, "delay", time.Second, 100*time.Millisecond, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	hold, err := parseMillis(query, "hold", 3*time.Second, 100*time.Millisecond, 30*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := url.Values{}
+	for k, v := range query {
+		base[k] = v
+	}
+	for _, k := range []string{"frames", "delay", "hold", "format"} {
+		base.Del(k)
+	}
+
+	var frames []render.Frame
+	var opts *render.Options
+	if data := query.Get("frames"); data != "" {
+		var queries []FrameQuery
+		if err := json.Unmarshal([]byte(data), &queries); err != nil {
+			return nil, nil, invalidParam(ErrInvalidFrames, "Invalid frames data format: %v", err)
+		}
+		if len(queries) == 0 || len(queries) > render.MAX_FRAMES {
+			return nil, nil, invalidParam(ErrInvalidFrames, "Invalid number of frames: %d (must be between 1 and %d)", len(queries), render.MAX_FRAMES)
+		}
+		if base.Has("scale") || base.Has("points") {
+			return nil, nil, invalidParam(ErrInvalidQuery, "scale and points cannot be combined with frames")
+		}
+		sort.SliceStable(queries, func(i, j int) bool { return queries[i].Time.Before(queries[j].Time) })
+
+		for _, fq := range queries {
+			q := url.Values{}
+			for k, v := range base {
+				q[k] = v
+			}
+			scale, _ := json.Marshal(fq.Scale)
+			q.Set("scale", string(scale))
+			if len(fq.Points) > 0 {
+				q.Set("points", string(fq.Points))
+			}
+			frameOpts, err := ParseRenderOptions(q)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = frameOpts
+			frame := render.Frame{ScaleMap: frameOpts.ScaleMap, Points: frameOpts.Points, Delay: delay}
+			if !fq.Time.IsZero() {
+				frame.Label = fq.Time.In(jst).Format("2006-01-02 15:04:05 JST")
+			}
+			frames = append(frames, frame)
+		}
+	} else {
+		if opts, err = ParseRenderOptions(base); err != nil {
+			return nil, nil, err
+		}
+		frames = revealFrames(opts, delay)
+	}
+	frames[len(frames)-1].Delay = hold
+	return opts, frames, nil
+}
+
+// Function to build the frames revealing a map one intensity at a time,
+// strongest first
+func revealFrames(opts *render.Options, delay time.Duration) []render.Frame {
+	seen := make(map[int]bool)
+	for _, scale := range opts.ScaleMap {
+		seen[scale] = seen[scale] || scale > 0
+	}
+	for _, p := range opts.Points {
+		seen[p.Scale] = seen[p.Scale] || p.Scale > 0
+	}
+	var levels []int
+	for scale, shown := range seen {
+		if shown {
+			levels = append(levels, scale)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+	if len(levels) == 0 {
+		// Nothing to reveal, so the map is shown as is
+		return []render.Frame{{ScaleMap: opts.ScaleMap, Points: opts.Points, Delay: delay}}
+	}
+
+	frames := make([]render.Frame, len(levels))
+	for i, level := range levels {
+		frame := render.Frame{ScaleMap: make(map[int]int), Delay: delay}
+		for id, scale := range opts.ScaleMap {
+			if scale >= level {
+				frame.ScaleMap[id] = scale
+			}
+		}
+		for _, p := range opts.Points {
+			if p.Scale >= level {
+				frame.Points = append(frame.Points, p)
+			}
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+// GET /animation?frames=[...]&delay=1000&hold=3000, or the /map parameters
+// alone for a reveal of the map
+func (s *server) animationHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := render.ParseAnimationFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		writeAPIError(w, invalidParam(ErrInvalidQuery, "Invalid format: %v", err))
+		return
+	}
+	opts, frames, err := parseAnimation(r.URL.Query())
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	s.serveAnimation(w, r, opts, frames, format)
+}
+
+// Function to render and send an animation, or 304 when the client already
+// holds it
+func (s *server) serveAnimation(w http.ResponseWriter, r *http.Request, opts *render.Options, frames []render.Frame, format string) {
+	etag := optionsETag(s.assets, []any{"animation", opts, frames, format})
+	if notModified(w, r, etag, s.maxAge) {
+		return
+	}
+
+	backend := opts.Backend
+	if backend == "" {
+		backend = s.rollout.Pick()
+	}
+	release, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	data, err := render.Animate(s.dataset, opts, render.Backends[backend], frames, format)
+	annotateRequest(r.Context(), "backend", backend, "frames", len(frames), "render_duration", time.Since(start))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+
+	recordUsage(r.Context(), opts.Width*opts.Height*len(frames))
+	setCacheHeaders(w, etag, s.maxAge)
+	contentType := "image/gif"
+	if format == render.FormatAPNG {
+		contentType = "image/apng"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Render-Backend", backend)
+	w.Write(data)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Accepted API keys, stored by hash so lookups do not leak key contents
+// through timing and the keys themselves are not kept in memory
+type apiKeys struct {
+	names map[[32]byte]string
+	// Paths that authenticate their requests otherwise, and take no key
+	exempt map[string]bool
+}
+
+// Function to load API keys from a file and/or a comma-separated list (the
+// CANVAS_API_KEYS variable). Entries are "name=key" or a bare key, and the
+// key may be a secret reference such as vault:secret/data/canvas#key. Blank
+// lines and lines starting with # are skipped in the file.
+func loadAPIKeys(path, list string) (*apiKeys, error) {
+	var entries []string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API keys: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	keys := &apiKeys{names: make(map[[32]byte]string)}
+	for i, entry := range entries {
+		name, ref, found := strings.Cut(entry, "=")
+		if !found {
+			name, ref = fmt.Sprintf("key-%d", i+1), entry
+		}
+		key, err := resolveSecret(strings.TrimSpace(ref))
+		if err != nil {
+			return nil, fmt.Errorf("API key %s: %w", name, err)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("API key %s is too short (at least 16 characters)", name)
+		}
+		keys.names[sha256.Sum256([]byte(key))] = strings.TrimSpace(name)
+	}
+	if len(keys.names) == 0 {
+		return nil, fmt.Errorf("no API keys configured")
+	}
+	return keys, nil
+}
+
+// Function to find the key sent with a request: Authorization: Bearer,
+// X-API-Key, or the api_key query parameter
+func presentedAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+type apiKeyNameKey struct{}
+
+// Function to get the name of the API key a request was made with, or
+// "anonymous" when the server requires none
+func apiKeyName(ctx context.Context) string {
+	if name, ok := ctx.Value(apiKeyNameKey{}).(string); ok {
+		return name
+	}
+	return anonymousKey
+}
+
+// Middleware rejecting requests without a valid key, other than on exempt
+// paths. The api_key parameter is moved to an X-API-Key header before the
+// request goes further, so it never reaches recordings, cache keys or
+// upstream URLs.
+func (k *apiKeys) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if k.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := presentedAPIKey(r)
+		name, ok := k.names[sha256.Sum256([]byte(key))]
+		if key == "" || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="canvas"`)
+			message := "Missing API key"
+			if key != "" {
+				message = "Invalid API key"
+			}
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized, message)
+			return
+		}
+		annotateRequest(r.Context(), "api_key", name)
+
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyNameKey{}, name))
+		if r.URL.Query().Has("api_key") {
+			query := r.URL.Query()
+			query.Del("api_key")
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = query.Encode()
+			if r.Header.Get("Authorization") == "" && r.Header.Get("X-API-Key") == "" {
+				r.Header.Set("X-API-Key", key)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"canvas/geo"
+)
+
+// A feature that scale and values can shade, as listed by /areas
+type areaInfo struct {
+	ID     int    `json:"id"`
+	NameJa string `json:"name_ja,omitempty"`
+	NameEn string `json:"name_en,omitempty"`
+	// [lon, lat] of the center of its area
+	Centroid [2]float64 `json:"centroid"`
+	// [minLon, minLat, maxLon, maxLat], as the bbox of GeoJSON
+	BBox [4]float64 `json:"bbox"`
+}
+
+// GET /areas lists the features of the map, or of a map of -maps with map=,
+// as of asof, so clients can build scale payloads without a copy of the
+// GeoJSON.
+func (s *server) areasHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if name := query.Get("map"); name != "" {
+		m, ok := s.maps.Get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrMapNotFound, fmt.Sprintf("Map not found: %s", name))
+			return
+		}
+		s = s.withMap(m)
+	}
+	s, err := s.asOf(query)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	etag := optionsETag(s.assets, "areas")
+	if notModified(w, r, etag, s.maxAge) {
+		return
+	}
+	areas := areaList(s.dataset)
+	setCacheHeaders(w, etag, s.maxAge)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"areas": areas})
+}
+
+// Function to describe the features of a dataset, by ID
+func areaList(dataset *geo.Dataset) []areaInfo {
+	// Degrees to about 10 cm, finer than any map
+	round := func(v float64) float64 { return math.Round(v*1e6) / 1e6 }
+	areas := make([]areaInfo, 0, len(dataset.Full.Features))
+	for _, feature := range dataset.Full.Features {
+		area := areaInfo{ID: int(feature.Properties["id"].(float64))}
+		area.NameEn, area.NameJa = geo.FeatureNames(feature)
+		lon, lat := geo.Centroid(feature)
+		area.Centroid = [2]float64{round(lon), round(lat)}
+		b := geo.FeatureBounds(feature)
+		area.BBox = [4]float64{round(b.MinLon), round(b.MinLat), round(b.MaxLon), round(b.MaxLat)}
+		areas = append(areas, area)
+	}
+	sort.Slice(areas, func(i, j int) bool { return areas[i].ID < areas[j].ID })
+	return areas
+}
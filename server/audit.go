@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Entries kept in memory when no audit file is configured
+const auditMemoryLimit = 10000
+
+// One administrative or publishing action
+type AuditEntry struct {
+	Time    time.Time         `json:"time"`
+	Actor   string            `json:"actor"`
+	Action  string            `json:"action"`
+	Target  string            `json:"target,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Append-only audit trail. Entries are written to a JSON Lines file when one
+// is configured, otherwise the most recent ones are kept in memory.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries []AuditEntry
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	if path != "" {
+		// O_APPEND keeps earlier entries intact even if the process crashes mid-write
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// Function to identify who made a request
+func auditActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *auditLog) Record(actor, action, target string, details map[string]string) {
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil {
+		line, err := json.Marshal(entry)
+		if err == nil {
+			_, err = a.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			slog.Error("failed to write audit entry", "action", action, "err", err)
+		}
+		return
+	}
+
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditMemoryLimit {
+		a.entries = a.entries[len(a.entries)-auditMemoryLimit:]
+	}
+}
+
+// Function to read every entry, oldest first
+func (a *auditLog) all() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return append([]AuditEntry(nil), a.entries...), nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Query with ?action=, ?actor=, ?since=<RFC 3339> and ?limit=, newest first
+func (a *auditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "Invalid since: must be an RFC 3339 timestamp")
+			return
+		}
+		since = t
+	}
+
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "Invalid limit: must be between 1 and 10000")
+			return
+		}
+		limit = n
+	}
+
+	entries, err := a.all()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, "Failed to read audit log")
+		return
+	}
+
+	result := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		entry := entries[i]
+		if action := query.Get("action"); action != "" && entry.Action != action {
+			continue
+		}
+		if actor := query.Get("actor"); actor != "" && entry.Actor != actor {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		result = append(result, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
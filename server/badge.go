@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"canvas/render"
+)
+
+// Smallest and largest badge sizes, in pixels per side
+const (
+	MIN_BADGE_SIZE = 16
+	MAX_BADGE_SIZE = 256
+)
+
+// GET /badge?scale=[...]&size=64, or max=<0-7> instead of scale
+func (s *server) badgeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	size := 64
+	if v := query.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MIN_BADGE_SIZE || n > MAX_BADGE_SIZE {
+			writeError(w, http.StatusBadRequest, ErrInvalidDimensions,
+				fmt.Sprintf("Invalid size: %s (must be between %d and %d)", v, MIN_BADGE_SIZE, MAX_BADGE_SIZE))
+			return
+		}
+		size = n
+	}
+
+	intensity := 0
+	switch {
+	case query.Get("max") != "":
+		n, err := strconv.Atoi(query.Get("max"))
+		if err != nil || n < 0 || n > 7 {
+			writeError(w, http.StatusBadRequest, ErrInvalidScale, fmt.Sprintf("Invalid max: %s (must be between 0 and 7)", query.Get("max")))
+			return
+		}
+		intensity = n
+	case query.Get("scale") != "":
+		var intensities []IntensityQuery
+		if err := json.Unmarshal([]byte(query.Get("scale")), &intensities); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidScale, fmt.Sprintf("Invalid scale data format: %v", err))
+			return
+		}
+		for _, iq := range intensities {
+			if iq.Scale < 0 || iq.Scale > 7 {
+				writeError(w, http.StatusBadRequest, ErrInvalidScale, fmt.Sprintf("Invalid scale value for ID %d: %d", iq.ID, iq.Scale))
+				return
+			}
+			if iq.Scale > intensity {
+				intensity = iq.Scale
+			}
+		}
+	default:
+		writeError(w, http.StatusBadRequest, ErrMissingScale, "scale or max parameter is required")
+		return
+	}
+
+	background := query.Get("background")
+	if background != "" && background != "transparent" && background != "dark" {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid background: %s (must be transparent or dark)", background))
+		return
+	}
+
+	etag := optionsETag(s.assets, []any{"badge", size, intensity, background == "dark"})
+	if notModified(w, r, etag, s.maxAge) {
+		return
+	}
+
+	data, err := render.RenderBadge(s.dataset, size, intensity, background == "dark")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+	recordUsage(r.Context(), size*size)
+	setCacheHeaders(w, etag, s.maxAge)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
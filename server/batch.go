@@ -0,0 +1,299 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"canvas/render"
+)
+
+const (
+	maxBatchMaps  = 16      // Maps of one POST /map/batch
+	maxBatchBytes = 1 << 20 // Largest body of POST /map/batch
+)
+
+// One map of a batch, parsed and ready to render
+type batchMap struct {
+	name      string
+	server    *server
+	opts      *render.Options
+	etag      string
+	eventTime string
+}
+
+// Function to turn the JSON value of a batch parameter into its query
+// string values: strings as they are, numbers and booleans as written, and
+// arrays and objects, such as scale or markers, as JSON. An array of strings
+// repeats the parameter, as several overlays do. Null gives none.
+func batchParam(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return nil, nil
+	case raw[0] == '"':
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	case raw[0] == '[':
+		var values []string
+		if err := json.Unmarshal(raw, &values); err == nil && len(values) > 0 {
+			return values, nil
+		}
+		fallthrough
+	case raw[0] == '{':
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, raw); err != nil {
+			return nil, err
+		}
+		return []string{buf.String()}, nil
+	}
+	return []string{string(raw)}, nil
+}
+
+// Function to decode the maps of a batch, each a JSON object of /map
+// parameters and the name of its file
+func decodeBatch(body []byte) ([]map[string]json.RawMessage, error) {
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, invalidParam(ErrInvalidBatch, "Invalid batch format: %v (must be a JSON array of objects)", err)
+	}
+	if len(entries) == 0 || len(entries) > maxBatchMaps {
+		return nil, invalidParam(ErrInvalidBatch, "Invalid number of maps: %d (must be between 1 and %d)", len(entries), maxBatchMaps)
+	}
+	return entries, nil
+}
+
+// Function to get the query of the i-th map of a batch, its parameters
+// over those of the batch query, and the name of its file
+func batchQuery(query url.Values, entry map[string]json.RawMessage, i int) (url.Values, string, error) {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	name := fmt.Sprintf("map-%d.png", i+1)
+	for k, raw := range entry {
+		values, err := batchParam(raw)
+		if err != nil {
+			return nil, "", invalidParam(ErrInvalidBatch, "Map %d: invalid %s: %v", i+1, k, err)
+		}
+		switch {
+		case k == "name":
+			if len(values) != 1 {
+				return nil, "", invalidParam(ErrInvalidBatch, "Map %d: name must be a string", i+1)
+			}
+			name = values[0]
+		case len(values) > 0:
+			q[k] = values
+		default:
+			q.Del(k)
+		}
+	}
+	return q, name, nil
+}
+
+// Function to parse the maps of a batch over the parameters of the query.
+// Every map is checked before any is rendered.
+func (s *server) parseBatch(r *http.Request, body []byte) ([]batchMap, error) {
+	entries, err := decodeBatch(body)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(map[string]*quakeEvent)
+	names := make(map[string]bool)
+	maps := make([]batchMap, 0, len(entries))
+	for i, entry := range entries {
+		q, name, err := batchQuery(r.URL.Query(), entry, i)
+		if err != nil {
+			return nil, err
+		}
+		if path.Ext(name) == "" {
+			name += ".png"
+		}
+		if name == ".png" || len(name) > 100 || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+			return nil, invalidParam(ErrInvalidBatch, "Map %d: invalid name: %q (must be a file name without a path)", i+1, name)
+		}
+		if names[name] {
+			return nil, invalidParam(ErrInvalidBatch, "Map %d: %s is the name of another map", i+1, name)
+		}
+		names[name] = true
+		for _, k := range []string{"format", "debug", "download", "output"} {
+			if q.Has(k) {
+				return nil, invalidParam(ErrInvalidQuery, "Map %d: %s cannot be given in a batch", i+1, k)
+			}
+		}
+
+		m, err := s.parseBatchMap(r, q, events)
+		if err != nil {
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				e := *apiErr
+				e.Message = fmt.Sprintf("Map %d: %s", i+1, e.Message)
+				return nil, &e
+			}
+			return nil, err
+		}
+		m.name = name
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+// Function to parse one map of a batch, filling the intensities of its
+// event, if it names one, as /map?event= does
+func (s *server) parseBatchMap(r *http.Request, q url.Values, events map[string]*quakeEvent) (batchMap, error) {
+	var m batchMap
+	if id := q.Get("event"); id != "" {
+		ev, ok := events[id]
+		if !ok {
+			var err error
+			if ev, err = s.feed.Event(r.Context(), id); err != nil {
+				return m, err
+			}
+			events[id] = ev
+		}
+		var err error
+		if q, err = eventQuery(q, ev); err != nil {
+			return m, err
+		}
+		q.Del("event")
+		m.eventTime = ev.Time.Format(time.RFC3339)
+	}
+
+	c, err := s.asOf(q)
+	if err != nil {
+		return m, err
+	}
+	opts, err := ParseRenderOptions(q)
+	if err != nil {
+		return m, err
+	}
+	if err := c.checkPrefectureNames(q); err != nil {
+		return m, err
+	}
+	c.applyMap(opts)
+	m.server, m.opts, m.etag = c, opts, optionsETag(c.assets, opts)
+	return m, nil
+}
+
+// POST /map/batch takes a JSON array of maps, each an object of /map
+// parameters and an optional file name, and returns their PNGs in one ZIP,
+// or as multipart/mixed when the request accepts it. Parameters of the query
+// apply to every map.
+func (s *server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, ErrPayloadTooLarge, fmt.Sprintf("Batch too large (at most %d bytes)", maxBatchBytes))
+			return
+		}
+		writeError(w, http.StatusBadRequest, ErrInvalidBatch, fmt.Sprintf("Failed to read batch: %v", err))
+		return
+	}
+	maps, err := s.parseBatch(r, body)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+
+	// Parts are written to a buffer, so that a failed render still gets an
+	// error response
+	var buf bytes.Buffer
+	var (
+		add         func(m batchMap, data []byte, id string) error
+		finish      func() error
+		contentType string
+	)
+	if acceptsMultipart(r) {
+		mw := multipart.NewWriter(&buf)
+		add = func(m batchMap, data []byte, id string) error {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", "image/png")
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": m.name}))
+			header.Set("ETag", m.etag)
+			header.Set("X-Image-ID", id)
+			part, err := mw.CreatePart(header)
+			if err == nil {
+				_, err = part.Write(data)
+			}
+			return err
+		}
+		finish = mw.Close
+		contentType = "multipart/mixed; boundary=" + mw.Boundary()
+	} else {
+		archive := zip.NewWriter(&buf)
+		modified := time.Now()
+		add = func(m batchMap, data []byte, id string) error {
+			// PNGs are compressed already
+			f, err := archive.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Store, Modified: modified})
+			if err == nil {
+				_, err = f.Write(data)
+			}
+			return err
+		}
+		finish = archive.Close
+		contentType = "application/zip"
+	}
+
+	pixels := 0
+	backends := make([]string, 0, len(maps))
+	for _, m := range maps {
+		data, backend, err := m.server.render(r.Context(), m.opts)
+		if err == nil {
+			data, err = withMetadata(data, m.etag, m.eventTime)
+		}
+		if err != nil {
+			annotateRequest(r.Context(), "error", err.Error())
+			writeAPIError(w, err)
+			return
+		}
+		id := s.images.Put(data)
+		s.images.Tag(renderCacheKey(m.etag, m.eventTime), id)
+		pixels += m.opts.Width * m.opts.Height
+		backends = append(backends, backend)
+		if err := add(m, data, id); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+	}
+	if err := finish(); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+
+	annotateRequest(r.Context(), "maps", len(maps), "backend", strings.Join(backends, ","))
+	recordUsage(r.Context(), pixels)
+	w.Header().Set("Content-Type", contentType)
+	if contentType == "application/zip" {
+		w.Header().Set("Content-Disposition", `attachment; filename="maps.zip"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// Function to tell whether the client asked for multipart/mixed rather than
+// a ZIP
+func acceptsMultipart(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == "multipart/mixed" {
+			return true
+		}
+	}
+	return false
+}
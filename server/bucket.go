@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Values of the output parameter of /map
+const (
+	outputImage = "image" // The PNG itself
+	outputURL   = "url"   // JSON with the URL of the PNG uploaded to -bucket
+)
+
+// Longest validity of a signed URL, as S3 and GCS allow
+const maxBucketURLTTL = 7 * 24 * time.Hour
+
+// Object storage bucket that output=url uploads maps to, over the S3 API.
+// Google Cloud Storage is reached through its S3-compatible XML API, with an
+// HMAC key. Objects are named by the hash of the image, so a map rendered
+// again overwrites the same object.
+type objectBucket struct {
+	endpoint  *url.URL // URL of the bucket; objects are below it
+	prefix    string   // Prefix of the object names
+	region    string
+	publicURL string        // URL the bucket is public at, empty for signed URLs
+	urlTTL    time.Duration // Validity of signed URLs
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// Function to parse -bucket, s3://bucket/prefix or gs://bucket/prefix. The
+// region and endpoint query parameters point s3:// at another region or an
+// S3-compatible service, such as MinIO or Cloudflare R2. Credentials are
+// the standard AWS_* environment variables, holding an HMAC key for gs://.
+func newObjectBucket(raw, publicURL string, urlTTL time.Duration) (*objectBucket, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid bucket %q (must be s3://bucket/prefix or gs://bucket/prefix)", raw)
+	}
+	b := &objectBucket{
+		prefix:    strings.TrimPrefix(u.Path, "/"),
+		region:    u.Query().Get("region"),
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		urlTTL:    urlTTL,
+	}
+	if b.prefix != "" && !strings.HasSuffix(b.prefix, "/") {
+		b.prefix += "/"
+	}
+	if b.publicURL == "" && (urlTTL <= 0 || urlTTL > maxBucketURLTTL) {
+		return nil, fmt.Errorf("invalid bucket URL TTL %s (must be between 1s and 168h)", urlTTL)
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	switch u.Scheme {
+	case "s3":
+		if b.region == "" {
+			b.region = os.Getenv("AWS_REGION")
+		}
+		if b.region == "" {
+			b.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		if endpoint == "" {
+			// Virtual-hosted style, which AWS prefers
+			b.endpoint = &url.URL{Scheme: "https", Host: u.Host + ".s3." + b.region + ".amazonaws.com", Path: "/"}
+		}
+		b.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	case "gs":
+		if b.region == "" {
+			b.region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("invalid bucket %q (must be s3://bucket/prefix or gs://bucket/prefix)", raw)
+	}
+	if b.endpoint == nil {
+		// Path style, which S3-compatible services support without DNS
+		e, err := url.Parse(endpoint)
+		if err != nil || (e.Scheme != "https" && e.Scheme != "http") || e.Host == "" {
+			return nil, fmt.Errorf("invalid bucket endpoint %q (must be an http or https URL)", endpoint)
+		}
+		e.Path = strings.TrimSuffix(e.Path, "/") + "/" + u.Host + "/"
+		b.endpoint = e
+	}
+
+	b.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	b.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload to %s", raw)
+	}
+	return b, nil
+}
+
+// Function to get the URL of an object, on the endpoint of the bucket
+func (b *objectBucket) objectURL(key string) *url.URL {
+	return b.endpoint.JoinPath(key)
+}
+
+// Upload PUTs an image into the bucket. As names are content hashes, objects
+// may be cached for good.
+func (b *objectBucket) Upload(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+	signAWSRequest(req, data, b.accessKey, b.secretKey, b.region, "s3", time.Now())
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bucket returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// URL returns where an uploaded object can be fetched: below the public URL
+// of the bucket, or else a signed URL valid until the time returned
+func (b *objectBucket) URL(key string, now time.Time) (string, time.Time) {
+	if b.publicURL != "" {
+		return b.publicURL + "/" + key, time.Time{}
+	}
+	return presignAWSURL(b.objectURL(key), b.accessKey, b.secretKey, b.sessionToken, b.region, "s3", b.urlTTL, now), now.Add(b.urlTTL)
+}
+
+// Response of output=url
+type uploadedMap struct {
+	URL     string `json:"url"`
+	Expires string `json:"expires,omitempty"` // RFC 3339, unset for public URLs
+	Key     string `json:"key"`
+	ImageID string `json:"image_id"`
+	Bytes   int    `json:"bytes"`
+}
+
+// Function to parse the output parameter of /map, which needs a bucket to
+// upload to for url
+func (s *server) parseOutput(value string) (string, error) {
+	switch value {
+	case "", outputImage:
+		return outputImage, nil
+	case outputURL:
+		if s.bucket == nil {
+			return "", invalidParam(ErrInvalidQuery, "output=url is not available (the server has no bucket)")
+		}
+		return outputURL, nil
+	}
+	return "", invalidParam(ErrInvalidQuery, "Invalid output: %s (must be image or url)", value)
+}
+
+// Function to upload a rendered PNG to the bucket and answer with its URL
+func (s *server) serveUploaded(w http.ResponseWriter, r *http.Request, data []byte, id string) {
+	key := s.bucket.prefix + id + ".png"
+	start := time.Now()
+	if err := s.bucket.Upload(r.Context(), key, data, "image/png"); err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeError(w, http.StatusBadGateway, ErrUploadFailed, fmt.Sprintf("Failed to upload map: %v", err))
+		return
+	}
+	annotateRequest(r.Context(), "upload_key", key, "upload_duration", time.Since(start))
+
+	uploaded := uploadedMap{Key: key, ImageID: id, Bytes: len(data)}
+	var expires time.Time
+	uploaded.URL, expires = s.bucket.URL(key, time.Now())
+	if !expires.IsZero() {
+		uploaded.Expires = expires.UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// Signed URLs expire, so the answer is not cached
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Image-ID", id)
+	json.NewEncoder(w).Encode(uploaded)
+}
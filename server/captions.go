@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Captions used when no template is configured for a publisher and locale
+var defaultCaptions = map[string]string{
+	"en": `M{{printf "%.1f" .Magnitude}} earthquake{{if .Hypocenter}} near {{.Hypocenter}}{{end}} at {{jst .Time}} JST. Maximum intensity {{.MaxIntensity}}.{{if .Tsunami}} Tsunami warning in effect.{{end}}`,
+	"ja": `{{jst .Time}}頃、{{if .Hypocenter}}{{.Hypocenter}}で{{end}}地震がありました。最大震度{{.MaxIntensity}}、マグニチュード{{printf "%.1f" .Magnitude}}。{{if .Tsunami}}津波警報が発表されています。{{end}}`,
+}
+
+var jst = time.FixedZone("JST", 9*60*60)
+
+// Functions available in caption templates
+var captionFuncs = template.FuncMap{
+	"jst": func(t time.Time) string {
+		return t.In(jst).Format("2006-01-02 15:04")
+	},
+	// Prefecture IDs with at least the given intensity, strongest first
+	"atLeast": func(scale int, intensities map[int]int) []int {
+		var ids []int
+		for id, s := range intensities {
+			if s >= scale {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if intensities[ids[i]] != intensities[ids[j]] {
+				return intensities[ids[i]] > intensities[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+		return ids
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+}
+
+// Values a caption template is executed with
+type captionData struct {
+	*quakeEvent
+	MaxIntensity int
+	Publisher    string
+	Locale       string
+}
+
+// Caption templates by publisher, then locale. The "default" publisher
+// applies to publishers without their own entry.
+type captionTemplates struct {
+	templates map[string]map[string]*template.Template
+}
+
+// Function to parse the built-in templates and, if given, a JSON file of
+// {"publisher": {"locale": "template"}} overrides
+func loadCaptionTemplates(path string) (*captionTemplates, error) {
+	sources := map[string]map[string]string{"default": {}}
+	for locale, text := range defaultCaptions {
+		sources["default"][locale] = text
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read caption templates: %w", err)
+		}
+		var custom map[string]map[string]string
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("failed to parse caption templates: %w", err)
+		}
+		for publisher, locales := range custom {
+			if sources[publisher] == nil {
+				sources[publisher] = make(map[string]string)
+			}
+			for locale, text := range locales {
+				sources[publisher][locale] = text
+			}
+		}
+	}
+
+	ct := &captionTemplates{templates: make(map[string]map[string]*template.Template)}
+	for publisher, locales := range sources {
+		ct.templates[publisher] = make(map[string]*template.Template)
+		for locale, text := range locales {
+			name := publisher + "/" + locale
+			tmpl, err := template.New(name).Option("missingkey=error").Funcs(captionFuncs).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid caption template %s: %w", name, err)
+			}
+			// Executing against an empty event catches unknown fields at startup
+			if err := tmpl.Execute(io.Discard, captionData{quakeEvent: &quakeEvent{}}); err != nil {
+				return nil, fmt.Errorf("invalid caption template %s: %w", name, err)
+			}
+			ct.templates[publisher][locale] = tmpl
+		}
+	}
+	return ct, nil
+}
+
+// Function to pick the most specific template: the publisher's own in the
+// locale or English, then the default in the locale or English
+func (ct *captionTemplates) lookup(publisher, locale string) *template.Template {
+	for _, p := range []string{publisher, "default"} {
+		for _, l := range []string{locale, "en"} {
+			if tmpl, ok := ct.templates[p][l]; ok {
+				return tmpl
+			}
+		}
+	}
+	return nil
+}
+
+// Function to produce the message text accompanying a published image
+func (ct *captionTemplates) Caption(publisher, locale string, ev *quakeEvent) (string, error) {
+	tmpl := ct.lookup(publisher, locale)
+	if tmpl == nil {
+		return "", fmt.Errorf("no caption template for %s/%s", publisher, locale)
+	}
+
+	var sb strings.Builder
+	data := captionData{quakeEvent: ev, MaxIntensity: ev.MaxIntensity(nil), Publisher: publisher, Locale: locale}
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to render caption: %w", err)
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// POST an event to preview its caption for ?publisher= and ?locale=
+func (ct *captionTemplates) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var ev quakeEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&ev); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidEvent, fmt.Sprintf("Invalid event: %v", err))
+		return
+	}
+
+	publisher := r.URL.Query().Get("publisher")
+	locale := r.URL.Query().Get("locale")
+	if locale == "" {
+		locale = "en"
+	}
+	caption, err := ct.Caption(publisher, locale, &ev)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, ErrCaptionFailed, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(caption)))
+	w.Write([]byte(caption))
+}
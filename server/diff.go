@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"canvas/render"
+)
+
+// Colors of the diff image: changed pixels stand out on a dimmed copy of the
+// second image
+var (
+	diffChanged = color.RGBA{R: 0xff, G: 0x00, B: 0xff, A: 0xff}
+	diffDimming = 0.5
+)
+
+// Function to compare two images of the same size. Pixels whose channels
+// differ by more than threshold are counted and highlighted.
+func diffImages(a, b image.Image, threshold int) (*image.RGBA, int, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return nil, 0, &apiError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    ErrDimensionMismatch,
+			Message: fmt.Sprintf("Images differ in size: %dx%d and %dx%d", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy()),
+		}
+	}
+
+	// Work on flat NRGBA buffers; At() per pixel is too slow for size=3 maps
+	pa, pb := toNRGBA(a), toNRGBA(b)
+	out := image.NewRGBA(image.Rect(0, 0, ab.Dx(), ab.Dy()))
+	changed := 0
+	for i := 0; i < len(pa.Pix); i += 4 {
+		ca := color.NRGBA{R: pa.Pix[i], G: pa.Pix[i+1], B: pa.Pix[i+2], A: pa.Pix[i+3]}
+		cb := color.NRGBA{R: pb.Pix[i], G: pb.Pix[i+1], B: pb.Pix[i+2], A: pb.Pix[i+3]}
+		c := diffChanged
+		if channelDelta(ca, cb) > threshold {
+			changed++
+		} else {
+			gray := uint8((0.299*float64(cb.R) + 0.587*float64(cb.G) + 0.114*float64(cb.B)) * diffDimming)
+			c = color.RGBA{R: gray, G: gray, B: gray, A: 0xff}
+		}
+		out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return out, changed, nil
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	if n, ok := img.(*image.NRGBA); ok && b.Min == (image.Point{}) && n.Stride == 4*b.Dx() {
+		return n
+	}
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+	return n
+}
+
+// Function to find the largest difference between the channels of two colors
+func channelDelta(a, b color.NRGBA) int {
+	delta := 0
+	for _, d := range []int{
+		int(a.R) - int(b.R), int(a.G) - int(b.G), int(a.B) - int(b.B), int(a.A) - int(b.A),
+	} {
+		if d < 0 {
+			d = -d
+		}
+		if d > delta {
+			delta = d
+		}
+	}
+	return delta
+}
+
+// Function to load one side of a diff: a stored image ID in id, or the query
+// string of a render in spec
+func (s *server) diffSide(r *http.Request, name string) (image.Image, error) {
+	query := r.URL.Query()
+	id, spec := query.Get(name), query.Get(name+"_spec")
+
+	var data []byte
+	switch {
+	case id != "" && spec != "":
+		return nil, invalidParam(ErrInvalidQuery, "Only one of %s and %s_spec can be given", name, name)
+	case id != "":
+		stored, ok := s.images.Get(id)
+		if !ok {
+			return nil, &apiError{Status: http.StatusNotFound, Code: ErrImageNotFound, Message: fmt.Sprintf("Image not found: %s", id)}
+		}
+		data = stored
+	case spec != "":
+		values, err := url.ParseQuery(spec)
+		if err != nil {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid %s_spec: %v", name, err)
+		}
+		rendered, _, err := s.renderQuery(r.Context(), values)
+		if err != nil {
+			return nil, err
+		}
+		data = rendered
+	default:
+		return nil, invalidParam(ErrInvalidQuery, "Either %s (an image ID) or %s_spec (map parameters) is required", name, name)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image %s: %w", name, err)
+	}
+	return img, nil
+}
+
+// GET /diff?a=<id>&b=<id>, or a_spec / b_spec with URL-encoded map parameters
+func (s *server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := 0
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 255 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid threshold: %s (must be between 0 and 255)", v))
+			return
+		}
+		threshold = n
+	}
+
+	a, err := s.diffSide(r, "a")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	b, err := s.diffSide(r, "b")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	out, changed, err := diffImages(a, b, threshold)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	data, err := render.EncodePNG(out)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	total := out.Bounds().Dx() * out.Bounds().Dy()
+	recordUsage(r.Context(), total)
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Diff-Pixels", strconv.Itoa(changed))
+	w.Header().Set("X-Diff-Ratio", strconv.FormatFloat(float64(changed)/float64(total), 'f', 6, 64))
+	w.Write(data)
+}
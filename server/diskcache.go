@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the disk cache is swept of expired entries even when it is
+// under its size, and how long a partly written entry is left to its writer
+const (
+	diskCacheSweepInterval = 10 * time.Minute
+	diskCacheTempTTL       = time.Hour
+)
+
+// Rendered maps kept on disk by the ETag of their request, so that restarts
+// keep expensive renders and several processes can share them. Entries are
+// named by a hash of the ETag, which covers the map data and renderer, and
+// written to a temporary file then renamed, so readers never see half an
+// entry. Entries unused for the TTL are removed, and the least recently used
+// go first when the directory is over its size.
+type diskCache struct {
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+
+	mu sync.Mutex
+	// Bytes in the directory at the last sweep, plus those written since;
+	// other processes' writes show up at the next sweep
+	size     int64
+	sweeping bool
+}
+
+// Function to open the cache directory, creating it if needed, and sweep it
+// now and then
+func newDiskCache(dir string, ttl time.Duration, maxBytes int64) (*diskCache, error) {
+	if ttl <= 0 || maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid disk cache limits: ttl %s, %d bytes (must be positive)", ttl, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create disk cache: %w", err)
+	}
+	c := &diskCache{dir: dir, ttl: ttl, maxBytes: maxBytes}
+	c.sweep()
+	go func() {
+		for range time.Tick(diskCacheSweepInterval) {
+			c.sweep()
+		}
+	}()
+
+	metrics.Help("canvas_disk_cache_bytes", "Bytes of rendered maps in the disk cache, as of the last sweep and this process's writes.")
+	metrics.Help("canvas_disk_cache_requests_total", "Disk cache lookups, by whether they found the map.")
+	metrics.OnCollect(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		metrics.Set("canvas_disk_cache_bytes", "", float64(c.size))
+	})
+	return c, nil
+}
+
+// Function to get the path of the entry of an ETag, spread over 256
+// subdirectories
+func (c *diskCache) path(etag string) string {
+	sum := sha256.Sum256([]byte(etag))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name+".png")
+}
+
+// Get returns the map rendered for an ETag, if it is cached and unexpired.
+// Hits are touched, so entries in use are neither expired nor evicted.
+func (c *diskCache) Get(etag string) ([]byte, bool) {
+	path := c.path(etag)
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > c.ttl {
+		metrics.Add("canvas_disk_cache_requests_total", labels("result", "miss"), 1)
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		metrics.Add("canvas_disk_cache_requests_total", labels("result", "miss"), 1)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	metrics.Add("canvas_disk_cache_requests_total", labels("result", "hit"), 1)
+	return data, true
+}
+
+// Put stores the map rendered for an ETag, sweeping the directory if this
+// takes it over its size
+func (c *diskCache) Put(etag string, data []byte) error {
+	path := c.path(etag)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(data))
+	over := c.size > c.maxBytes && !c.sweeping
+	c.mu.Unlock()
+	if over {
+		go c.sweep()
+	}
+	return nil
+}
+
+// One file of the cache directory
+type diskCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Function to remove expired entries and abandoned temporary files, then the
+// least recently used entries until the directory is back under 90% of its
+// size, so that it is not swept again at the next write
+func (c *diskCache) sweep() {
+	c.mu.Lock()
+	if c.sweeping {
+		c.mu.Unlock()
+		return
+	}
+	c.sweeping = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.sweeping = false
+		c.mu.Unlock()
+	}()
+
+	var (
+		entries []diskCacheEntry
+		total   int64
+		removed int
+	)
+	now := time.Now()
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		age := now.Sub(info.ModTime())
+		switch {
+		case strings.HasPrefix(d.Name(), ".tmp-"):
+			if age > diskCacheTempTTL {
+				os.Remove(path)
+			}
+		case filepath.Ext(path) != ".png":
+		case age > c.ttl:
+			if os.Remove(path) == nil {
+				removed++
+			}
+		default:
+			entries = append(entries, diskCacheEntry{path: path, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+
+	if total > c.maxBytes {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+		for _, e := range entries {
+			if total <= c.maxBytes*9/10 {
+				break
+			}
+			if os.Remove(e.path) == nil {
+				total -= e.size
+				removed++
+			}
+		}
+	}
+	if removed > 0 {
+		slog.Info("swept disk cache", "removed", removed, "bytes", total)
+	}
+
+	c.mu.Lock()
+	c.size = total
+	c.mu.Unlock()
+}
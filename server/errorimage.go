@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"canvas/render"
+)
+
+// Function to tell whether a client wants errors as images, asked for with
+// onerror=image, which chat embeds and <img> tags need since they silently
+// drop any other body
+func wantsErrorImage(r *http.Request) bool {
+	return r.URL.Query().Get("onerror") == "image"
+}
+
+// errorImageWriter holds back error responses so they can be replaced by an
+// image, and passes everything else through
+type errorImageWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (ew *errorImageWriter) WriteHeader(status int) {
+	if status >= 400 && !strings.HasPrefix(ew.Header().Get("Content-Type"), "image/") {
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorImageWriter) Write(b []byte) (int, error) {
+	if ew.status != 0 {
+		return ew.body.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+// Middleware answering failed requests with onerror=image with a PNG of the
+// error, at the size of the map asked for. The status code is kept, and the
+// error code is sent in X-Error-Code.
+func withErrorImages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsErrorImage(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorImageWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status == 0 {
+			return
+		}
+
+		// JSON errors are summarized by their message, and others, such as
+		// the mux's 404, by their text
+		code, message := "", strings.TrimSpace(ew.body.String())
+		var body errorBody
+		if json.Unmarshal(ew.body.Bytes(), &body) == nil && body.Error.Code != "" {
+			code, message = body.Error.Code, body.Error.Message
+		}
+		width, height := placeholderSize(r)
+		data, err := render.Placeholder(width, height, errorImageTitle(ew.status), message)
+		if err != nil {
+			requestLogger(r.Context()).Error("failed to draw error image", "err", err)
+			w.WriteHeader(ew.status)
+			w.Write(ew.body.Bytes())
+			return
+		}
+
+		h := w.Header()
+		if code != "" {
+			h.Set("X-Error-Code", code)
+		}
+		h.Set("Content-Type", "image/png")
+		h.Set("Cache-Control", "no-store")
+		h.Del("Content-Length")
+		w.WriteHeader(ew.status)
+		w.Write(data)
+	})
+}
+
+// Function to title an error image by the kind of failure
+func errorImageTitle(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return "Not found"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "Access denied"
+	case status == http.StatusTooManyRequests:
+		return "Too many requests"
+	case status < 500:
+		return "Invalid map request"
+	case status == http.StatusServiceUnavailable:
+		return maintenanceTitle
+	default:
+		return "Map unavailable"
+	}
+}
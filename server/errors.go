@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Machine-readable error codes, documented in the README. Clients branch on
+// these, so existing codes must not change meaning.
+const (
+	ErrMissingScale        = "MISSING_SCALE"
+	ErrInvalidScale        = "INVALID_SCALE"
+	ErrInvalidPoints       = "INVALID_POINTS"
+	ErrInvalidMarkers      = "INVALID_MARKERS"
+	ErrInvalidOverlay      = "INVALID_OVERLAY"
+	ErrInvalidDimensions   = "INVALID_DIMENSIONS"
+	ErrInvalidStyle        = "INVALID_STYLE"
+	ErrInvalidMargin       = "INVALID_MARGIN"
+	ErrInvalidMinSpan      = "INVALID_MIN_SPAN"
+	ErrInvalidExtent       = "INVALID_EXTENT"
+	ErrInvalidBBox         = "INVALID_BBOX"
+	ErrInvalidBackend      = "INVALID_BACKEND"
+	ErrInvalidPrecision    = "INVALID_PRECISION"
+	ErrInvalidLayers       = "INVALID_LAYERS"
+	ErrInvalidQuery        = "INVALID_QUERY"
+	ErrInvalidEvent        = "INVALID_EVENT"
+	ErrUnknownIDs          = "UNKNOWN_IDS"
+	ErrInvalidTile         = "INVALID_TILE"
+	ErrInvalidFrames       = "INVALID_FRAMES"
+	ErrInvalidPanels       = "INVALID_PANELS"
+	ErrInvalidBatch        = "INVALID_BATCH"
+	ErrInvalidJob          = "INVALID_JOB"
+	ErrInvalidValues       = "INVALID_VALUES"
+	ErrInvalidRamp         = "INVALID_RAMP"
+	ErrInvalidGeoJSON      = "INVALID_GEOJSON"
+	ErrCaptionFailed       = "CAPTION_FAILED"
+	ErrImageNotFound       = "IMAGE_NOT_FOUND"
+	ErrEventNotFound       = "EVENT_NOT_FOUND"
+	ErrMapNotFound         = "MAP_NOT_FOUND"
+	ErrJobNotFound         = "JOB_NOT_FOUND"
+	ErrJobNotFinished      = "JOB_NOT_FINISHED"
+	ErrDimensionMismatch   = "DIMENSION_MISMATCH"
+	ErrNoStations          = "NO_STATIONS"
+	ErrNoHypocenter        = "NO_HYPOCENTER"
+	ErrUnauthorized        = "UNAUTHORIZED"
+	ErrForbidden           = "FORBIDDEN"
+	ErrFeatureDisabled     = "FEATURE_DISABLED"
+	ErrMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	ErrPayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	ErrRateLimited         = "RATE_LIMITED"
+	ErrQuotaExceeded       = "QUOTA_EXCEEDED"
+	ErrRenderFailed        = "RENDER_FAILED"
+	ErrOverloaded          = "OVERLOADED"
+	ErrMaintenance         = "MAINTENANCE"
+	ErrUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	ErrUploadFailed        = "UPLOAD_FAILED"
+	ErrInternal            = "INTERNAL_ERROR"
+)
+
+// Error carrying the HTTP status and code it is reported with
+type apiError struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+	// Query parameter at fault, when one is
+	Param string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// Function to build a 400 error for an invalid request parameter
+func invalidParam(code, format string, args ...any) error {
+	return &apiError{Status: http.StatusBadRequest, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Param   string `json:"param,omitempty"`
+	} `json:"error"`
+}
+
+// Function to write {"error": {"code": ..., "message": ...}} with the status
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	writeErrorBody(w, status, body)
+}
+
+// Function to write an error body with the status
+func writeErrorBody(w http.ResponseWriter, status int, body errorBody) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Function to report an error, using its status and code if it is an
+// apiError and a 500 otherwise
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		if apiErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+		}
+		var body errorBody
+		body.Error.Code, body.Error.Message, body.Error.Param = apiErr.Code, apiErr.Message, apiErr.Param
+		writeErrorBody(w, apiErr.Status, body)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Bumped whenever a change to the drawing code alters the output for the
+// same parameters, so cached maps are not served after a deploy
+const RENDERER_VERSION = "9"
+
+// Function to fingerprint the assets a render depends on: the map data, the
+// fonts and the renderer itself
+func assetVersion(simplify bool, paths ...string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "renderer=%s simplify=%t\n", RENDERER_VERSION, simplify)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// Function to derive the ETag of a render from its normalized options, so
+// equivalent queries (reordered scale entries, size=1 versus width=1280)
+// share one. The tag is weak: without a forced backend, canary renders of
+// the same map may differ in their bytes but not in what they show.
+func optionsETag(assets string, v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(append([]byte(assets+"\n"), data...))
+	return `W/"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// Function to check an If-None-Match header against an ETag, using the weak
+// comparison RFC 9110 prescribes for it
+func etagMatches(header, etag string) bool {
+	if header == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to set the caching headers of a render
+func setCacheHeaders(w http.ResponseWriter, etag string, maxAge int) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+}
+
+// Function to answer 304 when the client already holds the render; returns
+// true when the response is complete. Checked before rendering, so a
+// revalidation costs no rasterization.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, maxAge int) bool {
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	setCacheHeaders(w, etag, maxAge)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,58 @@
+package server
+
+import "time"
+
+// An earthquake as ingested from a feed, with the observed intensity per
+// prefecture on the same 0-7 scale as the scale query parameter
+type quakeEvent struct {
+	ID          string      `json:"id"`
+	Time        time.Time   `json:"time"`
+	Hypocenter  string      `json:"hypocenter,omitempty"`
+	Latitude    float64     `json:"latitude"`
+	Longitude   float64     `json:"longitude"`
+	Depth       float64     `json:"depth"`
+	Magnitude   float64     `json:"magnitude"`
+	Tsunami     bool        `json:"tsunami"`
+	Intensities map[int]int `json:"intensities"`
+	// Observation points of the report, when the feed lists them
+	Stations []stationIntensity `json:"stations,omitempty"`
+}
+
+// Intensity observed at one station, named as in the feed
+type stationIntensity struct {
+	Name  string `json:"name"`
+	Scale int    `json:"scale"`
+}
+
+// Function to place an event that names its hypocenter region but gives no
+// epicenter, or the unknown -200,-200 of p2pquake, by the region's
+// coordinates. Events whose region is not known are left as they are.
+func (ev *quakeEvent) locate() {
+	known := ev.Latitude >= -90 && ev.Latitude <= 90 && ev.Longitude >= -180 && ev.Longitude <= 180 &&
+		(ev.Latitude != 0 || ev.Longitude != 0)
+	if known || ev.Hypocenter == "" {
+		return
+	}
+	if lat, lon, ok := epicenters.Geocode(ev.Hypocenter); ok {
+		ev.Latitude, ev.Longitude = lat, lon
+	}
+}
+
+// Function to find the highest intensity, optionally among some prefectures only
+func (ev *quakeEvent) MaxIntensity(prefectures []int) int {
+	highest := 0
+	if len(prefectures) == 0 {
+		for _, scale := range ev.Intensities {
+			if scale > highest {
+				highest = scale
+			}
+		}
+		return highest
+	}
+	for _, id := range prefectures {
+		if ev.Intensities[id] > highest {
+			highest = ev.Intensities[id]
+		}
+	}
+	return highest
+}
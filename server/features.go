@@ -0,0 +1,395 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"canvas/render"
+)
+
+// Query parameter, and optionally one of its values, that a feature flag
+// gates. An empty value gates the parameter whatever it is set to. A gate
+// with a path prefix instead gates every request under it.
+type featureGate struct {
+	param string
+	value string
+	path  string
+}
+
+// Capability that operators turn on or off per deployment or per API key,
+// so experimental parts of the API can be rolled out gradually
+type featureFlag struct {
+	name        string
+	description string
+	// State when neither the configuration nor an operator sets it.
+	// Capabilities that shipped before their flag default to on, so
+	// existing clients keep working; experimental ones default to off.
+	enabled bool
+	gates   []featureGate
+	// Whether the build has the capability at all, when it depends on build
+	// tags; flags the build lacks are not reported
+	available func() bool
+}
+
+// Function to get whether the build has the capability of a flag
+func (f featureFlag) built() bool {
+	return f.available == nil || f.available()
+}
+
+// Known feature flags
+var featureFlags = []featureFlag{
+	{
+		name:        "accel_backend",
+		description: "backend=accel, the experimental accelerated rasterizer (in builds with the accel tag)",
+		gates:       []featureGate{{param: "backend", value: "accel"}},
+		available: func() bool {
+			_, ok := render.Backends["accel"]
+			return ok
+		},
+	},
+	{
+		name:        "custom_style",
+		description: "stroke, stroke_width and fill_opacity, to restyle the borders and fills",
+		enabled:     true,
+		gates:       []featureGate{{param: "stroke"}, {param: "stroke_width"}, {param: "fill_opacity"}},
+	},
+	{
+		name:        "palette",
+		description: "values, ramp and ramp_mode, choropleth maps colored by a ramp",
+		enabled:     true,
+		gates:       []featureGate{{param: "values"}, {param: "ramp"}, {param: "ramp_mode"}},
+	},
+	{
+		name:        "overlays",
+		description: "overlay and reference, GeoJSON and built-in line overlays",
+		enabled:     true,
+		gates:       []featureGate{{param: "overlay"}, {param: "reference"}},
+	},
+	{
+		name:        "tiles",
+		description: "/tiles/{z}/{x}/{y}, the map as XYZ web map tiles",
+		enabled:     true,
+		gates:       []featureGate{{path: "/tiles/"}},
+	},
+}
+
+// Function to find a feature flag by name
+func lookupFeature(name string) (featureFlag, bool) {
+	i := slices.IndexFunc(featureFlags, func(f featureFlag) bool { return f.name == name })
+	if i < 0 {
+		return featureFlag{}, false
+	}
+	return featureFlags[i], true
+}
+
+// Configuration of the -features file: the state of flags for the
+// deployment, and for API keys by name
+type featureConfig struct {
+	Flags map[string]bool            `json:"flags,omitempty"`
+	Keys  map[string]map[string]bool `json:"keys,omitempty"`
+}
+
+// Function to check that a configuration only names known flags
+func (c *featureConfig) validate() error {
+	check := func(flags map[string]bool) error {
+		for name := range flags {
+			if _, ok := lookupFeature(name); !ok {
+				return fmt.Errorf("unknown feature flag: %s", name)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Flags); err != nil {
+		return err
+	}
+	for key, flags := range c.Keys {
+		if err := check(flags); err != nil {
+			return fmt.Errorf("key %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Feature flags of the process. The state of a flag for a request is that
+// of its API key if set, else that of the deployment, else the default of
+// the flag. Operators change it at runtime at /features; changes last until
+// the process restarts and are not shared between replicas.
+type featureSet struct {
+	mu sync.Mutex
+	// State from the -features file
+	config featureConfig
+	// State set at runtime, over config
+	runtime featureConfig
+	audit   *auditLog
+}
+
+// Function to load the -features file; an empty path leaves every flag at
+// its default
+func loadFeatures(path string, audit *auditLog) (*featureSet, error) {
+	f := &featureSet{audit: audit}
+	if path == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature flags: %w", err)
+	}
+	if err := json.Unmarshal(data, &f.config); err != nil {
+		return nil, fmt.Errorf("failed to parse feature flags: %w", err)
+	}
+	if err := f.config.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Function to get whether a flag is on for an API key
+func (f *featureSet) Enabled(name, key string) bool {
+	flag, ok := lookupFeature(name)
+	if !ok {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range []featureConfig{f.runtime, f.config} {
+		if on, ok := c.Keys[key][name]; ok {
+			return on
+		}
+	}
+	for _, c := range []featureConfig{f.runtime, f.config} {
+		if on, ok := c.Flags[name]; ok {
+			return on
+		}
+	}
+	return flag.enabled
+}
+
+// Function to get the state of every flag the build has for an API key
+func (f *featureSet) For(key string) map[string]bool {
+	states := make(map[string]bool, len(featureFlags))
+	for _, flag := range featureFlags {
+		if flag.built() {
+			states[flag.name] = f.Enabled(flag.name, key)
+		}
+	}
+	return states
+}
+
+// Function to find a capability of the query whose flag is off for an API
+// key, returning the flag and what the query used of it. Path gates apply to
+// the path of the request.
+func (f *featureSet) disabled(path string, query url.Values, key string) (string, string, bool) {
+	for _, flag := range featureFlags {
+		for _, gate := range flag.gates {
+			if gate.path != "" {
+				if !strings.HasPrefix(path, gate.path) {
+					continue
+				}
+				if f.Enabled(flag.name, key) {
+					break
+				}
+				return flag.name, path, true
+			}
+			if !query.Has(gate.param) || (gate.value != "" && query.Get(gate.param) != gate.value) {
+				continue
+			}
+			if f.Enabled(flag.name, key) {
+				break
+			}
+			used := gate.param
+			if gate.value != "" {
+				used += "=" + gate.value
+			}
+			return flag.name, used, true
+		}
+	}
+	return "", "", false
+}
+
+// Middleware refusing requests that use a capability whose flag is off for
+// their API key, with 403 FEATURE_DISABLED. The maps of a batch and the
+// sides of a diff are checked like the query.
+func (f *featureSet) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyName(r.Context())
+		for _, query := range renderQueries(r) {
+			if name, used, ok := f.disabled(r.URL.Path, query, key); ok {
+				annotateRequest(r.Context(), "feature_disabled", name)
+				writeError(w, http.StatusForbidden, ErrFeatureDisabled, fmt.Sprintf("%s is not enabled (feature %s)", used, name))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type featureStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+	Enabled     bool   `json:"enabled"`
+	// State per API key, where it differs from the deployment
+	Keys map[string]bool `json:"keys,omitempty"`
+}
+
+// GET lists the feature flags with their state for the deployment and the
+// API keys that override it. PUT sets a flag, as {"name": "overlays",
+// "enabled": false}, for one API key when "key" is given. DELETE with name=
+// (and key=) drops what PUT set, back to the -features file.
+func (f *featureSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Name    string `json:"name"`
+			Enabled *bool  `json:"enabled"`
+			Key     string `json:"key"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid feature flag: %v", err))
+			return
+		}
+		if _, ok := lookupFeature(req.Name); !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Unknown feature flag: %s", req.Name))
+			return
+		}
+		if req.Enabled == nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "enabled is required")
+			return
+		}
+		f.set(req.Name, req.Key, *req.Enabled)
+		f.audit.Record(auditActor(r), "feature.set", req.Name, map[string]string{
+			"key":     req.Key,
+			"enabled": strconv.FormatBool(*req.Enabled),
+		})
+	case http.MethodDelete:
+		name, key := r.URL.Query().Get("name"), r.URL.Query().Get("key")
+		if _, ok := lookupFeature(name); !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Unknown feature flag: %s", name))
+			return
+		}
+		f.reset(name, key)
+		f.audit.Record(auditActor(r), "feature.reset", name, map[string]string{"key": key})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"features": f.status()})
+}
+
+// Function to set a flag at runtime, for the deployment when key is empty
+func (f *featureSet) set(name, key string, on bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		if f.runtime.Flags == nil {
+			f.runtime.Flags = make(map[string]bool)
+		}
+		f.runtime.Flags[name] = on
+		return
+	}
+	if f.runtime.Keys == nil {
+		f.runtime.Keys = make(map[string]map[string]bool)
+	}
+	if f.runtime.Keys[key] == nil {
+		f.runtime.Keys[key] = make(map[string]bool)
+	}
+	f.runtime.Keys[key][name] = on
+}
+
+// Function to drop what set changed
+func (f *featureSet) reset(name, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		delete(f.runtime.Flags, name)
+		return
+	}
+	delete(f.runtime.Keys[key], name)
+}
+
+// Function to describe every flag the build has, with the keys set in the
+// configuration or at runtime
+func (f *featureSet) status() []featureStatus {
+	f.mu.Lock()
+	var keys []string
+	for _, c := range []featureConfig{f.config, f.runtime} {
+		for key := range c.Keys {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	var statuses []featureStatus
+	for _, flag := range featureFlags {
+		if !flag.built() {
+			continue
+		}
+		// The deployment state is that of a key with no overrides
+		enabled := f.Enabled(flag.name, "")
+		status := featureStatus{Name: flag.name, Description: flag.description, Default: flag.enabled, Enabled: enabled}
+		for _, key := range keys {
+			if on := f.Enabled(flag.name, key); on != enabled {
+				if status.Keys == nil {
+					status.Keys = make(map[string]bool)
+				}
+				status.Keys[key] = on
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+type versionInfo struct {
+	Version  string          `json:"version"`
+	Revision string          `json:"revision,omitempty"`
+	Go       string          `json:"go"`
+	Backends []string        `json:"backends"`
+	Features map[string]bool `json:"features"`
+}
+
+// Function to get the module version and VCS revision the server was built
+// from
+func buildVersion() (version, revision string) {
+	version = "(devel)"
+	if build, ok := debug.ReadBuildInfo(); ok {
+		version = build.Main.Version
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	return version, revision
+}
+
+// Function to handle GET /version: the build of the server, its backends,
+// and the feature flags as they apply to the caller's API key
+func (f *featureSet) versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := versionInfo{Go: runtime.Version(), Features: f.For(apiKeyName(r.Context()))}
+	info.Version, info.Revision = buildVersion()
+	for name := range render.Backends {
+		info.Backends = append(info.Backends, name)
+	}
+	sort.Strings(info.Backends)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/render"
+)
+
+// Longest file name, in bytes, once the tokens are filled in
+const maxFilenameLength = 128
+
+// Tokens of the filename parameter
+var filenameTokens = []string{"{date}", "{event}", "{max}", "{width}", "{height}"}
+
+var filenameTokenPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Function to check the download and filename parameters, before anything is
+// rendered
+func parseDownload(query url.Values) error {
+	switch query.Get("download") {
+	case "", "0", "1", "true", "false":
+	default:
+		return invalidParam(ErrInvalidQuery, "Invalid download: %s (must be 1 or 0)", query.Get("download"))
+	}
+	for _, token := range filenameTokenPattern.FindAllString(query.Get("filename"), -1) {
+		if !knownFilenameToken(token) {
+			return invalidParam(ErrInvalidQuery, "Invalid filename: unknown token %s (must be one of %s)", token, strings.Join(filenameTokens, ", "))
+		}
+	}
+	return nil
+}
+
+func knownFilenameToken(token string) bool {
+	for _, known := range filenameTokens {
+		if token == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to build the Content-Disposition of a map: an attachment with
+// download=1, else inline when a filename is given, else none. The date is
+// that of the boundaries drawn, which event maps set to the day of the
+// event, or today in JST.
+func contentDisposition(query url.Values, opts *render.Options, eventID string) string {
+	download := query.Get("download") == "1" || query.Get("download") == "true"
+	template := query.Get("filename")
+	if !download && template == "" {
+		return ""
+	}
+	if template == "" {
+		template = "map"
+		if eventID != "" {
+			template = "{date}_{event}_shindo{max}"
+		}
+	}
+
+	date := time.Now().In(jst).Format("20060102")
+	if asof, err := time.Parse(time.DateOnly, query.Get("asof")); err == nil {
+		date = asof.Format("20060102")
+	}
+	top := 0
+	for _, scale := range opts.ScaleMap {
+		top = max(top, scale)
+	}
+	for _, p := range opts.Points {
+		top = max(top, p.Scale)
+	}
+	name := strings.NewReplacer(
+		"{date}", date,
+		"{event}", eventID,
+		"{max}", strconv.Itoa(top),
+		"{width}", strconv.Itoa(opts.Width),
+		"{height}", strconv.Itoa(opts.Height),
+	).Replace(template)
+	name = sanitizeFilename(name)
+	if !strings.HasSuffix(strings.ToLower(name), ".png") {
+		name += ".png"
+	}
+
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+	// Browsers take the UTF-8 name from filename*, and older clients an
+	// ASCII one with anything else replaced
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, name)
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, ascii, escapeRFC5987(name))
+}
+
+// Function to percent-encode a value for filename*, keeping only the
+// attr-chars of RFC 5987
+func escapeRFC5987(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// Function to make a file name safe to save: no directories, control
+// characters or characters Windows refuses, no leading dots, and not too
+// long. Names left empty become "map".
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > maxFilenameLength {
+		name = strings.ToValidUTF8(name[:maxFilenameLength], "")
+	}
+	if name == "" {
+		return "map"
+	}
+	return name
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"canvas/geo"
+	"canvas/i18n"
+)
+
+// Longest range of a frequency map, in days
+const maxFrequencyDays = 366
+
+// Colors of the counts unless the query gives a ramp: pale for a few
+// exceedances, dark red for many
+const defaultFrequencyRamp = "1:#fde68a,2:#fbbf24,5:#f97316,10:#dc2626,25:#7f1d1d"
+
+// Function to count, per prefecture, the earthquakes that reached an
+// intensity there. Every prefecture has a count, so the view takes in the
+// whole country.
+func exceedanceCounts(events []*quakeEvent, minIntensity int) map[int]int {
+	counts := make(map[int]int, len(geo.Prefectures))
+	for _, p := range geo.Prefectures {
+		counts[p.Code] = 0
+	}
+	for _, ev := range events {
+		for id, scale := range ev.Intensities {
+			if _, ok := counts[id]; ok && scale >= minIntensity {
+				counts[id]++
+			}
+		}
+	}
+	return counts
+}
+
+// GET /frequency renders how many times each prefecture reached an
+// intensity over a date range, as a choropleth map: from= and to= are the
+// first and last days in JST (to defaults to today), and min_intensity= the
+// intensity counted (default 3). Every /map parameter except scale, values
+// and event is accepted; ramp and ramp_mode override the default colors.
+func (s *server) frequencyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for _, name := range []string{"scale", "values", "event"} {
+		if query.Has(name) {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, name+" cannot be given for /frequency")
+			return
+		}
+	}
+	parseDay := func(name, value string) (time.Time, bool) {
+		day, err := time.ParseInLocation(time.DateOnly, value, jst)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid %s: %s (must be YYYY-MM-DD)", name, value))
+			return time.Time{}, false
+		}
+		return day, true
+	}
+	if query.Get("from") == "" {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "from parameter is required")
+		return
+	}
+	from, ok := parseDay("from", query.Get("from"))
+	if !ok {
+		return
+	}
+	today := time.Now().In(jst).Format(time.DateOnly)
+	last, ok := parseDay("to", cmp.Or(query.Get("to"), today))
+	if !ok {
+		return
+	}
+	to := last.AddDate(0, 0, 1)
+	if !to.After(from) || to.Sub(from) > maxFrequencyDays*24*time.Hour {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid range: %s to %s (to must not be before from, and at most %d days apart)", from.Format(time.DateOnly), last.Format(time.DateOnly), maxFrequencyDays))
+		return
+	}
+	minIntensity := 3
+	if v := query.Get("min_intensity"); v != "" {
+		var err error
+		if minIntensity, err = strconv.Atoi(v); err != nil || minIntensity < 1 || minIntensity > 7 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid min_intensity: %s (must be 1 to 7)", v))
+			return
+		}
+	}
+
+	events, err := s.feed.Between(r.Context(), from, to, minIntensity)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	counts := exceedanceCounts(events, minIntensity)
+	values := make([]ValueQuery, 0, len(counts))
+	for _, p := range geo.Prefectures {
+		values = append(values, ValueQuery{ID: p.Code, Value: float64(counts[p.Code])})
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	for _, name := range []string{"from", "to", "min_intensity"} {
+		q.Del(name)
+	}
+	q.Set("values", string(data))
+	if q.Get("ramp") == "" {
+		q.Set("ramp", defaultFrequencyRamp)
+	}
+	if q.Get("footer") == "" {
+		lang := q.Get("lang")
+		span := i18n.T(lang, "span", from.Format(time.DateOnly), last.Format(time.DateOnly))
+		q.Set("footer", i18n.T(lang, "footer.frequency", minIntensity, span, len(events))+"  "+i18n.T(lang, "footer.source"))
+	}
+	annotateRequest(r.Context(), "events", len(events), "min_intensity", minIntensity)
+	// Ranges reaching today still gain events
+	maxAge := s.maxAge
+	if !to.Before(time.Now()) {
+		maxAge = int(s.feed.ttl.Seconds())
+	}
+	// serveMap counts the render towards the usage of the API key
+	s.serveMap(w, r, q, maxAge)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"canvas/render"
+)
+
+// PanelQuery is one entry of the panels parameter: the intensities of one
+// map of a grid, and its title.
+type PanelQuery struct {
+	Title  string           `json:"title,omitempty"`
+	Scale  []IntensityQuery `json:"scale,omitempty"`
+	Points json.RawMessage  `json:"points,omitempty"`
+}
+
+// Function to parse the panels of a grid, each through the /map parameters
+// with its own scale and points, and the number of columns they are laid
+// out in
+func parseGrid(query url.Values) (*render.Options, []render.Panel, int, error) {
+	var queries []PanelQuery
+	if err := json.Unmarshal([]byte(query.Get("panels")), &queries); err != nil {
+		return nil, nil, 0, invalidParam(ErrInvalidPanels, "Invalid panels data format: %v", err)
+	}
+	if len(queries) == 0 || len(queries) > render.MAX_PANELS {
+		return nil, nil, 0, invalidParam(ErrInvalidPanels, "Invalid number of panels: %d (must be between 1 and %d)", len(queries), render.MAX_PANELS)
+	}
+
+	// Side by side up to three panels, then in rows of as even a length as
+	// possible
+	columns := len(queries)
+	if columns > 3 {
+		columns = map[int]int{4: 2, 5: 3, 6: 3, 7: 4, 8: 4, 9: 3}[columns]
+	}
+	if v := query.Get("columns"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > render.MAX_PANELS {
+			return nil, nil, 0, invalidParam(ErrInvalidQuery, "Invalid columns: %s (must be between 1 and %d)", v, render.MAX_PANELS)
+		}
+		columns = n
+	}
+
+	base := url.Values{}
+	for k, v := range query {
+		base[k] = v
+	}
+	base.Del("panels")
+	base.Del("columns")
+	if base.Has("scale") || base.Has("points") {
+		return nil, nil, 0, invalidParam(ErrInvalidQuery, "scale and points cannot be combined with panels")
+	}
+
+	var opts *render.Options
+	panels := make([]render.Panel, len(queries))
+	for i, pq := range queries {
+		q := url.Values{}
+		for k, v := range base {
+			q[k] = v
+		}
+		scale, _ := json.Marshal(pq.Scale)
+		q.Set("scale", string(scale))
+		if len(pq.Points) > 0 {
+			q.Set("points", string(pq.Points))
+		}
+		panelOpts, err := ParseRenderOptions(q)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		opts = panelOpts
+		panels[i] = render.Panel{ScaleMap: panelOpts.ScaleMap, Points: panelOpts.Points, Title: pq.Title}
+	}
+
+	width, height := render.GridSize(opts, len(panels), columns)
+	if width > render.MAX_DIMENSION || height > render.MAX_DIMENSION || width*height > render.MAX_PIXELS {
+		return nil, nil, 0, invalidParam(ErrInvalidDimensions, "Grid too large: %dx%d (at most %d on a side and %d pixels; lower width or height)",
+			width, height, render.MAX_DIMENSION, render.MAX_PIXELS)
+	}
+	return opts, panels, columns, nil
+}
+
+// GET /grid?panels=[{"title":"...","scale":[...]},...]&columns=2, with any
+// other /map parameter applying to every panel
+func (s *server) gridHandler(w http.ResponseWriter, r *http.Request) {
+	opts, panels, columns, err := parseGrid(r.URL.Query())
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	etag := optionsETag(s.assets, []any{"grid", opts, panels, columns})
+	if notModified(w, r, etag, s.maxAge) {
+		return
+	}
+
+	backend := opts.Backend
+	if backend == "" {
+		backend = s.rollout.Pick()
+	}
+	release, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	rgba, err := render.Grid(s.dataset, opts, render.Backends[backend], panels, columns)
+	var data []byte
+	if err == nil {
+		data, err = render.EncodePNG(rgba)
+	}
+	annotateRequest(r.Context(), "backend", backend, "panels", len(panels), "render_duration", time.Since(start))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+
+	id := s.images.Put(data)
+	recordUsage(r.Context(), rgba.Bounds().Dx()*rgba.Bounds().Dy())
+	setCacheHeaders(w, etag, s.maxAge)
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Render-Backend", backend)
+	w.Header().Set("X-Image-ID", id)
+	w.Write(data)
+}
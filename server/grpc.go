@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/canvaspb"
+	"canvas/render"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Domain of the ErrorInfo detail of gRPC errors, whose reason is the code
+// the HTTP API reports
+const grpcErrorDomain = "canvas"
+
+// The gRPC API of canvaspb/canvas.proto. Calls run as requests to the
+// public endpoints, through the same feature flags, maintenance mode,
+// limits and access log, like jobs do.
+type grpcService struct {
+	canvaspb.UnimplementedCanvasServer
+	handler http.Handler // The public endpoints, behind the feature flags
+	frames  http.Handler // Streams the frames of RenderFrames, behind the same gates as /animation
+}
+
+// Stream of a RenderFrames call, carried to the frames handler by the
+// context of its request
+type frameStreamKey struct{}
+
+// Function to build the gRPC server of the API
+func newGRPCServer(handler, frames http.Handler) *grpc.Server {
+	srv := grpc.NewServer()
+	canvaspb.RegisterCanvasServer(srv, &grpcService{handler: withRequestLog(handler), frames: withRequestLog(frames)})
+	return srv
+}
+
+// Render draws one map through GET /map, /map/latest or /map/{name}.
+func (g *grpcService) Render(ctx context.Context, req *canvaspb.RenderRequest) (*canvaspb.RenderResponse, error) {
+	query := grpcQuery(req.Params, req.Scale, req.Points)
+	path := "/map"
+	switch {
+	case req.Event == "latest":
+		if req.Map != "" {
+			return nil, status.Error(codes.InvalidArgument, "map cannot be given with event latest")
+		}
+		path = "/map/latest"
+	case req.Event != "":
+		query.Set("event", req.Event)
+	}
+	if req.Map != "" {
+		path = "/map/" + url.PathEscape(req.Map)
+	}
+
+	rec, err := g.serve(ctx, g.handler, path, query)
+	if err != nil {
+		return nil, err
+	}
+	var unknown []int32
+	if ids := rec.header.Get("X-Unknown-IDs"); ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			n, _ := strconv.Atoi(id)
+			unknown = append(unknown, int32(n))
+		}
+	}
+	return &canvaspb.RenderResponse{
+		Image:       rec.body.Bytes(),
+		ContentType: rec.header.Get("Content-Type"),
+		ImageId:     rec.header.Get("X-Image-ID"),
+		Etag:        rec.header.Get("ETag"),
+		Backend:     rec.header.Get("X-Render-Backend"),
+		EventId:     rec.header.Get("X-Event-ID"),
+		EventTime:   rec.header.Get("X-Event-Time"),
+		UnknownIds:  unknown,
+	}, nil
+}
+
+// RenderFrames draws an animation as GET /animation does, sending each frame
+// as it is drawn.
+func (g *grpcService) RenderFrames(req *canvaspb.AnimationRequest, stream canvaspb.Canvas_RenderFramesServer) error {
+	query := grpcQuery(req.Params, req.Scale, req.Points)
+	if len(req.Steps) > 0 {
+		steps := make([]FrameQuery, len(req.Steps))
+		for i, step := range req.Steps {
+			if step.Time != "" {
+				t, err := time.Parse(time.RFC3339, step.Time)
+				if err != nil {
+					return status.Errorf(codes.InvalidArgument, "Invalid time of step %d: %s (must be RFC 3339)", i, step.Time)
+				}
+				steps[i].Time = t
+			}
+			steps[i].Scale = intensityQueries(step.Scale)
+			if len(step.Points) > 0 {
+				steps[i].Points, _ = json.Marshal(pointQueries(step.Points))
+			}
+		}
+		data, _ := json.Marshal(steps)
+		query.Set("frames", string(data))
+	}
+	ctx := context.WithValue(stream.Context(), frameStreamKey{}, stream)
+	_, err := g.serve(ctx, g.frames, "/animation", query)
+	return err
+}
+
+// Function to run a call as a GET request to handler, and turn an error
+// response into a gRPC status with the code of the HTTP API
+func (g *grpcService) serve(ctx context.Context, handler http.Handler, path string, query url.Values) (*jobRecorder, error) {
+	target := path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			req.Header.Set("X-Request-ID", ids[0])
+		}
+	}
+	rec := &jobRecorder{header: http.Header{}}
+	handler.ServeHTTP(rec, req)
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", rec.header.Get("X-Request-ID")))
+	if rec.status == 0 || rec.status == http.StatusOK {
+		return rec, nil
+	}
+
+	var body errorBody
+	json.Unmarshal(rec.body.Bytes(), &body)
+	st := status.New(grpcCode(rec.status), body.Error.Message)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: body.Error.Code, Domain: grpcErrorDomain}}
+	if body.Error.Param != "" {
+		details = append(details, &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: body.Error.Param, Description: body.Error.Message}}})
+	}
+	if seconds, err := strconv.Atoi(rec.header.Get("Retry-After")); err == nil {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(seconds) * time.Second)})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return nil, st.Err()
+}
+
+// Function to map the HTTP status of an error to its gRPC code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+// Function to build the query of a call from its parameters, with the
+// intensities and points given as messages
+func grpcQuery(params map[string]string, scale []*canvaspb.Intensity, points []*canvaspb.Point) url.Values {
+	query := url.Values{}
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	if len(scale) > 0 {
+		data, _ := json.Marshal(intensityQueries(scale))
+		query.Set("scale", string(data))
+	}
+	if len(points) > 0 {
+		data, _ := json.Marshal(pointQueries(points))
+		query.Set("points", string(data))
+	}
+	return query
+}
+
+func intensityQueries(scale []*canvaspb.Intensity) []IntensityQuery {
+	queries := make([]IntensityQuery, len(scale))
+	for i, s := range scale {
+		queries[i] = IntensityQuery{ID: int(s.Id), Scale: int(s.Scale)}
+	}
+	return queries
+}
+
+func pointQueries(points []*canvaspb.Point) []PointQuery {
+	queries := make([]PointQuery, len(points))
+	for i, p := range points {
+		queries[i] = PointQuery{Name: p.Name, Lat: p.Lat, Lon: p.Lon, Scale: int(p.Scale)}
+	}
+	return queries
+}
+
+// Function to draw the animation of a RenderFrames call and send each frame
+// to its stream as a PNG once it is drawn
+func (s *server) framesHandler(w http.ResponseWriter, r *http.Request) {
+	stream, ok := r.Context().Value(frameStreamKey{}).(canvaspb.Canvas_RenderFramesServer)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrInternal, "no stream to send frames to")
+		return
+	}
+	opts, frames, err := parseAnimation(r.URL.Query())
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+
+	backend := opts.Backend
+	if backend == "" {
+		backend = s.rollout.Pick()
+	}
+	release, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	err = render.DrawFrames(s.dataset, opts, render.Backends[backend], frames, func(i int, rgba *image.RGBA) error {
+		data, err := render.EncodePNG(rgba)
+		if err != nil {
+			return err
+		}
+		return stream.Send(&canvaspb.Frame{
+			Index:   int32(i),
+			Count:   int32(len(frames)),
+			Png:     data,
+			DelayMs: int32(frames[i].Delay.Milliseconds()),
+			Label:   frames[i].Label,
+		})
+	})
+	annotateRequest(r.Context(), "backend", backend, "frames", len(frames), "render_duration", time.Since(start))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+	recordUsage(r.Context(), opts.Width*opts.Height*len(frames))
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// Function to send the map as an svg element to inline in a page, drawn by
+// the same renderer as the PNG. Each prefecture's path has its name and
+// intensity as a tooltip, and data attributes for scripts and style sheets;
+// with href, it links to its page.
+func (s *server) serveHTMLMap(w http.ResponseWriter, r *http.Request, opts *render.Options, maxAge int) {
+	href, err := parseHrefTemplate(r.URL.Query().Get("href"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	etag := optionsETag(s.assets, struct {
+		*render.Options
+		Format, Href string
+	}{opts, formatHTML, href})
+	if notModified(w, r, etag, maxAge) {
+		return
+	}
+
+	release, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer release()
+	scene := render.BuildScene(s.dataset, opts)
+	scene.Annotate = func(id int, name, nameJa string) render.SVGAnnotation {
+		region := hitRegionJSON{ID: id, Name: name, NameJa: nameJa, Scale: opts.ScaleMap[id], lang: opts.Lang, scaleType: opts.ScaleType}
+		a := render.SVGAnnotation{Data: [][2]string{{"id", strconv.Itoa(id)}}}
+		if name != "" {
+			a.Data = append(a.Data, [2]string{"name", name})
+		}
+		if nameJa != "" {
+			a.Data = append(a.Data, [2]string{"name-ja", nameJa})
+		}
+		a.Data = append(a.Data, [2]string{"scale", strconv.Itoa(region.Scale)})
+		if v, ok := opts.Values[id]; ok {
+			region.Value = &v
+			a.Data = append(a.Data, [2]string{"value", strconv.FormatFloat(v, 'f', -1, 64)})
+		}
+		a.Title, a.Href = region.Title(), region.link(href)
+		return a
+	}
+	data, err := render.InlineSVG(scene, `role="img"`, fmt.Sprintf(`aria-label="%s"`, html.EscapeString(i18n.T(opts.Lang, "map.alt"))))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+	annotateRequest(r.Context(), "format", formatHTML)
+
+	setCacheHeaders(w, etag, maxAge)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(data)
+}
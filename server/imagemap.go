@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// Outputs of /map besides the image
+const (
+	formatPNG      = "png"
+	formatImageMap = "imagemap" // An <img> with an HTML <map> of the prefectures
+	formatRegions  = "regions"  // The same outlines as JSON
+	formatHTML     = "html"     // The map as an inline SVG with a tooltip per prefecture
+	formatAlt      = "alt"      // A description of the map, as its alt text
+)
+
+// Parameters of the hit region outputs, left out of the image URL
+var imageMapParams = []string{"format", "href", "map_name"}
+
+// Function to parse the format parameter of /map
+func parseMapFormat(value string) (string, error) {
+	switch value {
+	case "", formatPNG:
+		return formatPNG, nil
+	case formatImageMap, formatRegions, formatHTML, formatAlt:
+		return value, nil
+	}
+	return "", invalidParam(ErrInvalidQuery, "Invalid format: %s (must be png, imagemap, regions, html or alt)", value)
+}
+
+// One region of the JSON output
+type hitRegionJSON struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name,omitempty"`
+	NameJa   string     `json:"name_ja,omitempty"`
+	Scale    int        `json:"scale"`
+	Value    *float64   `json:"value,omitempty"`
+	Href     string     `json:"href,omitempty"`
+	Polygons [][][2]int `json:"polygons"`
+
+	lang      string // Language of the title
+	scaleType string // Scale of Scale
+}
+
+type hitRegionsReport struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Image  string `json:"image,omitempty"`
+	// Regions are in the order of the features, each with the exterior
+	// rings of its polygons in pixels of the image.
+	Regions []hitRegionJSON `json:"regions"`
+}
+
+// Function to check a link template: a relative URL or an http(s) one,
+// with {id}, {name} and {name_ja} filled in per prefecture
+func parseHrefTemplate(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(strings.NewReplacer("{id}", "0", "{name}", "x", "{name_ja}", "x").Replace(value))
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return "", invalidParam(ErrInvalidQuery, "Invalid href: %s (must be a relative or http(s) URL)", value)
+	}
+	return value, nil
+}
+
+// Function to fill in a link template for a region, escaping the names as
+// path segments
+func (r hitRegionJSON) link(tmpl string) string {
+	if tmpl == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{id}", strconv.Itoa(r.ID),
+		"{name}", url.PathEscape(r.Name),
+		"{name_ja}", url.PathEscape(r.NameJa),
+	).Replace(tmpl)
+}
+
+// Title describes a region for its alt text: its name, in Japanese with
+// lang=ja, and its intensity or value when it has one.
+func (r hitRegionJSON) Title() string {
+	name := r.Name
+	if r.lang == i18n.Japanese && r.NameJa != "" {
+		name = r.NameJa
+	}
+	if name == "" {
+		name = i18n.T(r.lang, "region.id", r.ID)
+	}
+	switch {
+	case r.Value != nil:
+		return i18n.T(r.lang, "region.title", name, strconv.FormatFloat(*r.Value, 'f', -1, 64))
+	case r.Scale > 0:
+		return i18n.T(r.lang, "region.title", name, intensityText(r.lang, r.scaleType, r.Scale))
+	}
+	return name
+}
+
+// Function to write an intensity of a scale in a language, such as
+// "intensity 4" or "MMI VII"
+func intensityText(lang, scaleType string, scale int) string {
+	switch scaleType {
+	case render.ScaleMMI:
+		return i18n.T(lang, "intensity.mmi", render.RomanNumeral(scale))
+	case render.ScaleLPGM:
+		return i18n.T(lang, "intensity.lpgm", scale)
+	}
+	return i18n.T(lang, "intensity", scale)
+}
+
+// Function to send the outlines of the prefectures in pixels of the map the
+// same query draws, as an HTML image map or as JSON, without rendering it.
+// GET requests also get the URL of the image, so a page can embed both.
+func (s *server) serveHitRegions(w http.ResponseWriter, r *http.Request, opts *render.Options, format string, maxAge int) {
+	query := r.URL.Query()
+	href, err := parseHrefTemplate(query.Get("href"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	mapName := query.Get("map_name")
+	if mapName == "" {
+		mapName = "canvas"
+	}
+
+	report := hitRegionsReport{Width: opts.Width, Height: opts.Height, Regions: []hitRegionJSON{}}
+	if r.Method == http.MethodGet {
+		for _, name := range imageMapParams {
+			query.Del(name)
+		}
+		report.Image = (&url.URL{Path: r.URL.Path, RawQuery: query.Encode()}).String()
+	}
+	etag := optionsETag(s.assets, struct {
+		*render.Options
+		Format, Href, MapName, Image string
+	}{opts, format, href, mapName, report.Image})
+	if notModified(w, r, etag, maxAge) {
+		return
+	}
+	release, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer release()
+	scene := render.BuildScene(s.dataset, opts)
+	for _, region := range render.HitRegions(scene) {
+		out := hitRegionJSON{ID: region.ID, Name: region.Name, NameJa: region.NameJa, Scale: opts.ScaleMap[region.ID], lang: opts.Lang, scaleType: opts.ScaleType}
+		if v, ok := opts.Values[region.ID]; ok {
+			out.Value = &v
+		}
+		out.Href = out.link(href)
+		for _, polygon := range region.Polygons {
+			ring := make([][2]int, len(polygon))
+			for i, p := range polygon {
+				ring[i] = [2]int{p.X, p.Y}
+			}
+			out.Polygons = append(out.Polygons, ring)
+		}
+		report.Regions = append(report.Regions, out)
+	}
+	annotateRequest(r.Context(), "format", format, "regions", len(report.Regions))
+
+	setCacheHeaders(w, etag, maxAge)
+	if format == formatRegions {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	imageMapTemplate.Execute(w, struct {
+		hitRegionsReport
+		MapName, Alt string
+	}{report, mapName, i18n.T(opts.Lang, "map.alt")})
+}
+
+// An HTML fragment to paste in a page: the image, when it has a URL, and
+// an area per polygon. Areas without a link still carry the title.
+var imageMapTemplate = template.Must(template.New("imagemap").Funcs(template.FuncMap{
+	"coords": func(ring [][2]int) string {
+		var sb strings.Builder
+		for i, p := range ring {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(strconv.Itoa(p[0]))
+			sb.WriteByte(',')
+			sb.WriteString(strconv.Itoa(p[1]))
+		}
+		return sb.String()
+	},
+}).Parse(`{{if .Image}}<img src="{{.Image}}" width="{{.Width}}" height="{{.Height}}" usemap="#{{.MapName}}" alt="{{.Alt}}">
+{{end}}<map name="{{.MapName}}">
+{{- range .Regions}}{{$region := .}}{{range .Polygons}}
+<area shape="poly" coords="{{coords .}}"{{if $region.Href}} href="{{$region.Href}}"{{end}} alt="{{$region.Title}}" title="{{$region.Title}}">
+{{- end}}{{end}}
+</map>
+`))
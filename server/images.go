@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"canvas/render"
+
+	"golang.org/x/image/draw"
+)
+
+// Smallest and largest thumbnail widths
+const (
+	MIN_THUMB_WIDTH = 16
+	MAX_THUMB_WIDTH = 1280
+)
+
+// Recently rendered images, addressed by a hash of their content, so they can
+// be fetched again or derived from (thumbnails, diffs) without re-rendering.
+// Thumbnails share the byte budget; least recently used entries go first.
+type imageStore struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// Images by the ETag of the request that rendered them
+	tags map[string]string
+}
+
+type storedImage struct {
+	key  string
+	data []byte
+	tags []string
+}
+
+func newImageStore(maxBytes int) *imageStore {
+	st := &imageStore{maxBytes: maxBytes, entries: make(map[string]*list.Element), lru: list.New(), tags: make(map[string]string)}
+	metrics.Help("canvas_image_store_bytes", "Bytes of rendered images and thumbnails held in memory.")
+	metrics.Help("canvas_thumbnails_total", "Thumbnail requests, by whether they were served from the cache.")
+	metrics.OnCollect(func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		metrics.Set("canvas_image_store_bytes", "", float64(st.size))
+	})
+	return st
+}
+
+// Function to store a rendered PNG and return its ID
+func (st *imageStore) Put(data []byte) string {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:16])
+	st.put(id, data)
+	return id
+}
+
+func (st *imageStore) put(key string, data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if elem, ok := st.entries[key]; ok {
+		st.lru.MoveToFront(elem)
+		return
+	}
+	if len(data) > st.maxBytes {
+		return
+	}
+
+	st.entries[key] = st.lru.PushFront(&storedImage{key: key, data: data})
+	st.size += len(data)
+	for st.size > st.maxBytes {
+		oldest := st.lru.Back()
+		img := oldest.Value.(*storedImage)
+		st.lru.Remove(oldest)
+		delete(st.entries, img.key)
+		for _, etag := range img.tags {
+			if st.tags[etag] == img.key {
+				delete(st.tags, etag)
+			}
+		}
+		st.size -= len(img.data)
+	}
+}
+
+// Function to remember which stored image a request rendered, by its ETag,
+// so the request can be answered without rendering while renders are off
+func (st *imageStore) Tag(etag, id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	elem, ok := st.entries[id]
+	if !ok || st.tags[etag] == id {
+		return
+	}
+	img := elem.Value.(*storedImage)
+	img.tags = append(img.tags, etag)
+	st.tags[etag] = id
+}
+
+// Function to get the image a request with the ETag rendered, if it is
+// still stored
+func (st *imageStore) Tagged(etag string) ([]byte, string, bool) {
+	st.mu.Lock()
+	id, ok := st.tags[etag]
+	st.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	data, ok := st.Get(id)
+	return data, id, ok
+}
+
+func (st *imageStore) Get(key string) ([]byte, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	elem, ok := st.entries[key]
+	if !ok {
+		return nil, false
+	}
+	st.lru.MoveToFront(elem)
+	return elem.Value.(*storedImage).data, true
+}
+
+// Function to get a thumbnail of a stored image, generating it on first use
+func (st *imageStore) Thumbnail(id string, width int) ([]byte, error) {
+	key := id + "/thumb/" + strconv.Itoa(width)
+	if data, ok := st.Get(key); ok {
+		metrics.Add("canvas_thumbnails_total", labels("result", "hit"), 1)
+		return data, nil
+	}
+	metrics.Add("canvas_thumbnails_total", labels("result", "miss"), 1)
+
+	data, ok := st.Get(id)
+	if !ok {
+		return nil, &apiError{Status: http.StatusNotFound, Code: ErrImageNotFound, Message: fmt.Sprintf("Image not found: %s", id)}
+	}
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode stored image: %w", err)
+	}
+
+	bounds := src.Bounds()
+	if width >= bounds.Dx() {
+		// Never upscale; the original is the largest thumbnail there is
+		return data, nil
+	}
+	height := (bounds.Dy()*width + bounds.Dx()/2) / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	thumb, err := render.EncodePNG(dst)
+	if err != nil {
+		return nil, err
+	}
+	st.put(key, thumb)
+	return thumb, nil
+}
+
+// GET /images/{id}
+func (st *imageStore) imageHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	data, ok := st.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrImageNotFound, fmt.Sprintf("Image not found: %s", id))
+		return
+	}
+	writeStoredImage(w, data)
+}
+
+// GET /images/{id}/thumb?w=320
+func (st *imageStore) thumbHandler(w http.ResponseWriter, r *http.Request) {
+	width := 320
+	if v := r.URL.Query().Get("w"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < MIN_THUMB_WIDTH || n > MAX_THUMB_WIDTH {
+			writeError(w, http.StatusBadRequest, ErrInvalidDimensions,
+				fmt.Sprintf("Invalid w: %s (must be between %d and %d)", v, MIN_THUMB_WIDTH, MAX_THUMB_WIDTH))
+			return
+		}
+		width = n
+	}
+
+	data, err := st.Thumbnail(r.PathValue("id"), width)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeStoredImage(w, data)
+}
+
+func writeStoredImage(w http.ResponseWriter, data []byte) {
+	// IDs are content hashes, so a stored image never changes
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data)
+}
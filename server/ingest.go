@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Shortest ingest secret accepted, in bytes
+const minIngestSecret = 16
+
+// Endpoint upstream systems push events to. Each body is signed with
+// HMAC-SHA256 under a shared secret, sent as X-Signature-256: sha256=<hex>.
+type ingestHandler struct {
+	secret   []byte
+	pipeline *eventPipeline
+}
+
+func newIngestHandler(secretRef string, pipeline *eventPipeline) (*ingestHandler, error) {
+	secret, err := resolveSecret(secretRef)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minIngestSecret {
+		return nil, fmt.Errorf("ingest secret must be at least %d bytes", minIngestSecret)
+	}
+	return &ingestHandler{secret: []byte(secret), pipeline: pipeline}, nil
+}
+
+// Function to check the signature header against the body
+func (h *ingestHandler) verify(signature string, body []byte) bool {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	sent, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(sent, mac.Sum(nil))
+}
+
+// Function to normalize a pushed payload: either an event as accepted by
+// /captions, or a p2pquake JMAQuake record (code 551)
+func parseIngestEvent(body []byte) (*quakeEvent, error) {
+	var probe struct {
+		Code       int             `json:"code"`
+		Earthquake json.RawMessage `json:"earthquake"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+
+	var ev *quakeEvent
+	if probe.Earthquake != nil {
+		if probe.Code != 551 {
+			return nil, fmt.Errorf("unsupported p2pquake code %d (must be 551)", probe.Code)
+		}
+		var q jmaQuake
+		if err := json.Unmarshal(body, &q); err != nil {
+			return nil, err
+		}
+		var err error
+		if ev, err = q.event(); err != nil {
+			return nil, err
+		}
+	} else {
+		ev = &quakeEvent{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(ev); err != nil {
+			return nil, err
+		}
+		if ev.Time.IsZero() {
+			return nil, fmt.Errorf("missing time")
+		}
+	}
+
+	if ev.ID == "" {
+		return nil, fmt.Errorf("missing id")
+	}
+	ev.locate()
+	for code, scale := range ev.Intensities {
+		if scale < 0 || scale > 7 {
+			return nil, fmt.Errorf("intensity %d of prefecture %d is out of range (must be between 0 and 7)", scale, code)
+		}
+	}
+	return ev, nil
+}
+
+type ingestResponse struct {
+	Event      string   `json:"event"`
+	Render     bool     `json:"render"`
+	Rules      []string `json:"rules"`
+	Publishers []string `json:"publishers"`
+	Duplicate  bool     `json:"duplicate"`
+}
+
+// POST /ingest with a signed event. The event is accepted once it is
+// verified and valid, and rendered and published in the background.
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, ErrInvalidEvent, "Event too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, ErrInvalidEvent, fmt.Sprintf("Invalid event: %v", err))
+		return
+	}
+	if !h.verify(r.Header.Get("X-Signature-256"), body) {
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized, "Invalid signature")
+		return
+	}
+
+	ev, err := parseIngestEvent(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidEvent, fmt.Sprintf("Invalid event: %v", err))
+		return
+	}
+	annotateRequest(r.Context(), "event", ev.ID)
+
+	decision, duplicate, err := h.pipeline.Submit("ingest", ev)
+	if err != nil {
+		slog.Error("failed to submit event", "event", ev.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal, "Failed to submit event")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ingestResponse{
+		Event:      ev.ID,
+		Render:     decision.Render,
+		Rules:      decision.Rules,
+		Publishers: decision.Publishers,
+		Duplicate:  duplicate,
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testIngestSecret = "0123456789abcdef"
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestIngestVerify(t *testing.T) {
+	h := &ingestHandler{secret: []byte(testIngestSecret)}
+	body := `{"id":"test-1","time":"2024-01-01T16:10:00+09:00"}`
+	valid := sign(testIngestSecret, body)
+	flipped := "0"
+	if strings.HasSuffix(valid, "0") {
+		flipped = "1"
+	}
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		ok        bool
+	}{
+		{"valid", valid, body, true},
+		{"tampered body", valid, strings.Replace(body, "test-1", "test-2", 1), false},
+		{"tampered signature", valid[:len(valid)-1] + flipped, body, false},
+		{"other secret", sign("fedcba9876543210", body), body, false},
+		{"missing", "", body, false},
+		{"no prefix", strings.TrimPrefix(valid, "sha256="), body, false},
+		{"other algorithm", "sha1=" + strings.TrimPrefix(valid, "sha256="), body, false},
+		{"not hex", "sha256=xyz", body, false},
+		{"truncated", valid[:len(valid)-2], body, false},
+	}
+	for _, tt := range tests {
+		if ok := h.verify(tt.signature, []byte(tt.body)); ok != tt.ok {
+			t.Errorf("%s: verify = %v; want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestIngestSignature(t *testing.T) {
+	h := &ingestHandler{
+		secret:   []byte(testIngestSecret),
+		pipeline: newEventPipeline(nil, nil, nil, nil, "en"),
+	}
+	// Without intensities the event is accepted but not rendered
+	body := `{"id":"test-1","time":"2024-01-01T16:10:00+09:00"}`
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		status    int
+	}{
+		{"valid", sign(testIngestSecret, body), body, http.StatusAccepted},
+		{"missing", "", body, http.StatusUnauthorized},
+		{"tampered", sign(testIngestSecret, body), strings.Replace(body, "test-1", "test-2", 1), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/ingest", strings.NewReader(tt.body))
+		if tt.signature != "" {
+			r.Header.Set("X-Signature-256", tt.signature)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d; want %d (%s)", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestIngestTakesNoAPIKey(t *testing.T) {
+	keys := &apiKeys{names: map[[32]byte]string{}, exempt: map[string]bool{"/ingest": true}}
+	handler := keys.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, status := range map[string]int{
+		"/ingest": http.StatusOK,
+		"/map":    http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != status {
+			t.Errorf("%s without a key: status %d; want %d", path, w.Code, status)
+		}
+	}
+}
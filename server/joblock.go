@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coordinates background jobs (rendering and publishing an ingested event,
+// scheduled posts) between replicas, so each one runs exactly once. A claim
+// is a lease: if its holder dies before marking the job done, another
+// replica can take it over once the lease expires.
+type jobLocker interface {
+	// Claim reports whether this replica now holds the job
+	Claim(job string, lease time.Duration) (bool, error)
+	// Done marks the job as finished so it is never claimed again
+	Done(job string) error
+}
+
+// Job coordinator shared by background jobs. The in-memory default only
+// deduplicates within one process; -lock-dir shares it between replicas.
+var jobLocks jobLocker = newMemoryJobLocker()
+
+// Identity of this process in lease files
+var jobOwner = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+type memoryJobLocker struct {
+	mu   sync.Mutex
+	jobs map[string]time.Time // lease expiry, zero once done
+}
+
+func newMemoryJobLocker() *memoryJobLocker {
+	return &memoryJobLocker{jobs: make(map[string]time.Time)}
+}
+
+func (l *memoryJobLocker) Claim(job string, lease time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if expiry, ok := l.jobs[job]; ok && (expiry.IsZero() || time.Now().Before(expiry)) {
+		return false, nil
+	}
+	l.jobs[job] = time.Now().Add(lease)
+	return true, nil
+}
+
+func (l *memoryJobLocker) Done(job string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.jobs[job] = time.Time{}
+	return nil
+}
+
+// Locker backed by a directory shared between replicas (NFS, EFS, a common
+// volume). Claims are files created with O_EXCL, which only one replica can
+// win. An expired lease is taken over by creating the next generation's file,
+// so takeovers are exclusive as well.
+type dirJobLocker struct {
+	dir string
+}
+
+func newDirJobLocker(dir string) (*dirJobLocker, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	return &dirJobLocker{dir: dir}, nil
+}
+
+// Function to derive a file-name-safe prefix from a job name
+func (l *dirJobLocker) prefix(job string) string {
+	sum := sha256.Sum256([]byte(job))
+	return filepath.Join(l.dir, hex.EncodeToString(sum[:16]))
+}
+
+func (l *dirJobLocker) Claim(job string, lease time.Duration) (bool, error) {
+	prefix := l.prefix(job)
+	if _, err := os.Stat(prefix + ".done"); err == nil {
+		return false, nil
+	}
+
+	// Find the latest generation and check whether its lease is still held
+	generation := 0
+	for ; ; generation++ {
+		data, err := os.ReadFile(prefix + "." + strconv.Itoa(generation))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read lease: %w", err)
+		}
+		if _, err := os.Stat(prefix + "." + strconv.Itoa(generation+1)); err == nil {
+			continue
+		}
+		_, expiry, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+		nanos, err := strconv.ParseInt(expiry, 10, 64)
+		if err == nil && time.Now().UnixNano() < nanos {
+			return false, nil
+		}
+		generation++
+		break
+	}
+
+	f, err := os.OpenFile(prefix+"."+strconv.Itoa(generation), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		// Another replica claimed it first
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to create lease: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %d\n", jobOwner, time.Now().Add(lease).UnixNano()); err != nil {
+		return false, fmt.Errorf("failed to write lease: %w", err)
+	}
+	return true, nil
+}
+
+func (l *dirJobLocker) Done(job string) error {
+	if err := os.WriteFile(l.prefix(job)+".done", []byte(jobOwner+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to mark job done: %w", err)
+	}
+	return nil
+}
+
+// Function to remove lease files older than maxAge, so the directory does not
+// grow without bound
+func (l *dirJobLocker) Prune(maxAge time.Duration) error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(l.dir, entry.Name()))
+		}
+	}
+	return nil
+}
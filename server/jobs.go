@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a render job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// How long a job may render before it fails
+const jobTimeout = 5 * time.Minute
+
+// Endpoints a job can render, by their path or, ending in /, its prefix
+var jobPaths = []string{"/map", "/map/", "/animation", "/propagation", "/grid", "/social", "/frequency"}
+
+// Headers of the rendered response kept with the result of a job
+var jobResultHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "X-Image-ID", "X-Event-ID", "X-Event-Time", "X-Render-Backend", "X-Unknown-IDs"}
+
+// An expensive render run in the background: a GET request to one of the
+// rendering endpoints, whose response is kept until the job expires
+type renderJob struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	URL      string     `json:"url"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Set once the job is done
+	Result      string `json:"result,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	ImageID     string `json:"image_id,omitempty"`
+	// Set when the job failed, as the endpoint reported it
+	Error *jobError `json:"error,omitempty"`
+	// Where the result is pushed, and how that went
+	Callback      string `json:"callback,omitempty"`
+	CallbackError string `json:"callback_error,omitempty"`
+
+	ctx        context.Context
+	remoteAddr string // Rate limited as the client that submitted it
+	status     int
+	header     http.Header
+	body       []byte
+}
+
+type jobError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+}
+
+// Jobs of this replica, run by a fixed number of workers in the order they
+// were submitted. Finished jobs are kept for a while, then forgotten.
+type jobQueue struct {
+	handler       http.Handler // The public endpoints, behind the feature flags
+	ttl           time.Duration
+	callbackHosts []string
+
+	mu      sync.Mutex
+	jobs    map[string]*renderJob
+	pending chan *renderJob
+}
+
+func newJobQueue(handler http.Handler, workers, queue int, ttl time.Duration, callbackHosts []string) *jobQueue {
+	q := &jobQueue{handler: handler, ttl: ttl, callbackHosts: callbackHosts, jobs: make(map[string]*renderJob), pending: make(chan *renderJob, queue)}
+	metrics.Help("canvas_jobs_total", "Render jobs finished, by result.")
+	metrics.Help("canvas_jobs_pending", "Render jobs queued or running.")
+	metrics.OnCollect(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		pending := 0
+		for _, job := range q.jobs {
+			if job.Status == jobQueued || job.Status == jobRunning {
+				pending++
+			}
+		}
+		metrics.Set("canvas_jobs_pending", "", float64(pending))
+	})
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+// Function to check the URL of a job: a path of a rendering endpoint and its
+// query, without a scheme or host
+func parseJobURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, invalidParam(ErrInvalidJob, "Invalid url: %s (must be a path such as /map?scale=...)", raw)
+	}
+	for _, p := range jobPaths {
+		if u.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(u.Path, p) && u.Path != "/map/batch") {
+			return u, nil
+		}
+	}
+	return nil, invalidParam(ErrInvalidJob, "Invalid url: %s cannot be rendered as a job (must be /map, /map/{name}, /animation, /propagation, /grid, /social or /frequency)", u.Path)
+}
+
+// Function to check a callback URL against the hosts allowed by
+// -job-callback-hosts
+func (q *jobQueue) parseCallback(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	if len(q.callbackHosts) == 0 {
+		return "", invalidParam(ErrInvalidJob, "Callbacks are disabled on this server (see -job-callback-hosts)")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", invalidParam(ErrInvalidJob, "Invalid callback: %s (must be an http or https URL)", raw)
+	}
+	if !slices.Contains(q.callbackHosts, u.Hostname()) {
+		return "", invalidParam(ErrInvalidJob, "Invalid callback: %s is not an allowed host", u.Hostname())
+	}
+	return u.String(), nil
+}
+
+// POST /jobs {"url": "/map?scale=...&size=3", "callback": "https://..."}
+// queues a render and returns 202 with the job, to be polled at
+// /jobs/{id}. The render runs with the API key of the request.
+func (q *jobQueue) createHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL      string `json:"url"`
+		Callback string `json:"callback"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidJob, fmt.Sprintf("Invalid job: %v", err))
+		return
+	}
+	u, err := parseJobURL(body.URL)
+	if err == nil {
+		body.Callback, err = q.parseCallback(body.Callback)
+	}
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	job := &renderJob{
+		ID:       hex.EncodeToString(b),
+		Status:   jobQueued,
+		URL:      u.RequestURI(),
+		Created:  time.Now().UTC(),
+		Callback: body.Callback,
+		// The render outlives the request, but keeps its API key
+		ctx:        context.WithoutCancel(r.Context()),
+		remoteAddr: r.RemoteAddr,
+	}
+
+	q.mu.Lock()
+	q.expire()
+	select {
+	case q.pending <- job:
+		q.jobs[job.ID] = job
+	default:
+		q.mu.Unlock()
+		writeAPIError(w, &apiError{Status: http.StatusServiceUnavailable, Code: ErrOverloaded, Message: "Too many jobs waiting", RetryAfter: 30 * time.Second})
+		return
+	}
+	status := *job
+	q.mu.Unlock()
+
+	annotateRequest(r.Context(), "job", job.ID, "job_url", job.URL)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJob(w, http.StatusAccepted, &status)
+}
+
+// Function to drop finished jobs older than the TTL; the lock is held
+func (q *jobQueue) expire() {
+	for id, job := range q.jobs {
+		if job.Finished != nil && time.Since(*job.Finished) > q.ttl {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Function to run jobs as they come
+func (q *jobQueue) work() {
+	for job := range q.pending {
+		q.run(job)
+	}
+}
+
+// Function to render a job through the public endpoints and keep the
+// response, then push it to the callback
+func (q *jobQueue) run(job *renderJob) {
+	start := time.Now()
+	q.mu.Lock()
+	job.Status = jobRunning
+	started := start.UTC()
+	job.Started = &started
+	q.mu.Unlock()
+
+	// Annotations go to the job's log line, not to the long finished
+	// request that submitted it
+	info := &requestInfo{id: job.ID, logger: slog.Default().With("job_id", job.ID)}
+	ctx, cancel := context.WithTimeout(context.WithValue(job.ctx, requestInfoKey{}, info), jobTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+	rec := &jobRecorder{header: http.Header{}}
+	if err == nil {
+		req.RemoteAddr = job.remoteAddr
+		q.handler.ServeHTTP(rec, req)
+	} else {
+		writeError(rec, http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	q.mu.Lock()
+	finished := time.Now().UTC()
+	job.Finished = &finished
+	job.status, job.header, job.body = rec.status, rec.header, rec.body.Bytes()
+	if rec.status == http.StatusOK {
+		job.Status = jobDone
+		job.Result = "/jobs/" + job.ID + "/result"
+		job.ContentType = rec.header.Get("Content-Type")
+		job.Bytes = rec.body.Len()
+		job.ImageID = rec.header.Get("X-Image-ID")
+	} else {
+		job.Status = jobFailed
+		var body errorBody
+		json.Unmarshal(job.body, &body)
+		job.Error = &jobError{Status: rec.status, Code: body.Error.Code, Message: body.Error.Message, Param: body.Error.Param}
+	}
+	status := job.Status
+	q.mu.Unlock()
+
+	metrics.Add("canvas_jobs_total", labels("result", status), 1)
+	info.mu.Lock()
+	args := append([]any{"url", job.URL, "status", status, "duration", time.Since(start)}, info.attrs...)
+	info.mu.Unlock()
+	info.logger.Info("job", args...)
+
+	if job.Callback != "" {
+		err := q.push(job)
+		q.mu.Lock()
+		if err != nil {
+			job.CallbackError = err.Error()
+		}
+		q.mu.Unlock()
+		if err != nil {
+			info.logger.Warn("job callback failed", "callback", job.Callback, "err", err)
+		}
+	}
+}
+
+// Function to POST the result of a finished job, or its error, to its
+// callback, as GET /jobs/{id}/result would return it
+func (q *jobQueue) push(job *renderJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.Callback, bytes.NewReader(job.body))
+	if err != nil {
+		return err
+	}
+	for _, k := range jobResultHeaders {
+		if v := job.header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("X-Job-ID", job.ID)
+	req.Header.Set("X-Job-Status", job.Status)
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Function to look up a job by the ID in the path, or report it missing
+func (q *jobQueue) lookup(w http.ResponseWriter, r *http.Request) (*renderJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	job, ok := q.jobs[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrJobNotFound, "Job not found: "+r.PathValue("id"))
+		return nil, false
+	}
+	return job, true
+}
+
+// GET /jobs/{id} reports the state of a job. Unfinished jobs are sent with
+// Retry-After, the time to wait before polling again.
+func (q *jobQueue) statusHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := q.lookup(w, r)
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	status := *job
+	q.mu.Unlock()
+	if status.Finished == nil {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJob(w, http.StatusOK, &status)
+}
+
+// GET /jobs/{id}/result returns what the endpoint of a finished job
+// responded: the image, or the error of a failed job with its status
+func (q *jobQueue) resultHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := q.lookup(w, r)
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	finished, status, header, body := job.Finished != nil, job.status, job.header, job.body
+	q.mu.Unlock()
+	if !finished {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, ErrJobNotFinished, "Job "+job.ID+" has not finished")
+		return
+	}
+	for _, k := range jobResultHeaders {
+		if v := header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeJob(w http.ResponseWriter, status int, job *renderJob) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Response writer keeping the response of a job in memory
+type jobRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *jobRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *jobRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *jobRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
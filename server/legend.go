@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// Multipliers of the legend sizes, those of the legend on maps of the /map
+// size presets
+var legendSizes = map[string]float64{"1": 1, "2": 2, "3": 4}
+
+// GET /legend draws the key to the intensity colors on its own, for pages
+// that show it apart from the map: in the scale_type, lang and simulate of
+// /map, the palette of a map of -maps, and as a PNG or SVG.
+func (s *server) legendHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if name := query.Get("map"); name != "" {
+		m, ok := s.maps.Get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrMapNotFound, fmt.Sprintf("Map not found: %s", name))
+			return
+		}
+		s = s.withMap(m)
+	}
+
+	opts := &render.Options{Palette: s.palette, Multiplier: 1}
+	var err error
+	if opts.ScaleType, err = render.ParseScaleType(query.Get("scale_type")); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid scale_type: %s (must be jma, mmi or lpgm)", query.Get("scale_type")))
+		return
+	}
+	if opts.Lang, err = i18n.Parse(query.Get("lang")); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid lang: %s (must be en or ja)", query.Get("lang")))
+		return
+	}
+	if opts.Simulate, err = render.ParseSimulation(query.Get("simulate")); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid simulate: %s (must be deuteranopia, protanopia or tritanopia)", query.Get("simulate")))
+		return
+	}
+	if v := query.Get("size"); v != "" {
+		multiplier, ok := legendSizes[v]
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidDimensions, fmt.Sprintf("Invalid size: %s (must be 1, 2 or 3)", v))
+			return
+		}
+		opts.Multiplier = multiplier
+	}
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = render.LegendPNG
+	case render.LegendPNG, render.LegendSVG:
+	default:
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid format: %s (must be png or svg)", format))
+		return
+	}
+
+	etag := optionsETag(s.assets, []any{"legend", opts.ScaleType, opts.Lang, opts.Simulate, opts.Palette, opts.Multiplier, format})
+	if notModified(w, r, etag, s.maxAge) {
+		return
+	}
+
+	data, err := render.RenderLegend(opts, format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrRenderFailed, err.Error())
+		return
+	}
+	size := render.LegendSize(opts)
+	recordUsage(r.Context(), size.X*size.Y)
+	setCacheHeaders(w, etag, s.maxAge)
+	if format == render.LegendSVG {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Write(data)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SetupLogging installs the process-wide structured logger, writing text or
+// JSON lines to stderr from the given level up.
+func SetupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s (must be text or json)", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Function to log an error and exit, in place of log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestInfoKey struct{}
+
+// Per-request logging state; handlers add attributes that end up on the
+// request's access log line
+type requestInfo struct {
+	id     string
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	attrs []any
+}
+
+func requestFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// Function to get the logger of the current request, tagged with its ID
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info := requestFromContext(ctx); info != nil {
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// Function to get the ID of the current request, or "" outside of one
+func requestID(ctx context.Context) string {
+	if info := requestFromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// Function to add attributes to the current request's access log line
+func annotateRequest(ctx context.Context, args ...any) {
+	if info := requestFromContext(ctx); info != nil {
+		info.mu.Lock()
+		info.attrs = append(info.attrs, args...)
+		info.mu.Unlock()
+	}
+}
+
+// Middleware assigning every request an ID (kept from X-Request-ID when the
+// caller sent a sane one) and writing one access log line when it completes
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		info := &requestInfo{id: id, logger: slog.Default().With("request_id", id)}
+		w.Header().Set("X-Request-ID", id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case sw.status >= 500:
+			level = slog.LevelError
+		case sw.status >= 400:
+			level = slog.LevelWarn
+		}
+
+		args := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"bytes", sw.bytes,
+			"duration", time.Since(start),
+		}
+		if params := summarizeQuery(r.URL.Query()); len(params) > 0 {
+			args = append(args, slog.Group("params", params...))
+		}
+		info.mu.Lock()
+		args = append(args, info.attrs...)
+		info.mu.Unlock()
+		info.logger.Log(r.Context(), level, "request", args...)
+
+		if sw.status >= 500 || sw.status == http.StatusTooManyRequests {
+			message := http.StatusText(sw.status)
+			for i := 0; i+1 < len(info.attrs); i += 2 {
+				if info.attrs[i] == "error" {
+					message = fmt.Sprint(info.attrs[i+1])
+				}
+			}
+			dashboard.RecordError(errorRecord{Time: start, RequestID: id, Path: r.URL.Path, Status: sw.status, Message: message})
+		}
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to condense the query parameters for the log: the scale list is
+// reduced to its length, API keys are hidden and other values are cut at 64
+// characters
+func summarizeQuery(query url.Values) []any {
+	var params []any
+	for _, key := range sortedKeys(query) {
+		value := query.Get(key)
+		if key == "api_key" {
+			params = append(params, key, "[redacted]")
+			continue
+		}
+		if key == "scale" {
+			var entries []json.RawMessage
+			if json.Unmarshal([]byte(value), &entries) == nil {
+				params = append(params, "scale_entries", len(entries))
+				continue
+			}
+		}
+		if len(value) > 64 {
+			value = strings.ToValidUTF8(value[:64], "") + "..."
+		}
+		params = append(params, key, value)
+	}
+	return params
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"canvas/render"
+)
+
+// Default text of the maintenance placeholder and error
+const (
+	maintenanceTitle   = "Temporarily unavailable"
+	maintenanceMessage = "Maps are paused for maintenance and will be back shortly."
+)
+
+// Largest placeholder drawn, so a bogus size cannot cost a large allocation
+const maxPlaceholderWidth = 1920
+
+// Maintenance (or draining) mode, toggled by operators at runtime. While on,
+// renders are refused with 503 and Retry-After, and requests that can be
+// answered from what was already rendered still are.
+type maintenanceMode struct {
+	mu         sync.Mutex
+	enabled    bool
+	since      time.Time
+	message    string
+	retryAfter time.Duration
+	// Retry-After when the operator gives none
+	defaultRetryAfter time.Duration
+	audit             *auditLog
+}
+
+// The maintenance mode of the process, set up by Run
+var maintenance *maintenanceMode
+
+func newMaintenanceMode(retryAfter time.Duration, audit *auditLog) *maintenanceMode {
+	m := &maintenanceMode{defaultRetryAfter: retryAfter, audit: audit}
+	metrics.Help("canvas_maintenance", "Whether maintenance mode is on.")
+	metrics.Help("canvas_maintenance_rejected_total", "Requests refused in maintenance mode, by whether a placeholder image was sent.")
+	metrics.OnCollect(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		on := 0.0
+		if m.enabled {
+			on = 1
+		}
+		metrics.Set("canvas_maintenance", "", on)
+	})
+	return m
+}
+
+// Function to turn maintenance mode on; zero retryAfter uses the default
+func (m *maintenanceMode) Enable(message string, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled = true
+	m.message = message
+	if m.message == "" {
+		m.message = maintenanceMessage
+	}
+	m.retryAfter = retryAfter
+	if m.retryAfter <= 0 {
+		m.retryAfter = m.defaultRetryAfter
+	}
+}
+
+func (m *maintenanceMode) Disable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = false
+}
+
+// Function to get whether maintenance mode is on, with its message and
+// Retry-After
+func (m *maintenanceMode) Active() (bool, string, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enabled, m.message, m.retryAfter
+}
+
+type maintenanceKey struct{}
+
+// Function to tell a handler wrapped by WrapCached that it may only answer
+// from rendered images, and must call Reject otherwise
+func cacheOnly(ctx context.Context) bool {
+	on, _ := ctx.Value(maintenanceKey{}).(bool)
+	return on
+}
+
+// Middleware refusing every request while maintenance mode is on
+func (m *maintenanceMode) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if on, _, _ := m.Active(); on {
+			m.Reject(w, r, 0, 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware letting requests through while maintenance mode is on, marked
+// so the handler serves what it already rendered instead of rendering
+func (m *maintenanceMode) WrapCached(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if on, _, _ := m.Active(); on {
+			r = r.WithContext(context.WithValue(r.Context(), maintenanceKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Function to refuse a request with 503 and Retry-After. Clients asking for
+// an image, such as <img> tags or with onerror=image, get a placeholder of
+// the size of the map instead of a JSON error, taken from the query when
+// width and height are zero.
+func (m *maintenanceMode) Reject(w http.ResponseWriter, r *http.Request, width, height int) {
+	_, message, retryAfter := m.Active()
+	annotateRequest(r.Context(), "maintenance", true)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if strings.Contains(r.Header.Get("Accept"), "image/") || wantsErrorImage(r) {
+		if width == 0 || height == 0 {
+			width, height = placeholderSize(r)
+		}
+		data, err := render.Placeholder(width, height, maintenanceTitle, message)
+		if err == nil {
+			metrics.Add("canvas_maintenance_rejected_total", labels("placeholder", "true"), 1)
+			w.Header().Set("Content-Type", "image/png")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(data)
+			return
+		}
+		requestLogger(r.Context()).Error("failed to draw placeholder", "err", err)
+	}
+	metrics.Add("canvas_maintenance_rejected_total", labels("placeholder", "false"), 1)
+	writeError(w, http.StatusServiceUnavailable, ErrMaintenance, message)
+}
+
+// Function to size a placeholder from the width, height or size parameters
+// of a request, at most maxPlaceholderWidth wide and 16:9 unless both are
+// given
+func placeholderSize(r *http.Request) (int, int) {
+	query := r.URL.Query()
+	dimension := func(name string) int {
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil || n < render.MIN_DIMENSION {
+			return 0
+		}
+		return n
+	}
+	width, height := dimension("width"), dimension("height")
+	if width == 0 && height == 0 {
+		if size, err := strconv.Atoi(query.Get("size")); err == nil && size >= 1 && size <= 3 {
+			width = int(render.BASE_WIDTH) * size
+		} else {
+			width = int(render.BASE_WIDTH)
+		}
+	}
+	switch {
+	case width == 0:
+		width = height * 16 / 9
+	case height == 0:
+		height = width * 9 / 16
+	}
+	if width > maxPlaceholderWidth {
+		height = height * maxPlaceholderWidth / width
+		width = maxPlaceholderWidth
+	}
+	return width, max(height, render.MIN_DIMENSION)
+}
+
+type maintenanceStatus struct {
+	Enabled    bool       `json:"enabled"`
+	Since      *time.Time `json:"since,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retry_after,omitempty"`
+}
+
+// GET shows whether maintenance mode is on. PUT turns it on, with an
+// optional {"message": "...", "retry_after": 600} in seconds, and DELETE
+// turns it off.
+func (m *maintenanceMode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Message    string `json:"message"`
+			RetryAfter int    `json:"retry_after"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid maintenance settings: %v", err))
+				return
+			}
+		}
+		if req.RetryAfter < 0 || req.RetryAfter > 86400 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid retry_after: %d (must be between 0 and 86400 seconds)", req.RetryAfter))
+			return
+		}
+		m.Enable(req.Message, time.Duration(req.RetryAfter)*time.Second)
+		_, message, retryAfter := m.Active()
+		m.audit.Record(auditActor(r), "maintenance.enable", "", map[string]string{
+			"message":     message,
+			"retry_after": strconv.Itoa(int(retryAfter.Seconds())),
+		})
+	case http.MethodDelete:
+		m.Disable()
+		m.audit.Record(auditActor(r), "maintenance.disable", "", nil)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	m.mu.Lock()
+	status := maintenanceStatus{Enabled: m.enabled}
+	if m.enabled {
+		since := m.since
+		status.Since, status.Message, status.RetryAfter = &since, m.message, int(m.retryAfter.Seconds())
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// Name of the built-in map of Japan's prefectures
+const defaultMapName = "japan"
+
+// Map names usable in /map/{name}
+var mapNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Configuration of one named map in the -maps file
+type mapConfig struct {
+	// GeoJSON or TopoJSON file of the features, relative to the -maps file
+	GeoJSON string `json:"geojson"`
+	// Object of a TopoJSON file holding the features, when it has several
+	Object string `json:"object,omitempty"`
+	// Property identifying each feature, as ids in the scale parameter
+	// (default "id")
+	IDProperty string `json:"id_property,omitempty"`
+	// CRS of the coordinates, such as jgd2011 or tokyo (default: the crs
+	// member of a GeoJSON file, or WGS84)
+	CRS string `json:"crs,omitempty"`
+	// Projection of the map: equirectangular (the default), mercator or
+	// azimuthal. Requests can pick another with projection.
+	Projection string `json:"projection,omitempty"`
+	// Colors of intensities 0 to 7 (default: the JMA-style colors)
+	Palette []string `json:"palette,omitempty"`
+	// Color and width of the borders and opacity of the fills (default:
+	// #a1a1aa, 0.4 and 0.8). Requests can override each with stroke,
+	// stroke_width and fill_opacity.
+	Style *render.Style `json:"style,omitempty"`
+	// Earlier boundaries, such as before municipal mergers, picked with
+	// asof=YYYY-MM-DD
+	Snapshots []snapshotConfig `json:"snapshots,omitempty"`
+}
+
+// Configuration of the boundaries a map had before a date
+type snapshotConfig struct {
+	// First day the snapshot no longer applies, as YYYY-MM-DD
+	Until string `json:"until"`
+	// GeoJSON or TopoJSON file of the features, relative to the -maps file
+	GeoJSON string `json:"geojson"`
+	// Object of a TopoJSON file holding the features, when it has several
+	Object string `json:"object,omitempty"`
+	// CRS of the coordinates (default: that of the map)
+	CRS string `json:"crs,omitempty"`
+}
+
+// Boundaries of a map in use before a date
+type mapSnapshot struct {
+	until   time.Time
+	dataset *geo.Dataset
+	assets  string
+}
+
+// A map loaded from its configuration
+type namedMap struct {
+	name       string
+	dataset    *geo.Dataset
+	projection string
+	palette    []string
+	style      *render.Style
+	assets     string
+	// Earlier boundaries, oldest first
+	snapshots []mapSnapshot
+}
+
+// Registry of the maps the server renders, by name. The map of Japan is
+// always registered, and also serves /map.
+type mapRegistry struct {
+	maps map[string]*namedMap
+}
+
+// Function to load the -maps file, a JSON object of map configurations by
+// name, next to the built-in map of Japan
+func loadMapRegistry(path string, japan *geo.Dataset, japanAssets string, simplify bool) (*mapRegistry, error) {
+	reg := &mapRegistry{maps: map[string]*namedMap{
+		defaultMapName: {name: defaultMapName, dataset: japan, projection: geo.DefaultProjection, assets: japanAssets},
+	}}
+	if path == "" {
+		return reg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Maps map[string]mapConfig `json:"maps"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid maps file %s: %w", path, err)
+	}
+
+	for name, cfg := range file.Maps {
+		if !mapNamePattern.MatchString(name) || name == "latest" || name == "batch" || name == "alt" {
+			return nil, fmt.Errorf("map %q: invalid name (lowercase letters, digits, - and _, and not latest, batch or alt)", name)
+		}
+		if name == defaultMapName {
+			// Only snapshots can be added to the built-in map
+			if cfg.GeoJSON != "" || cfg.Object != "" || cfg.IDProperty != "" || cfg.CRS != "" || cfg.Projection != "" || cfg.Palette != nil || cfg.Style != nil {
+				return nil, fmt.Errorf("map %q: only snapshots can be configured for the built-in map", name)
+			}
+			japan := reg.maps[defaultMapName]
+			if japan.snapshots, err = loadSnapshots(name, path, cfg.Snapshots, geo.LoadOptions{Simplify: simplify}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if cfg.GeoJSON == "" {
+			return nil, fmt.Errorf("map %q: geojson is required", name)
+		}
+		if cfg.Projection, err = geo.ParseProjection(cfg.Projection); err != nil {
+			return nil, fmt.Errorf("map %q: %w", name, err)
+		}
+		if cfg.Palette != nil {
+			if err := render.ValidatePalette(cfg.Palette); err != nil {
+				return nil, fmt.Errorf("map %q: %w", name, err)
+			}
+		}
+		if cfg.Style != nil {
+			if err := cfg.Style.Validate(); err != nil {
+				return nil, fmt.Errorf("map %q: %w", name, err)
+			}
+		}
+		if cfg.IDProperty == "" {
+			cfg.IDProperty = "id"
+		}
+		crs, err := parseMapCRS(cfg.CRS)
+		if err != nil {
+			return nil, fmt.Errorf("map %q: %w", name, err)
+		}
+		opts := geo.LoadOptions{Object: cfg.Object, IDProperty: cfg.IDProperty, CRS: crs, Simplify: simplify}
+
+		geojsonPath := cfg.GeoJSON
+		if !filepath.IsAbs(geojsonPath) {
+			geojsonPath = filepath.Join(filepath.Dir(path), geojsonPath)
+		}
+		dataset, err := geo.LoadFile(geojsonPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("map %q: %w", name, err)
+		}
+		assets, err := assetVersion(simplify, geojsonPath, "./fonts/roboto-regular.ttf", "./fonts/roboto-medium.ttf")
+		if err != nil {
+			return nil, fmt.Errorf("map %q: %w", name, err)
+		}
+		if crs != "" {
+			// The same file draws differently in another CRS
+			assets = string(crs) + "-" + assets
+		}
+		snapshots, err := loadSnapshots(name, path, cfg.Snapshots, opts)
+		if err != nil {
+			return nil, err
+		}
+		reg.maps[name] = &namedMap{name: name, dataset: dataset, projection: cfg.Projection, palette: cfg.Palette,
+			style: cfg.Style, assets: name + "-" + assets, snapshots: snapshots}
+	}
+	return reg, nil
+}
+
+// Function to load the snapshots of a map, sorted oldest first, with the
+// load options of the map unless they override them
+func loadSnapshots(name, path string, configs []snapshotConfig, mapOpts geo.LoadOptions) ([]mapSnapshot, error) {
+	snapshots := make([]mapSnapshot, 0, len(configs))
+	for _, cfg := range configs {
+		until, err := time.Parse(time.DateOnly, cfg.Until)
+		if err != nil {
+			return nil, fmt.Errorf("map %q: invalid snapshot until %q (must be YYYY-MM-DD)", name, cfg.Until)
+		}
+		if cfg.GeoJSON == "" {
+			return nil, fmt.Errorf("map %q: snapshot %s: geojson is required", name, cfg.Until)
+		}
+		geojsonPath := cfg.GeoJSON
+		if !filepath.IsAbs(geojsonPath) {
+			geojsonPath = filepath.Join(filepath.Dir(path), geojsonPath)
+		}
+		opts := mapOpts
+		opts.Object = cfg.Object
+		if cfg.CRS != "" {
+			if opts.CRS, err = parseMapCRS(cfg.CRS); err != nil {
+				return nil, fmt.Errorf("map %q: snapshot %s: %w", name, cfg.Until, err)
+			}
+		}
+		dataset, err := geo.LoadFile(geojsonPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("map %q: snapshot %s: %w", name, cfg.Until, err)
+		}
+		assets, err := assetVersion(opts.Simplify, geojsonPath, "./fonts/roboto-regular.ttf", "./fonts/roboto-medium.ttf")
+		if err != nil {
+			return nil, fmt.Errorf("map %q: snapshot %s: %w", name, cfg.Until, err)
+		}
+		if opts.CRS != "" {
+			assets = string(opts.CRS) + "-" + assets
+		}
+		snapshots = append(snapshots, mapSnapshot{until: until, dataset: dataset, assets: name + "@" + cfg.Until + "-" + assets})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].until.Before(snapshots[j].until) })
+	for i := 1; i < len(snapshots); i++ {
+		if snapshots[i].until.Equal(snapshots[i-1].until) {
+			return nil, fmt.Errorf("map %q: two snapshots until %s", name, snapshots[i].until.Format(time.DateOnly))
+		}
+	}
+	return snapshots, nil
+}
+
+// Function to parse the crs of a map configuration, where empty leaves it
+// to the file
+func parseMapCRS(name string) (geo.CRS, error) {
+	if name == "" {
+		return "", nil
+	}
+	return geo.ParseCRS(name)
+}
+
+func (reg *mapRegistry) Get(name string) (*namedMap, bool) {
+	m, ok := reg.maps[name]
+	return m, ok
+}
+
+// Function to get a copy of the server that renders another map
+func (s *server) withMap(m *namedMap) *server {
+	c := *s
+	c.dataset, c.assets, c.palette, c.snapshots = m.dataset, m.assets, m.palette, m.snapshots
+	c.style = render.Style{}
+	if m.style != nil {
+		c.style = *m.style
+	}
+	c.projection = m.projection
+	c.prefectures = m.name == defaultMapName
+	return &c
+}
+
+// Function to get a copy of the server that renders the boundaries in use
+// on the asof date of a query, YYYY-MM-DD. Dates after every snapshot, and
+// queries without one, use the current boundaries.
+func (s *server) asOf(query url.Values) (*server, error) {
+	v := query.Get("asof")
+	if v == "" {
+		return s, nil
+	}
+	date, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid asof: %s (must be YYYY-MM-DD)", v)
+	}
+	for _, snapshot := range s.snapshots {
+		if date.Before(snapshot.until) {
+			c := *s
+			c.dataset, c.assets = snapshot.dataset, snapshot.assets
+			return &c, nil
+		}
+	}
+	return s, nil
+}
+
+// GET /map/{name} renders a named map with the /map parameters. Events are
+// given by prefecture, so event= only works on the map of Japan.
+func (s *server) namedMapHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	m, ok := s.maps.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrMapNotFound, fmt.Sprintf("Map not found: %s", name))
+		return
+	}
+	annotateRequest(r.Context(), "map", name)
+	if name != defaultMapName && r.URL.Query().Has("event") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("event cannot be given for map %s (only %s)", name, defaultMapName))
+		return
+	}
+	s.withMap(m).mapHandler(w, r)
+}
+
+type mapInfo struct {
+	Name       string        `json:"name"`
+	Features   int           `json:"features"`
+	Projection string        `json:"projection"`
+	Palette    []string      `json:"palette,omitempty"`
+	Style      *render.Style `json:"style,omitempty"`
+	// Dates until which earlier boundaries apply, oldest first
+	Snapshots []string `json:"snapshots,omitempty"`
+}
+
+// GET /maps lists the named maps
+func (reg *mapRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The built-in map first, then by name
+	names := []string{defaultMapName}
+	for name := range reg.maps {
+		if name != defaultMapName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+
+	maps := make([]mapInfo, len(names))
+	for i, name := range names {
+		m := reg.maps[name]
+		maps[i] = mapInfo{Name: name, Features: len(m.dataset.Full.Features), Projection: m.projection, Palette: m.palette, Style: m.style}
+		for _, snapshot := range m.snapshots {
+			maps[i].Snapshots = append(maps[i].Snapshots, snapshot.until.Format(time.DateOnly))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"maps": maps})
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"canvas/render"
+)
+
+// License written into PNG maps unless -license says otherwise
+const defaultLicense = "Code available under the MIT License (GitHub: evacuate)."
+
+// License written into the metadata of PNG maps, set with -license
+var imageLicense = defaultLicense
+
+// Function to write into a rendered map how it was produced, so archives
+// can tell maps apart after they leave the server: the renderer, the
+// license, a hash of the normalized parameters (the ETag without its
+// quotes) and, for event maps, the time of the event
+func withMetadata(data []byte, etag, eventTime string) ([]byte, error) {
+	version, revision := buildVersion()
+	software := fmt.Sprintf("canvas %s (renderer %s)", version, RENDERER_VERSION)
+	if revision != "" {
+		software = fmt.Sprintf("canvas %s %s (renderer %s)", version, revision, RENDERER_VERSION)
+	}
+	data, err := render.EmbedText(data, []render.TextChunk{
+		{Keyword: "Software", Text: software},
+		{Keyword: "Copyright", Text: imageLicense},
+		{Keyword: "Parameters Hash", Text: strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)},
+		{Keyword: "Event Time", Text: eventTime},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write PNG metadata: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Minimal metrics registry exposed in the Prometheus text format, so the
+// server does not need a client library
+type metricsRegistry struct {
+	mu         sync.Mutex
+	help       map[string]string
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	collectors []func()
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		help:       make(map[string]string),
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Function to format label pairs, e.g. labels("backend", "svg")
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metricsRegistry) Help(name, text string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.help[name] = text
+}
+
+// Function to register a callback refreshing gauges right before a scrape
+func (m *metricsRegistry) OnCollect(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, fn)
+}
+
+func (m *metricsRegistry) Add(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][labels] += v
+}
+
+func (m *metricsRegistry) Set(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.gauges[name] == nil {
+		m.gauges[name] = make(map[string]float64)
+	}
+	m.gauges[name][labels] = v
+}
+
+func (m *metricsRegistry) Observe(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h := m.histograms[name][labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.histograms[name][labels] = h
+	}
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Function to read a counter, summed over the series whose labels contain filter
+func (m *metricsRegistry) Counter(name, filter string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total float64
+	for l, v := range m.counters[name] {
+		if strings.Contains(l, filter) {
+			total += v
+		}
+	}
+	return total
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	collectors := append([]func(){}, m.collectors...)
+	m.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeSeries := func(kind string, series map[string]map[string]float64) {
+		for _, name := range sortedKeys(series) {
+			m.writeHeader(w, name, kind)
+			for _, l := range sortedKeys(series[name]) {
+				fmt.Fprintf(w, "%s%s %g\n", name, braces(l), series[name][l])
+			}
+		}
+	}
+	writeSeries("counter", m.counters)
+	writeSeries("gauge", m.gauges)
+
+	for _, name := range sortedKeys(m.histograms) {
+		m.writeHeader(w, name, "histogram")
+		for _, l := range sortedKeys(m.histograms[name]) {
+			h := m.histograms[name][l]
+			sep := ""
+			if l != "" {
+				sep = ","
+			}
+			for i, bound := range durationBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, l, sep, bound, h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, l, sep, h.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, braces(l), h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(l), h.count)
+		}
+	}
+}
+
+func (m *metricsRegistry) writeHeader(w http.ResponseWriter, name, kind string) {
+	if help, ok := m.help[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func braces(l string) string {
+	if l == "" {
+		return ""
+	}
+	return "{" + l + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
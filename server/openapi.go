@@ -0,0 +1,467 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/geo"
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// A query or path parameter of an operation, and the schema its values are
+// checked against before the handler runs. The handlers still check what a
+// schema cannot express, such as the JSON of scale.
+type apiParam struct {
+	Name        string
+	In          string // query (default) or path
+	Description string
+	Type        string // string (default), integer, number or boolean
+	Enum        []string
+	Min, Max    *float64
+	Format      string // date for YYYY-MM-DD, date-time for RFC 3339
+	Required    bool
+	Repeated    bool   // Given once per value, as overlay
+	Code        string // Error code of an invalid value (default INVALID_QUERY)
+}
+
+// An endpoint of the public API, by its method and the pattern it is routed
+// under
+type apiOperation struct {
+	Method, Path string
+	ID, Summary  string
+	Params       []apiParam
+	Body         string // Media type of the request body, if any
+	Status       int    // Status of success (default 200)
+	Produces     []string
+}
+
+// The OpenAPI document of the public API, generated from its operations,
+// and the check of requests against it
+type apiSpec struct {
+	mux        *http.ServeMux
+	operations map[string]*apiOperation // By method and path, as "GET /map/{name}"
+	document   []byte
+}
+
+// Function to bound a numeric parameter
+func bound(v float64) *float64 {
+	return &v
+}
+
+// Function to list the keys of a registry in order, for an enum
+func enumOf[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
+
+// Parameters shared by /map and everything drawn through its parameters
+func mapParams() []apiParam {
+	dimension := func(name, description string) apiParam {
+		return apiParam{Name: name, Description: description, Type: "integer", Min: bound(render.MIN_DIMENSION), Max: bound(render.MAX_DIMENSION), Code: ErrInvalidDimensions}
+	}
+	return []apiParam{
+		{Name: "scale", Description: `JSON array of {"id": <prefecture id>, "scale": <0-7>}, where id may also be a prefecture name or code, as "兵庫県", "Hyogo" or "JP-28"`},
+		{Name: "points", Description: "JSON array of station intensities drawn as markers"},
+		{Name: "scale_type", Description: "Intensity scale of scale and points", Enum: []string{render.ScaleJMA, render.ScaleMMI, render.ScaleLPGM}},
+		{Name: "values", Description: `JSON array of {"id": <feature id>, "value": <number>}, colored by ramp`},
+		{Name: "ramp", Description: "2 to 16 stops value:color, in ascending order"},
+		{Name: "ramp_mode", Description: "How values between stops are colored", Enum: []string{"steps", "linear"}, Code: ErrInvalidRamp},
+		dimension("width", "Output width in pixels"),
+		dimension("height", "Output height in pixels"),
+		{Name: "size", Description: "Preset used when width and height are absent: 1 (1280x720), 2 (2560x1440) or 3 (5120x2880)", Type: "integer", Min: bound(1), Max: bound(3), Code: ErrInvalidDimensions},
+		{Name: "scale_text", Description: "Draw the intensity value on each prefecture", Type: "boolean"},
+		{Name: "footer", Description: "Custom footer text"},
+		{Name: "title", Description: "Title written in a banner above the map"},
+		{Name: "subtitle", Description: "Line written under the title"},
+		{Name: "preset", Description: "Social card size, with the title banner", Enum: enumOf(cardPresets)},
+		{Name: "logo", Description: "Corner of the configured logo, or none", Enum: []string{render.LogoTopLeft, render.LogoTopRight, render.LogoBottomLeft, render.LogoBottomRight, "none"}},
+		{Name: "logo_opacity", Description: "Opacity of the logo", Type: "number", Min: bound(0), Max: bound(1)},
+		{Name: "stroke", Description: "Color of the prefecture borders, #rrggbb or rrggbb"},
+		{Name: "stroke_width", Description: "Width of the borders in pixels at 1280x720", Type: "number", Max: bound(render.MAX_STROKE_WIDTH), Code: ErrInvalidStyle},
+		{Name: "fill_opacity", Description: "Opacity of the prefecture fills", Type: "number", Min: bound(0), Max: bound(1), Code: ErrInvalidStyle},
+		{Name: "margin", Description: "Fraction of the canvas left empty on each side", Type: "number", Min: bound(0), Max: bound(0.45), Code: ErrInvalidMargin},
+		{Name: "min_span", Description: "Minimum extent of the view in degrees", Type: "number", Min: bound(0), Max: bound(90), Code: ErrInvalidMinSpan},
+		{Name: "extent", Description: "Fit the shaded prefectures, or the whole country", Enum: []string{"auto", "japan"}, Code: ErrInvalidExtent},
+		{Name: "bbox", Description: "minLon,minLat,maxLon,maxLat, or a region name such as kanto"},
+		{Name: "backend", Description: "Rasterization backend, instead of the configured rollout", Enum: enumOf(render.Backends), Code: ErrInvalidBackend},
+		{Name: "precision", Description: fmt.Sprintf("Decimals of the path coordinates, 1 to %d, or auto", render.MAX_PRECISION)},
+		{Name: "layers", Description: "Layer stack, bottom first"},
+		{Name: "density", Description: "Thin labels and markers by zoom, or show every one", Enum: []string{render.DensityAuto, render.DensityAll}},
+		{Name: "insets", Description: "Draw remote islands in boxes, or not", Enum: []string{render.InsetsAuto, render.InsetsNone}},
+		{Name: "projection", Description: "Map projection (default: that of the map)", Enum: enumOf(geo.Projections)},
+		{Name: "heatmap", Description: "Interpolate the points intensities over the land", Type: "boolean"},
+		{Name: "markers", Description: "JSON array of pins and symbols drawn over the map"},
+		{Name: "overlay", Description: "GeoJSON lines and polygons drawn over the map", Repeated: true},
+		{Name: "reference", Description: "Built-in tectonic reference lines: plates, faults or plates,faults"},
+		{Name: "highlight", Description: "Outline the prefectures with the strongest shaking", Type: "boolean"},
+		{Name: "asof", Description: "Date whose boundaries are drawn", Format: "date"},
+		{Name: "crs", Description: "CRS of the points, markers, overlay and bbox coordinates"},
+		{Name: "names", Description: "Write the prefecture names", Enum: []string{render.NamesRomaji, render.NamesKanji, render.NamesBoth}},
+		{Name: "lang", Description: "Language of the built-in footers, banners and titles", Enum: []string{i18n.English, i18n.Japanese}},
+		{Name: "simulate", Description: "Show the map as seen with a color vision deficiency", Enum: enumOf(render.Simulations)},
+	}
+}
+
+// Parameter refusing IDs that match no feature of the map
+var strictParam = apiParam{Name: "strict", Description: "Refuse IDs of scale and values that match no feature, instead of reporting them in X-Unknown-IDs", Type: "boolean"}
+
+// Parameters of a single map image, on top of mapParams
+func imageParams() []apiParam {
+	return []apiParam{
+		strictParam,
+		{Name: "format", Description: "png, the clickable outlines as imagemap or regions, an interactive SVG as html, or the alt text as alt", Enum: []string{formatPNG, formatImageMap, formatRegions, formatHTML, formatAlt}},
+		{Name: "href", Description: "Link of each prefecture of imagemap and html, with {id}, {name} and {name_ja} filled in"},
+		{Name: "map_name", Description: "Name of the imagemap <map>"},
+		{Name: "download", Description: "1 to have browsers save the map rather than show it", Enum: []string{"0", "1", "true", "false"}},
+		{Name: "filename", Description: "Name browsers save the map under, with tokens such as {date} and {max}"},
+		{Name: "output", Description: "The image, or the URL it is uploaded to", Enum: []string{outputImage, outputURL}},
+		{Name: "debug", Description: "Return where the render spent its time instead of the image", Enum: []string{debugTimings}},
+	}
+}
+
+// Function to pick the parameters of a list, without those named
+func without(params []apiParam, names ...string) []apiParam {
+	return slices.DeleteFunc(slices.Clone(params), func(p apiParam) bool { return slices.Contains(names, p.Name) })
+}
+
+// Function to build the parameter of a duration in milliseconds
+func millisParam(name, description string, least, most time.Duration) apiParam {
+	return apiParam{Name: name, Description: description + ", in milliseconds", Type: "integer", Min: bound(float64(least.Milliseconds())), Max: bound(float64(most.Milliseconds()))}
+}
+
+// Function to list the operations of the public API
+func apiOperations() []*apiOperation {
+	event := apiParam{Name: "event", Description: "p2pquake or 14-digit JMA ID of an archived earthquake to draw"}
+	mode := apiParam{Name: "mode", Description: "Shade the prefectures of an event, or mark its stations", Enum: []string{"prefectures", "points"}}
+	name := apiParam{Name: "name", In: "path", Description: "Map of -maps", Required: true}
+	imageID := apiParam{Name: "id", In: "path", Description: "X-Image-ID of the render", Required: true}
+	jobID := apiParam{Name: "id", In: "path", Description: "ID of the job", Required: true}
+	minIntensity := apiParam{Name: "min_intensity", Description: "Weakest intensity counted", Type: "integer", Min: bound(1), Max: bound(7)}
+	images := []string{"image/png", "text/html", "application/json", "text/plain"}
+	animations := []string{"image/gif", "image/apng"}
+
+	withEvent := append(append(mapParams(), imageParams()...), event, mode)
+	tile := append(without(mapParams(), tileFixedParams...), apiParam{Name: "event", Description: "ID of an archived earthquake, or latest"}, mode, strictParam)
+	for _, p := range []string{"z", "x", "y"} {
+		tile = append(tile, apiParam{Name: p, In: "path", Type: "string", Required: true, Description: map[string]string{
+			"z": fmt.Sprintf("Zoom, 0 to %d", geo.MaxTileZoom), "x": "Column", "y": "Row, followed by .png, or @2x.png for high-density screens",
+		}[p]})
+	}
+	return []*apiOperation{
+		{Method: "GET", Path: "/map", ID: "getMap", Summary: "Draw a seismic intensity map", Params: withEvent, Produces: images},
+		{Method: "GET", Path: "/map/latest", ID: "getLatestMap", Summary: "Draw the most recent earthquake", Params: append(without(append(mapParams(), imageParams()...), "scale", "points", "scale_type"), mode), Produces: images},
+		{Method: "GET", Path: "/map/alt", ID: "getMapAltText", Summary: "Describe a map for screen readers, as format=alt does", Params: append(without(append(mapParams(), imageParams()...), "format"), event, mode), Produces: []string{"text/plain"}},
+		{Method: "GET", Path: "/map/{name}", ID: "getNamedMap", Summary: "Draw a map of -maps", Params: append(withEvent, name), Produces: images},
+		{Method: "POST", Path: "/map", ID: "uploadMap", Summary: "Draw a map over posted GeoJSON or TopoJSON", Body: "application/geo+json", Params: append(mapParams(),
+			apiParam{Name: "id_property", Description: "Feature property matched against the ids of scale"},
+			apiParam{Name: "object", Description: "Object of a TopoJSON file holding the features"}), Produces: []string{"image/png"}},
+		{Method: "POST", Path: "/map/batch", ID: "renderBatch", Summary: "Draw up to 16 maps into a ZIP", Body: "application/json", Params: append(mapParams(), event), Produces: []string{"application/zip"}},
+		{Method: "GET", Path: "/tiles/{z}/{x}/{y}", ID: "getTile", Summary: "Draw the map as an XYZ web map tile", Params: tile, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/animation", ID: "getAnimation", Summary: "Animate intensities as reports come in", Params: append(mapParams(),
+			apiParam{Name: "frames", Description: `JSON array of {"time", "scale", "points"}, or none to reveal the map strongest first`, Code: ErrInvalidFrames},
+			millisParam("delay", "How long each frame is shown", 100*time.Millisecond, 10*time.Second),
+			millisParam("hold", "How long the last frame is shown", 100*time.Millisecond, 30*time.Second),
+			apiParam{Name: "format", Enum: []string{render.FormatGIF, render.FormatAPNG}}), Produces: animations},
+		{Method: "GET", Path: "/propagation", ID: "getPropagation", Summary: "Animate the P and S waves of an earthquake", Params: append(mapParams(),
+			apiParam{Name: "event", Description: "Archived earthquake whose hypocenter is used"},
+			apiParam{Name: "epicenter", Description: "JMA hypocenter region name, instead of lat and lon"},
+			apiParam{Name: "lat", Type: "number", Min: bound(-90), Max: bound(90)},
+			apiParam{Name: "lon", Type: "number", Min: bound(-180), Max: bound(180)},
+			apiParam{Name: "depth", Description: "Depth in km", Type: "number", Min: bound(0), Max: bound(700)},
+			apiParam{Name: "time", Description: "Origin time", Format: "date-time"},
+			millisParam("duration", "Time after the origin the animation ends", time.Second, 5*time.Minute),
+			millisParam("step", "Time between frames", 100*time.Millisecond, time.Minute),
+			millisParam("delay", "How long each frame is shown", 20*time.Millisecond, 10*time.Second),
+			millisParam("hold", "How long the last frame is shown", 20*time.Millisecond, 30*time.Second),
+			apiParam{Name: "format", Enum: []string{render.FormatGIF, render.FormatAPNG}}), Produces: animations},
+		{Method: "GET", Path: "/grid", ID: "getGrid", Summary: "Draw several maps side by side", Params: append(without(mapParams(), "scale", "points"),
+			apiParam{Name: "panels", Description: `JSON array of up to 9 panels, each of /map parameters`, Required: true, Code: ErrInvalidPanels},
+			apiParam{Name: "columns", Type: "integer", Min: bound(1), Max: bound(render.MAX_PANELS)}), Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/badge", ID: "getBadge", Summary: "Draw the highest intensity as a square badge", Params: []apiParam{
+			{Name: "scale", Description: "JSON array of intensities, as on /map", Code: ErrInvalidScale},
+			{Name: "max", Description: "Intensity, instead of scale", Type: "integer", Min: bound(0), Max: bound(7), Code: ErrInvalidScale},
+			{Name: "size", Description: "Side in pixels", Type: "integer", Min: bound(MIN_BADGE_SIZE), Max: bound(MAX_BADGE_SIZE), Code: ErrInvalidDimensions},
+			{Name: "background", Enum: []string{"transparent", "dark"}},
+		}, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/legend", ID: "getLegend", Summary: "Draw the key to the intensity colors on its own", Params: []apiParam{
+			{Name: "scale_type", Description: "Intensity scale of the key", Enum: []string{render.ScaleJMA, render.ScaleMMI, render.ScaleLPGM}},
+			{Name: "map", Description: "Map of -maps whose palette is used"},
+			{Name: "lang", Description: "Language of the title and classes", Enum: []string{i18n.English, i18n.Japanese}},
+			{Name: "simulate", Description: "Show the key as seen with a color vision deficiency", Enum: enumOf(render.Simulations)},
+			{Name: "size", Description: "Size of the key on maps of that /map size preset", Enum: []string{"1", "2", "3"}, Code: ErrInvalidDimensions},
+			{Name: "format", Enum: []string{render.LegendPNG, render.LegendSVG}},
+		}, Produces: []string{"image/png", "image/svg+xml"}},
+		{Method: "GET", Path: "/diff", ID: "getDiff", Summary: "Highlight the pixels two maps differ in", Params: []apiParam{
+			{Name: "a", Description: "Image ID of the first map"}, {Name: "a_spec", Description: "Map parameters of the first map"},
+			{Name: "b", Description: "Image ID of the second map"}, {Name: "b_spec", Description: "Map parameters of the second map"},
+			{Name: "threshold", Description: "Channel difference ignored", Type: "integer", Min: bound(0), Max: bound(255)},
+		}, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/social", ID: "getSocialKit", Summary: "ZIP of the images, alt text and caption of a post", Params: append(without(mapParams(), "scale", "points", "width", "height", "size", "preset"),
+			apiParam{Name: "event", Description: "Earthquake of the post (default: the latest)"},
+			apiParam{Name: "publisher"}, apiParam{Name: "locale"}), Produces: []string{"application/zip"}},
+		{Method: "GET", Path: "/summary", ID: "getSummary", Summary: "Map of the strongest shaking over a day or week", Params: []apiParam{
+			{Name: "period", Enum: []string{summaryDaily, summaryWeekly}},
+			{Name: "end", Description: "Last day of the period, in JST", Format: "date"},
+			minIntensity,
+		}, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/frequency", ID: "getFrequency", Summary: "Choropleth of how often each prefecture shook", Params: []apiParam{
+			{Name: "from", Description: "First day, in JST", Format: "date", Required: true},
+			{Name: "to", Description: "Last day, in JST (default: today)", Format: "date"},
+			minIntensity,
+			{Name: "ramp", Description: "Stops value:color of the counts"},
+			{Name: "footer"},
+			{Name: "lang", Enum: []string{i18n.English, i18n.Japanese}},
+		}, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/maps", ID: "listMaps", Summary: "List the maps of -maps", Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/areas", ID: "listAreas", Summary: "List the features scale and values can shade, with their names, centroid and bbox", Params: []apiParam{
+			{Name: "map", Description: "Map of -maps to list instead of the default one"},
+			{Name: "asof", Description: "Date whose boundaries are listed", Format: "date"},
+		}, Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/images/{id}", ID: "getImage", Summary: "A recent render, by its X-Image-ID", Params: []apiParam{imageID}, Produces: []string{"image/png"}},
+		{Method: "GET", Path: "/images/{id}/thumb", ID: "getThumbnail", Summary: "Thumbnail of a recent render", Params: []apiParam{imageID,
+			{Name: "w", Description: "Width in pixels", Type: "integer", Min: bound(MIN_THUMB_WIDTH), Max: bound(MAX_THUMB_WIDTH), Code: ErrInvalidDimensions}}, Produces: []string{"image/png"}},
+		{Method: "POST", Path: "/jobs", ID: "createJob", Summary: "Queue a render in the background", Body: "application/json", Status: http.StatusAccepted, Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/jobs/{id}", ID: "getJob", Summary: "State of a render job", Params: []apiParam{jobID}, Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/jobs/{id}/result", ID: "getJobResult", Summary: "Result of a finished render job", Params: []apiParam{jobID}, Produces: images},
+		{Method: "GET", Path: "/usage", ID: "getUsage", Summary: "Usage of the API key this month", Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/version", ID: "getVersion", Summary: "Version of the server and its feature flags", Produces: []string{"application/json"}},
+		{Method: "GET", Path: "/openapi.json", ID: "getOpenAPI", Summary: "This document", Produces: []string{"application/json"}},
+	}
+}
+
+// Function to build the spec of the API served by mux
+func newAPISpec(mux *http.ServeMux) *apiSpec {
+	s := &apiSpec{mux: mux, operations: make(map[string]*apiOperation)}
+	for _, op := range apiOperations() {
+		s.operations[op.Method+" "+op.Path] = op
+	}
+	s.document, _ = json.MarshalIndent(s.openAPI(), "", "  ")
+	return s
+}
+
+// Function to build the OpenAPI 3 document of the operations
+func (s *apiSpec) openAPI() map[string]any {
+	version, _ := buildVersion()
+	paths := map[string]map[string]any{}
+	for _, op := range s.operations {
+		var params []any
+		for _, p := range op.Params {
+			params = append(params, p.openAPI())
+		}
+		content := map[string]any{}
+		for _, t := range op.Produces {
+			schema := map[string]any{"type": "string", "format": "binary"}
+			if t == "application/json" || t == "text/html" {
+				schema = map[string]any{}
+			}
+			content[t] = map[string]any{"schema": schema}
+		}
+		operation := map[string]any{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses": map[string]any{
+				strconv.Itoa(cmp.Or(op.Status, http.StatusOK)): map[string]any{"description": "Success", "content": content},
+				"default": map[string]any{"description": "Error", "content": map[string]any{
+					"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+				}},
+			},
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Body != "" {
+			operation["requestBody"] = map[string]any{"required": true, "content": map[string]any{op.Body: map[string]any{"schema": map[string]any{}}}}
+		}
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]any{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "canvas",
+			"description": "Seismic intensity maps of Japan",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"Error": map[string]any{
+					"type": "object",
+					"properties": map[string]any{"error": map[string]any{
+						"type":     "object",
+						"required": []string{"code", "message"},
+						"properties": map[string]any{
+							"code":    map[string]any{"type": "string"},
+							"message": map[string]any{"type": "string"},
+							"param":   map[string]any{"type": "string", "description": "Parameter at fault, for invalid parameters"},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// Function to describe a parameter as an OpenAPI parameter object
+func (p *apiParam) openAPI() map[string]any {
+	schema := map[string]any{"type": cmp.Or(p.Type, "string")}
+	if len(p.Enum) > 0 {
+		schema["enum"] = p.Enum
+	}
+	if p.Min != nil {
+		schema["minimum"] = *p.Min
+	}
+	if p.Max != nil {
+		schema["maximum"] = *p.Max
+	}
+	if p.Format != "" {
+		schema["format"] = p.Format
+	}
+	if p.Repeated {
+		schema = map[string]any{"type": "array", "items": schema}
+	}
+	param := map[string]any{"name": p.Name, "in": cmp.Or(p.In, "query"), "schema": schema}
+	if p.Description != "" {
+		param["description"] = p.Description
+	}
+	if p.Required {
+		param["required"] = true
+	}
+	return param
+}
+
+// Function to check a value of a parameter against its schema
+func (p *apiParam) check(value string) error {
+	invalid := func(must string) error {
+		return &apiError{Status: http.StatusBadRequest, Code: cmp.Or(p.Code, ErrInvalidQuery), Param: p.Name,
+			Message: fmt.Sprintf("Invalid %s: %s (must be %s)", p.Name, value, must)}
+	}
+	switch p.Type {
+	case "integer":
+		n, err := strconv.Atoi(value)
+		if err != nil || (p.Min != nil && float64(n) < *p.Min) || (p.Max != nil && float64(n) > *p.Max) {
+			return invalid(p.rangeText("an integer"))
+		}
+	case "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || (p.Min != nil && n < *p.Min) || (p.Max != nil && n > *p.Max) {
+			return invalid(p.rangeText("a number"))
+		}
+	case "boolean":
+		if value != "true" && value != "false" {
+			return invalid("true or false")
+		}
+	}
+	if len(p.Enum) > 0 && !slices.Contains(p.Enum, value) {
+		must := p.Enum[len(p.Enum)-1]
+		if len(p.Enum) > 1 {
+			must = strings.Join(p.Enum[:len(p.Enum)-1], ", ") + " or " + must
+		}
+		return invalid(must)
+	}
+	switch p.Format {
+	case "date":
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return invalid("YYYY-MM-DD")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return invalid("RFC 3339")
+		}
+	}
+	return nil
+}
+
+// Function to describe the bounds of a numeric parameter
+func (p *apiParam) rangeText(kind string) string {
+	switch {
+	case p.Min != nil && p.Max != nil:
+		return fmt.Sprintf("%s between %g and %g", kind, *p.Min, *p.Max)
+	case p.Min != nil:
+		return fmt.Sprintf("%s of at least %g", kind, *p.Min)
+	case p.Max != nil:
+		return fmt.Sprintf("%s of at most %g", kind, *p.Max)
+	}
+	return kind
+}
+
+// Function to check the query of a request to an operation. Parameters it
+// does not declare are left to the handler.
+func (op *apiOperation) validate(r *http.Request) error {
+	query := r.URL.Query()
+	for i := range op.Params {
+		p := &op.Params[i]
+		if p.In == "path" {
+			continue
+		}
+		if p.Required && query.Get(p.Name) == "" {
+			return &apiError{Status: http.StatusBadRequest, Code: cmp.Or(p.Code, ErrInvalidQuery), Param: p.Name,
+				Message: fmt.Sprintf("%s parameter is required", p.Name)}
+		}
+		for _, v := range query[p.Name] {
+			if v == "" {
+				continue
+			}
+			if err := p.check(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Middleware checking the query parameters of requests to the operations of
+// the spec, with 400 and the parameter at fault, before they reach their
+// handler
+func (s *apiSpec) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := s.mux.Handler(r)
+		_, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			path = pattern
+		}
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if op, ok := s.operations[method+" "+path]; ok {
+			if err := op.validate(r); err != nil {
+				annotateRequest(r.Context(), "error", err.Error())
+				writeAPIError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware checking requests to a handler outside the mux as those to an
+// operation of the spec, as the gRPC frames stream is checked as /animation
+func (s *apiSpec) WrapOperation(method, path string, next http.Handler) http.Handler {
+	op := s.operations[method+" "+path]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := op.validate(r); err != nil {
+			annotateRequest(r.Context(), "error", err.Error())
+			writeAPIError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /openapi.json returns the OpenAPI 3 document of the public API
+func (s *apiSpec) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(s.document)
+}
@@ -0,0 +1,592 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"canvas/geo"
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// IntensityQuery is one entry of the scale parameter.
+type IntensityQuery struct {
+	ID    int `json:"id"`
+	Scale int `json:"scale"`
+	// The prefecture name or code the ID was resolved from, if any
+	prefecture string
+}
+
+// UnmarshalJSON reads an entry whose id is the numeric feature ID, as a
+// number or a string of digits, or, as feeds often give it, a prefecture by
+// name or code: "兵庫県", "兵庫", "Hyogo" or "JP-28".
+func (q *IntensityQuery) UnmarshalJSON(data []byte) error {
+	var entry struct {
+		ID    json.RawMessage `json:"id"`
+		Scale int             `json:"scale"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	*q = IntensityQuery{Scale: entry.Scale}
+	if len(entry.ID) == 0 || string(entry.ID) == "null" {
+		return nil
+	}
+	var key string
+	if json.Unmarshal(entry.ID, &key) != nil {
+		return json.Unmarshal(entry.ID, &q.ID)
+	}
+	if id, err := strconv.Atoi(key); err == nil && id >= 0 {
+		q.ID = id
+		return nil
+	}
+	code, ok := geo.ParsePrefecture(key)
+	if !ok {
+		return fmt.Errorf("unknown prefecture: %q (must be a name, such as 兵庫県 or Hyogo, or a code, such as 28 or JP-28)", key)
+	}
+	q.ID, q.prefecture = code, key
+	return nil
+}
+
+// Function to list the entries of the scale parameter that name a
+// prefecture, by the name or code given
+func prefectureNames(query url.Values) []string {
+	var intensities []IntensityQuery
+	if json.Unmarshal([]byte(query.Get("scale")), &intensities) != nil {
+		return nil
+	}
+	var names []string
+	for _, intensity := range intensities {
+		if intensity.prefecture != "" {
+			names = append(names, intensity.prefecture)
+		}
+	}
+	return names
+}
+
+// ValueQuery is one entry of the values parameter.
+type ValueQuery struct {
+	ID    int     `json:"id"`
+	Value float64 `json:"value"`
+}
+
+// PointQuery is one entry of the points parameter: a station given by its
+// coordinates, or by name when the server has a station list.
+type PointQuery struct {
+	Name  string   `json:"name,omitempty"`
+	Lat   *float64 `json:"lat,omitempty"`
+	Lon   *float64 `json:"lon,omitempty"`
+	Scale int      `json:"scale"`
+}
+
+// MarkerQuery is one entry of the markers parameter.
+type MarkerQuery struct {
+	Lon   *float64 `json:"lon"`
+	Lat   *float64 `json:"lat"`
+	Icon  string   `json:"icon,omitempty"`
+	Label string   `json:"label,omitempty"`
+	Color string   `json:"color,omitempty"`
+}
+
+// Station list used to place points given by name, loaded with -stations
+var stations *geo.Stations
+
+// Resolves epicenters given as hypocenter region names to coordinates
+type epicenterGeocoder interface {
+	Geocode(name string) (lat, lon float64, ok bool)
+}
+
+// Geocoder of epicenter names: the bundled table of JMA hypocenter
+// regions, with -hypocenters overrides
+var epicenters epicenterGeocoder = geo.DefaultHypocenters()
+
+// Logo composited over the maps, loaded with -logo, or nil
+var logo *render.Logo
+
+// ParseRenderOptions parses and validates the /map query parameters. Errors
+// are API errors with a 400 status.
+func ParseRenderOptions(query url.Values) (*render.Options, error) {
+	scaleData := query.Get("scale")
+	pointsData := query.Get("points")
+	valuesData := query.Get("values")
+	markersData := query.Get("markers")
+	overlayData := query["overlay"]
+	if scaleData == "" && pointsData == "" && valuesData == "" && markersData == "" && len(overlayData) == 0 {
+		return nil, invalidParam(ErrMissingScale, "scale, points, values, markers or overlay parameter is required")
+	}
+	if valuesData != "" && scaleData != "" {
+		return nil, invalidParam(ErrInvalidQuery, "scale and values cannot be combined")
+	}
+
+	var intensities []IntensityQuery
+	if scaleData != "" {
+		if err := json.Unmarshal([]byte(scaleData), &intensities); err != nil {
+			return nil, invalidParam(ErrInvalidScale, "Invalid scale data format: %v", err)
+		}
+	}
+
+	opts := render.DefaultOptions()
+	scaleType, err := render.ParseScaleType(query.Get("scale_type"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid scale_type: %s (must be jma, mmi or lpgm)", query.Get("scale_type"))
+	}
+	opts.ScaleType = scaleType
+	opts.Extent = query.Get("extent")
+	opts.FooterText = query.Get("footer")
+	opts.Title, opts.Subtitle = query.Get("title"), query.Get("subtitle")
+	if err := render.ValidateBanner(opts.Title, opts.Subtitle); err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid banner: %v", err)
+	}
+	opts.ShowScale = query.Get("scale_text") == "true"
+	opts.Backend = query.Get("backend")
+
+	for _, intensity := range intensities {
+		// Check the intensity value
+		if intensity.Scale < 0 || intensity.Scale > render.MaxScale(scaleType) {
+			return nil, invalidParam(ErrInvalidScale, "Invalid scale value for ID %d: %d", intensity.ID, intensity.Scale)
+		}
+		opts.ScaleMap[intensity.ID] = intensity.Scale
+	}
+
+	// CRS of the coordinates in points, markers, overlay and bbox
+	crs, err := geo.ParseCRS(query.Get("crs"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid crs: %s (must be wgs84, jgd2011, jgd2000 or tokyo, or their EPSG code)", query.Get("crs"))
+	}
+
+	if pointsData != "" {
+		points, err := parsePoints(pointsData, crs, scaleType)
+		if err != nil {
+			return nil, err
+		}
+		opts.Points = points
+	}
+
+	if markersData != "" {
+		markers, err := parseMarkers(markersData, crs)
+		if err != nil {
+			return nil, err
+		}
+		opts.Markers = markers
+	}
+
+	if len(overlayData) > 0 {
+		overlays, err := parseOverlays(overlayData, crs)
+		if err != nil {
+			return nil, err
+		}
+		opts.Overlays = overlays
+	}
+
+	if valuesData != "" {
+		values, ramp, err := parseChoropleth(valuesData, query.Get("ramp"), query.Get("ramp_mode"))
+		if err != nil {
+			return nil, err
+		}
+		opts.Values, opts.Ramp = values, ramp
+	} else if query.Has("ramp") || query.Has("ramp_mode") {
+		return nil, invalidParam(ErrInvalidQuery, "ramp and ramp_mode require values")
+	}
+
+	// Size presets, kept for existing clients
+	switch query.Get("size") {
+	case "1":
+		opts.Multiplier = 1.0 // 1280x720
+	case "2":
+		opts.Multiplier = 2.0 // 2560x1440
+	case "3":
+		opts.Multiplier = 4.0 // 5120x2880
+	default:
+		opts.Multiplier = 1.0
+	}
+	opts.Width = int(render.BASE_WIDTH * opts.Multiplier)
+	opts.Height = int(render.BASE_HEIGHT * opts.Multiplier)
+
+	if err := parseDimensions(query, &opts); err != nil {
+		return nil, err
+	}
+	if err := parsePreset(query, &opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Logo, err = parseLogo(query); err != nil {
+		return nil, err
+	}
+
+	style, err := parseStyle(query)
+	if err != nil {
+		return nil, err
+	}
+	opts.Style = style
+
+	if v := query.Get("margin"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed < 0 || parsed > 0.45 {
+			return nil, invalidParam(ErrInvalidMargin, "Invalid margin: %s (must be between 0 and 0.45)", v)
+		}
+		opts.Margin = parsed
+	}
+
+	if v := query.Get("min_span"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed < 0 || parsed > 90 {
+			return nil, invalidParam(ErrInvalidMinSpan, "Invalid min_span: %s (must be between 0 and 90)", v)
+		}
+		opts.MinSpan = parsed
+	}
+
+	if opts.Extent != "" && opts.Extent != "auto" && opts.Extent != "japan" {
+		return nil, invalidParam(ErrInvalidExtent, "Invalid extent: %s (must be auto or japan)", opts.Extent)
+	}
+
+	if v := query.Get("bbox"); v != "" {
+		b, err := geo.ParseBBox(v)
+		if err != nil {
+			return nil, invalidParam(ErrInvalidBBox, "%v", err)
+		}
+		if _, region := geo.Regions[strings.ToLower(v)]; !region {
+			b = b.ToWGS84(crs)
+		}
+		opts.BBox = &b
+	}
+
+	if v := query.Get("precision"); v != "" && v != "auto" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > render.MAX_PRECISION {
+			return nil, invalidParam(ErrInvalidPrecision, "Invalid precision: %s (must be auto or between 1 and %d)", v, render.MAX_PRECISION)
+		}
+		opts.Precision = parsed
+	}
+
+	density, err := render.ParseDensity(query.Get("density"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid density: %s (must be auto or all)", query.Get("density"))
+	}
+	opts.Density = density
+
+	insets, err := render.ParseInsets(query.Get("insets"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid insets: %s (must be auto or none)", query.Get("insets"))
+	}
+	opts.Insets = insets
+
+	if v := query.Get("projection"); v != "" {
+		if _, err := geo.ParseProjection(v); err != nil {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid projection: %s (must be equirectangular, mercator or azimuthal)", v)
+		}
+		opts.Projection = v
+	}
+
+	names, err := render.ParseNames(query.Get("names"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid names: %s (must be romaji, kanji or both)", query.Get("names"))
+	}
+	opts.Names = names
+
+	if opts.Lang, err = i18n.Parse(query.Get("lang")); err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid lang: %s (must be en or ja)", query.Get("lang"))
+	}
+
+	simulate, err := render.ParseSimulation(query.Get("simulate"))
+	if err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid simulate: %s (must be deuteranopia, protanopia or tritanopia)", query.Get("simulate"))
+	}
+	opts.Simulate = simulate
+
+	if v := query.Get("layers"); v != "" {
+		layers, err := render.ParseLayers(v)
+		if err != nil {
+			return nil, invalidParam(ErrInvalidLayers, "Invalid layers: %v", err)
+		}
+		opts.Layers = layers
+	}
+	if query.Get("heatmap") == "true" {
+		opts.Layers = render.WithHeatmap(opts.Layers)
+	}
+	if query.Get("highlight") == "true" {
+		opts.Layers = render.WithHighlight(opts.Layers)
+	}
+	if v := query.Get("reference"); v != "" {
+		names, err := render.ParseReference(v)
+		if err != nil {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid reference: %v", err)
+		}
+		opts.Reference = names
+	}
+	if len(opts.Overlays) > 0 || len(opts.Reference) > 0 {
+		opts.Layers = render.WithOverlays(opts.Layers)
+	}
+	if len(opts.Markers) > 0 {
+		opts.Layers = render.WithMarkers(opts.Layers)
+	}
+
+	if opts.Backend != "" {
+		if _, ok := render.Backends[opts.Backend]; !ok {
+			return nil, invalidParam(ErrInvalidBackend, "Unknown backend: %s", opts.Backend)
+		}
+	}
+
+	return &opts, nil
+}
+
+// Canvas sizes of the social card presets
+var cardPresets = map[string][2]int{
+	"og":      {1200, 630},  // Open Graph link previews
+	"twitter": {1200, 675},  // Large summary cards
+	"square":  {1080, 1080}, // Feed posts
+}
+
+// Function to apply the size of a social card preset. A preset takes the
+// place of width, height and size, and draws the title banner, so it needs a
+// title.
+func parsePreset(query url.Values, opts *render.Options) error {
+	name := query.Get("preset")
+	if name == "" {
+		return nil
+	}
+	size, ok := cardPresets[name]
+	if !ok {
+		return invalidParam(ErrInvalidQuery, "Invalid preset: %s (must be og, twitter or square)", name)
+	}
+	for _, k := range []string{"width", "height", "size"} {
+		if query.Has(k) {
+			return invalidParam(ErrInvalidQuery, "preset cannot be combined with width, height or size")
+		}
+	}
+	if opts.Title == "" {
+		return invalidParam(ErrInvalidQuery, "preset requires a title")
+	}
+	opts.Width, opts.Height = size[0], size[1]
+	opts.Multiplier = min(float64(size[0])/render.BASE_WIDTH, float64(size[1])/render.BASE_HEIGHT)
+	return nil
+}
+
+// Function to place the configured logo: logo= moves it to another corner
+// or, as none, leaves it out, and logo_opacity= fades it
+func parseLogo(query url.Values) (*render.Logo, error) {
+	position, opacity := query.Get("logo"), query.Get("logo_opacity")
+	if logo == nil {
+		if (position != "" && position != "none") || opacity != "" {
+			return nil, invalidParam(ErrInvalidQuery, "No logo is configured")
+		}
+		return nil, nil
+	}
+	if position == "none" {
+		return nil, nil
+	}
+	placed := *logo
+	if position != "" {
+		placed.Position = position
+	}
+	if opacity != "" {
+		parsed, err := strconv.ParseFloat(opacity, 64)
+		if err != nil || !(parsed >= 0 && parsed <= 1) {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid logo_opacity: %s (must be between 0 and 1)", opacity)
+		}
+		placed.Opacity = parsed
+	}
+	if err := placed.Validate(); err != nil {
+		return nil, invalidParam(ErrInvalidQuery, "Invalid logo: %s (must be top-left, top-right, bottom-left, bottom-right or none)", position)
+	}
+	return &placed, nil
+}
+
+// Function to parse the style of the borders and fills. Parameters left out
+// keep the style of the map.
+func parseStyle(query url.Values) (render.Style, error) {
+	var style render.Style
+	if v := query.Get("stroke"); v != "" {
+		style.Stroke = "#" + strings.TrimPrefix(strings.ToLower(v), "#")
+		if err := (render.Style{Stroke: style.Stroke}).Validate(); err != nil {
+			return style, invalidParam(ErrInvalidStyle, "Invalid stroke: %s (must be #rrggbb or rrggbb)", v)
+		}
+	}
+	if v := query.Get("stroke_width"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(parsed > 0) || parsed > render.MAX_STROKE_WIDTH {
+			return style, invalidParam(ErrInvalidStyle, "Invalid stroke_width: %s (must be greater than 0 and at most %g)", v, render.MAX_STROKE_WIDTH)
+		}
+		style.StrokeWidth = parsed
+	}
+	if v := query.Get("fill_opacity"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(parsed >= 0 && parsed <= 1) {
+			return style, invalidParam(ErrInvalidStyle, "Invalid fill_opacity: %s (must be between 0 and 1)", v)
+		}
+		style.FillOpacity = &parsed
+	}
+	return style, nil
+}
+
+// Function to parse the values of a choropleth map and the ramp coloring
+// them, in steps (the default) or linear
+func parseChoropleth(valuesData, rampData, mode string) (map[int]float64, *render.Ramp, error) {
+	var queries []ValueQuery
+	if err := json.Unmarshal([]byte(valuesData), &queries); err != nil {
+		return nil, nil, invalidParam(ErrInvalidValues, "Invalid values data format: %v", err)
+	}
+	values := make(map[int]float64, len(queries))
+	for _, q := range queries {
+		if _, dup := values[q.ID]; dup {
+			return nil, nil, invalidParam(ErrInvalidValues, "Invalid values: ID %d is given twice", q.ID)
+		}
+		values[q.ID] = q.Value
+	}
+
+	if rampData == "" {
+		return nil, nil, invalidParam(ErrInvalidRamp, "ramp parameter is required with values")
+	}
+	var continuous bool
+	switch mode {
+	case "", "steps":
+	case "linear":
+		continuous = true
+	default:
+		return nil, nil, invalidParam(ErrInvalidRamp, "Invalid ramp_mode: %s (must be steps or linear)", mode)
+	}
+	ramp, err := render.ParseRamp(rampData, continuous)
+	if err != nil {
+		return nil, nil, invalidParam(ErrInvalidRamp, "Invalid ramp: %v", err)
+	}
+	return values, ramp, nil
+}
+
+// Function to parse the points parameter, looking up stations given by name
+// and converting coordinates given in another CRS. Intensities are on the
+// scale of scale_type.
+func parsePoints(data string, crs geo.CRS, scaleType string) ([]render.Point, error) {
+	var queries []PointQuery
+	if err := json.Unmarshal([]byte(data), &queries); err != nil {
+		return nil, invalidParam(ErrInvalidPoints, "Invalid points data format: %v", err)
+	}
+	if len(queries) > render.MAX_POINTS {
+		return nil, invalidParam(ErrInvalidPoints, "Too many points: %d (at most %d)", len(queries), render.MAX_POINTS)
+	}
+
+	points := make([]render.Point, len(queries))
+	for i, q := range queries {
+		if q.Scale < 0 || q.Scale > render.MaxScale(scaleType) {
+			return nil, invalidParam(ErrInvalidPoints, "Invalid scale value for point %d: %d", i, q.Scale)
+		}
+		switch {
+		case q.Lat != nil && q.Lon != nil:
+			if *q.Lat < -90 || *q.Lat > 90 || *q.Lon < -180 || *q.Lon > 180 {
+				return nil, invalidParam(ErrInvalidPoints, "Invalid point %d: %g,%g (out of range)", i, *q.Lat, *q.Lon)
+			}
+			lon, lat := crs.ToWGS84(*q.Lon, *q.Lat)
+			points[i] = render.Point{Lat: lat, Lon: lon, Scale: q.Scale}
+		case q.Name != "":
+			station, ok := stations.Lookup(q.Name)
+			if !ok {
+				return nil, invalidParam(ErrInvalidPoints, "Unknown station: %s", q.Name)
+			}
+			points[i] = render.Point{Lat: station.Lat, Lon: station.Lon, Scale: q.Scale}
+		default:
+			return nil, invalidParam(ErrInvalidPoints, "Invalid point %d: needs lat and lon, or name", i)
+		}
+	}
+	return points, nil
+}
+
+// Function to parse the markers parameter, converting coordinates given in
+// another CRS. Colors may leave out the #.
+func parseMarkers(data string, crs geo.CRS) ([]render.Marker, error) {
+	var queries []MarkerQuery
+	if err := json.Unmarshal([]byte(data), &queries); err != nil {
+		return nil, invalidParam(ErrInvalidMarkers, "Invalid markers data format: %v", err)
+	}
+	if len(queries) > render.MAX_MARKERS {
+		return nil, invalidParam(ErrInvalidMarkers, "Too many markers: %d (at most %d)", len(queries), render.MAX_MARKERS)
+	}
+
+	markers := make([]render.Marker, len(queries))
+	for i, q := range queries {
+		if q.Lat == nil || q.Lon == nil {
+			return nil, invalidParam(ErrInvalidMarkers, "Invalid marker %d: needs lat and lon", i)
+		}
+		if *q.Lat < -90 || *q.Lat > 90 || *q.Lon < -180 || *q.Lon > 180 {
+			return nil, invalidParam(ErrInvalidMarkers, "Invalid marker %d: %g,%g (out of range)", i, *q.Lat, *q.Lon)
+		}
+		lon, lat := crs.ToWGS84(*q.Lon, *q.Lat)
+		m := render.Marker{Lon: lon, Lat: lat, Icon: q.Icon, Label: q.Label}
+		if q.Color != "" {
+			m.Color = "#" + strings.TrimPrefix(strings.ToLower(q.Color), "#")
+		}
+		if err := m.Validate(); err != nil {
+			return nil, invalidParam(ErrInvalidMarkers, "Invalid marker %d: %v", i, err)
+		}
+		markers[i] = m
+	}
+	return markers, nil
+}
+
+// Function to apply the width and height parameters. When only one is given
+// the other follows the 16:9 base aspect ratio.
+func parseDimensions(query url.Values, opts *render.Options) error {
+	parse := func(name string) (int, error) {
+		v := query.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < render.MIN_DIMENSION || n > render.MAX_DIMENSION {
+			return 0, invalidParam(ErrInvalidDimensions, "Invalid %s: %s (must be between %d and %d)", name, v, render.MIN_DIMENSION, render.MAX_DIMENSION)
+		}
+		return n, nil
+	}
+
+	width, err := parse("width")
+	if err != nil {
+		return err
+	}
+	height, err := parse("height")
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case width == 0 && height == 0:
+		return nil
+	case height == 0:
+		height = int(math.Round(float64(width) * render.BASE_HEIGHT / render.BASE_WIDTH))
+	case width == 0:
+		width = int(math.Round(float64(height) * render.BASE_WIDTH / render.BASE_HEIGHT))
+	}
+	if width > render.MAX_DIMENSION || height > render.MAX_DIMENSION || height < render.MIN_DIMENSION || width < render.MIN_DIMENSION {
+		return invalidParam(ErrInvalidDimensions, "Invalid dimensions: %dx%d (each side must be between %d and %d)", width, height, render.MIN_DIMENSION, render.MAX_DIMENSION)
+	}
+	if width*height > render.MAX_PIXELS {
+		return invalidParam(ErrInvalidDimensions, "Invalid dimensions: %dx%d (at most %d pixels)", width, height, render.MAX_PIXELS)
+	}
+
+	opts.Width = width
+	opts.Height = height
+	opts.Multiplier = min(float64(width)/render.BASE_WIDTH, float64(height)/render.BASE_HEIGHT)
+	return nil
+}
+
+// Function to parse the overlay parameters, one GeoJSON layer each, in the
+// order they are drawn
+func parseOverlays(data []string, crs geo.CRS) ([]*render.Overlay, error) {
+	if len(data) > render.MAX_OVERLAYS {
+		return nil, invalidParam(ErrInvalidOverlay, "Too many overlays: %d (at most %d)", len(data), render.MAX_OVERLAYS)
+	}
+	overlays := make([]*render.Overlay, len(data))
+	vertices := 0
+	for i, layer := range data {
+		overlay, err := render.ParseOverlay([]byte(layer), crs)
+		if err != nil {
+			return nil, invalidParam(ErrInvalidOverlay, "Invalid overlay %d: %v", i, err)
+		}
+		vertices += overlay.Vertices()
+		overlays[i] = overlay
+	}
+	if vertices > render.MAX_OVERLAY_VERTICES {
+		return nil, invalidParam(ErrInvalidOverlay, "Too many overlay vertices: %d (at most %d)", vertices, render.MAX_OVERLAY_VERTICES)
+	}
+	return overlays, nil
+}
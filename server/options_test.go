@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+
+	"canvas/render"
+)
+
+func TestParseDimensions(t *testing.T) {
+	tests := []struct {
+		query      string
+		width      int
+		height     int
+		multiplier float64
+	}{
+		{"", 0, 0, 0},
+		{"width=1280&height=720", 1280, 720, 1},
+		// One dimension keeps the 16:9 base aspect ratio
+		{"width=1920", 1920, 1080, 1.5},
+		{"height=1080", 1920, 1080, 1.5},
+		{"width=640", 640, 360, 0.5},
+		{"height=360", 640, 360, 0.5},
+		{"width=1000", 1000, 563, 0.78125},
+		{"height=100", 178, 100, 100.0 / 720},
+		{"height=64", 114, 64, 64.0 / 720},
+		{"width=5120", 5120, 2880, 4},
+		{"height=2880", 5120, 2880, 4},
+		// Both dimensions are kept, and the map is scaled to fit inside them
+		{"width=640&height=640", 640, 640, 0.5},
+		{"width=1280&height=1440", 1280, 1440, 1},
+		{"width=64&height=64", 64, 64, 0.05},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		var opts render.Options
+		if err := parseDimensions(query, &opts); err != nil {
+			t.Errorf("parseDimensions(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if opts.Width != tt.width || opts.Height != tt.height || opts.Multiplier != tt.multiplier {
+			t.Errorf("parseDimensions(%q) = %dx%d at %g; want %dx%d at %g", tt.query,
+				opts.Width, opts.Height, opts.Multiplier, tt.width, tt.height, tt.multiplier)
+		}
+	}
+}
+
+func TestParseDimensionsInvalid(t *testing.T) {
+	for _, query := range []string{
+		"width=abc",
+		"width=1.5",
+		"width=-1",
+		"width=63",
+		"height=63",
+		"width=5121",
+		"height=5121",
+		// The derived dimension is out of range
+		"width=64",
+		"height=3000",
+		// Too many pixels
+		"width=5120&height=5120",
+	} {
+		values, _ := url.ParseQuery(query)
+		var opts render.Options
+		err := parseDimensions(values, &opts)
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.Code != ErrInvalidDimensions {
+			t.Errorf("parseDimensions(%q) = %v; want %s", query, err, ErrInvalidDimensions)
+		}
+		if opts.Width != 0 || opts.Height != 0 {
+			t.Errorf("parseDimensions(%q) set %dx%d", query, opts.Width, opts.Height)
+		}
+	}
+}
+
+func TestIntensityQueryID(t *testing.T) {
+	tests := []struct {
+		id         string
+		want       int
+		prefecture string
+	}{
+		{`28`, 28, ""},
+		{`"28"`, 28, ""},
+		{`"08"`, 8, ""},
+		// Digits are feature IDs, even past the prefectures
+		{`"100"`, 100, ""},
+		{`"Hyogo"`, 28, "Hyogo"},
+		{`"兵庫県"`, 28, "兵庫県"},
+		{`"JP-28"`, 28, "JP-28"},
+		{`"２８"`, 28, "２８"},
+	}
+	for _, tt := range tests {
+		var q IntensityQuery
+		if err := json.Unmarshal([]byte(`{"id":`+tt.id+`,"scale":3}`), &q); err != nil {
+			t.Errorf("id %s failed: %v", tt.id, err)
+			continue
+		}
+		if q.ID != tt.want || q.prefecture != tt.prefecture || q.Scale != 3 {
+			t.Errorf("id %s = %d from %q; want %d from %q", tt.id, q.ID, q.prefecture, tt.want, tt.prefecture)
+		}
+	}
+	var q IntensityQuery
+	if err := json.Unmarshal([]byte(`{"id":"Atlantis","scale":3}`), &q); err == nil {
+		t.Errorf("id Atlantis = %d; want an error", q.ID)
+	}
+}
+
+func TestCheckPrefectureNames(t *testing.T) {
+	for _, tt := range []struct {
+		scale       string
+		prefectures bool
+		ok          bool
+	}{
+		{`[{"id":"Hyogo","scale":3}]`, true, true},
+		{`[{"id":"Hyogo","scale":3}]`, false, false},
+		{`[{"id":"JP-28","scale":3}]`, false, false},
+		{`[{"id":28,"scale":3},{"id":"1001","scale":2}]`, false, true},
+	} {
+		s := &server{prefectures: tt.prefectures}
+		err := s.checkPrefectureNames(url.Values{"scale": {tt.scale}})
+		var apiErr *apiError
+		if tt.ok && err != nil || !tt.ok && (!errors.As(err, &apiErr) || apiErr.Code != ErrInvalidScale) {
+			t.Errorf("scale %s on prefectures=%v: %v", tt.scale, tt.prefectures, err)
+		}
+	}
+}
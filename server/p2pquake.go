@@ -0,0 +1,477 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"canvas/geo"
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// Client of the P2P地震情報 API (https://www.p2pquake.net/develop/json_api_v2/).
+// The latest event is cached for ttl, so a burst of /map/latest requests
+// after an earthquake costs one upstream call.
+type p2pquakeFeed struct {
+	baseURL string
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	latest  *quakeEvent
+	fetched time.Time
+	// Archived events do not change, so they are kept until the cache is full
+	events map[string]*quakeEvent
+}
+
+// Most archived events kept in memory
+const maxCachedEvents = 256
+
+// Most reports read for the earthquakes of a period, in pages of 100
+const maxPeriodReports = 5000
+
+var (
+	// p2pquake record IDs are MongoDB object IDs
+	p2pquakeIDPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+	// JMA event IDs are the origin time in JST, as yyyymmddhhmmss
+	jmaEventIDPattern = regexp.MustCompile(`^[0-9]{14}$`)
+
+	errFeedNotFound = errors.New("not found")
+)
+
+func newP2PQuakeFeed(baseURL string, ttl time.Duration) (*p2pquakeFeed, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid p2pquake URL: %q", baseURL)
+	}
+	metrics.Help("canvas_feed_requests_total", "Requests to live data feeds, by feed and result.")
+	return &p2pquakeFeed{baseURL: strings.TrimSuffix(baseURL, "/"), ttl: ttl, events: make(map[string]*quakeEvent)}, nil
+}
+
+// JMAQuake record (code 551), reduced to the fields the maps use
+type jmaQuake struct {
+	ID         string `json:"id"`
+	Code       int    `json:"code"`
+	Earthquake struct {
+		Time       string `json:"time"`
+		Hypocenter struct {
+			Name      string  `json:"name"`
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+			Depth     float64 `json:"depth"`
+			Magnitude float64 `json:"magnitude"`
+		} `json:"hypocenter"`
+		DomesticTsunami string `json:"domesticTsunami"`
+	} `json:"earthquake"`
+	Points []struct {
+		Pref   string `json:"pref"`
+		Addr   string `json:"addr"`
+		IsArea bool   `json:"isArea"`
+		Scale  int    `json:"scale"`
+	} `json:"points"`
+}
+
+// Function to convert a p2pquake intensity code (10 = 1, 45 = 5-, 50 = 5+,
+// 55 = 6-, 60 = 6+, 70 = 7) to the 0-7 scale of the scale parameter
+func p2pquakeScale(code int) int {
+	switch {
+	case code >= 70:
+		return 7
+	case code >= 55:
+		return 6
+	case code >= 45:
+		return 5
+	case code >= 10:
+		return code / 10
+	}
+	return 0
+}
+
+// Function to turn a JMAQuake record into an event, keeping the highest
+// intensity observed in each prefecture
+func (q *jmaQuake) event() (*quakeEvent, error) {
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", q.Earthquake.Time, jst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid earthquake time %q: %w", q.Earthquake.Time, err)
+	}
+	hypo := q.Earthquake.Hypocenter
+	ev := &quakeEvent{
+		ID:          q.ID,
+		Time:        t,
+		Hypocenter:  hypo.Name,
+		Latitude:    hypo.Latitude,
+		Longitude:   hypo.Longitude,
+		Depth:       hypo.Depth,
+		Magnitude:   hypo.Magnitude,
+		Tsunami:     q.Earthquake.DomesticTsunami == "Warning" || q.Earthquake.DomesticTsunami == "Watch",
+		Intensities: make(map[int]int),
+	}
+	for _, point := range q.Points {
+		code, ok := geo.PrefectureCode(point.Pref)
+		if !ok {
+			continue
+		}
+		scale := p2pquakeScale(point.Scale)
+		if scale > ev.Intensities[code] {
+			ev.Intensities[code] = scale
+		}
+		// Early reports list regions rather than stations
+		if !point.IsArea {
+			ev.Stations = append(ev.Stations, stationIntensity{Name: point.Addr, Scale: scale})
+		}
+	}
+	ev.locate()
+	return ev, nil
+}
+
+// Function to return the most recent earthquake with observed intensities.
+// Reports without any (hypocenter-only or foreign earthquakes) are skipped.
+func (f *p2pquakeFeed) Latest(ctx context.Context) (*quakeEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.latest != nil && time.Since(f.fetched) < f.ttl {
+		return f.latest, nil
+	}
+
+	var quakes []jmaQuake
+	if err := f.get(ctx, "/history?codes=551&limit=20", &quakes); err != nil {
+		if f.latest != nil {
+			// Serve the last known event rather than fail while the feed is down
+			requestLogger(ctx).Warn("p2pquake unavailable, serving cached event", "err", err, "event", f.latest.ID)
+			return f.latest, nil
+		}
+		return nil, err
+	}
+	for i := range quakes {
+		ev, err := quakes[i].event()
+		if err != nil || len(ev.Intensities) == 0 {
+			continue
+		}
+		f.latest, f.fetched = ev, time.Now()
+		return ev, nil
+	}
+	return nil, &apiError{Status: http.StatusNotFound, Code: ErrEventNotFound, Message: "No recent earthquake with observed intensities"}
+}
+
+// Function to return an archived earthquake, by p2pquake record ID or JMA
+// event ID
+func (f *p2pquakeFeed) Event(ctx context.Context, id string) (*quakeEvent, error) {
+	if !p2pquakeIDPattern.MatchString(id) && !jmaEventIDPattern.MatchString(id) {
+		return nil, invalidParam(ErrInvalidEvent, "Invalid event ID: %q (expected a p2pquake ID or a 14-digit JMA event ID)", id)
+	}
+	f.mu.Lock()
+	ev, ok := f.events[id]
+	f.mu.Unlock()
+	if ok {
+		return ev, nil
+	}
+
+	var err error
+	if jmaEventIDPattern.MatchString(id) {
+		ev, err = f.eventByJMAID(ctx, id)
+	} else {
+		var quake jmaQuake
+		if err = f.get(ctx, "/jma/quake/"+id, &quake); err == nil {
+			ev, err = quake.event()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ev.Intensities) == 0 {
+		return nil, &apiError{Status: http.StatusNotFound, Code: ErrEventNotFound, Message: fmt.Sprintf("Event %s has no observed intensities", id)}
+	}
+
+	f.mu.Lock()
+	if len(f.events) >= maxCachedEvents {
+		for key := range f.events {
+			delete(f.events, key)
+			break
+		}
+	}
+	f.events[id] = ev
+	f.mu.Unlock()
+	return ev, nil
+}
+
+// Function to find the report of a JMA event. The API cannot search by
+// event ID, so the reports of that day are matched on the origin time, which
+// intensity reports give to the minute. Of several reports for the event, the
+// one covering the most prefectures wins.
+func (f *p2pquakeFeed) eventByJMAID(ctx context.Context, id string) (*quakeEvent, error) {
+	origin, err := time.ParseInLocation("20060102150405", id, jst)
+	if err != nil {
+		return nil, invalidParam(ErrInvalidEvent, "Invalid event ID: %q (%v)", id, err)
+	}
+	day := origin.Format("20060102")
+	var quakes []jmaQuake
+	if err := f.get(ctx, "/jma/quake?since_date="+day+"&until_date="+day+"&limit=100", &quakes); err != nil {
+		return nil, err
+	}
+
+	var best *quakeEvent
+	for i := range quakes {
+		ev, err := quakes[i].event()
+		if err != nil || !ev.Time.Equal(origin.Truncate(time.Minute)) {
+			continue
+		}
+		if best == nil || len(ev.Intensities) > len(best.Intensities) {
+			best = ev
+		}
+	}
+	if best == nil {
+		return nil, &apiError{Status: http.StatusNotFound, Code: ErrEventNotFound, Message: fmt.Sprintf("No earthquake reported for event %s", id)}
+	}
+	return best, nil
+}
+
+// Function to return the earthquakes that originated from from until to
+// and reached at least minScale, oldest first. A report is sent for each
+// stage of an earthquake, so reports of the same origin time are merged,
+// keeping the highest intensity of each prefecture.
+func (f *p2pquakeFeed) Between(ctx context.Context, from, to time.Time, minScale int) ([]*quakeEvent, error) {
+	// The API filters on its own intensity codes
+	minCode := map[int]int{5: 45, 6: 55, 7: 70}[minScale]
+	if minCode == 0 {
+		minCode = 10 * max(minScale, 1)
+	}
+	params := url.Values{
+		"since_date": {from.In(jst).Format("20060102")},
+		"until_date": {to.Add(-time.Nanosecond).In(jst).Format("20060102")},
+		"min_scale":  {strconv.Itoa(minCode)},
+		"order":      {"1"},
+		"limit":      {"100"},
+	}
+	byOrigin := make(map[time.Time]*quakeEvent)
+	var events []*quakeEvent
+	for offset := 0; offset < maxPeriodReports; offset += 100 {
+		params.Set("offset", strconv.Itoa(offset))
+		var quakes []jmaQuake
+		if err := f.get(ctx, "/jma/quake?"+params.Encode(), &quakes); err != nil {
+			return nil, err
+		}
+		for i := range quakes {
+			ev, err := quakes[i].event()
+			if err != nil || len(ev.Intensities) == 0 || ev.Time.Before(from) || !ev.Time.Before(to) {
+				continue
+			}
+			merged, ok := byOrigin[ev.Time]
+			if !ok {
+				byOrigin[ev.Time] = ev
+				events = append(events, ev)
+				continue
+			}
+			for id, scale := range ev.Intensities {
+				merged.Intensities[id] = max(merged.Intensities[id], scale)
+			}
+			// Later reports refine the hypocenter
+			if ev.Hypocenter != "" && merged.Hypocenter == "" {
+				merged.Hypocenter, merged.Latitude, merged.Longitude = ev.Hypocenter, ev.Latitude, ev.Longitude
+			}
+			merged.Magnitude = max(merged.Magnitude, ev.Magnitude)
+			merged.Tsunami = merged.Tsunami || ev.Tsunami
+		}
+		if len(quakes) < 100 {
+			break
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// Function to fetch and decode one API response, reporting the feed state
+// to the status dashboard
+func (f *p2pquakeFeed) get(ctx context.Context, path string, v any) error {
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.baseURL+path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := outboundClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return errFeedNotFound
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("p2pquake returned %s", resp.Status)
+		}
+		return json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(v)
+	}()
+
+	if errors.Is(err, errFeedNotFound) {
+		// The feed answered, it just has no such record
+		metrics.Add("canvas_feed_requests_total", labels("feed", "p2pquake", "result", "not_found"), 1)
+		dashboard.SetFeed("p2pquake", "connected", "")
+		return &apiError{Status: http.StatusNotFound, Code: ErrEventNotFound, Message: "No such event in the earthquake feed"}
+	}
+	if err != nil {
+		metrics.Add("canvas_feed_requests_total", labels("feed", "p2pquake", "result", "error"), 1)
+		dashboard.SetFeed("p2pquake", "error", err.Error())
+		return &apiError{Status: http.StatusBadGateway, Code: ErrUpstreamUnavailable, Message: "Earthquake feed unavailable: " + err.Error()}
+	}
+	metrics.Add("canvas_feed_requests_total", labels("feed", "p2pquake", "result", "ok"), 1)
+	dashboard.SetFeed("p2pquake", "connected", "")
+	return nil
+}
+
+// Function to describe an event in the footer, in the language of lang=.
+// The bundled font has no Japanese glyphs, so the hypocenter name is left
+// out.
+func eventFooter(ev *quakeEvent, lang string) string {
+	footer := ev.Time.In(jst).Format("2006-01-02 15:04 JST")
+	if ev.Magnitude > 0 {
+		footer += fmt.Sprintf("  M%.1f", ev.Magnitude)
+	}
+	if ev.Depth > 0 {
+		footer += "  " + i18n.T(lang, "footer.depth", ev.Depth)
+	}
+	return footer + "  " + i18n.T(lang, "footer.source")
+}
+
+// Function to title the banner of a social card preset of an event, such as
+// "Intensity report 2024-01-01 16:10" over "石川県能登地方  M7.6  Max.
+// intensity 7", or "震度速報 2024-01-01 16:10" over "石川県能登地方  M7.6
+// 最大震度7" with lang=ja
+func eventBanner(ev *quakeEvent, lang string) (title, subtitle string) {
+	title = i18n.T(lang, "banner.event", ev.Time.In(jst).Format("2006-01-02 15:04"))
+	var parts []string
+	if ev.Hypocenter != "" {
+		parts = append(parts, ev.Hypocenter)
+	}
+	if ev.Magnitude > 0 {
+		parts = append(parts, fmt.Sprintf("M%.1f", ev.Magnitude))
+	}
+	if maxScale := ev.MaxIntensity(nil); maxScale > 0 {
+		parts = append(parts, i18n.T(lang, "intensity.max", maxScale))
+	}
+	return title, strings.Join(parts, "  ")
+}
+
+// Function to fill the scale parameter, or the points parameter with
+// mode=points, the footer and asof date unless they were given, and the
+// banner of a preset without a title, from an event
+func eventQuery(query url.Values, ev *quakeEvent) (url.Values, error) {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Del("mode")
+	// The feed reports JMA intensities
+	if scaleType := query.Get("scale_type"); scaleType != "" && scaleType != render.ScaleJMA {
+		return nil, invalidParam(ErrInvalidQuery, "scale_type=%s cannot be given with event", scaleType)
+	}
+
+	switch mode := query.Get("mode"); mode {
+	case "", "prefectures":
+		intensities := make([]IntensityQuery, 0, len(ev.Intensities))
+		for _, p := range geo.Prefectures {
+			if scale, ok := ev.Intensities[p.Code]; ok {
+				intensities = append(intensities, IntensityQuery{ID: p.Code, Scale: scale})
+			}
+		}
+		scale, err := json.Marshal(intensities)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("scale", string(scale))
+	case "points":
+		// Stations missing from the station list are left out
+		points := make([]PointQuery, 0, len(ev.Stations))
+		for _, observed := range ev.Stations {
+			if station, ok := stations.Lookup(observed.Name); ok {
+				points = append(points, PointQuery{Lat: &station.Lat, Lon: &station.Lon, Scale: observed.Scale})
+			}
+		}
+		if len(points) == 0 {
+			return nil, &apiError{Status: http.StatusUnprocessableEntity, Code: ErrNoStations,
+				Message: fmt.Sprintf("None of the %d stations of event %s are in the station list", len(ev.Stations), ev.ID)}
+		}
+		data, err := json.Marshal(points)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("points", string(data))
+	default:
+		return nil, invalidParam(ErrInvalidQuery, "Invalid mode: %s (must be prefectures or points)", mode)
+	}
+
+	if q.Get("footer") == "" {
+		q.Set("footer", eventFooter(ev, query.Get("lang")))
+	}
+	if q.Get("preset") != "" && q.Get("title") == "" {
+		title, subtitle := eventBanner(ev, query.Get("lang"))
+		q.Set("title", title)
+		if q.Get("subtitle") == "" {
+			q.Set("subtitle", subtitle)
+		}
+	}
+	// Drawn on the boundaries of the day of the event
+	if q.Get("asof") == "" && !ev.Time.IsZero() {
+		q.Set("asof", ev.Time.In(jst).Format(time.DateOnly))
+	}
+	return q, nil
+}
+
+// GET /map/latest renders the most recent earthquake. Every /map parameter
+// except scale is accepted.
+func (s *server) latestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("scale") || r.URL.Query().Has("points") || r.URL.Query().Has("event") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "scale, points and event cannot be given for /map/latest")
+		return
+	}
+	ev, err := s.feed.Latest(r.Context())
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	// A newer event may arrive at any time, so caches keep the map no longer
+	// than the feed does
+	s.serveEvent(w, r, ev, int(s.feed.ttl.Seconds()), nil)
+}
+
+// Function to render /map?event=<id>, an archived earthquake, in place of
+// the scale parameter
+func (s *server) eventMapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("scale") || r.URL.Query().Has("points") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "scale or points cannot be given with event")
+		return
+	}
+	ev, err := s.feed.Event(r.Context(), r.URL.Query().Get("event"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	s.serveEvent(w, r, ev, s.maxAge, nil)
+}
+
+// Function to render the map of an event, named in the X-Event-ID header
+// with its time in X-Event-Time, with its options changed by adjust as in
+// serveAdjustedMap
+func (s *server) serveEvent(w http.ResponseWriter, r *http.Request, ev *quakeEvent, maxAge int, adjust func(*render.Options)) {
+	query, err := eventQuery(r.URL.Query(), ev)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	query.Del("event")
+	annotateRequest(r.Context(), "event", ev.ID)
+	w.Header().Set("X-Event-ID", ev.ID)
+	w.Header().Set("X-Event-Time", ev.Time.Format(time.RFC3339))
+	s.serveAdjustedMap(w, r, query, maxAge, adjust)
+}
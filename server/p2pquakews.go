@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// The API pushes peer and area messages every minute or so; a
+	// connection silent for longer is dead
+	streamIdleTimeout = 5 * time.Minute
+	// Wait before reconnecting, doubled after each failure up to the maximum
+	streamBackoff    = time.Second
+	streamMaxBackoff = 5 * time.Minute
+)
+
+// Function to submit the earthquakes pushed by the p2pquake WebSocket API as
+// they arrive, reconnecting when the connection drops, the push-based
+// counterpart of Poll. Events seen by both are only processed once.
+func (p *eventPipeline) Stream(ctx context.Context, wsURL string) {
+	delay := streamBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := p.stream(ctx, wsURL)
+		if ctx.Err() != nil {
+			return
+		}
+		// A connection that held for a while starts the backoff over
+		if time.Since(start) > streamMaxBackoff {
+			delay = streamBackoff
+		}
+		slog.Warn("p2pquake stream disconnected, reconnecting", "err", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, streamMaxBackoff)
+	}
+}
+
+// Function to read one connection until it fails
+func (p *eventPipeline) stream(ctx context.Context, wsURL string) error {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return err
+	}
+	origin := *u
+	origin.Scheme, origin.Path, origin.RawQuery = "https", "/", ""
+	if u.Scheme == "ws" {
+		origin.Scheme = "http"
+	}
+	config, err := websocket.NewConfig(wsURL, origin.String())
+	if err != nil {
+		return err
+	}
+	config.Dialer = &net.Dialer{Timeout: 10 * time.Second}
+	// The CAs of -ca-bundle apply; -proxy does not
+	if t, ok := outboundClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		config.TlsConfig = t.TLSClientConfig.Clone()
+	}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	slog.Info("connected to p2pquake stream", "url", wsURL)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return err
+		}
+		ev, err := parseStreamMessage(msg)
+		if err != nil {
+			slog.Warn("invalid p2pquake message", "err", err)
+			continue
+		}
+		if ev == nil {
+			continue
+		}
+		if _, _, err := p.Submit("p2pquake-ws", ev); err != nil {
+			slog.Error("failed to submit event", "event", ev.ID, "err", err)
+		}
+	}
+}
+
+// Function to read an earthquake from a message of the stream. Other kinds
+// of messages, such as peer counts or tsunami forecasts, give nil.
+func parseStreamMessage(msg []byte) (*quakeEvent, error) {
+	var probe struct {
+		Code int    `json:"code"`
+		ID   string `json:"_id"`
+	}
+	if err := json.Unmarshal(msg, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Code != 551 {
+		return nil, nil
+	}
+	var q jmaQuake
+	if err := json.Unmarshal(msg, &q); err != nil {
+		return nil, err
+	}
+	// Streamed records carry their ID as _id
+	if q.ID == "" {
+		q.ID = probe.ID
+	}
+	ev, err := q.event()
+	if err != nil {
+		return nil, fmt.Errorf("record %s: %w", q.ID, err)
+	}
+	return ev, nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A destination for rendered events, such as a chat or social network
+type publisher interface {
+	Publish(ctx context.Context, ev *quakeEvent, image []byte, caption string) error
+}
+
+// How long a replica may take to render and publish an event before another
+// one can take it over
+const pipelineLease = 5 * time.Minute
+
+// Pipeline taking events from the feeds through the publishing rules. Each
+// event is processed once across replicas: it is rendered when a rule
+// matches, and handed with its caption to the publishers of those rules.
+type eventPipeline struct {
+	server   *server
+	rules    *publishRules // Nil renders every event, for every publisher
+	captions *captionTemplates
+	// Publishers by the name publishing rules refer to them with
+	publishers map[string]publisher
+	locale     string
+}
+
+func newEventPipeline(s *server, rules *publishRules, captions *captionTemplates, publishers map[string]publisher, locale string) *eventPipeline {
+	metrics.Help("canvas_pipeline_events_total", "Events submitted to the publishing pipeline, by source and result.")
+	return &eventPipeline{server: s, rules: rules, captions: captions, publishers: publishers, locale: locale}
+}
+
+// Function to decide what happens to an event and start it in the
+// background. Events already submitted, by any feed or replica, are
+// reported as duplicates and dropped.
+func (p *eventPipeline) Submit(source string, ev *quakeEvent) (publishDecision, bool, error) {
+	decision := publishDecision{Render: true, Rules: []string{}, Publishers: []string{}}
+	if p.rules == nil {
+		for name := range p.publishers {
+			decision.Publishers = append(decision.Publishers, name)
+		}
+		sort.Strings(decision.Publishers)
+	} else {
+		decision = p.rules.Evaluate(ev)
+	}
+	// Hypocenter-only reports have nothing to draw
+	if len(ev.Intensities) == 0 {
+		decision.Render = false
+	}
+
+	job := "event:" + ev.ID
+	claimed, err := jobLocks.Claim(job, pipelineLease)
+	if err != nil {
+		return decision, false, err
+	}
+	if !claimed {
+		metrics.Add("canvas_pipeline_events_total", labels("source", source, "result", "duplicate"), 1)
+		return decision, true, nil
+	}
+	if !decision.Render {
+		metrics.Add("canvas_pipeline_events_total", labels("source", source, "result", "skipped"), 1)
+		return decision, false, jobLocks.Done(job)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pipelineLease)
+		defer cancel()
+		failed, err := p.process(ctx, ev, decision, source)
+		if err != nil {
+			// The lease is left to expire, so a redelivery can retry
+			metrics.Add("canvas_pipeline_events_total", labels("source", source, "result", "error"), 1)
+			slog.Error("failed to process event", "event", ev.ID, "source", source, "err", err)
+			return
+		}
+		// Some publishers have the event, so a retry would post it twice
+		// to them
+		result := "published"
+		if len(failed) > 0 {
+			result = "partial"
+		}
+		metrics.Add("canvas_pipeline_events_total", labels("source", source, "result", result), 1)
+		if err := jobLocks.Done(job); err != nil {
+			slog.Error("failed to mark event done", "event", ev.ID, "err", err)
+		}
+	}()
+	return decision, false, nil
+}
+
+// Function to render an event and hand it to its publishers, returning those
+// that failed. A publisher failing does not stop the others, but the event
+// fails when none of them has it.
+func (p *eventPipeline) process(ctx context.Context, ev *quakeEvent, decision publishDecision, source string) ([]string, error) {
+	query, err := eventQuery(url.Values{}, ev)
+	if err != nil {
+		return nil, err
+	}
+	image, backend, err := p.server.renderQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("render failed: %w", err)
+	}
+	id := p.server.images.Put(image)
+
+	var published, failed []string
+	for _, name := range decision.Publishers {
+		pub, ok := p.publishers[name]
+		if !ok {
+			slog.Warn("no such publisher, skipping", "event", ev.ID, "publisher", name)
+			failed = append(failed, name)
+			continue
+		}
+		caption, err := p.captions.Caption(name, p.locale, ev)
+		if err == nil {
+			err = pub.Publish(ctx, ev, image, caption)
+		}
+		if err != nil {
+			slog.Error("failed to publish event", "event", ev.ID, "publisher", name, "err", err)
+			failed = append(failed, name)
+			continue
+		}
+		published = append(published, name)
+	}
+
+	slog.Info("processed event", "event", ev.ID, "source", source, "image_id", id, "backend", backend,
+		"rules", decision.Rules, "published", published, "failed", failed)
+	p.server.audit.Record("pipeline", "event.publish", ev.ID, map[string]string{
+		"source":    source,
+		"image_id":  id,
+		"rules":     strings.Join(decision.Rules, ","),
+		"published": strings.Join(published, ","),
+		"failed":    strings.Join(failed, ","),
+	})
+	if len(decision.Publishers) > 0 && len(published) == 0 {
+		return failed, fmt.Errorf("every publisher failed: %s", strings.Join(failed, ", "))
+	}
+	return failed, nil
+}
+
+// Function to submit the latest event of the p2pquake feed every interval,
+// the pull-based counterpart of /ingest
+func (p *eventPipeline) Poll(ctx context.Context, feed *p2pquakeFeed, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if ev, err := feed.Latest(ctx); err != nil {
+			slog.Warn("failed to poll p2pquake", "err", err)
+		} else if _, _, err := p.Submit("p2pquake", ev); err != nil {
+			slog.Error("failed to submit event", "event", ev.ID, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// The hypocenter and origin time of a propagation animation
+type hypocenter struct {
+	Lat, Lon, Depth float64
+	Time            time.Time
+}
+
+// Function to parse the hypocenter given by lat and lon, or by the name of
+// its region in epicenter, and depth and time
+func parseHypocenter(query url.Values) (*hypocenter, error) {
+	parse := func(name string, least, most float64) (float64, error) {
+		v := query.Get(name)
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < least || n > most {
+			return 0, invalidParam(ErrInvalidQuery, "Invalid %s: %q (must be between %g and %g)", name, v, least, most)
+		}
+		return n, nil
+	}
+	var h hypocenter
+	var err error
+	if name := query.Get("epicenter"); name != "" {
+		if query.Has("lat") || query.Has("lon") {
+			return nil, invalidParam(ErrInvalidQuery, "lat and lon cannot be given with epicenter")
+		}
+		var ok bool
+		if h.Lat, h.Lon, ok = epicenters.Geocode(name); !ok {
+			return nil, invalidParam(ErrInvalidQuery, "Unknown epicenter: %q (must be a JMA hypocenter region name, e.g. 石川県能登地方)", name)
+		}
+	} else {
+		if h.Lat, err = parse("lat", -90, 90); err != nil {
+			return nil, err
+		}
+		if h.Lon, err = parse("lon", -180, 180); err != nil {
+			return nil, err
+		}
+	}
+	if query.Get("depth") != "" {
+		if h.Depth, err = parse("depth", 0, 700); err != nil {
+			return nil, err
+		}
+	}
+	if v := query.Get("time"); v != "" {
+		if h.Time, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid time: %q (must be RFC 3339)", v)
+		}
+	}
+	return &h, nil
+}
+
+// Function to build the frames of the P and S waves spreading from a
+// hypocenter, every step until duration after the origin
+func propagationFrames(h *hypocenter, duration, step, delay time.Duration) ([]render.Frame, error) {
+	count := int(duration/step) + 1
+	if count > render.MAX_FRAMES {
+		return nil, invalidParam(ErrInvalidQuery, "Too many frames: %d (duration / step must be at most %d)", count, render.MAX_FRAMES-1)
+	}
+	frames := make([]render.Frame, count)
+	for i := range frames {
+		elapsed := time.Duration(i) * step
+		label := fmt.Sprintf("+%d s", int(elapsed.Seconds()))
+		if !h.Time.IsZero() {
+			label = h.Time.Add(elapsed).In(jst).Format("2006-01-02 15:04:05 JST") + " (" + label + ")"
+		}
+		frames[i] = render.Frame{
+			Label: label,
+			Waves: &render.Waves{Lat: h.Lat, Lon: h.Lon, Depth: h.Depth, Elapsed: elapsed},
+			Delay: delay,
+		}
+	}
+	return frames, nil
+}
+
+// Function to parse the timing of a propagation: its duration, the time
+// between frames, how long each is shown and how long the last one is, all
+// in milliseconds
+func parsePropagation(query url.Values, h *hypocenter) ([]render.Frame, time.Duration, error) {
+	duration, err := parseMillis(query, "duration", time.Minute, time.Second, 5*time.Minute)
+	if err != nil {
+		return nil, 0, err
+	}
+	step, err := parseMillis(query, "step", 2*time.Second, 100*time.Millisecond, time.Minute)
+	if err != nil {
+		return nil, 0, err
+	}
+	delay, err := parseMillis(query, "delay", 100*time.Millisecond, 20*time.Millisecond, 10*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	hold, err := parseMillis(query, "hold", 2*time.Second, 20*time.Millisecond, 30*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	frames, err := propagationFrames(h, duration, step, delay)
+	if err != nil {
+		return nil, 0, err
+	}
+	frames[len(frames)-1].Delay = hold
+	return frames, duration, nil
+}
+
+// Function to frame the ground the S wave covers by the end of the
+// animation, at least 150 km around the epicenter
+func propagationBBox(h *hypocenter, duration time.Duration) *geo.BBox {
+	last := render.Waves{Lat: h.Lat, Lon: h.Lon, Depth: h.Depth, Elapsed: duration}
+	radius := max(150, last.Radius(render.SWaveSpeed))
+	dLat := radius / 111.2
+	dLon := dLat / math.Cos(h.Lat*math.Pi/180)
+	return &geo.BBox{MinLon: h.Lon - dLon, MinLat: h.Lat - dLat, MaxLon: h.Lon + dLon, MaxLat: h.Lat + dLat}
+}
+
+// GET /propagation?lat=37.5&lon=137.3&depth=10&time=..., or event=<id> for
+// the hypocenter of an archived earthquake. Every /map parameter is accepted,
+// and the map defaults to the area the S wave reaches.
+func (s *server) propagationHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := render.FormatAPNG
+	if v := query.Get("format"); v != "" {
+		var err error
+		if format, err = render.ParseAnimationFormat(v); err != nil {
+			writeAPIError(w, invalidParam(ErrInvalidQuery, "Invalid format: %v", err))
+			return
+		}
+	}
+
+	var h *hypocenter
+	if id := query.Get("event"); id != "" {
+		if query.Has("lat") || query.Has("lon") || query.Has("epicenter") {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "lat, lon and epicenter cannot be given with event")
+			return
+		}
+		ev, err := s.feed.Event(r.Context(), id)
+		if err != nil {
+			annotateRequest(r.Context(), "error", err.Error())
+			writeAPIError(w, err)
+			return
+		}
+		annotateRequest(r.Context(), "event", ev.ID)
+		w.Header().Set("X-Event-ID", ev.ID)
+		// The feed reports an unknown hypocenter as -200,-200
+		if ev.Latitude < -90 || ev.Latitude > 90 || ev.Longitude < -180 || ev.Longitude > 180 {
+			writeError(w, http.StatusUnprocessableEntity, ErrNoHypocenter, fmt.Sprintf("Event %s has no known hypocenter", ev.ID))
+			return
+		}
+		h = &hypocenter{Lat: ev.Latitude, Lon: ev.Longitude, Depth: max(0, ev.Depth), Time: ev.Time}
+	} else {
+		var err error
+		if h, err = parseHypocenter(query); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+
+	frames, duration, err := parsePropagation(query, h)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	s.servePropagation(w, r, h, duration, frames, format)
+}
+
+// Function to apply the /map parameters to a propagation and send it
+func (s *server) servePropagation(w http.ResponseWriter, r *http.Request, h *hypocenter, duration time.Duration, frames []render.Frame, format string) {
+	q := url.Values{}
+	for k, v := range r.URL.Query() {
+		q[k] = v
+	}
+	for _, k := range []string{"event", "epicenter", "lat", "lon", "depth", "time", "duration", "step", "delay", "hold", "format"} {
+		q.Del(k)
+	}
+	if !q.Has("scale") && !q.Has("points") {
+		q.Set("scale", "[]")
+	}
+	opts, err := ParseRenderOptions(q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if opts.BBox == nil && len(opts.ScaleMap) == 0 && len(opts.Points) == 0 {
+		opts.BBox = propagationBBox(h, duration)
+	}
+	for i := range frames {
+		frames[i].ScaleMap, frames[i].Points = opts.ScaleMap, opts.Points
+	}
+	// serveAnimation counts the frames towards the usage of the API key
+	s.serveAnimation(w, r, opts, frames, format)
+}
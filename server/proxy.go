@@ -0,0 +1,227 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response headers kept in the cache and passed on to clients
+var cachedHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Type", "ETag", "Last-Modified", "X-Event-ID", "X-Event-Time", "X-Image-ID", "X-Render-Backend", "X-Unknown-IDs"}
+
+// Request headers carrying the caller's credentials, passed on to the upstream
+var credentialHeaders = []string{"Authorization", "X-API-Key"}
+
+// Front for another rendering instance: cache hits are served locally, misses
+// are fetched from the upstream, and stale entries are revalidated with
+// If-None-Match when the upstream sent an ETag
+type cachingProxy struct {
+	upstream   *url.URL
+	client     *http.Client
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cachedResponse struct {
+	key     string
+	header  http.Header
+	body    []byte
+	fetched time.Time
+}
+
+func newCachingProxy(upstream string, ttl time.Duration, maxEntries int) (*cachingProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream URL: %s", upstream)
+	}
+	if maxEntries < 1 {
+		return nil, fmt.Errorf("cache must hold at least one entry: %d", maxEntries)
+	}
+
+	metrics.Help("canvas_proxy_requests_total", "Requests served in proxy mode, by cache result.")
+	metrics.Help("canvas_proxy_cache_entries", "Responses held in the proxy cache.")
+	p := &cachingProxy{
+		upstream: u,
+		// Renders take longer than the outbound timeout allows, but the
+		// proxy and CA settings still apply
+		client:     &http.Client{Transport: outboundClient.Transport, Timeout: 2 * time.Minute},
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	metrics.OnCollect(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		metrics.Set("canvas_proxy_cache_entries", "", float64(p.lru.Len()))
+	})
+	return p, nil
+}
+
+func (p *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Encode sorts the parameters, so reordered queries share an entry.
+	// Callers with different credentials never do, as the upstream may
+	// answer them differently.
+	key := credentialDigest(r) + r.URL.Path + "?" + r.URL.Query().Encode()
+	entry := p.lookup(key)
+	if entry != nil && time.Since(entry.fetched) < p.ttl {
+		p.serve(w, r, entry, "hit")
+		return
+	}
+	if cacheOnly(r.Context()) {
+		// In maintenance, stale entries are served without revalidation
+		if entry == nil {
+			maintenance.Reject(w, r, 0, 0)
+			return
+		}
+		p.serve(w, r, entry, "stale")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, p.upstream.JoinPath(r.URL.Path).String(), nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("Failed to build upstream request: %v", err))
+		return
+	}
+	req.URL.RawQuery = r.URL.RawQuery
+	if id := requestID(r.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	for _, name := range credentialHeaders {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	if entry != nil && entry.header.Get("ETag") != "" {
+		req.Header.Set("If-None-Match", entry.header.Get("ETag"))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if entry != nil {
+			requestLogger(r.Context()).Warn("upstream unavailable, serving stale response", "err", err)
+			p.serve(w, r, entry, "stale")
+			return
+		}
+		metrics.Add("canvas_proxy_requests_total", labels("result", "error"), 1)
+		writeError(w, http.StatusBadGateway, ErrUpstreamUnavailable, fmt.Sprintf("Upstream unavailable: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		entry = p.store(key, entry.header, entry.body)
+		p.serve(w, r, entry, "revalidated")
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		metrics.Add("canvas_proxy_requests_total", labels("result", "error"), 1)
+		writeError(w, http.StatusBadGateway, ErrUpstreamUnavailable, fmt.Sprintf("Failed to read upstream response: %v", err))
+		return
+	}
+
+	header := make(http.Header)
+	for _, name := range cachedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+
+	// Only successful renders are cached; errors, and answers that must not
+	// be cached such as signed URLs, are passed through as-is
+	if resp.StatusCode != http.StatusOK || strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		metrics.Add("canvas_proxy_requests_total", labels("result", "pass"), 1)
+		copyHeader(w.Header(), header)
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+	p.serve(w, r, p.store(key, header, body), "miss")
+}
+
+// Function to hash the credentials of a request into a cache key prefix, empty
+// for requests without any
+func credentialDigest(r *http.Request) string {
+	h := sha256.New()
+	found := false
+	for _, name := range credentialHeaders {
+		if v := r.Header.Get(name); v != "" {
+			fmt.Fprintf(h, "%s: %s\n", name, v)
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil)) + " "
+}
+
+func (p *cachingProxy) serve(w http.ResponseWriter, r *http.Request, entry *cachedResponse, result string) {
+	metrics.Add("canvas_proxy_requests_total", labels("result", result), 1)
+	copyHeader(w.Header(), entry.header)
+	w.Header().Set("X-Cache", strings.ToUpper(result))
+
+	if etag := entry.header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(entry.body)
+}
+
+func (p *cachingProxy) lookup(key string) *cachedResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.entries[key]
+	if !ok {
+		return nil
+	}
+	p.lru.MoveToFront(elem)
+	return elem.Value.(*cachedResponse)
+}
+
+// Function to insert or refresh an entry, evicting the least recently used
+func (p *cachingProxy) store(key string, header http.Header, body []byte) *cachedResponse {
+	entry := &cachedResponse{key: key, header: header, body: body, fetched: time.Now()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.entries[key]; ok {
+		elem.Value = entry
+		p.lru.MoveToFront(elem)
+		return entry
+	}
+	p.entries[key] = p.lru.PushFront(entry)
+	for p.lru.Len() > p.maxEntries {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.entries, oldest.Value.(*cachedResponse).key)
+	}
+	return entry
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Header.Get("Authorization") + "|" + r.Header.Get("X-API-Key")))
+	}))
+	defer upstream.Close()
+	proxy, err := newCachingProxy(upstream.URL, time.Minute, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   string
+		cache  string
+	}{
+		{"anonymous", "", "", "|", "MISS"},
+		{"bearer", "Authorization", "Bearer key-a", "Bearer key-a|", "MISS"},
+		{"other bearer", "Authorization", "Bearer key-b", "Bearer key-b|", "MISS"},
+		{"bearer again", "Authorization", "Bearer key-a", "Bearer key-a|", "HIT"},
+		{"header", "X-API-Key", "key-a", "|key-a", "MISS"},
+		{"anonymous again", "", "", "|", "HIT"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/map?scale=13:4", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("%s: upstream saw %q; want %q", tt.name, got, tt.want)
+		}
+		if got := w.Header().Get("X-Cache"); got != tt.cache {
+			t.Errorf("%s: X-Cache %s; want %s", tt.name, got, tt.cache)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"canvas/render"
+)
+
+// Token bucket refilled at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Function to take cost tokens, or report how long until they are available
+func (b *tokenBucket) take(cost float64, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return true, 0
+	}
+	return false, time.Duration((cost - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Per-client and global request limits. The cost of a request grows with its
+// output area, so one size=3 map counts as much as sixteen default ones.
+type rateLimiter struct {
+	rate, burst float64
+	global      *tokenBucket
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate, burst, globalRate, globalBurst float64) (*rateLimiter, error) {
+	if rate < 0 || globalRate < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if (rate > 0 && burst < 1) || (globalRate > 0 && globalBurst < 1) {
+		return nil, fmt.Errorf("rate limit bursts must be at least 1")
+	}
+
+	now := time.Now()
+	l := &rateLimiter{rate: rate, burst: burst, clients: make(map[netip.Addr]*tokenBucket), lastSweep: now}
+	if globalRate > 0 {
+		l.global = newTokenBucket(globalRate, globalBurst, now)
+	}
+	metrics.Help("canvas_rate_limited_total", "Requests rejected by the rate limiter, by scope.")
+	return l, nil
+}
+
+// Function to admit a request of the given cost, returning the scope that
+// rejected it and when to retry
+func (l *rateLimiter) Allow(client netip.Addr, cost float64) (string, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets that have refilled completely carry no state worth keeping
+	if now.Sub(l.lastSweep) > time.Minute {
+		for addr, b := range l.clients {
+			if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+				delete(l.clients, addr)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	var bucket *tokenBucket
+	if l.rate > 0 {
+		bucket = l.clients[client]
+		if bucket == nil {
+			bucket = newTokenBucket(l.rate, l.burst, now)
+			l.clients[client] = bucket
+		}
+		// A request larger than the burst could never pass, so it costs a full burst
+		if ok, wait := bucket.take(math.Min(cost, l.burst), now); !ok {
+			return "client", wait
+		}
+	}
+	if l.global != nil {
+		if ok, wait := l.global.take(math.Min(cost, l.global.burst), now); !ok {
+			if bucket != nil {
+				bucket.tokens += math.Min(cost, l.burst)
+			}
+			return "global", wait
+		}
+	}
+	return "", 0
+}
+
+// Middleware answering 429 with Retry-After once a limit is exceeded
+func (l *rateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, _ := netip.ParseAddr(host)
+
+		scope, wait := l.Allow(addr.Unmap(), requestCost(r))
+		if scope != "" {
+			metrics.Add("canvas_rate_limited_total", labels("scope", scope), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, ErrRateLimited, fmt.Sprintf("Rate limit exceeded (%s), retry in %s", scope, wait.Round(time.Second)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Function to weigh a request by the output area of its maps relative to
+// the base size: each map of a batch, and a diff with the sides it renders
+// from a_spec and b_spec
+func requestCost(r *http.Request) float64 {
+	cost := 0.0
+	for _, query := range renderQueries(r) {
+		cost += queryCost(query)
+	}
+	return cost
+}
+
+// Function to weigh one map by its output area relative to the base size
+func queryCost(query url.Values) float64 {
+	opts, err := ParseRenderOptions(query)
+	if err != nil {
+		return 1
+	}
+	return math.Max(1, float64(opts.Width*opts.Height)/(render.BASE_WIDTH*render.BASE_HEIGHT))
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestCostDiff(t *testing.T) {
+	tests := []struct {
+		query string
+		cost  float64
+	}{
+		{"a=1&b=2", 1},
+		{"a_spec=" + url.QueryEscape(`scale=[{"id":13,"scale":5}]`) + "&b=2", 2},
+		{"a_spec=" + url.QueryEscape(`scale=[{"id":13,"scale":5}]&width=2560`) +
+			"&b_spec=" + url.QueryEscape(`scale=[{"id":13,"scale":4}]`), 1 + 4 + 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/diff?"+tt.query, nil)
+		if cost := requestCost(r); cost != tt.cost {
+			t.Errorf("requestCost(/diff?%s) = %g; want %g", tt.query, cost, tt.cost)
+		}
+	}
+}
+
+func TestRequestCostBatch(t *testing.T) {
+	tests := []struct {
+		target string
+		body   string
+		cost   float64
+	}{
+		{"/map/batch", `[{"scale":[{"id":13,"scale":5}]}]`, 1},
+		{"/map/batch", `[{"scale":[{"id":13,"scale":5}]},{"scale":[{"id":14,"scale":3}]},{"event":"x"}]`, 3},
+		// Parameters of the query apply to every map, unless a map drops them
+		{"/map/batch?width=2560", `[{"scale":[{"id":13,"scale":5}]},{"scale":[{"id":14,"scale":3}],"width":null}]`, 4 + 1},
+		// Batches the handler refuses cost as one request
+		{"/map/batch", `{"scale":[]}`, 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		if cost := requestCost(r); cost != tt.cost {
+			t.Errorf("requestCost(%s %s) = %g; want %g", tt.target, tt.body, cost, tt.cost)
+		}
+		// The handler still reads the whole body
+		var body strings.Builder
+		if _, err := io.Copy(&body, r.Body); err != nil || body.String() != tt.body {
+			t.Errorf("requestCost(%s %s) left the body %q", tt.target, tt.body, body.String())
+		}
+	}
+}
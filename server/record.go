@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedRequest is one line of a recording file. Only the request path and
+// query parameters are kept so recordings can be shared without exposing
+// client addresses or headers.
+type RecordedRequest struct {
+	Time     time.Time           `json:"time"`
+	Path     string              `json:"path"`
+	Query    map[string][]string `json:"query"`
+	Status   int                 `json:"status"`
+	Bytes    int                 `json:"bytes"`
+	Duration float64             `json:"duration_ms"`
+	SHA256   string              `json:"sha256,omitempty"`
+}
+
+type requestRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newRequestRecorder(path string) (*requestRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (rec *requestRecorder) write(entry RecordedRequest) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.enc.Encode(entry)
+}
+
+func (rec *requestRecorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.file.Close()
+}
+
+// recordingWriter captures the status code and body of a response
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// Middleware that appends every request to the recording file
+func (rec *requestRecorder) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		entry := RecordedRequest{
+			Time:     start.UTC(),
+			Path:     r.URL.Path,
+			Query:    r.URL.Query(),
+			Status:   rw.status,
+			Bytes:    rw.body.Len(),
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if rw.status == http.StatusOK {
+			sum := sha256.Sum256(rw.body.Bytes())
+			entry.SHA256 = hex.EncodeToString(sum[:])
+		}
+		if err := rec.write(entry); err != nil {
+			requestLogger(r.Context()).Error("failed to record request", "err", err)
+		}
+	})
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Connections kept open to Redis between commands
+	redisPoolSize = 8
+	// Timeout of one command when the request has no earlier deadline
+	redisTimeout = 2 * time.Second
+	// How long an instance may hold the claim on rendering a map before
+	// the others stop waiting for it and render it themselves
+	redisClaimTTL = time.Minute
+	// How often waiting instances look for the map
+	redisPollInterval = 100 * time.Millisecond
+)
+
+// Deletes the claim only if it is still ours, so a claim that expired and
+// was taken by another instance is left alone
+const redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// Error reply of Redis
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Minimal client of the Redis protocol (RESP), enough for the shared render
+// cache: commands are sent as arrays of bulk strings over pooled
+// connections
+type redisClient struct {
+	addr     string
+	tls      *tls.Config // nil for plain TCP
+	username string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Function to parse a Redis URL, redis://[user:password@]host:port/db, or
+// rediss:// for TLS with the CAs of -ca-bundle
+func newRedisClient(raw string) (*redisClient, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis URL (must be redis://host:port/db or rediss://host:port/db)")
+	}
+	c := &redisClient{addr: u.Host, pool: make(chan *redisConn, redisPoolSize)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		c.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if t, ok := outboundClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			c.tls.RootCAs = t.TLSClientConfig.RootCAs
+		}
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			// redis://:password@host and redis://password@host both give
+			// the password alone
+			c.password = u.User.Username()
+		} else {
+			c.username = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid redis database: %s", db)
+		}
+	}
+	return c, nil
+}
+
+// Function to run a command and return its reply: a string, an int64, nil,
+// or a slice of those. Error replies are returned as redisError.
+func (c *redisClient) Do(ctx context.Context, args ...string) (any, error) {
+	for attempt := 0; ; attempt++ {
+		conn, pooled, err := c.conn(ctx, attempt == 0)
+		if err != nil {
+			return nil, err
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) > redisTimeout {
+			deadline = time.Now().Add(redisTimeout)
+		}
+		conn.SetDeadline(deadline)
+		reply, err := conn.do(args)
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			// The connection may be midway through a reply
+			conn.Close()
+			// Redis closes idle connections, which only shows on use
+			if pooled {
+				continue
+			}
+			return nil, err
+		}
+		select {
+		case c.pool <- conn:
+		default:
+			conn.Close()
+		}
+		return reply, err
+	}
+}
+
+// Function to take a pooled connection if allowed and there is one, or open
+// and set up a new one
+func (c *redisClient) conn(ctx context.Context, pooled bool) (*redisConn, bool, error) {
+	if pooled {
+		select {
+		case conn := <-c.pool:
+			return conn, true, nil
+		default:
+		}
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if c.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	var setup [][]string
+	if c.password != "" {
+		if c.username != "" {
+			setup = append(setup, []string{"AUTH", c.username, c.password})
+		} else {
+			setup = append(setup, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := conn.do(args); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+	return conn, false, nil
+}
+
+// Function to send one command and read its reply
+func (conn *redisConn) do(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+// Function to read one reply
+func (conn *redisConn) read() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+// Rendered maps shared by instances through Redis, by the same keys as the
+// disk cache. An instance about to render a map claims it first, and the
+// others wait for its result rather than render the same map. Redis being
+// down only costs renders: every error is a miss.
+type redisCache struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+// Function to connect to Redis and check that it answers
+func newRedisCache(raw string, ttl time.Duration) (*redisCache, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid redis TTL %s (must be positive)", ttl)
+	}
+	client, err := newRedisClient(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Do(context.Background(), "PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+	metrics.Help("canvas_redis_cache_requests_total", "Redis cache lookups, by whether they found the map, waited for another instance to render it, or failed.")
+	return &redisCache{client: client, ttl: ttl}, nil
+}
+
+// Function to get the Redis keys of a map and of the claim on rendering it
+func redisKeys(key string) (data, claim string) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return "canvas:map:" + name, "canvas:claim:" + name
+}
+
+// Get returns the map cached under key, if any
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	data, err := c.get(ctx, key)
+	switch {
+	case err != nil:
+		requestLogger(ctx).Warn("failed to read redis cache", "err", err)
+		metrics.Add("canvas_redis_cache_requests_total", labels("result", "error"), 1)
+	case data == nil:
+		metrics.Add("canvas_redis_cache_requests_total", labels("result", "miss"), 1)
+	default:
+		metrics.Add("canvas_redis_cache_requests_total", labels("result", "hit"), 1)
+	}
+	return data, data != nil
+}
+
+// Function to read the map cached under key, nil if there is none
+func (c *redisCache) get(ctx context.Context, key string) ([]byte, error) {
+	dataKey, _ := redisKeys(key)
+	reply, err := c.client.Do(ctx, "GET", dataKey)
+	if data, ok := reply.(string); ok && err == nil {
+		return []byte(data), nil
+	}
+	return nil, err
+}
+
+// Put caches a map under key for the TTL
+func (c *redisCache) Put(ctx context.Context, key string, data []byte) error {
+	dataKey, _ := redisKeys(key)
+	_, err := c.client.Do(ctx, "SET", dataKey, string(data), "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+	return err
+}
+
+// Claim makes this instance the one rendering the map of key, and returns
+// a function giving the claim up. While another instance holds the claim,
+// it waits for that instance's map, and returns it instead, until the claim
+// is given up or expires, or ctx ends; the caller then renders the map too.
+func (c *redisCache) Claim(ctx context.Context, key string) ([]byte, func()) {
+	_, claimKey := redisKeys(key)
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	release := func() {
+		// The request may be over, but the claim should still go
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), redisTimeout)
+		defer cancel()
+		c.client.Do(ctx, "EVAL", redisReleaseScript, "1", claimKey, token)
+	}
+	for {
+		reply, err := c.client.Do(ctx, "SET", claimKey, token, "NX", "PX", strconv.FormatInt(redisClaimTTL.Milliseconds(), 10))
+		if err != nil {
+			return nil, func() {}
+		}
+		if reply == "OK" {
+			return nil, release
+		}
+
+		// Another instance is rendering it
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, func() {}
+			case <-time.After(redisPollInterval):
+			}
+			data, err := c.get(ctx, key)
+			if err != nil {
+				return nil, func() {}
+			}
+			if data != nil {
+				metrics.Add("canvas_redis_cache_requests_total", labels("result", "waited"), 1)
+				return data, func() {}
+			}
+			held, err := c.client.Do(ctx, "EXISTS", claimKey)
+			if err != nil {
+				return nil, func() {}
+			}
+			if held == int64(0) {
+				// Given up without a map, such as after a failed render
+				break
+			}
+		}
+	}
+}
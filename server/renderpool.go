@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds concurrent rasterizations. Requests beyond the limit wait in a short
+// queue; when the queue is full or the wait too long they are shed with a 503
+// rather than letting memory grow until the host runs out.
+type renderPool struct {
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+	waiting  atomic.Int64
+}
+
+func newRenderPool(concurrency, maxQueue int, maxWait time.Duration) *renderPool {
+	p := &renderPool{slots: make(chan struct{}, concurrency), maxQueue: int64(maxQueue), maxWait: maxWait}
+	metrics.Help("canvas_renders_in_flight", "Rasterizations currently running.")
+	metrics.Help("canvas_render_queue_depth", "Renders waiting for a free slot.")
+	metrics.Help("canvas_renders_shed_total", "Renders rejected because the server was saturated, by reason.")
+	metrics.Help("canvas_renders_shared_total", "Map requests served by the render of an identical request already in progress.")
+	metrics.OnCollect(func() {
+		metrics.Set("canvas_renders_in_flight", "", float64(len(p.slots)))
+		metrics.Set("canvas_render_queue_depth", "", float64(p.waiting.Load()))
+	})
+	return p
+}
+
+// Function to wait for a render slot; the returned function frees it
+func (p *renderPool) Acquire(ctx context.Context) (func(), error) {
+	release := func() { <-p.slots }
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if p.waiting.Add(1) > p.maxQueue {
+		p.waiting.Add(-1)
+		metrics.Add("canvas_renders_shed_total", labels("reason", "queue_full"), 1)
+		return nil, p.overloaded("Server is busy, render queue is full")
+	}
+	defer p.waiting.Add(-1)
+
+	timer := time.NewTimer(p.maxWait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		metrics.Add("canvas_renders_shed_total", labels("reason", "timeout"), 1)
+		return nil, p.overloaded("Server is busy, timed out waiting for a render slot")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *renderPool) overloaded(message string) error {
+	return &apiError{Status: http.StatusServiceUnavailable, Code: ErrOverloaded, Message: message, RetryAfter: p.maxWait}
+}
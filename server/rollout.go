@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"canvas/render"
+)
+
+// Splits traffic between a primary and a canary backend, so a new renderer
+// can be validated on a share of production requests
+type backendRollout struct {
+	primary string
+	canary  string
+	percent float64
+}
+
+func newBackendRollout(primary, canary string, percent float64) (*backendRollout, error) {
+	if _, ok := render.Backends[primary]; !ok {
+		return nil, fmt.Errorf("unknown backend: %s", primary)
+	}
+	if canary != "" {
+		if _, ok := render.Backends[canary]; !ok {
+			return nil, fmt.Errorf("unknown canary backend: %s", canary)
+		}
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("canary percentage must be between 0 and 100: %g", percent)
+	}
+
+	metrics.Help("canvas_renders_total", "Renders by backend and result.")
+	metrics.Help("canvas_render_duration_seconds", "Time spent rasterizing, by backend.")
+	return &backendRollout{primary: primary, canary: canary, percent: percent}, nil
+}
+
+// Function to choose the backend for one request
+func (ro *backendRollout) Pick() string {
+	if ro.canary != "" && rand.Float64()*100 < ro.percent {
+		return ro.canary
+	}
+	return ro.primary
+}
+
+// Function to render with the named backend and record its metrics
+func (ro *backendRollout) Render(name string, scene *render.Scene) ([]byte, error) {
+	start := time.Now()
+	data, err := render.Backends[name].Render(scene)
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Add("canvas_renders_total", labels("backend", name, "result", result), 1)
+	metrics.Observe("canvas_render_duration_seconds", labels("backend", name), time.Since(start).Seconds())
+	return data, err
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+
+	"canvas/geo"
+)
+
+// Rule deciding whether an ingested event is rendered and who publishes it.
+// All conditions of a rule must hold; zero values are not checked.
+type publishRule struct {
+	Name         string   `json:"name"`
+	MinIntensity int      `json:"min_intensity,omitempty"`
+	Prefectures  []int    `json:"prefectures,omitempty"`
+	Regions      []string `json:"regions,omitempty"`
+	MinMagnitude float64  `json:"min_magnitude,omitempty"`
+	Tsunami      bool     `json:"tsunami,omitempty"`
+	Publishers   []string `json:"publishers"`
+
+	regions []geo.BBox
+}
+
+// Set of publishing rules. An event is rendered when at least one rule
+// matches, and sent to the publishers of every matching rule.
+type publishRules struct {
+	Rules []publishRule `json:"rules"`
+}
+
+// Outcome of evaluating the rules against one event
+type publishDecision struct {
+	Render     bool     `json:"render"`
+	Rules      []string `json:"rules"`
+	Publishers []string `json:"publishers"`
+}
+
+// Function to load and validate the rules file
+func loadPublishRules(path string) (*publishRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publish rules: %w", err)
+	}
+
+	var rules publishRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse publish rules: %w", err)
+	}
+
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.MinIntensity < 0 || rule.MinIntensity > 7 {
+			return nil, fmt.Errorf("%s: min_intensity must be between 0 and 7", rule.Name)
+		}
+		for _, id := range rule.Prefectures {
+			if id < 1 || id > 47 {
+				return nil, fmt.Errorf("%s: invalid prefecture ID %d", rule.Name, id)
+			}
+		}
+		for _, region := range rule.Regions {
+			b, err := geo.ParseBBox(region)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", rule.Name, err)
+			}
+			rule.regions = append(rule.regions, b)
+		}
+		if len(rule.Publishers) == 0 {
+			return nil, fmt.Errorf("%s: at least one publisher is required", rule.Name)
+		}
+	}
+	return &rules, nil
+}
+
+func (rule *publishRule) Matches(ev *quakeEvent) bool {
+	if rule.MinIntensity > 0 && ev.MaxIntensity(rule.Prefectures) < rule.MinIntensity {
+		return false
+	}
+	if rule.MinMagnitude > 0 && ev.Magnitude < rule.MinMagnitude {
+		return false
+	}
+	if rule.Tsunami && !ev.Tsunami {
+		return false
+	}
+	if len(rule.regions) > 0 {
+		// Regions of interest are matched against the epicenter
+		inside := false
+		for _, b := range rule.regions {
+			if ev.Longitude >= b.MinLon && ev.Longitude <= b.MaxLon && ev.Latitude >= b.MinLat && ev.Latitude <= b.MaxLat {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to decide whether an event is rendered and where it is published
+func (rs *publishRules) Evaluate(ev *quakeEvent) publishDecision {
+	decision := publishDecision{Rules: []string{}, Publishers: []string{}}
+	publishers := make(map[string]bool)
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if !rule.Matches(ev) {
+			continue
+		}
+		decision.Render = true
+		decision.Rules = append(decision.Rules, rule.Name)
+		for _, p := range rule.Publishers {
+			publishers[p] = true
+		}
+	}
+	for p := range publishers {
+		decision.Publishers = append(decision.Publishers, p)
+	}
+	sort.Strings(decision.Publishers)
+	return decision
+}
+
+// GET lists the rules; POST evaluates the event in the body against them,
+// so operators can check a rule change before real events go through it
+func (rs *publishRules) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var result any
+	switch r.Method {
+	case http.MethodGet:
+		result = rs
+	case http.MethodPost:
+		var ev quakeEvent
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&ev); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidEvent, fmt.Sprintf("Invalid event: %v", err))
+			return
+		}
+		result = rs.Evaluate(&ev)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
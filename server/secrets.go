@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A secrets provider resolves a reference to its value. References look like
+// "<provider>:<location>", e.g. "env:DISCORD_TOKEN", "file:/run/secrets/key",
+// "vault:secret/data/canvas#discord" or "aws:prod/canvas#discord". A value
+// without a known prefix is used as-is, so plaintext config keeps working.
+type secretsProvider interface {
+	Lookup(location string) (string, error)
+}
+
+var secretsProviders = map[string]secretsProvider{
+	"env":   envSecrets{},
+	"file":  fileSecrets{},
+	"vault": vaultSecrets{},
+	"aws":   awsSecrets{},
+}
+
+var secretsCache sync.Map
+
+// Function to resolve a secret reference; results are cached for the lifetime of the process
+func resolveSecret(ref string) (string, error) {
+	if cached, ok := secretsCache.Load(ref); ok {
+		return cached.(string), nil
+	}
+
+	scheme, location, found := strings.Cut(ref, ":")
+	provider, ok := secretsProviders[scheme]
+	if !found || !ok {
+		return ref, nil
+	}
+
+	value, err := provider.Lookup(location)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s secret %q: %w", scheme, location, err)
+	}
+	secretsCache.Store(ref, value)
+	return value, nil
+}
+
+// Function to split "path#key" references into their parts
+func splitSecretKey(location string) (path, key string) {
+	path, key, _ = strings.Cut(location, "#")
+	return path, key
+}
+
+// Function to pick a key out of a JSON object secret, or return the whole value
+func selectSecretKey(value []byte, key string) (string, error) {
+	if key == "" {
+		return strings.TrimSpace(string(value)), nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	v, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found", key)
+	}
+	return fmt.Sprint(v), nil
+}
+
+type envSecrets struct{}
+
+func (envSecrets) Lookup(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable is not set")
+	}
+	return value, nil
+}
+
+// Files such as Docker or Kubernetes secrets mounts
+type fileSecrets struct{}
+
+func (fileSecrets) Lookup(location string) (string, error) {
+	path, key := splitSecretKey(location)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return selectSecretKey(data, key)
+}
+
+// HashiCorp Vault KV secrets, using VAULT_ADDR and VAULT_TOKEN
+type vaultSecrets struct{}
+
+func (vaultSecrets) Lookup(location string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+
+	path, key := splitSecretKey(location)
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	// KV version 2 nests the values in another data object
+	data := body.Data
+	if nested, ok := data["data"]; ok && data["metadata"] != nil {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", err
+		}
+	}
+	fields, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		key = "value"
+	}
+	return selectSecretKey(fields, key)
+}
+
+// AWS Secrets Manager, using the standard AWS_* environment variables
+type awsSecrets struct{}
+
+func (awsSecrets) Lookup(location string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	id, key := splitSecretKey(location)
+	payload, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+
+	host := fmt.Sprintf("secretsmanager.%s.amazonaws.com", region)
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, payload, accessKey, secretKey, region, "secretsmanager", time.Now())
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("secrets manager returned %s: %s", resp.Status, msg)
+	}
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return selectSecretKey([]byte(body.SecretString), key)
+}
+
+// Function to sign a request with AWS Signature Version 4
+func signAWSRequest(req *http.Request, payload []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Host", req.URL.Host)
+
+	// Every header set above is signed, in lowercase sorted order
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(secretKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// Function to presign a GET of u with AWS Signature Version 4 in the query
+// string, valid for expires from now
+func presignAWSURL(u *url.URL, accessKey, secretKey, sessionToken, region, service string, expires time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if sessionToken != "" {
+		query.Set("X-Amz-Security-Token", sessionToken)
+	}
+	// Query escaping differs from AWS's only in spaces, which none of these
+	// have
+	canonicalQuery := query.Encode()
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		path,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := awsSigningKey(secretKey, date, region, service)
+	signed := *u
+	signed.RawQuery = canonicalQuery + "&X-Amz-Signature=" + hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	return signed.String()
+}
+
+// Function to derive the key signing the requests of a day, region and
+// service from the secret key
+func awsSigningKey(secretKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// Reference renders covering the drawing features. Each one is rendered with
+// every backend and compared with the golden hashes in selftest_golden.json,
+// which `canvas selftest -write` regenerates after an intended change.
+var selftestScenarios = []struct {
+	Name  string
+	Query string
+}{
+	{"all_intensities", `scale=[{"id":1,"scale":0},{"id":2,"scale":1},{"id":3,"scale":2},{"id":4,"scale":3},{"id":5,"scale":4},{"id":6,"scale":5},{"id":7,"scale":6},{"id":8,"scale":7}]&extent=japan`},
+	{"scale_text", `scale=[{"id":13,"scale":5},{"id":14,"scale":4},{"id":11,"scale":3},{"id":12,"scale":2}]&scale_text=true`},
+	{"footer_cjk", `scale=[{"id":27,"scale":4}]&footer=震度速報 大阪府北部 M5.5`},
+	{"region", `scale=[{"id":1,"scale":6}]&bbox=hokkaido`},
+	{"square", `scale=[{"id":47,"scale":3}]&width=720&height=720&margin=0.05`},
+	{"insets", `scale=[{"id":13,"scale":4},{"id":40,"scale":3},{"id":47,"scale":5}]`},
+	{"overlays", `scale=[{"id":17,"scale":6},{"id":16,"scale":4}]&overlay={"type":"FeatureCollection","features":[{"type":"Feature","properties":{"stroke":"#ef4444","stroke-width":3,"stroke-dasharray":"6,3"},"geometry":{"type":"LineString","coordinates":[[136.6,37.1],[137.0,37.4],[137.4,37.5]]}},{"type":"Feature","properties":{"fill":"#3b82f6","fill-opacity":0.3,"stroke":"#1d4ed8"},"geometry":{"type":"Polygon","coordinates":[[[136.8,36.6],[137.3,36.6],[137.3,37.0],[136.8,37.0],[136.8,36.6]]]}}]}`},
+}
+
+//go:embed selftest_golden.json
+var selftestGoldenJSON []byte
+
+type selftestResult struct {
+	Name     string  `json:"name"`
+	Backend  string  `json:"backend"`
+	Hash     string  `json:"hash,omitempty"`
+	Golden   string  `json:"golden,omitempty"`
+	Pass     bool    `json:"pass"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+type selftestReport struct {
+	Pass    bool             `json:"pass"`
+	Assets  string           `json:"assets"`
+	Results []selftestResult `json:"results"`
+}
+
+// Function to key a scenario in the golden file
+func selftestKey(name, backend string) string {
+	return name + "/" + backend
+}
+
+// Function to hash the decoded pixels of a PNG, so a change in the encoder's
+// compression does not count as a change in output
+func pixelHash(data []byte) (string, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%dx%d\n", rgba.Rect.Dx(), rgba.Rect.Dy())
+	h.Write(rgba.Pix)
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// Function to render every scenario with every backend. acquire, when set,
+// bounds the renders like any other.
+func runSelftest(ctx context.Context, dataset *geo.Dataset, acquire func(context.Context) (func(), error)) (*selftestReport, error) {
+	var golden map[string]string
+	if err := json.Unmarshal(selftestGoldenJSON, &golden); err != nil {
+		return nil, fmt.Errorf("invalid embedded golden values: %w", err)
+	}
+
+	backends := make([]string, 0, len(render.Backends))
+	for name := range render.Backends {
+		backends = append(backends, name)
+	}
+	sort.Strings(backends)
+
+	report := &selftestReport{Pass: true}
+	for _, scenario := range selftestScenarios {
+		query, err := url.ParseQuery(scenario.Query)
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", scenario.Name, err)
+		}
+		opts, err := ParseRenderOptions(query)
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", scenario.Name, err)
+		}
+
+		for _, backend := range backends {
+			result := selftestResult{Name: scenario.Name, Backend: backend, Golden: golden[selftestKey(scenario.Name, backend)]}
+			if acquire != nil {
+				release, err := acquire(ctx)
+				if err != nil {
+					return nil, err
+				}
+				result.Hash, result.Duration, err = selftestRender(dataset, opts, backend)
+				release()
+				if err != nil {
+					result.Error = err.Error()
+				}
+			} else if result.Hash, result.Duration, err = selftestRender(dataset, opts, backend); err != nil {
+				result.Error = err.Error()
+			}
+
+			result.Pass = result.Error == "" && result.Hash == result.Golden
+			report.Pass = report.Pass && result.Pass
+			report.Results = append(report.Results, result)
+		}
+	}
+	return report, nil
+}
+
+func selftestRender(dataset *geo.Dataset, opts *render.Options, backend string) (string, float64, error) {
+	start := time.Now()
+	data, err := render.Backends[backend].Render(render.BuildScene(dataset, opts))
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return "", elapsed, err
+	}
+	hash, err := pixelHash(data)
+	return hash, elapsed, err
+}
+
+// POST /selftest renders the reference scenarios and compares them with the
+// golden values. The golden values assume the default -simplify=true.
+func (s *server) selftestHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := runSelftest(r.Context(), s.dataset, s.pool.Acquire)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	report.Assets = s.assets
+
+	failed := 0
+	for _, result := range report.Results {
+		if !result.Pass {
+			failed++
+		}
+	}
+	s.audit.Record(auditActor(r), "selftest.run", "", map[string]string{
+		"pass":   strconv.FormatBool(report.Pass),
+		"failed": strconv.Itoa(failed),
+		"assets": s.assets,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SelftestCommand runs the self-test from the command line, or with -write
+// regenerates the golden values after an intended change in output.
+func SelftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	write := fs.String("write", "", "write the current hashes as golden values to this file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: canvas selftest [-write server/selftest_golden.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dataset, err := geo.Load("japan.geojson", true)
+	if err != nil {
+		return err
+	}
+	report, err := runSelftest(context.Background(), dataset, nil)
+	if err != nil {
+		return err
+	}
+
+	if *write != "" {
+		golden := make(map[string]string)
+		for _, result := range report.Results {
+			if result.Error != "" {
+				return fmt.Errorf("%s with %s: %s", result.Name, result.Backend, result.Error)
+			}
+			golden[selftestKey(result.Name, result.Backend)] = result.Hash
+		}
+		data, err := json.MarshalIndent(golden, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*write, append(data, '\n'), 0o644)
+	}
+
+	for _, result := range report.Results {
+		status := "ok"
+		switch {
+		case result.Error != "":
+			status = "error: " + result.Error
+		case !result.Pass:
+			status = "changed (golden " + result.Golden + ")"
+		}
+		fmt.Printf("%-16s %-7s %8.1fms %s %s\n", result.Name, result.Backend, result.Duration, result.Hash, status)
+	}
+	if !report.Pass {
+		return fmt.Errorf("output differs from the golden values")
+	}
+	return nil
+}
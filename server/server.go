@@ -0,0 +1,876 @@
+// Package server is the HTTP rendering service: the /map, /badge, /legend,
+// /diff, /grid, /animation, /propagation and image endpoints, their limits
+// and authentication, and the admin endpoints.
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"canvas/geo"
+	"canvas/render"
+
+	"google.golang.org/grpc"
+)
+
+// Shared state of the HTTP handlers
+type server struct {
+	dataset *geo.Dataset
+	rollout *backendRollout
+	audit   *auditLog
+	images  *imageStore
+	pool    *renderPool
+	feed    *p2pquakeFeed
+	assets  string // Fingerprint of the map data, fonts and renderer, for ETags
+	maxAge  int    // Cache-Control max-age of renders, in seconds
+	maps    *mapRegistry
+	palette []string // Intensity colors of the map, nil for the default
+	// Borders and fills of the map, under those the query gives
+	style render.Style
+	// Projection of the map when the query names none, empty for the
+	// default
+	projection string
+	// Earlier boundaries of the map, picked with asof
+	snapshots []mapSnapshot
+	maxUpload int64 // Largest map accepted by POST /map, in bytes
+	captions  *captionTemplates
+	bucket    *objectBucket // Where output=url uploads maps, nil when unset
+	disk      *diskCache    // Renders kept across restarts, nil when unset
+	redis     *redisCache   // Renders shared between instances, nil when unset
+	// Whether the features are the prefectures by JIS code, which scale may
+	// name
+	prefectures bool
+}
+
+// Run parses the server flags from args and serves until SIGINT or SIGTERM.
+// Invalid configuration is logged and exits the process.
+func Run(args []string) {
+	fs := flag.NewFlagSet("canvas", flag.ExitOnError)
+	addr := fs.String("addr", defaultListenAddr(), "address to listen on (default from LISTEN_ADDR or PORT, else :8080)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests when stopping")
+	recordPath := fs.String("record", "", "append anonymized render requests to this file")
+	backend := fs.String("backend", "svg", "rasterization backend serving most requests")
+	canaryBackend := fs.String("canary-backend", "", "rasterization backend receiving a share of the traffic")
+	canaryPercent := fs.Float64("canary-percent", 0, "percentage of requests sent to the canary backend")
+	sloLatency := fs.Duration("slo-latency", 5*time.Second, "latency within which a request counts towards the SLO")
+	sloObjective := fs.Float64("slo-objective", 0.99, "fraction of requests that must meet the SLO")
+	auditPath := fs.String("audit-log", "", "append the audit trail to this file instead of keeping it in memory")
+	proxy := fs.String("proxy", "", "proxy URL for outbound connections (default from HTTP_PROXY/HTTPS_PROXY)")
+	caBundle := fs.String("ca-bundle", "", "PEM file of additional CAs trusted for outbound TLS")
+	outboundTimeout := fs.Duration("outbound-timeout", 10*time.Second, "timeout for outbound requests")
+	simplify := fs.Bool("simplify", true, "precompute simplified geometries and pick one by zoom level")
+	dataPath := fs.String("data", "japan.geojson", "GeoJSON or TopoJSON file of the prefectures")
+	maxUploadMB := fs.Int("max-upload-mb", 5, "largest map accepted by POST /map, in MiB (0 disables uploads)")
+	dataCRS := fs.String("data-crs", "", "CRS of the -data coordinates: wgs84, jgd2011, jgd2000 or tokyo (default: the crs member of the file, or wgs84)")
+	allowCIDR := fs.String("allow-cidr", "", "comma-separated CIDR ranges allowed to use the server (default: everyone)")
+	adminAddr := fs.String("admin-addr", "", "serve the admin endpoints (/metrics, /slo, /audit, /status, /maintenance, /features, /selftest, /rules, /captions) on this separate address, e.g. 127.0.0.1:9090")
+	adminToken := fs.String("admin-token", "", "token the admin endpoints require, as a secret reference such as env:CANVAS_ADMIN_TOKEN; without -admin-addr, the admin endpoints are only served on the public address with it")
+	grpcAddr := fs.String("grpc-addr", "", "serve the gRPC API of canvaspb/canvas.proto to internal callers on this address, e.g. 127.0.0.1:9000")
+	upstream := fs.String("upstream", "", "act as a caching proxy for the rendering instance at this URL")
+	cacheTTL := fs.Duration("cache-ttl", time.Minute, "how long the proxy serves a cached response before revalidating it")
+	cacheEntries := fs.Int("cache-entries", 256, "maximum number of responses held by the proxy")
+	rulesPath := fs.String("publish-rules", "", "JSON file of rules deciding which events are rendered and published")
+	captionsPath := fs.String("captions", "", "JSON file of caption templates by publisher and locale")
+	imageStoreMB := fs.Int("image-store-mb", 256, "memory kept for recent renders and their thumbnails, in MiB")
+	rateLimit := fs.Float64("rate-limit", 0, "renders per second allowed per client IP, weighted by output area (0 disables)")
+	rateBurst := fs.Float64("rate-burst", 10, "renders a client IP can make at once before -rate-limit applies")
+	globalRateLimit := fs.Float64("global-rate-limit", 0, "renders per second allowed across all clients, weighted by output area (0 disables)")
+	globalRateBurst := fs.Float64("global-rate-burst", 50, "renders allowed at once across all clients")
+	quotaRenders := fs.Int64("quota-renders", 0, "renders allowed per API key and calendar month (0 disables)")
+	quotaPixels := fs.Int64("quota-pixels", 0, "output pixels allowed per API key and calendar month (0 disables)")
+	usagePath := fs.String("usage-file", "", "keep the monthly usage per API key in this file, so it survives restarts")
+	apiKeysPath := fs.String("api-keys", "", "file of API keys required to use the server, one name=key per line (also CANVAS_API_KEYS)")
+	maxRenders := fs.Int("max-renders", runtime.NumCPU(), "rasterizations allowed to run at once")
+	renderQueue := fs.Int("render-queue", 2*runtime.NumCPU(), "renders allowed to wait for a slot before new ones are rejected")
+	renderQueueWait := fs.Duration("render-queue-wait", 10*time.Second, "how long a render waits for a slot before it is rejected")
+	maintenanceOn := fs.Bool("maintenance", false, "start in maintenance mode, refusing renders until it is turned off at /maintenance")
+	maintenanceRetryAfter := fs.Duration("maintenance-retry-after", 5*time.Minute, "Retry-After sent in maintenance mode unless the operator gives one")
+	cacheMaxAge := fs.Duration("cache-max-age", 10*time.Minute, "how long clients and CDNs may cache a rendered map or badge before revalidating it")
+	p2pquakeURL := fs.String("p2pquake-url", "https://api.p2pquake.net/v2", "base URL of the P2P地震情報 API used by /map/latest and /map?event=")
+	p2pquakeTTL := fs.Duration("p2pquake-ttl", 15*time.Second, "how long the latest earthquake is cached before the API is asked again")
+	mapsPath := fs.String("maps", "", "JSON file of named maps served at /map/{name}, besides japan")
+	hypocentersPath := fs.String("hypocenters", "", "CSV file of hypocenter regions (name,lat,lon) adding to or overriding the bundled table used to place epicenters given by name")
+	logoPath := fs.String("logo", "", "PNG or SVG logo composited over a corner of every map")
+	logoPosition := fs.String("logo-position", render.LogoBottomRight, "corner of the logo: top-left, top-right, bottom-left or bottom-right")
+	logoWidth := fs.Float64("logo-width", 120, "width of the logo in pixels at 1280x720, scaled with the map")
+	logoOpacity := fs.Float64("logo-opacity", 0.8, "opacity of the logo, 0 to 1")
+	logoFooter := fs.Bool("logo-replaces-footer", false, "leave the footer text out of maps with a logo")
+	license := fs.String("license", defaultLicense, "license written into the metadata of every PNG map (empty leaves it out)")
+	stationsPath := fs.String("stations", "", "CSV file of observation stations (name,lat,lon) used to place points given by name")
+	ingestSecret := fs.String("ingest-secret", "", "shared secret verifying events pushed to POST /ingest, or a secret reference such as env:INGEST_SECRET (unset disables /ingest)")
+	p2pquakePoll := fs.Duration("p2pquake-poll", 0, "how often the latest p2pquake event is sent through the publishing pipeline (0 disables)")
+	p2pquakeWS := fs.String("p2pquake-ws", "", "p2pquake WebSocket URL whose earthquakes are sent through the publishing pipeline as they arrive, e.g. wss://api.p2pquake.net/v2/ws (empty disables)")
+	webhooksPath := fs.String("webhooks", "", "JSON file of webhooks the publishing pipeline POSTs rendered events to, as publishers")
+	summaries := fs.String("summary", "", "comma-separated summary maps to publish after each period: daily, weekly or both (empty disables)")
+	summaryMinIntensity := fs.Int("summary-min-intensity", 3, "lowest maximum intensity of the earthquakes counted in summaries")
+	summaryPublishers := fs.String("summary-publishers", "", "comma-separated publishers the summaries are sent to")
+	featuresPath := fs.String("features", "", "JSON file of feature flags turned on or off for the deployment and per API key")
+	jobWorkers := fs.Int("job-workers", 2, "render jobs submitted to POST /jobs that run at once")
+	jobQueueSize := fs.Int("job-queue", 100, "render jobs allowed to wait for a worker before new ones are rejected")
+	jobTTL := fs.Duration("job-ttl", time.Hour, "how long the result of a render job is kept after it finishes")
+	jobCallbackHosts := fs.String("job-callback-hosts", "", "comma-separated hosts render jobs may push their results to (empty disables callbacks)")
+	bucketURL := fs.String("bucket", "", "object storage bucket that output=url uploads maps to: s3://bucket/prefix or gs://bucket/prefix, with optional region= and endpoint= (empty disables output=url)")
+	bucketPublicURL := fs.String("bucket-public-url", "", "URL the -bucket is publicly readable at; without it, output=url returns signed URLs")
+	bucketURLTTL := fs.Duration("bucket-url-ttl", time.Hour, "how long the signed URLs of output=url stay valid, at most 168h")
+	diskCacheDir := fs.String("disk-cache", "", "directory keeping rendered maps across restarts, shareable between processes (empty disables)")
+	diskCacheTTL := fs.Duration("disk-cache-ttl", 7*24*time.Hour, "how long a map in the disk cache is kept after it was last used")
+	diskCacheMB := fs.Int("disk-cache-mb", 1024, "disk space kept for rendered maps, in MiB; the least recently used go first")
+	redisURL := fs.String("redis", "", "Redis URL, redis://[:password@]host:port/db or rediss://, sharing rendered maps between instances; may be a secret reference (empty disables)")
+	redisTTL := fs.Duration("redis-ttl", 24*time.Hour, "how long a map is kept in Redis")
+	lockDir := fs.String("lock-dir", "", "directory shared between replicas to coordinate background jobs")
+	logFormat := fs.String("log-format", "text", "log format: text or json")
+	logLevel := fs.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.Parse(args)
+
+	if err := SetupLogging(*logFormat, *logLevel); err != nil {
+		fatal("invalid logging configuration", "err", err)
+	}
+
+	if err := configureOutbound(*proxy, *caBundle, *outboundTimeout); err != nil {
+		fatal("invalid outbound configuration", "err", err)
+	}
+
+	if *lockDir != "" {
+		locker, err := newDirJobLocker(*lockDir)
+		if err != nil {
+			fatal("failed to set up job locks", "err", err)
+		}
+		jobLocks = locker
+		go func() {
+			for range time.Tick(time.Hour) {
+				if err := locker.Prune(24 * time.Hour); err != nil {
+					slog.Error("failed to prune job locks", "err", err)
+				}
+			}
+		}()
+	}
+
+	if *sloObjective <= 0 || *sloObjective >= 1 {
+		fatal("SLO objective must be between 0 and 1", "objective", *sloObjective)
+	}
+	slo := newSLOTracker(*sloLatency, *sloObjective)
+	go slo.Run(time.Minute)
+
+	rollout, err := newBackendRollout(*backend, *canaryBackend, *canaryPercent)
+	if err != nil {
+		fatal("invalid backend configuration", "err", err)
+	}
+	audit, err := newAuditLog(*auditPath)
+	if err != nil {
+		fatal("failed to open audit log", "err", err)
+	}
+	audit.Record("system", "server.start", "", map[string]string{
+		"backend":        *backend,
+		"canary_backend": *canaryBackend,
+		"canary_percent": strconv.FormatFloat(*canaryPercent, 'g', -1, 64),
+	})
+
+	features, err := loadFeatures(*featuresPath, audit)
+	if err != nil {
+		fatal("failed to load feature flags", "err", err)
+	}
+
+	maintenance = newMaintenanceMode(*maintenanceRetryAfter, audit)
+	if *maintenanceOn {
+		maintenance.Enable("", 0)
+	}
+
+	// Renders are rate limited and metered; stored images and thumbnails are
+	// cheap
+	usage, err := newUsageTracker(*quotaRenders, *quotaPixels, *usagePath)
+	if err != nil {
+		fatal("invalid usage configuration", "err", err)
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := usage.Save(); err != nil {
+				slog.Error("failed to save usage", "err", err)
+			}
+		}
+	}()
+	limit := usage.Wrap
+	if *rateLimit > 0 || *globalRateLimit > 0 {
+		limiter, err := newRateLimiter(*rateLimit, *rateBurst, *globalRateLimit, *globalRateBurst)
+		if err != nil {
+			fatal("invalid rate limit", "err", err)
+		}
+		limit = func(h http.Handler) http.Handler { return usage.Wrap(limiter.Wrap(h)) }
+	}
+
+	if *logoPath != "" {
+		image, err := render.LoadLogo(*logoPath)
+		if err != nil {
+			fatal("failed to load logo", "err", err)
+		}
+		logo = &render.Logo{Image: image, Position: *logoPosition, Width: *logoWidth, Opacity: *logoOpacity, ReplaceFooter: *logoFooter}
+		if err := logo.Validate(); err != nil {
+			fatal("invalid logo", "err", err)
+		}
+	}
+
+	imageLicense = *license
+
+	mux := http.NewServeMux()
+
+	captions, err := loadCaptionTemplates(*captionsPath)
+	if err != nil {
+		fatal("failed to load caption templates", "err", err)
+	}
+	var rules *publishRules
+	if *rulesPath != "" {
+		if rules, err = loadPublishRules(*rulesPath); err != nil {
+			fatal("failed to load publish rules", "err", err)
+		}
+	}
+
+	var (
+		render, latest, named, alt http.Handler
+		s                          *server
+	)
+	if *upstream != "" {
+		// Edge instances only cache, so the map data is never loaded
+		if *ingestSecret != "" || *p2pquakePoll > 0 || *p2pquakeWS != "" || *summaries != "" || *webhooksPath != "" {
+			fatal("-ingest-secret, -p2pquake-poll, -p2pquake-ws, -summary and -webhooks render events, and cannot be used with -upstream")
+		}
+		proxy, err := newCachingProxy(*upstream, *cacheTTL, *cacheEntries)
+		if err != nil {
+			fatal("invalid proxy configuration", "err", err)
+		}
+		render, latest, named, alt = proxy, proxy, proxy, proxy
+		mux.Handle("GET /images/", proxy)
+		mux.Handle("GET /maps", proxy)
+		mux.Handle("GET /areas", proxy)
+		mux.Handle("GET /tiles/", proxy)
+		slog.Info("proxying renders", "upstream", *upstream)
+	} else {
+		crs, err := parseMapCRS(*dataCRS)
+		if err != nil {
+			fatal("invalid -data-crs", "err", err)
+		}
+		dataset, err := geo.LoadFile(*dataPath, geo.LoadOptions{CRS: crs, Simplify: *simplify})
+		if err != nil {
+			fatal("failed to load map data", "err", err)
+		}
+		images := newImageStore(*imageStoreMB << 20)
+		if *maxRenders < 1 || *renderQueue < 0 {
+			fatal("invalid render limits", "max_renders", *maxRenders, "render_queue", *renderQueue)
+		}
+		pool := newRenderPool(*maxRenders, *renderQueue, *renderQueueWait)
+		dashboard.pool = pool
+		assets, err := assetVersion(*simplify, *dataPath, "./fonts/roboto-regular.ttf", "./fonts/roboto-medium.ttf")
+		if err != nil {
+			fatal("failed to fingerprint map assets", "err", err)
+		}
+		if crs != "" {
+			assets = string(crs) + "-" + assets
+		}
+		if *stationsPath != "" {
+			stations, err = geo.LoadStations(*stationsPath)
+			if err != nil {
+				fatal("failed to load stations", "err", err)
+			}
+			slog.Info("loaded stations", "count", stations.Len())
+		}
+		if *hypocentersPath != "" {
+			hypocenters, err := geo.LoadHypocenters(*hypocentersPath)
+			if err != nil {
+				fatal("failed to load hypocenter regions", "err", err)
+			}
+			epicenters = hypocenters
+			slog.Info("loaded hypocenter regions", "count", hypocenters.Len())
+		}
+		feed, err := newP2PQuakeFeed(*p2pquakeURL, *p2pquakeTTL)
+		if err != nil {
+			fatal("invalid feed configuration", "err", err)
+		}
+		maps, err := loadMapRegistry(*mapsPath, dataset, assets, *simplify)
+		if err != nil {
+			fatal("failed to load maps", "err", err)
+		}
+		s = &server{dataset: dataset, rollout: rollout, audit: audit, images: images, pool: pool, feed: feed,
+			assets: assets, maxAge: int(cacheMaxAge.Seconds()), maps: maps, maxUpload: int64(*maxUploadMB) << 20, captions: captions,
+			prefectures: true}
+		if *bucketURL != "" {
+			if s.bucket, err = newObjectBucket(*bucketURL, *bucketPublicURL, *bucketURLTTL); err != nil {
+				fatal("invalid bucket configuration", "err", err)
+			}
+			slog.Info("uploading output=url maps", "bucket", *bucketURL)
+		}
+		if *diskCacheDir != "" {
+			if s.disk, err = newDiskCache(*diskCacheDir, *diskCacheTTL, int64(*diskCacheMB)<<20); err != nil {
+				fatal("invalid disk cache configuration", "err", err)
+			}
+			slog.Info("caching renders on disk", "dir", *diskCacheDir)
+		}
+		if *redisURL != "" {
+			raw, err := resolveSecret(*redisURL)
+			if err != nil {
+				fatal("failed to resolve the redis URL", "err", err)
+			}
+			if s.redis, err = newRedisCache(raw, *redisTTL); err != nil {
+				fatal("invalid redis configuration", "err", err)
+			}
+			slog.Info("sharing renders through redis")
+		}
+		japan, _ := maps.Get(defaultMapName)
+		s.snapshots = japan.snapshots
+		render = http.HandlerFunc(s.mapHandler)
+		latest = http.HandlerFunc(s.latestHandler)
+		named = http.HandlerFunc(s.namedMapHandler)
+		alt = http.HandlerFunc(s.altHandler)
+		mux.Handle("GET /maps", maps)
+		mux.HandleFunc("GET /areas", s.areasHandler)
+		mux.HandleFunc("GET /images/{id}", images.imageHandler)
+		mux.HandleFunc("GET /images/{id}/thumb", images.thumbHandler)
+		mux.Handle("GET /diff", maintenance.Wrap(limit(http.HandlerFunc(s.diffHandler))))
+		mux.Handle("GET /badge", maintenance.Wrap(limit(http.HandlerFunc(s.badgeHandler))))
+		mux.Handle("GET /legend", maintenance.Wrap(limit(http.HandlerFunc(s.legendHandler))))
+		mux.Handle("GET /animation", maintenance.Wrap(limit(http.HandlerFunc(s.animationHandler))))
+		mux.Handle("GET /propagation", maintenance.Wrap(limit(http.HandlerFunc(s.propagationHandler))))
+		mux.Handle("GET /grid", maintenance.Wrap(limit(http.HandlerFunc(s.gridHandler))))
+		mux.Handle("POST /map/batch", maintenance.Wrap(limit(http.HandlerFunc(s.batchHandler))))
+		mux.Handle("GET /social", maintenance.Wrap(limit(http.HandlerFunc(s.socialHandler))))
+		mux.Handle("GET /summary", maintenance.Wrap(limit(http.HandlerFunc(s.summaryHandler))))
+		mux.Handle("GET /frequency", maintenance.Wrap(limit(http.HandlerFunc(s.frequencyHandler))))
+		mux.Handle("GET /tiles/{z}/{x}/{y}", maintenance.WrapCached(slo.Wrap("tiles", limit(http.HandlerFunc(s.tileHandler)))))
+
+		publishers := make(map[string]publisher)
+		if *webhooksPath != "" {
+			hooks, err := loadWebhooks(*webhooksPath)
+			if err != nil {
+				fatal("failed to load webhooks", "err", err)
+			}
+			for name, hook := range hooks {
+				publishers[name] = hook
+			}
+			slog.Info("loaded webhooks", "count", len(hooks))
+		}
+		pipeline := newEventPipeline(s, rules, captions, publishers, "en")
+		if *ingestSecret != "" {
+			ingest, err := newIngestHandler(*ingestSecret, pipeline)
+			if err != nil {
+				fatal("invalid ingest configuration", "err", err)
+			}
+			mux.Handle("POST /ingest", maintenance.Wrap(ingest))
+		}
+		if *p2pquakePoll > 0 {
+			go pipeline.Poll(context.Background(), feed, *p2pquakePoll)
+		}
+		if *p2pquakeWS != "" {
+			go pipeline.Stream(context.Background(), *p2pquakeWS)
+		}
+		if *summaries != "" {
+			scheduler := &summaryScheduler{pipeline: pipeline, minIntensity: *summaryMinIntensity}
+			for _, period := range strings.Split(*summaries, ",") {
+				period, err := parseSummaryPeriod(strings.TrimSpace(period))
+				if err != nil {
+					fatal("invalid -summary", "err", err)
+				}
+				scheduler.periods = append(scheduler.periods, period)
+			}
+			if *summaryMinIntensity < 1 || *summaryMinIntensity > 7 {
+				fatal("-summary-min-intensity must be between 1 and 7", "min_intensity", *summaryMinIntensity)
+			}
+			for _, name := range strings.Split(*summaryPublishers, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					scheduler.publishers = append(scheduler.publishers, name)
+				}
+			}
+			go scheduler.Run(context.Background())
+		}
+	}
+
+	if *recordPath != "" {
+		recorder, err := newRequestRecorder(*recordPath)
+		if err != nil {
+			fatal("failed to open recording file", "err", err)
+		}
+		defer recorder.Close()
+		render = recorder.Wrap(render)
+		slog.Info("recording requests", "path", *recordPath)
+	}
+
+	mux.Handle("/map", maintenance.WrapCached(slo.Wrap("map", limit(render))))
+	mux.Handle("/map/latest", maintenance.WrapCached(slo.Wrap("map_latest", limit(latest))))
+	mux.Handle("/map/alt", maintenance.WrapCached(slo.Wrap("map_alt", limit(alt))))
+	mux.Handle("/map/{name}", maintenance.WrapCached(slo.Wrap("map", limit(named))))
+	if s != nil && s.maxUpload > 0 {
+		mux.Handle("POST /map", maintenance.WrapCached(slo.Wrap("map_upload", limit(http.HandlerFunc(s.uploadHandler)))))
+	}
+	mux.Handle("GET /usage", usage)
+	mux.HandleFunc("GET /version", features.versionHandler)
+
+	// Admin endpoints change the deployment and show the parameters of
+	// requests. They are served on the internal address when one is given,
+	// and on the public listener only behind the admin token.
+	adminMux := http.NewServeMux()
+	var adminPatterns []string
+	handleAdmin := func(pattern string, handler http.Handler) {
+		adminMux.Handle(pattern, handler)
+		adminPatterns = append(adminPatterns, pattern)
+	}
+	handleAdmin("/metrics", metrics)
+	handleAdmin("/slo", slo)
+	handleAdmin("/audit", audit)
+	handleAdmin("/status", dashboard)
+	handleAdmin("/maintenance", maintenance)
+	handleAdmin("/features", features)
+	if s != nil {
+		handleAdmin("POST /selftest", http.HandlerFunc(s.selftestHandler))
+	}
+	handleAdmin("/captions", captions)
+	if rules != nil {
+		handleAdmin("/rules", rules)
+	}
+	var admin http.Handler = adminMux
+	if *adminToken != "" {
+		token, err := resolveSecret(*adminToken)
+		if err != nil {
+			fatal("invalid -admin-token", "err", err)
+		}
+		admin = requireAdminToken(token, adminMux)
+	}
+	switch {
+	case *adminAddr != "":
+		// The dashboard shows thumbnails of recent renders
+		adminMux.Handle("GET /images/", mux)
+	case *adminToken != "":
+		for _, pattern := range adminPatterns {
+			mux.Handle(pattern, admin)
+		}
+	default:
+		slog.Warn("admin endpoints are disabled; set -admin-addr or -admin-token to serve them")
+	}
+
+	// Requests are checked against the OpenAPI document before their handler
+	spec := newAPISpec(mux)
+	mux.Handle("GET /openapi.json", spec)
+
+	// Jobs render through the same feature flags as requests
+	if *jobWorkers < 1 || *jobQueueSize < 1 {
+		fatal("invalid job limits", "job_workers", *jobWorkers, "job_queue", *jobQueueSize)
+	}
+	var callbackHosts []string
+	for _, host := range strings.Split(*jobCallbackHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			callbackHosts = append(callbackHosts, host)
+		}
+	}
+	jobs := newJobQueue(features.Wrap(spec.Wrap(mux)), *jobWorkers, *jobQueueSize, *jobTTL, callbackHosts)
+	mux.Handle("POST /jobs", maintenance.Wrap(http.HandlerFunc(jobs.createHandler)))
+	mux.HandleFunc("GET /jobs/{id}", jobs.statusHandler)
+	mux.HandleFunc("GET /jobs/{id}/result", jobs.resultHandler)
+
+	// gRPC calls, like jobs, render through the feature flags without an API key
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		if s == nil {
+			fatal("-grpc-addr renders maps, and cannot be used with -upstream")
+		}
+		frames := spec.WrapOperation(http.MethodGet, "/animation", maintenance.Wrap(limit(http.HandlerFunc(s.framesHandler))))
+		grpcServer = newGRPCServer(features.Wrap(spec.Wrap(mux)), features.Wrap(frames))
+	}
+
+	// Feature flags are checked after the API key is known
+	handler := features.Wrap(spec.Wrap(mux))
+	if *apiKeysPath != "" || os.Getenv("CANVAS_API_KEYS") != "" {
+		keys, err := loadAPIKeys(*apiKeysPath, os.Getenv("CANVAS_API_KEYS"))
+		if err != nil {
+			fatal("failed to load API keys", "err", err)
+		}
+		// Pushed events are signed with the ingest secret instead
+		keys.exempt = map[string]bool{"/ingest": true}
+		handler = keys.Wrap(handler)
+		slog.Info("API key authentication enabled", "keys", len(keys.names))
+	}
+	if *allowCIDR != "" {
+		allowlist, err := parseAllowlist(*allowCIDR)
+		if err != nil {
+			fatal("invalid allowlist", "err", err)
+		}
+		handler = allowlist.Wrap(handler)
+	}
+	handler = withErrorImages(handler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []*http.Server{{Addr: *addr, Handler: withRequestLog(handler), ReadHeaderTimeout: 10 * time.Second}}
+	if *adminAddr != "" {
+		servers = append(servers, &http.Server{Addr: *adminAddr, Handler: withRequestLog(admin), ReadHeaderTimeout: 10 * time.Second})
+	}
+	errs := make(chan error, len(servers)+1)
+	for _, srv := range servers {
+		go func() {
+			slog.Info("starting server", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+	if grpcServer != nil {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fatal("failed to listen for gRPC", "addr", *grpcAddr, "err", err)
+		}
+		go func() {
+			slog.Info("starting gRPC server", "addr", *grpcAddr)
+			if err := grpcServer.Serve(listener); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		fatal("server failed", "err", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting connections and let in-flight renders finish
+	slog.Info("shutting down, waiting for in-flight requests", "timeout", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown did not complete", "addr", srv.Addr, "err", err)
+		}
+	}
+	if grpcServer != nil {
+		// Calls in progress get what is left of the shutdown timeout
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+	if err := usage.Save(); err != nil {
+		slog.Error("failed to save usage", "err", err)
+	}
+	audit.Record("system", "server.stop", "", nil)
+}
+
+// Function to pick the default listen address from LISTEN_ADDR or PORT
+func defaultListenAddr() string {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+func (s *server) mapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("event") {
+		s.eventMapHandler(w, r)
+		return
+	}
+	s.serveMap(w, r, r.URL.Query(), s.maxAge)
+}
+
+// Function to render and send the map described by query, or 304 when the
+// client already holds it
+func (s *server) serveMap(w http.ResponseWriter, r *http.Request, query url.Values, maxAge int) {
+	s.serveAdjustedMap(w, r, query, maxAge, nil)
+}
+
+// Function to serve a map like serveMap, with its options changed by adjust,
+// when set, after they are parsed, such as to make a tile of it
+func (s *server) serveAdjustedMap(w http.ResponseWriter, r *http.Request, query url.Values, maxAge int, adjust func(*render.Options)) {
+	start := time.Now()
+	s, err := s.asOf(query)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	opts, err := ParseRenderOptions(query)
+	if err == nil {
+		err = s.checkPrefectureNames(query)
+	}
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	s.applyMap(opts)
+	if adjust != nil {
+		adjust(opts)
+	}
+	if err := s.checkUnknownIDs(w, r, query, opts); err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	debug, err := parseDebug(query.Get("debug"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	if debug == debugTimings {
+		s.serveTimings(w, r, opts, start)
+		return
+	}
+	format, err := parseMapFormat(query.Get("format"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	output, err := s.parseOutput(query.Get("output"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	if format != formatPNG {
+		if output != outputImage {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "output=url only applies to PNG maps")
+			return
+		}
+		switch format {
+		case formatHTML:
+			s.serveHTMLMap(w, r, opts, maxAge)
+			return
+		case formatAlt:
+			s.serveAltText(w, r, opts, maxAge)
+			return
+		}
+		s.serveHitRegions(w, r, opts, format, maxAge)
+		return
+	}
+	if err := parseDownload(query); err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	etag := optionsETag(s.assets, opts)
+	// Uploads answer with JSON, which is neither downloaded nor revalidated
+	if output == outputImage {
+		// Event maps name their event in X-Event-ID, and its time in
+		// X-Event-Time, before they get here
+		if disposition := contentDisposition(query, opts, w.Header().Get("X-Event-ID")); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		if notModified(w, r, etag, maxAge) {
+			return
+		}
+	}
+	serveCached := func(data []byte, id string) {
+		if output == outputURL {
+			s.serveUploaded(w, r, data, id)
+			return
+		}
+		setCacheHeaders(w, etag, maxAge)
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Image-ID", id)
+		w.Header().Set("X-Cache", "HIT")
+		w.Write(data)
+	}
+	// In maintenance, maps rendered before are still served; with a disk or
+	// Redis cache, they always are, and so are tiles, which map views ask for
+	// again and again
+	cacheKey := renderCacheKey(etag, w.Header().Get("X-Event-Time"))
+	if cacheOnly(r.Context()) || s.disk != nil || s.redis != nil || opts.Tile != nil {
+		data, id, ok := s.cachedMap(r.Context(), cacheKey)
+		if !ok && cacheOnly(r.Context()) {
+			maintenance.Reject(w, r, opts.Width, opts.Height)
+			return
+		}
+		if ok {
+			serveCached(data, id)
+			return
+		}
+	}
+	// Identical requests arriving while the map renders share its render,
+	// like cache hits
+	m, shared, err := renderFlights.Do(r.Context(), cacheKey, func(ctx context.Context) (renderedMap, error) {
+		return s.renderMap(ctx, opts, cacheKey, w.Header().Get("X-Event-Time"), r.URL.RawQuery, start)
+	})
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	switch {
+	case shared:
+		annotateRequest(r.Context(), "cache", "shared")
+		metrics.Add("canvas_renders_shared_total", "", 1)
+	case m.waited:
+		annotateRequest(r.Context(), "cache", "redis_wait")
+	default:
+		recordUsage(r.Context(), opts.Width*opts.Height)
+	}
+
+	w.Header().Set("X-Render-Backend", m.backend)
+	if output == outputURL {
+		s.serveUploaded(w, r, m.data, m.id)
+		return
+	}
+	setCacheHeaders(w, etag, maxAge)
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Image-ID", m.id)
+	w.Write(m.data)
+}
+
+// Function to render a map for serveMap, unless another instance is already
+// rendering it, and store it in every cache. rawQuery is shown on the status
+// dashboard.
+func (s *server) renderMap(ctx context.Context, opts *render.Options, cacheKey, eventTime, rawQuery string, start time.Time) (renderedMap, error) {
+	// Another instance rendering the same map is waited for
+	if s.redis != nil {
+		data, release := s.redis.Claim(ctx, cacheKey)
+		if data != nil {
+			return renderedMap{data: data, id: s.keepMap(ctx, cacheKey, data, "redis"), waited: true}, nil
+		}
+		defer release()
+	}
+
+	pngData, backend, err := s.render(ctx, opts)
+	if err != nil {
+		return renderedMap{}, err
+	}
+	pngData, err = withMetadata(pngData, optionsETag(s.assets, opts), eventTime)
+	if err != nil {
+		return renderedMap{}, &apiError{Status: http.StatusInternalServerError, Code: ErrRenderFailed, Message: err.Error()}
+	}
+
+	id := s.keepMap(ctx, cacheKey, pngData, "")
+	params, _ := url.QueryUnescape(rawQuery)
+	if len(params) > 160 {
+		params = strings.ToValidUTF8(params[:160], "") + "..."
+	}
+	dashboard.RecordRender(renderRecord{
+		Time:     start,
+		ImageID:  id,
+		Backend:  backend,
+		Params:   params,
+		Duration: time.Since(start),
+		Bytes:    len(pngData),
+	})
+	return renderedMap{data: pngData, id: id, backend: backend}, nil
+}
+
+// Function to get the key maps are cached under: the ETag of their options,
+// and the time of their event, which their metadata holds
+func renderCacheKey(etag, eventTime string) string {
+	if eventTime == "" {
+		return etag
+	}
+	return etag + "@" + eventTime
+}
+
+// Function to get a map rendered before from memory, else from the disk
+// cache, else from Redis, keeping it in the faster ones on the way
+func (s *server) cachedMap(ctx context.Context, key string) ([]byte, string, bool) {
+	if data, id, ok := s.images.Tagged(key); ok {
+		annotateRequest(ctx, "cache", "memory")
+		return data, id, true
+	}
+	if s.disk != nil {
+		if data, ok := s.disk.Get(key); ok {
+			annotateRequest(ctx, "cache", "disk")
+			return data, s.keepMap(ctx, key, data, "disk"), true
+		}
+	}
+	if s.redis != nil {
+		if data, ok := s.redis.Get(ctx, key); ok {
+			annotateRequest(ctx, "cache", "redis")
+			return data, s.keepMap(ctx, key, data, "redis"), true
+		}
+	}
+	return nil, "", false
+}
+
+// Function to keep a map in the image store and the caches faster than the
+// one it came from, "disk" or "redis", or every cache when it was just
+// rendered, and return its image ID
+func (s *server) keepMap(ctx context.Context, key string, data []byte, from string) string {
+	id := s.images.Put(data)
+	s.images.Tag(key, id)
+	if s.disk != nil && from != "disk" {
+		if err := s.disk.Put(key, data); err != nil {
+			requestLogger(ctx).Warn("failed to write disk cache", "err", err)
+		}
+	}
+	if s.redis != nil && from == "" {
+		if err := s.redis.Put(ctx, key, data); err != nil {
+			requestLogger(ctx).Warn("failed to write redis cache", "err", err)
+		}
+	}
+	return id
+}
+
+// Function to render the map described by the query parameters, returning
+// the PNG and the backend that drew it
+func (s *server) renderQuery(ctx context.Context, query url.Values) ([]byte, string, error) {
+	s, err := s.asOf(query)
+	if err != nil {
+		return nil, "", err
+	}
+	opts, err := ParseRenderOptions(query)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.checkPrefectureNames(query); err != nil {
+		return nil, "", err
+	}
+	s.applyMap(opts)
+	return s.render(ctx, opts)
+}
+
+// Function to apply the settings of the map to parsed options: its palette,
+// its style where the query gives none, and its projection unless the query
+// names one
+func (s *server) applyMap(opts *render.Options) {
+	opts.Palette = s.palette
+	opts.Style = opts.Style.Over(s.style)
+	if opts.Projection == "" {
+		opts.Projection = s.projection
+	}
+}
+
+// Function to render the map described by parsed options. Building the
+// scene takes every core, so it waits for a render slot like rasterizing.
+func (s *server) render(ctx context.Context, opts *render.Options) ([]byte, string, error) {
+	backend := opts.Backend
+	if backend == "" {
+		backend = s.rollout.Pick()
+	}
+	queued := opts.Timings.Start("queue")
+	release, err := s.pool.Acquire(ctx)
+	queued()
+	if err != nil {
+		return nil, backend, err
+	}
+	defer release()
+
+	scene := render.BuildScene(s.dataset, opts)
+	start := time.Now()
+	pngData, err := s.rollout.Render(backend, scene)
+	annotateRequest(ctx, "backend", backend, "render_duration", time.Since(start))
+	if err != nil {
+		return nil, backend, &apiError{Status: http.StatusInternalServerError, Code: ErrRenderFailed, Message: err.Error()}
+	}
+	return pngData, backend, nil
+}
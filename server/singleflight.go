@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Renders of /map in progress, by cache key, so identical requests arriving
+// together, as right after an earthquake, share one rasterization
+var renderFlights = &flightGroup{flights: make(map[string]*flight)}
+
+// Map rendered for a request, stored and ready to serve
+type renderedMap struct {
+	data    []byte
+	id      string
+	backend string
+	// Whether it came from another instance's render, through Redis
+	waited bool
+}
+
+// Renders in progress, by key. A render asked for while another with the
+// same key runs waits for its result instead of running again.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	m    renderedMap
+	err  error
+}
+
+// Do runs render for key, or waits for the run already in progress, and
+// reports whether the map was shared with it. The run does not stop when the
+// context of its caller ends, as others may be waiting for it; waiting
+// callers give up when theirs does.
+func (g *flightGroup) Do(ctx context.Context, key string, render func(context.Context) (renderedMap, error)) (renderedMap, bool, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.m, true, f.err
+		case <-ctx.Done():
+			return renderedMap{}, true, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{}), err: errors.New("render abandoned")}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.m, f.err = render(context.WithoutCancel(ctx))
+	return f.m, false, f.err
+}
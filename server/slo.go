@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Per-minute buckets are kept for the longest alerting window
+const sloBuckets = 6 * 60
+
+// Windows reported in the summary and as burn-rate gauges
+var sloWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// Multiwindow burn-rate alerts: both windows have to exceed the threshold
+var sloAlerts = []struct {
+	Name        string
+	Long, Short string
+	Threshold   float64
+}{
+	{"fast-burn", "1h", "5m", 14.4},
+	{"slow-burn", "6h", "30m", 6},
+}
+
+type sloBucket struct {
+	minute int64
+	total  uint64
+	good   uint64
+}
+
+type endpointSLO struct {
+	buckets [sloBuckets]sloBucket
+	firing  map[string]bool
+}
+
+// Tracks whether each endpoint answers successfully within the latency
+// target, e.g. "99% of maps within 5 seconds"
+type sloTracker struct {
+	mu        sync.Mutex
+	latency   time.Duration
+	objective float64
+	endpoints map[string]*endpointSLO
+}
+
+func newSLOTracker(latency time.Duration, objective float64) *sloTracker {
+	t := &sloTracker{
+		latency:   latency,
+		objective: objective,
+		endpoints: make(map[string]*endpointSLO),
+	}
+	metrics.Help("canvas_slo_burn_rate", "Error budget burn rate by endpoint and window.")
+	metrics.Help("canvas_slo_alert", "Whether a burn-rate alert is firing.")
+	metrics.OnCollect(t.collect)
+	return t
+}
+
+// statusWriter remembers the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Middleware counting good and bad requests for an endpoint. Client errors
+// do not consume the error budget.
+func (t *sloTracker) Wrap(endpoint string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		good := sw.status < 500 && time.Since(start) <= t.latency
+		t.record(endpoint, start, good)
+	})
+}
+
+func (t *sloTracker) record(endpoint string, at time.Time, good bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.endpoints[endpoint]
+	if e == nil {
+		e = &endpointSLO{firing: make(map[string]bool)}
+		t.endpoints[endpoint] = e
+	}
+
+	minute := at.Unix() / 60
+	b := &e.buckets[minute%sloBuckets]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+type sloWindowSummary struct {
+	Total     uint64  `json:"total"`
+	Good      uint64  `json:"good"`
+	ErrorRate float64 `json:"error_rate"`
+	BurnRate  float64 `json:"burn_rate"`
+}
+
+type sloEndpointSummary struct {
+	Windows map[string]sloWindowSummary `json:"windows"`
+	Alerts  []string                    `json:"alerts"`
+}
+
+type sloSummary struct {
+	Objective     float64                       `json:"objective"`
+	LatencyTarget float64                       `json:"latency_target_seconds"`
+	Endpoints     map[string]sloEndpointSummary `json:"endpoints"`
+}
+
+func (es sloEndpointSummary) firing(alert string) bool {
+	for _, a := range es.Alerts {
+		if a == alert {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to compute every window and alert; the caller holds t.mu
+func (t *sloTracker) summarize(now time.Time) sloSummary {
+	summary := sloSummary{
+		Objective:     t.objective,
+		LatencyTarget: t.latency.Seconds(),
+		Endpoints:     make(map[string]sloEndpointSummary),
+	}
+	budget := 1 - t.objective
+
+	for name, e := range t.endpoints {
+		es := sloEndpointSummary{Windows: make(map[string]sloWindowSummary), Alerts: []string{}}
+		for _, window := range sloWindows {
+			var ws sloWindowSummary
+			oldest := now.Unix()/60 - int64(window.Duration/time.Minute)
+			for _, b := range e.buckets {
+				if b.minute > oldest {
+					ws.Total += b.total
+					ws.Good += b.good
+				}
+			}
+			if ws.Total > 0 {
+				ws.ErrorRate = float64(ws.Total-ws.Good) / float64(ws.Total)
+				if budget > 0 {
+					ws.BurnRate = ws.ErrorRate / budget
+				}
+			}
+			es.Windows[window.Name] = ws
+		}
+		for _, alert := range sloAlerts {
+			if es.Windows[alert.Long].BurnRate > alert.Threshold && es.Windows[alert.Short].BurnRate > alert.Threshold {
+				es.Alerts = append(es.Alerts, alert.Name)
+			}
+		}
+		summary.Endpoints[name] = es
+	}
+	return summary
+}
+
+func (t *sloTracker) collect() {
+	t.mu.Lock()
+	summary := t.summarize(time.Now())
+	t.mu.Unlock()
+
+	for name, es := range summary.Endpoints {
+		for window, ws := range es.Windows {
+			metrics.Set("canvas_slo_burn_rate", labels("endpoint", name, "window", window), ws.BurnRate)
+		}
+		for _, alert := range sloAlerts {
+			firing := 0.0
+			if es.firing(alert.Name) {
+				firing = 1
+			}
+			metrics.Set("canvas_slo_alert", labels("endpoint", name, "alert", alert.Name), firing)
+		}
+	}
+}
+
+// Function to log alerts as they start and stop firing
+func (t *sloTracker) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.mu.Lock()
+		summary := t.summarize(time.Now())
+		for name, es := range summary.Endpoints {
+			e := t.endpoints[name]
+			for _, alert := range sloAlerts {
+				firing := es.firing(alert.Name)
+				if firing != e.firing[alert.Name] {
+					long, short := es.Windows[alert.Long], es.Windows[alert.Short]
+					if firing {
+						slog.Warn("SLO alert firing", "alert", alert.Name, "endpoint", name,
+							"burn_rate_"+alert.Long, long.BurnRate, "burn_rate_"+alert.Short, short.BurnRate)
+					} else {
+						slog.Info("SLO alert resolved", "alert", alert.Name, "endpoint", name)
+					}
+					e.firing[alert.Name] = firing
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *sloTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	summary := t.summarize(time.Now())
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(summary)
+}
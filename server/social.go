@@ -0,0 +1,186 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/geo"
+)
+
+// Images of a social media kit, at the sizes the networks crop to
+var socialImages = []struct {
+	Name          string
+	Width, Height int
+}{
+	{"card.png", 1200, 630},    // Open Graph and link previews
+	{"square.png", 1080, 1080}, // Feed posts
+	{"story.png", 1080, 1920},  // Stories and reels
+}
+
+// Intensities spelled out in the alt text, strongest first. Weaker ones are
+// only counted.
+const socialAltLevels = 3
+
+// Function to describe the map of an event for screen readers: the event,
+// then the prefectures of the strongest intensities
+func eventAltText(ev *quakeEvent) string {
+	var sb strings.Builder
+	sb.WriteString("Map of Japan with prefectures shaded by seismic intensity")
+	if ev.Magnitude > 0 {
+		fmt.Fprintf(&sb, " for the M%.1f earthquake", ev.Magnitude)
+	} else {
+		sb.WriteString(" for the earthquake")
+	}
+	if ev.Hypocenter != "" {
+		fmt.Fprintf(&sb, " near %s", ev.Hypocenter)
+	}
+	if !ev.Time.IsZero() {
+		fmt.Fprintf(&sb, " at %s JST", ev.Time.In(jst).Format("2006-01-02 15:04"))
+	}
+	sb.WriteString(".")
+
+	byScale := make(map[int][]string)
+	for _, p := range geo.Prefectures {
+		if scale, ok := ev.Intensities[p.Code]; ok && scale > 0 {
+			byScale[scale] = append(byScale[scale], p.Name)
+		}
+	}
+	scales := make([]int, 0, len(byScale))
+	for scale := range byScale {
+		scales = append(scales, scale)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(scales)))
+
+	rest := 0
+	for i, scale := range scales {
+		if i >= socialAltLevels {
+			rest += len(byScale[scale])
+			continue
+		}
+		if i == 0 {
+			fmt.Fprintf(&sb, " Maximum intensity %d in %s.", scale, strings.Join(byScale[scale], ", "))
+		} else {
+			fmt.Fprintf(&sb, " Intensity %d in %s.", scale, strings.Join(byScale[scale], ", "))
+		}
+	}
+	if rest > 0 {
+		fmt.Fprintf(&sb, " Lower intensities in %d more prefectures.", rest)
+	}
+	return sb.String()
+}
+
+// GET /social?event=<id>&publisher=&locale= returns a ZIP of what one post
+// of an event needs: its map cropped for a link card, a square post and a
+// story, with the alt text and caption. Without event, the latest earthquake
+// is used. The other /map parameters style every image.
+func (s *server) socialHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for _, k := range []string{"scale", "points", "width", "height", "size", "preset"} {
+		if query.Has(k) {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, "scale, points, width, height, size and preset cannot be given for /social")
+			return
+		}
+	}
+
+	maxAge := s.maxAge
+	var (
+		ev  *quakeEvent
+		err error
+	)
+	if id := query.Get("event"); id != "" {
+		ev, err = s.feed.Event(r.Context(), id)
+	} else {
+		ev, err = s.feed.Latest(r.Context())
+		maxAge = int(s.feed.ttl.Seconds())
+	}
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	annotateRequest(r.Context(), "event", ev.ID)
+
+	locale := query.Get("locale")
+	if locale == "" {
+		locale = "en"
+	}
+	caption, err := s.captions.Caption(query.Get("publisher"), locale, ev)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, ErrCaptionFailed, err.Error())
+		return
+	}
+
+	base, err := eventQuery(query, ev)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	for _, k := range []string{"event", "publisher", "locale"} {
+		base.Del(k)
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	modified := time.Now()
+	pixels := 0
+	for _, image := range socialImages {
+		q := url.Values{}
+		for k, v := range base {
+			q[k] = v
+		}
+		q.Set("width", strconv.Itoa(image.Width))
+		q.Set("height", strconv.Itoa(image.Height))
+
+		data, _, err := s.renderQuery(r.Context(), q)
+		if err != nil {
+			annotateRequest(r.Context(), "error", err.Error())
+			writeAPIError(w, err)
+			return
+		}
+		s.images.Put(data)
+		pixels += image.Width * image.Height
+
+		// PNGs are compressed already
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: image.Name, Method: zip.Store, Modified: modified})
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+	}
+	texts := []struct{ Name, Text string }{
+		{"alt.txt", eventAltText(ev)},
+		{"caption.txt", caption},
+	}
+	for _, text := range texts {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: text.Name, Method: zip.Deflate, Modified: modified})
+		if err == nil {
+			_, err = f.Write([]byte(text.Text + "\n"))
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+
+	recordUsage(r.Context(), pixels)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quake-%s-social.zip"`, ev.ID))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	w.Header().Set("X-Event-ID", ev.ID)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Function to list the maps a request asks for, as /map queries, for the
+// middleware that looks at every map before the handler runs: the maps of a
+// batch, or the query with the a_spec and b_spec of a diff. Specs that do not
+// parse are left to the handler to refuse.
+func renderQueries(r *http.Request) []url.Values {
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/map/batch":
+		body, err := peekBody(r, maxBatchBytes)
+		if err != nil {
+			return []url.Values{query}
+		}
+		entries, err := decodeBatch(body)
+		if err != nil {
+			return []url.Values{query}
+		}
+		queries := make([]url.Values, 0, len(entries))
+		for i, entry := range entries {
+			q, _, err := batchQuery(query, entry, i)
+			if err != nil {
+				return []url.Values{query}
+			}
+			queries = append(queries, q)
+		}
+		return queries
+	case r.URL.Path == "/diff":
+		queries := []url.Values{query}
+		for _, name := range []string{"a_spec", "b_spec"} {
+			if spec := query.Get(name); spec != "" {
+				if q, err := url.ParseQuery(spec); err == nil {
+					queries = append(queries, q)
+				}
+			}
+		}
+		return queries
+	}
+	return []url.Values{query}
+}
+
+// Function to read up to limit bytes of the body of a request, leaving the
+// whole body to be read again
+func peekBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	return data, err
+}
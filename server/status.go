@@ -0,0 +1,195 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of renders and errors kept for the dashboard
+const statusHistory = 20
+
+type renderRecord struct {
+	Time     time.Time
+	ImageID  string
+	Backend  string
+	Params   string
+	Duration time.Duration
+	Bytes    int
+}
+
+type errorRecord struct {
+	Time      time.Time
+	RequestID string
+	Path      string
+	Status    int
+	Message   string
+}
+
+// State of a live data feed, as reported by its client
+type feedState struct {
+	State   string
+	Detail  string
+	Updated time.Time
+}
+
+// Operator dashboard at /status: recent renders and errors, cache hit rates,
+// queue depth and feed connections
+type statusBoard struct {
+	started time.Time
+	pool    *renderPool
+
+	mu      sync.Mutex
+	renders []renderRecord
+	errors  []errorRecord
+	feeds   map[string]feedState
+}
+
+var dashboard = &statusBoard{started: time.Now(), feeds: make(map[string]feedState)}
+
+func (sb *statusBoard) RecordRender(rec renderRecord) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.renders = append(sb.renders, rec)
+	if len(sb.renders) > statusHistory {
+		sb.renders = sb.renders[1:]
+	}
+}
+
+func (sb *statusBoard) RecordError(rec errorRecord) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.errors = append(sb.errors, rec)
+	if len(sb.errors) > statusHistory {
+		sb.errors = sb.errors[1:]
+	}
+}
+
+// Function for feed clients to report their connection state
+func (sb *statusBoard) SetFeed(name, state, detail string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.feeds[name] = feedState{State: state, Detail: detail, Updated: time.Now()}
+}
+
+type cacheStats struct {
+	Name    string
+	Hits    float64
+	Total   float64
+	HitRate float64
+}
+
+type feedRow struct {
+	Name string
+	feedState
+}
+
+type statusPage struct {
+	Uptime   time.Duration
+	InFlight int
+	Capacity int
+	Queued   int64
+	Shed     float64
+	Caches   []cacheStats
+	Feeds    []feedRow
+	Renders  []renderRecord
+	Errors   []errorRecord
+}
+
+func cacheRate(name, metric, hit string) cacheStats {
+	c := cacheStats{Name: name, Hits: metrics.Counter(metric, hit), Total: metrics.Counter(metric, "")}
+	if c.Total > 0 {
+		c.HitRate = c.Hits / c.Total
+	}
+	return c
+}
+
+func (sb *statusBoard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page := statusPage{
+		Uptime: time.Since(sb.started).Round(time.Second),
+		Shed:   metrics.Counter("canvas_renders_shed_total", ""),
+		Caches: []cacheStats{
+			cacheRate("Thumbnails", "canvas_thumbnails_total", `result="hit"`),
+			cacheRate("Proxy", "canvas_proxy_requests_total", `result="hit"`),
+		},
+	}
+	if sb.pool != nil {
+		page.InFlight, page.Capacity, page.Queued = len(sb.pool.slots), cap(sb.pool.slots), sb.pool.waiting.Load()
+	}
+
+	sb.mu.Lock()
+	for i := len(sb.renders) - 1; i >= 0; i-- {
+		page.Renders = append(page.Renders, sb.renders[i])
+	}
+	for i := len(sb.errors) - 1; i >= 0; i-- {
+		page.Errors = append(page.Errors, sb.errors[i])
+	}
+	for name, feed := range sb.feeds {
+		page.Feeds = append(page.Feeds, feedRow{Name: name, feedState: feed})
+	}
+	sb.mu.Unlock()
+	sort.Slice(page.Feeds, func(i, j int) bool { return page.Feeds[i].Name < page.Feeds[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, page); err != nil {
+		requestLogger(r.Context()).Error("failed to render status page", "err", err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+	"clock":   func(t time.Time) string { return t.In(jst).Format("15:04:05") },
+	"ms":      func(d time.Duration) int64 { return d.Milliseconds() },
+	"kb":      func(n int) int { return (n + 512) / 1024 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Canvas status</title>
+<style>
+body { background: #18181b; color: #e4e4e7; font: 14px system-ui, sans-serif; margin: 2em; }
+h1 { font-size: 20px; } h2 { font-size: 16px; margin-top: 2em; color: #a1a1aa; }
+table { border-collapse: collapse; } td, th { padding: 4px 12px 4px 0; text-align: left; vertical-align: middle; }
+th { color: #a1a1aa; font-weight: 500; } .bad { color: #f87171; } .ok { color: #4ade80; }
+img { display: block; border: 1px solid #3f3f46; } code { color: #a1a1aa; }
+</style>
+</head>
+<body>
+<h1>Canvas status</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Renders in flight</th><td>{{.InFlight}} / {{.Capacity}}</td></tr>
+<tr><th>Queued</th><td>{{.Queued}}</td></tr>
+<tr><th>Shed since start</th><td{{if .Shed}} class="bad"{{end}}>{{.Shed}}</td></tr>
+</table>
+
+<h2>Caches</h2>
+<table>
+<tr><th>Cache</th><th>Hit rate</th><th>Hits</th><th>Requests</th></tr>
+{{range .Caches}}<tr><td>{{.Name}}</td><td>{{if .Total}}{{percent .HitRate}}{{else}}–{{end}}</td><td>{{.Hits}}</td><td>{{.Total}}</td></tr>
+{{end}}</table>
+
+<h2>Feeds</h2>
+{{if .Feeds}}<table>
+<tr><th>Feed</th><th>State</th><th>Detail</th><th>Updated (JST)</th></tr>
+{{range .Feeds}}<tr><td>{{.Name}}</td><td class="{{if eq .State "connected"}}ok{{else}}bad{{end}}">{{.State}}</td><td>{{.Detail}}</td><td>{{clock .Updated}}</td></tr>
+{{end}}</table>{{else}}<p>No live feeds configured.</p>{{end}}
+
+<h2>Recent renders</h2>
+{{if .Renders}}<table>
+<tr><th></th><th>Time (JST)</th><th>Backend</th><th>Duration</th><th>Size</th><th>Parameters</th></tr>
+{{range .Renders}}<tr><td><a href="/images/{{.ImageID}}"><img src="/images/{{.ImageID}}/thumb?w=160" width="160" alt=""></a></td><td>{{clock .Time}}</td><td>{{.Backend}}</td><td>{{ms .Duration}} ms</td><td>{{kb .Bytes}} KiB</td><td><code>{{.Params}}</code></td></tr>
+{{end}}</table>{{else}}<p>No renders yet.</p>{{end}}
+
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+<tr><th>Time (JST)</th><th>Status</th><th>Path</th><th>Request ID</th><th>Message</th></tr>
+{{range .Errors}}<tr><td>{{clock .Time}}</td><td class="bad">{{.Status}}</td><td>{{.Path}}</td><td><code>{{.RequestID}}</code></td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p>No errors.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// Summary periods. Both end at midnight JST: a daily summary covers the
+// day before, a weekly one the Monday to Sunday before.
+const (
+	summaryDaily  = "daily"
+	summaryWeekly = "weekly"
+)
+
+// How late after its period a summary is still published, so a replica
+// started mid-week does not post last week's summary again
+const summaryGrace = time.Hour
+
+// Function to check a summary period name
+func parseSummaryPeriod(period string) (string, error) {
+	switch period {
+	case summaryDaily, summaryWeekly:
+		return period, nil
+	}
+	return "", fmt.Errorf("invalid summary period: %q (must be daily or weekly)", period)
+}
+
+// Function to get the span of the period of the given kind ending at the
+// latest midnight JST at or before t, or for weekly summaries at the latest
+// Monday midnight
+func summaryWindow(period string, t time.Time) (from, to time.Time) {
+	t = t.In(jst)
+	to = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, jst)
+	if period == summaryWeekly {
+		to = to.AddDate(0, 0, -((int(to.Weekday()) + 6) % 7))
+		return to.AddDate(0, 0, -7), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+// Earthquakes of a period that reached an intensity, merged into one map
+type quakeSummary struct {
+	Period       string
+	From, To     time.Time
+	MinIntensity int
+	Events       []*quakeEvent // Oldest first
+	// Highest intensity per prefecture over the events
+	Intensities map[int]int
+}
+
+// Function to merge the events of a period into a summary. Events below
+// the minimum intensity are left out.
+func summarize(period string, from, to time.Time, minIntensity int, events []*quakeEvent) *quakeSummary {
+	summary := &quakeSummary{Period: period, From: from, To: to, MinIntensity: minIntensity, Intensities: make(map[int]int)}
+	for _, ev := range events {
+		if ev.MaxIntensity(nil) < minIntensity {
+			continue
+		}
+		summary.Events = append(summary.Events, ev)
+		for id, scale := range ev.Intensities {
+			summary.Intensities[id] = max(summary.Intensities[id], scale)
+		}
+	}
+	sort.Slice(summary.Events, func(i, j int) bool { return summary.Events[i].Time.Before(summary.Events[j].Time) })
+	return summary
+}
+
+// Function to describe the span of a summary, its last day inclusive
+func (sum *quakeSummary) span() string {
+	last := sum.To.Add(-time.Nanosecond).In(jst)
+	if sum.Period == summaryDaily {
+		return last.Format(time.DateOnly)
+	}
+	return sum.From.In(jst).Format(time.DateOnly) + " to " + last.Format(time.DateOnly)
+}
+
+// Function to describe the summary in the footer and in captions
+func (sum *quakeSummary) describe() string {
+	noun := "earthquakes"
+	if len(sum.Events) == 1 {
+		noun = "earthquake"
+	}
+	return fmt.Sprintf("%d %s of intensity %d or more, %s JST", len(sum.Events), noun, sum.MinIntensity, sum.span())
+}
+
+// Function to build the /map query of a summary: the highest intensity per
+// prefecture, and a cross on the epicenters of each hypocenter region,
+// labeled with its number of events when there are several. The strongest
+// event of a region places its cross.
+func (sum *quakeSummary) query() (url.Values, error) {
+	q := url.Values{}
+	intensities := make([]IntensityQuery, 0, len(sum.Intensities))
+	for _, p := range geo.Prefectures {
+		if scale, ok := sum.Intensities[p.Code]; ok {
+			intensities = append(intensities, IntensityQuery{ID: p.Code, Scale: scale})
+		}
+	}
+	scale, err := json.Marshal(intensities)
+	if err != nil {
+		return nil, err
+	}
+	q.Set("scale", string(scale))
+
+	type region struct {
+		strongest *quakeEvent
+		count     int
+	}
+	var names []string
+	regions := make(map[string]*region)
+	for _, ev := range sum.Events {
+		// p2pquake gives -200 for unknown epicenters
+		if ev.Latitude < -90 || ev.Latitude > 90 || ev.Longitude < -180 || ev.Longitude > 180 || (ev.Latitude == 0 && ev.Longitude == 0) {
+			continue
+		}
+		name := ev.Hypocenter
+		if name == "" {
+			name = ev.ID
+		}
+		r, ok := regions[name]
+		if !ok {
+			r = &region{}
+			regions[name] = r
+			names = append(names, name)
+		}
+		r.count++
+		if r.strongest == nil || ev.MaxIntensity(nil) > r.strongest.MaxIntensity(nil) ||
+			(ev.MaxIntensity(nil) == r.strongest.MaxIntensity(nil) && ev.Magnitude > r.strongest.Magnitude) {
+			r.strongest = ev
+		}
+	}
+	if len(names) > render.MAX_MARKERS {
+		names = names[:render.MAX_MARKERS]
+	}
+	markers := make([]MarkerQuery, 0, len(names))
+	for _, name := range names {
+		r := regions[name]
+		m := MarkerQuery{Lat: &r.strongest.Latitude, Lon: &r.strongest.Longitude, Icon: render.IconCross, Color: "#ef4444"}
+		if r.count > 1 {
+			m.Label = "×" + strconv.Itoa(r.count)
+		}
+		markers = append(markers, m)
+	}
+	if len(markers) > 0 {
+		data, err := json.Marshal(markers)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("markers", string(data))
+	}
+	q.Set("footer", sum.describe()+"  Source: P2PQuake")
+	return q, nil
+}
+
+// Function to describe a summary as an event for the publishers: its
+// strongest shaking, largest magnitude and any tsunami, at the start of the
+// period
+func (sum *quakeSummary) event() *quakeEvent {
+	ev := &quakeEvent{
+		ID:          "summary-" + sum.Period + "-" + sum.From.In(jst).Format("20060102"),
+		Time:        sum.From,
+		Latitude:    -200,
+		Longitude:   -200,
+		Intensities: sum.Intensities,
+	}
+	for _, e := range sum.Events {
+		ev.Magnitude = max(ev.Magnitude, e.Magnitude)
+		ev.Tsunami = ev.Tsunami || e.Tsunami
+	}
+	return ev
+}
+
+// Function to write the caption of a summary. Event caption templates
+// describe a single earthquake, so summaries have their own.
+func (sum *quakeSummary) caption(locale string) string {
+	top := 0
+	for _, scale := range sum.Intensities {
+		top = max(top, scale)
+	}
+	if locale == "ja" {
+		kind := "地震"
+		if sum.Period == summaryWeekly {
+			kind = "1週間の地震"
+		}
+		return fmt.Sprintf("%sのまとめ（%s）：震度%d以上の地震%d回、最大震度%d。", kind, sum.span(), sum.MinIntensity, len(sum.Events), top)
+	}
+	title := "Daily"
+	if sum.Period == summaryWeekly {
+		title = "Weekly"
+	}
+	return fmt.Sprintf("%s summary: %s. Maximum intensity %d.", title, sum.describe(), top)
+}
+
+// Scheduled summaries of the earthquakes of each day or week, rendered
+// after the period ends and handed to publishers like single events
+type summaryScheduler struct {
+	pipeline     *eventPipeline
+	periods      []string
+	minIntensity int
+	publishers   []string
+}
+
+// Function to build the summary of a period from the feed
+func (s *server) buildSummary(ctx context.Context, period string, from, to time.Time, minIntensity int) (*quakeSummary, error) {
+	events, err := s.feed.Between(ctx, from, to, minIntensity)
+	if err != nil {
+		return nil, err
+	}
+	return summarize(period, from, to, minIntensity, events), nil
+}
+
+// Function to check every minute whether a period has just ended, and
+// publish its summary. Each summary is claimed like an event, so one
+// replica publishes it.
+func (sch *summaryScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, period := range sch.periods {
+			from, to := summaryWindow(period, now)
+			if now.Sub(to) > summaryGrace {
+				continue
+			}
+			if err := sch.publish(ctx, period, from, to); err != nil {
+				slog.Error("failed to publish summary", "period", period, "from", from, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Function to render and publish the summary of one period unless another
+// run already did. Periods without events are not published.
+func (sch *summaryScheduler) publish(ctx context.Context, period string, from, to time.Time) error {
+	job := "summary:" + period + ":" + from.In(jst).Format(time.DateOnly)
+	claimed, err := jobLocks.Claim(job, pipelineLease)
+	if err != nil || !claimed {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, pipelineLease)
+	defer cancel()
+
+	s := sch.pipeline.server
+	sum, err := s.buildSummary(ctx, period, from, to, sch.minIntensity)
+	if err != nil {
+		// The lease is left to expire, so the next tick can retry
+		return err
+	}
+	if len(sum.Events) == 0 {
+		slog.Info("no earthquakes to summarize", "period", period, "span", sum.span())
+		return jobLocks.Done(job)
+	}
+	query, err := sum.query()
+	if err != nil {
+		return err
+	}
+	image, backend, err := s.renderQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("render failed: %w", err)
+	}
+	id := s.images.Put(image)
+
+	ev := sum.event()
+	caption := sum.caption(sch.pipeline.locale)
+	var published, failed []string
+	for _, name := range sch.publishers {
+		pub, ok := sch.pipeline.publishers[name]
+		if !ok {
+			slog.Warn("no such publisher, skipping", "summary", ev.ID, "publisher", name)
+			failed = append(failed, name)
+			continue
+		}
+		if err := pub.Publish(ctx, ev, image, caption); err != nil {
+			slog.Error("failed to publish summary", "summary", ev.ID, "publisher", name, "err", err)
+			failed = append(failed, name)
+			continue
+		}
+		published = append(published, name)
+	}
+
+	slog.Info("published summary", "summary", ev.ID, "events", len(sum.Events), "image_id", id, "backend", backend,
+		"published", published, "failed", failed)
+	s.audit.Record("pipeline", "summary.publish", ev.ID, map[string]string{
+		"events":    strconv.Itoa(len(sum.Events)),
+		"image_id":  id,
+		"published": strings.Join(published, ","),
+		"failed":    strings.Join(failed, ","),
+	})
+	return jobLocks.Done(job)
+}
+
+// GET /summary renders the summary of a past day or week, as the scheduler
+// would publish it: period=daily or weekly, end= the date the period ends
+// on (default: the latest), and min_intensity= (default 1). Every /map
+// parameter except scale, points, values and markers is accepted.
+func (s *server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for _, name := range []string{"scale", "points", "values", "markers"} {
+		if query.Has(name) {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, name+" cannot be given for /summary")
+			return
+		}
+	}
+	period, err := parseSummaryPeriod(cmp.Or(query.Get("period"), summaryDaily))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, err.Error())
+		return
+	}
+	end := time.Now()
+	if v := query.Get("end"); v != "" {
+		day, err := time.ParseInLocation(time.DateOnly, v, jst)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid end: %s (must be YYYY-MM-DD)", v))
+			return
+		}
+		end = day
+	}
+	minIntensity := 1
+	if v := query.Get("min_intensity"); v != "" {
+		if minIntensity, err = strconv.Atoi(v); err != nil || minIntensity < 1 || minIntensity > 7 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, fmt.Sprintf("Invalid min_intensity: %s (must be 1 to 7)", v))
+			return
+		}
+	}
+
+	from, to := summaryWindow(period, end)
+	sum, err := s.buildSummary(r.Context(), period, from, to, minIntensity)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if len(sum.Events) == 0 {
+		writeError(w, http.StatusNotFound, ErrEventNotFound, "No "+strings.TrimPrefix(sum.describe(), "0 "))
+		return
+	}
+	q, err := sum.query()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for _, name := range []string{"period", "end", "min_intensity"} {
+		query.Del(name)
+	}
+	for k, v := range query {
+		q[k] = v
+	}
+	annotateRequest(r.Context(), "summary", period, "events", len(sum.Events))
+	// A period that has ended does not change, but the feed may still add
+	// late reports for a while. serveMap counts the render towards the usage
+	// of the API key.
+	s.serveMap(w, r, q, s.maxAge)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// Side of a tile in pixels, doubled for the @2x tiles of high-density screens
+const tileSize = 256
+
+// Parameters of /map that tiles decide themselves: the tile sets the view and
+// size, and tiles carry no banner, logo, or other format
+var tileFixedParams = []string{
+	"width", "height", "size", "preset", "bbox", "extent", "projection", "margin", "min_span", "insets",
+	"title", "subtitle", "logo", "logo_opacity", "format", "output",
+}
+
+// Function to parse the path of a tile, {z}/{x}/{y}.png or {z}/{x}/{y}@2x.png,
+// into the tile and its pixel density
+func parseTilePath(z, x, y string) (geo.Tile, int, error) {
+	name, ok := strings.CutSuffix(y, ".png")
+	if !ok {
+		return geo.Tile{}, 0, invalidParam(ErrInvalidTile, "Invalid tile: %s/%s/%s (must be {z}/{x}/{y}.png or {z}/{x}/{y}@2x.png)", z, x, y)
+	}
+	density := 1
+	if name, ok = strings.CutSuffix(name, "@2x"); ok {
+		density = 2
+	}
+	var tile geo.Tile
+	var errZ, errX, errY error
+	tile.Z, errZ = strconv.Atoi(z)
+	tile.X, errX = strconv.Atoi(x)
+	tile.Y, errY = strconv.Atoi(name)
+	if errZ != nil || errX != nil || errY != nil {
+		return geo.Tile{}, 0, invalidParam(ErrInvalidTile, "Invalid tile: %s/%s/%s (must be {z}/{x}/{y}.png or {z}/{x}/{y}@2x.png)", z, x, y)
+	}
+	if err := tile.Validate(); err != nil {
+		return geo.Tile{}, 0, invalidParam(ErrInvalidTile, "%v", err)
+	}
+	return tile, density, nil
+}
+
+// GET /tiles/{z}/{x}/{y}.png renders the map as a web map tile, to lay over
+// Leaflet or MapLibre. The map is given as on /map, or by event, where
+// event=latest is the most recent earthquake. Tiles go through the same
+// caches as maps.
+func (s *server) tileHandler(w http.ResponseWriter, r *http.Request) {
+	tile, density, err := parseTilePath(r.PathValue("z"), r.PathValue("x"), r.PathValue("y"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	for _, name := range tileFixedParams {
+		if query.Has(name) {
+			writeError(w, http.StatusBadRequest, ErrInvalidQuery, name+" cannot be given for tiles")
+			return
+		}
+	}
+	annotateRequest(r.Context(), "tile", strconv.Itoa(tile.Z)+"/"+strconv.Itoa(tile.X)+"/"+strconv.Itoa(tile.Y))
+
+	adjust := func(opts *render.Options) {
+		opts.Tile = &tile
+		opts.Width, opts.Height = tileSize*density, tileSize*density
+		// Strokes and markers keep the size they have on a full map on screen
+		opts.Multiplier = float64(density)
+		if !query.Has("layers") {
+			// The scale values and footer are left to the page
+			opts.Layers = withoutLayer(opts.Layers, render.LayerLabels)
+		}
+	}
+	id := query.Get("event")
+	if id == "" {
+		s.serveAdjustedMap(w, r, query, s.maxAge, adjust)
+		return
+	}
+	if query.Has("scale") || query.Has("points") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "scale or points cannot be given with event")
+		return
+	}
+	var ev *quakeEvent
+	maxAge := s.maxAge
+	if id == "latest" {
+		ev, err = s.feed.Latest(r.Context())
+		// Tiles of a newer event must not be mixed with those cached
+		maxAge = int(s.feed.ttl.Seconds())
+	} else {
+		ev, err = s.feed.Event(r.Context(), id)
+	}
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	s.serveEvent(w, r, ev, maxAge, adjust)
+}
+
+// Function to drop a layer from a stack, the default stack when nil
+func withoutLayer(layers []render.Layer, name string) []render.Layer {
+	if layers == nil {
+		layers = render.DefaultLayers
+	}
+	var kept []render.Layer
+	for _, layer := range layers {
+		if layer.Name != name {
+			kept = append(kept, layer)
+		}
+	}
+	return kept
+}
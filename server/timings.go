@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"canvas/render"
+)
+
+// Debug mode of a render that reports where its time went instead of
+// sending the image
+const debugTimings = "timings"
+
+type timingStage struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// Memory of the process during a render. Other requests served at the same
+// time are counted too.
+type timingMemory struct {
+	Allocated   uint64 `json:"allocated_bytes"`
+	Allocations uint64 `json:"allocations"`
+	HeapInUse   uint64 `json:"heap_in_use_bytes"`
+	GCs         uint32 `json:"gc_cycles"`
+}
+
+type timingsReport struct {
+	Backend  string        `json:"backend"`
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	Duration float64       `json:"duration_ms"`
+	Stages   []timingStage `json:"stages"`
+	Memory   timingMemory  `json:"memory"`
+	Bytes    int           `json:"bytes"`
+}
+
+// Function to parse the debug parameter of a render
+func parseDebug(value string) (string, error) {
+	if value != "" && value != debugTimings {
+		return "", invalidParam(ErrInvalidQuery, "Invalid debug: %s (must be timings)", value)
+	}
+	return value, nil
+}
+
+// Function to render the map of parsed options and send the time spent in
+// each stage, with the memory allocated, instead of the image. The render
+// skips the cache, so it is timed in full, and is refused in maintenance.
+// Parsing started at start.
+func (s *server) serveTimings(w http.ResponseWriter, r *http.Request, opts *render.Options, start time.Time) {
+	if cacheOnly(r.Context()) {
+		maintenance.Reject(w, r, opts.Width, opts.Height)
+		return
+	}
+	opts.Timings = &render.Timings{}
+	parsed := time.Since(start)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	pngData, backend, err := s.render(r.Context(), opts)
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	runtime.ReadMemStats(&after)
+
+	report := timingsReport{
+		Backend:  backend,
+		Width:    opts.Width,
+		Height:   opts.Height,
+		Duration: milliseconds(time.Since(start)),
+		Stages:   []timingStage{{Name: "parse", Duration: milliseconds(parsed)}},
+		Memory: timingMemory{
+			Allocated:   after.TotalAlloc - before.TotalAlloc,
+			Allocations: after.Mallocs - before.Mallocs,
+			HeapInUse:   after.HeapInuse,
+			GCs:         after.NumGC - before.NumGC,
+		},
+		Bytes: len(pngData),
+	}
+	for _, stage := range opts.Timings.Stages() {
+		report.Stages = append(report.Stages, timingStage{Name: stage.Name, Duration: milliseconds(stage.Duration)})
+	}
+	annotateRequest(r.Context(), "debug", debugTimings, "allocated_bytes", report.Memory.Allocated)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Function to express a duration in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"canvas/geo"
+	"canvas/render"
+)
+
+// Function to list the IDs of scale and values that no feature of the map
+// has, in order
+func unknownIDs(dataset *geo.Dataset, opts *render.Options) []int {
+	var unknown []int
+	for id := range opts.ScaleMap {
+		if !dataset.HasID(id) {
+			unknown = append(unknown, id)
+		}
+	}
+	for id := range opts.Values {
+		if !dataset.HasID(id) {
+			unknown = append(unknown, id)
+		}
+	}
+	slices.Sort(unknown)
+	return slices.Compact(unknown)
+}
+
+// Function to report the IDs of a map that match no feature, which are
+// drawn as nothing: in X-Unknown-IDs, or as an error with strict=true
+func (s *server) checkUnknownIDs(w http.ResponseWriter, r *http.Request, query url.Values, opts *render.Options) error {
+	unknown := unknownIDs(s.dataset, opts)
+	if len(unknown) == 0 {
+		return nil
+	}
+	ids := make([]string, len(unknown))
+	for i, id := range unknown {
+		ids[i] = strconv.Itoa(id)
+	}
+	annotateRequest(r.Context(), "unknown_ids", strings.Join(ids, ","))
+	if query.Get("strict") == "true" {
+		param := "values"
+		for _, id := range unknown {
+			if _, ok := opts.ScaleMap[id]; ok {
+				param = "scale"
+				break
+			}
+		}
+		return &apiError{Status: http.StatusBadRequest, Code: ErrUnknownIDs, Param: param,
+			Message: "Unknown IDs in " + param + ": " + strings.Join(ids, ", ") + " (no feature of the map has them)"}
+	}
+	w.Header().Set("X-Unknown-IDs", strings.Join(ids, ","))
+	return nil
+}
+
+// Function to refuse prefecture names in the scale of a map whose features
+// are not the prefectures, where their codes would pick unrelated features
+func (s *server) checkPrefectureNames(query url.Values) error {
+	if s.prefectures {
+		return nil
+	}
+	if names := prefectureNames(query); len(names) > 0 {
+		return invalidParam(ErrInvalidScale, "Invalid scale: %q names a prefecture, but the features of this map are not prefectures (use their numeric IDs)", names[0])
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"canvas/geo"
+)
+
+// Limits of an uploaded map, so one request cannot hold a render slot for
+// long. Renders of uploads use the full geometry, as nothing is simplified
+// ahead of time.
+const (
+	maxUploadFeatures = 2000
+	maxUploadVertices = 500000
+)
+
+// POST /map renders a map of the features in the body, a GeoJSON
+// FeatureCollection or a TopoJSON topology, with the /map parameters in the
+// query. id_property names the property matched against the ids of scale
+// or values (default "id"), crs the CRS of the coordinates, and object the
+// object of a topology.
+func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("event") || query.Has("asof") {
+		writeError(w, http.StatusBadRequest, ErrInvalidQuery, "event and asof cannot be given with an uploaded map")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxUpload))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, ErrPayloadTooLarge, fmt.Sprintf("Map too large (at most %d bytes)", s.maxUpload))
+			return
+		}
+		writeError(w, http.StatusBadRequest, ErrInvalidGeoJSON, fmt.Sprintf("Failed to read map: %v", err))
+		return
+	}
+
+	dataset, err := parseUpload(body, query.Get("id_property"), query.Get("crs"), query.Get("object"))
+	if err != nil {
+		annotateRequest(r.Context(), "error", err.Error())
+		writeAPIError(w, err)
+		return
+	}
+	annotateRequest(r.Context(), "upload_bytes", len(body), "upload_features", len(dataset.Full.Features))
+
+	// The map is fingerprinted by its bytes and how they are read
+	sum := sha256.Sum256(body)
+	c := *s
+	c.dataset, c.palette, c.snapshots, c.prefectures = dataset, nil, nil, false
+	c.assets = "upload-" + hex.EncodeToString(sum[:8]) + "-" + query.Get("id_property") + "-" + query.Get("crs") + "-" + query.Get("object") + "-" + s.assets
+	c.serveMap(w, r, query, 0)
+}
+
+// Function to read and check an uploaded map
+func parseUpload(data []byte, idProperty, crsName, object string) (*geo.Dataset, error) {
+	// A crs member of the file applies unless crs is given
+	var crs geo.CRS
+	if crsName != "" {
+		var err error
+		if crs, err = geo.ParseCRS(crsName); err != nil {
+			return nil, invalidParam(ErrInvalidQuery, "Invalid crs: %s (must be wgs84, jgd2011, jgd2000 or tokyo, or their EPSG code)", crsName)
+		}
+	}
+	dataset, err := geo.Parse(data, geo.LoadOptions{Object: object, IDProperty: idProperty, CRS: crs})
+	if err != nil {
+		return nil, invalidParam(ErrInvalidGeoJSON, "%v", err)
+	}
+
+	features := dataset.Full.Features
+	if len(features) == 0 || len(features) > maxUploadFeatures {
+		return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: %d features (must be between 1 and %d)", len(features), maxUploadFeatures)
+	}
+	ids := make(map[float64]bool, len(features))
+	vertices := 0
+	for i, feature := range features {
+		switch feature.Geometry.Type {
+		case "Polygon", "MultiPolygon":
+		default:
+			return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: feature %d is a %s (must be Polygon or MultiPolygon)", i, feature.Geometry.Type)
+		}
+		id := feature.Properties["id"].(float64)
+		if ids[id] {
+			return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: two features have the ID %g", id)
+		}
+		ids[id] = true
+		for _, ring := range geo.FeatureRings(feature) {
+			if len(ring) < 4 {
+				return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: feature %d has a ring of %d points (at least 4)", i, len(ring))
+			}
+			for _, coord := range ring {
+				if len(coord) < 2 || coord[0] < -180 || coord[0] > 180 || coord[1] < -90 || coord[1] > 90 {
+					return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: feature %d has coordinates out of range", i)
+				}
+			}
+			vertices += len(ring)
+		}
+	}
+	if vertices > maxUploadVertices {
+		return nil, invalidParam(ErrInvalidGeoJSON, "Invalid map: %d vertices (at most %d)", vertices, maxUploadVertices)
+	}
+	return dataset, nil
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Name usage is counted under when the server has no API keys
+const anonymousKey = "anonymous"
+
+// Renders and output pixels of one API key in the current month
+type keyUsage struct {
+	Renders int64 `json:"renders"`
+	Pixels  int64 `json:"pixels"`
+}
+
+// Monthly usage per API key, with optional hard quotas. Months are calendar
+// months in UTC. Counts are kept per replica, and in a file when one is
+// given, so they survive restarts.
+type usageTracker struct {
+	renderQuota, pixelQuota int64 // Zero for no quota
+	path                    string
+
+	mu    sync.Mutex
+	month string
+	keys  map[string]*keyUsage
+	dirty bool
+}
+
+// On-disk form of the tracker
+type usageFile struct {
+	Month string               `json:"month"`
+	Keys  map[string]*keyUsage `json:"keys"`
+}
+
+func newUsageTracker(renderQuota, pixelQuota int64, path string) (*usageTracker, error) {
+	if renderQuota < 0 || pixelQuota < 0 {
+		return nil, fmt.Errorf("quotas must not be negative")
+	}
+	u := &usageTracker{renderQuota: renderQuota, pixelQuota: pixelQuota, path: path,
+		month: usageMonth(time.Now()), keys: make(map[string]*keyUsage)}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read usage: %w", err)
+		default:
+			var saved usageFile
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("invalid usage file %s: %w", path, err)
+			}
+			if saved.Month == u.month && saved.Keys != nil {
+				u.keys = saved.Keys
+			}
+		}
+	}
+	metrics.Help("canvas_usage_renders_total", "Renders counted towards the monthly usage, by API key.")
+	metrics.Help("canvas_usage_pixels_total", "Output pixels counted towards the monthly usage, by API key.")
+	metrics.Help("canvas_quota_exceeded_total", "Requests rejected by the monthly quotas, by API key.")
+	return u, nil
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Function to start a new month once the current one is over; called with
+// the lock held
+func (u *usageTracker) rollover(now time.Time) {
+	if month := usageMonth(now); month != u.month {
+		u.month = month
+		u.keys = make(map[string]*keyUsage)
+		u.dirty = true
+	}
+}
+
+// Function to get the usage of a key this month, with the month
+func (u *usageTracker) Get(key string) (keyUsage, string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(time.Now())
+	if usage := u.keys[key]; usage != nil {
+		return *usage, u.month
+	}
+	return keyUsage{}, u.month
+}
+
+// Function to count a render of the given output size
+func (u *usageTracker) Record(key string, pixels int64) {
+	u.mu.Lock()
+	u.rollover(time.Now())
+	usage := u.keys[key]
+	if usage == nil {
+		usage = &keyUsage{}
+		u.keys[key] = usage
+	}
+	usage.Renders++
+	usage.Pixels += pixels
+	u.dirty = true
+	u.mu.Unlock()
+
+	metrics.Add("canvas_usage_renders_total", labels("key", key), 1)
+	metrics.Add("canvas_usage_pixels_total", labels("key", key), float64(pixels))
+}
+
+// Function to check a key against the quotas, returning the error to reject
+// its request with once either is used up
+func (u *usageTracker) Check(key string) error {
+	usage, _ := u.Get(key)
+	var exceeded string
+	switch {
+	case u.renderQuota > 0 && usage.Renders >= u.renderQuota:
+		exceeded = fmt.Sprintf("%d renders", u.renderQuota)
+	case u.pixelQuota > 0 && usage.Pixels >= u.pixelQuota:
+		exceeded = fmt.Sprintf("%d pixels", u.pixelQuota)
+	default:
+		return nil
+	}
+	now := time.Now().UTC()
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return &apiError{
+		Status:     http.StatusTooManyRequests,
+		Code:       ErrQuotaExceeded,
+		Message:    fmt.Sprintf("Monthly quota of %s exceeded, resets at %s", exceeded, next.Format(time.RFC3339)),
+		RetryAfter: next.Sub(now),
+	}
+}
+
+// Function to write the counts to the usage file when they changed, through
+// a temporary file so a crash never leaves it half written
+func (u *usageTracker) Save() error {
+	u.mu.Lock()
+	if u.path == "" || !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(usageFile{Month: u.month, Keys: u.keys})
+	u.dirty = false
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), ".usage-*")
+	if err != nil {
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	return os.Rename(tmp.Name(), u.path)
+}
+
+type usageKey struct{}
+
+// Usage meter of one request; the handler reports what it rendered
+type usageMeter struct {
+	tracker *usageTracker
+	key     string
+}
+
+// Function to count a successful render towards the usage of the request's
+// API key. Requests outside of the usage middleware are not counted.
+func recordUsage(ctx context.Context, pixels int) {
+	if meter, ok := ctx.Value(usageKey{}).(*usageMeter); ok {
+		meter.tracker.Record(meter.key, int64(pixels))
+	}
+}
+
+// Middleware rejecting the requests of keys over their quota, and letting
+// the handler count the renders of the others
+func (u *usageTracker) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyName(r.Context())
+		if err := u.Check(key); err != nil {
+			metrics.Add("canvas_quota_exceeded_total", labels("key", key), 1)
+			annotateRequest(r.Context(), "error", err.Error())
+			writeAPIError(w, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), usageKey{}, &usageMeter{tracker: u, key: key})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type usageResponse struct {
+	Key     string `json:"key"`
+	Month   string `json:"month"`
+	Renders int64  `json:"renders"`
+	Pixels  int64  `json:"pixels"`
+	Quota   struct {
+		Renders int64 `json:"renders,omitempty"`
+		Pixels  int64 `json:"pixels,omitempty"`
+	} `json:"quota"`
+}
+
+// GET /usage reports the usage of the caller's API key this month
+func (u *usageTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := apiKeyName(r.Context())
+	usage, month := u.Get(key)
+	body := usageResponse{Key: key, Month: month, Renders: usage.Renders, Pixels: usage.Pixels}
+	body.Quota.Renders, body.Quota.Pixels = u.renderQuota, u.pixelQuota
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"canvas/i18n"
+	"canvas/render"
+)
+
+// Attempts of a webhook delivery before it fails, and the wait before the
+// first retry, doubled after each
+const (
+	webhookAttempts = 3
+	webhookBackoff  = 2 * time.Second
+)
+
+// Kinds of webhooks
+const (
+	webhookGeneric = "generic" // multipart/form-data of the event and image
+	webhookDiscord = "discord" // A Discord message with the image attached
+)
+
+// Largest Discord message
+const discordMaxContent = 2000
+
+// Destination POSTed the map of every event the publishing rules send to
+// its name. With a secret, the body is signed as /ingest expects it:
+// HMAC-SHA256 in X-Signature-256: sha256=<hex>. Discord webhooks post a
+// message instead, to a webhook URL or, with a bot token, to the messages
+// of a channel.
+type webhookPublisher struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	URL    string `json:"url"`              // May be a secret reference, as Discord webhook URLs hold a token
+	Secret string `json:"secret,omitempty"` // Secret reference, such as env:HOOK_SECRET
+	Token  string `json:"token,omitempty"`  // Discord bot token, or a secret reference to it
+	Lang   string `json:"lang,omitempty"`   // Language of the Discord embed
+
+	url    string
+	secret []byte
+	token  string
+}
+
+// Function to load the webhooks file, with each webhook as a publisher
+// under its name
+func loadWebhooks(path string) (map[string]publisher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks: %w", err)
+	}
+	var file struct {
+		Webhooks []*webhookPublisher `json:"webhooks"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks: %w", err)
+	}
+
+	hooks := make(map[string]publisher, len(file.Webhooks))
+	for i, hook := range file.Webhooks {
+		if hook.Name == "" {
+			return nil, fmt.Errorf("webhook %d: name is required", i+1)
+		}
+		if _, ok := hooks[hook.Name]; ok {
+			return nil, fmt.Errorf("webhook %s: another webhook has this name", hook.Name)
+		}
+		switch hook.Type {
+		case "":
+			hook.Type = webhookGeneric
+		case webhookGeneric, webhookDiscord:
+		default:
+			return nil, fmt.Errorf("webhook %s: invalid type %q (must be generic or discord)", hook.Name, hook.Type)
+		}
+		if hook.Type != webhookDiscord && (hook.Token != "" || hook.Lang != "") {
+			return nil, fmt.Errorf("webhook %s: token and lang only apply to discord webhooks", hook.Name)
+		}
+		if hook.Lang, err = i18n.Parse(hook.Lang); err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", hook.Name, err)
+		}
+		if hook.url, err = resolveSecret(hook.URL); err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", hook.Name, err)
+		}
+		u, err := url.Parse(hook.url)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("webhook %s: invalid url (must be an http or https URL)", hook.Name)
+		}
+		if hook.Token != "" {
+			if hook.token, err = resolveSecret(hook.Token); err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", hook.Name, err)
+			}
+		}
+		if hook.Secret != "" {
+			secret, err := resolveSecret(hook.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", hook.Name, err)
+			}
+			hook.secret = []byte(secret)
+		}
+		hooks[hook.Name] = hook
+	}
+	return hooks, nil
+}
+
+// Publish POSTs the event and its map as multipart/form-data, as a Discord
+// message on Discord webhooks. Network errors and 429 or 5xx responses are
+// retried, after the Retry-After of the response if it is longer.
+func (hook *webhookPublisher) Publish(ctx context.Context, ev *quakeEvent, image []byte, caption string) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var err error
+	if hook.Type == webhookDiscord {
+		err = writeDiscordMessage(mw, ev, image, caption, hook.Lang)
+	} else {
+		err = writeWebhookEvent(mw, ev, image, caption)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	delay := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, retry, err := hook.post(ctx, ev, body.Bytes(), mw.FormDataContentType())
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(max(delay, retryAfter)):
+		}
+		delay *= 2
+	}
+}
+
+// Function to write the parts of a generic webhook: an "event" part of JSON
+// with the event and its caption, and an "image" part with the PNG
+func writeWebhookEvent(mw *multipart.Writer, ev *quakeEvent, image []byte, caption string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="event"`)
+	header.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	payload := struct {
+		Event   *quakeEvent `json:"event"`
+		Caption string      `json:"caption"`
+	}{ev, caption}
+	if err := json.NewEncoder(part).Encode(payload); err != nil {
+		return err
+	}
+	return writeWebhookImage(mw, "image", ev, image)
+}
+
+// Function to write a Discord message: the caption as its content, and an
+// embed of the event showing the map, which is uploaded with the message
+// rather than linked, so the server needs no public URL
+func writeDiscordMessage(mw *multipart.Writer, ev *quakeEvent, image []byte, caption, lang string) error {
+	if runes := []rune(caption); len(runes) > discordMaxContent {
+		caption = string(runes[:discordMaxContent-1]) + "…"
+	}
+	title, description := eventBanner(ev, lang)
+	color, _ := strconv.ParseInt(strings.TrimPrefix(render.IntensityColor(ev.MaxIntensity(nil)), "#"), 16, 32)
+	type embedImage struct {
+		URL string `json:"url"`
+	}
+	type embedFooter struct {
+		Text string `json:"text"`
+	}
+	embed := struct {
+		Title       string      `json:"title"`
+		Description string      `json:"description,omitempty"`
+		Color       int64       `json:"color"`
+		Timestamp   string      `json:"timestamp,omitempty"`
+		Image       embedImage  `json:"image"`
+		Footer      embedFooter `json:"footer"`
+	}{
+		Title:       title,
+		Description: description,
+		Color:       color,
+		Image:       embedImage{URL: "attachment://" + webhookImageName(ev)},
+		Footer:      embedFooter{Text: i18n.T(lang, "footer.source")},
+	}
+	if !ev.Time.IsZero() {
+		embed.Timestamp = ev.Time.Format(time.RFC3339)
+	}
+	message := map[string]any{
+		"content":     caption,
+		"embeds":      []any{embed},
+		"attachments": []map[string]any{{"id": 0, "filename": webhookImageName(ev)}},
+		// Captions never ping anyone
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	}
+	part, err := mw.CreateFormField("payload_json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(message); err != nil {
+		return err
+	}
+	return writeWebhookImage(mw, "files[0]", ev, image)
+}
+
+// Function to name the PNG of an event in deliveries
+func webhookImageName(ev *quakeEvent) string {
+	return "quake-" + ev.ID + ".png"
+}
+
+// Function to write the PNG as a file part named field
+func writeWebhookImage(mw *multipart.Writer, field string, ev *quakeEvent, image []byte) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, webhookImageName(ev)))
+	header.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(image)
+	return err
+}
+
+// Function to make one delivery, reporting whether a failure may be
+// retried, and after how long the receiver asked for
+func (hook *webhookPublisher) post(ctx context.Context, ev *quakeEvent, body []byte, contentType string) (time.Duration, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Event-ID", ev.ID)
+	if hook.token != "" {
+		req.Header.Set("Authorization", "Bot "+hook.token)
+	}
+	if hook.secret != nil {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return 0, true, fmt.Errorf("webhook %s: %w", hook.Name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// Discord gives fractions of a second
+		var retryAfter time.Duration
+		if secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && secs > 0 {
+			retryAfter = time.Duration(secs * float64(time.Second))
+		}
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retryAfter, retry, fmt.Errorf("webhook %s: %s", hook.Name, resp.Status)
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Declarative render job, checked into git and regenerated with
+// `canvas render -spec`. The event and style apply to every output; each
+// output may override any /map parameter.
+//
+//	event:
+//	  scale:
+//	    - {id: 13, scale: 4}
+//	  overlays:
+//	    - {type: Feature, geometry: {type: LineString, coordinates: [[139.7, 35.6], [140.1, 35.9]]}}
+//	  footer: Tokyo M5.2
+//	style:
+//	  scale_text: true
+//	outputs:
+//	  - path: kanto.png
+//	    bbox: kanto
+//	    size: 2
+//	  - path: japan.png
+//	    extent: japan
+type renderSpec struct {
+	Event struct {
+		// Entries of the scale parameter, whose ids may be prefecture names
+		Scale []map[string]any `yaml:"scale"`
+		// Entries of the points, values and markers parameters
+		Points  []map[string]any `yaml:"points"`
+		Values  []map[string]any `yaml:"values"`
+		Markers []map[string]any `yaml:"markers"`
+		// GeoJSON layers of the overlay parameter, as objects or JSON strings
+		Overlays []any  `yaml:"overlays"`
+		Footer   string `yaml:"footer"`
+	} `yaml:"event"`
+	Style   map[string]any   `yaml:"style"`
+	Outputs []map[string]any `yaml:"outputs"`
+}
+
+// One output of a spec, resolved to /map parameters
+type specOutput struct {
+	Path  string
+	Query url.Values
+}
+
+// Function to read a spec file (YAML, or JSON as its subset) and resolve its
+// outputs. Output paths are relative to the spec file.
+func loadRenderSpec(path string) ([]specOutput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec renderSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid spec %s: %w", path, err)
+	}
+	event := spec.Event
+	if len(event.Scale) == 0 && len(event.Points) == 0 && len(event.Values) == 0 && len(event.Markers) == 0 && len(event.Overlays) == 0 {
+		return nil, fmt.Errorf("invalid spec %s: event needs scale, points, values, markers or overlays", path)
+	}
+	if len(spec.Outputs) == 0 {
+		return nil, fmt.Errorf("invalid spec %s: at least one output is required", path)
+	}
+
+	base := url.Values{}
+	for name, entries := range map[string][]map[string]any{"scale": event.Scale, "points": event.Points, "values": event.Values, "markers": event.Markers} {
+		if len(entries) > 0 {
+			data, err := json.Marshal(entries)
+			if err != nil {
+				return nil, fmt.Errorf("invalid spec %s: event.%s: %w", path, name, err)
+			}
+			base.Set(name, string(data))
+		}
+	}
+	for i, overlay := range event.Overlays {
+		layer, err := specJSON(overlay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spec %s: event.overlays %d: %w", path, i+1, err)
+		}
+		base.Add("overlay", layer)
+	}
+	if event.Footer != "" {
+		base.Set("footer", spec.Event.Footer)
+	}
+	if err := setSpecParams(base, spec.Style); err != nil {
+		return nil, fmt.Errorf("invalid spec %s: style: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	seen := make(map[string]bool)
+	outputs := make([]specOutput, 0, len(spec.Outputs))
+	for i, params := range spec.Outputs {
+		out, _ := params["path"].(string)
+		if out == "" {
+			return nil, fmt.Errorf("invalid spec %s: output %d has no path", path, i+1)
+		}
+		if !filepath.IsAbs(out) {
+			out = filepath.Join(dir, out)
+		}
+		if seen[out] {
+			return nil, fmt.Errorf("invalid spec %s: %s is written by more than one output", path, out)
+		}
+		seen[out] = true
+
+		query := url.Values{}
+		for k, v := range base {
+			query[k] = append([]string(nil), v...)
+		}
+		delete(params, "path")
+		if err := setSpecParams(query, params); err != nil {
+			return nil, fmt.Errorf("invalid spec %s: output %d: %w", path, i+1, err)
+		}
+		outputs = append(outputs, specOutput{Path: out, Query: query})
+	}
+	return outputs, nil
+}
+
+// Function to copy spec values into query parameters: scalars as they are,
+// and lists and objects as the JSON the parameter takes. A list of overlays
+// gives one layer each.
+func setSpecParams(query url.Values, params map[string]any) error {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !isSpecParam(k) {
+			return fmt.Errorf("unknown parameter %s", k)
+		}
+		switch v := params[k].(type) {
+		case string:
+			query.Set(k, v)
+		case int:
+			query.Set(k, strconv.Itoa(v))
+		case float64:
+			query.Set(k, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			query.Set(k, strconv.FormatBool(v))
+		case []any:
+			if k != "overlay" {
+				data, err := json.Marshal(v)
+				if err != nil {
+					return fmt.Errorf("%s: %w", k, err)
+				}
+				query.Set(k, string(data))
+				continue
+			}
+			query.Del(k)
+			for _, overlay := range v {
+				layer, err := specJSON(overlay)
+				if err != nil {
+					return fmt.Errorf("%s: %w", k, err)
+				}
+				query.Add(k, layer)
+			}
+		case map[string]any:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			query.Set(k, string(data))
+		default:
+			return fmt.Errorf("%s must be a string, number, boolean, list or object", k)
+		}
+	}
+	return nil
+}
+
+// Function to encode a structured spec value as JSON, taking a string as
+// JSON already
+func specJSON(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// Function to check a spec key against the /map parameters; the scale and
+// choropleth values come from the event only
+func isSpecParam(name string) bool {
+	if name == "scale_text" {
+		return true
+	}
+	for _, p := range renderParams {
+		if p.name == name && name != "scale" && name != "values" {
+			return true
+		}
+	}
+	return false
+}